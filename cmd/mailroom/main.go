@@ -18,14 +18,18 @@ import (
 	_ "github.com/nyaruka/mailroom/tasks/broadcasts"
 	_ "github.com/nyaruka/mailroom/tasks/campaigns"
 	_ "github.com/nyaruka/mailroom/tasks/expirations"
+	_ "github.com/nyaruka/mailroom/tasks/failover"
 	_ "github.com/nyaruka/mailroom/tasks/groups"
 	_ "github.com/nyaruka/mailroom/tasks/interrupts"
 	_ "github.com/nyaruka/mailroom/tasks/ivr"
 	_ "github.com/nyaruka/mailroom/tasks/schedules"
+	_ "github.com/nyaruka/mailroom/tasks/sendlater"
 	_ "github.com/nyaruka/mailroom/tasks/starts"
 	_ "github.com/nyaruka/mailroom/tasks/stats"
 	_ "github.com/nyaruka/mailroom/tasks/timeouts"
 
+	_ "github.com/nyaruka/mailroom/web/admin"
+	_ "github.com/nyaruka/mailroom/web/broadcast"
 	_ "github.com/nyaruka/mailroom/web/contact"
 	_ "github.com/nyaruka/mailroom/web/docs"
 	_ "github.com/nyaruka/mailroom/web/expression"
@@ -33,6 +37,7 @@ import (
 	_ "github.com/nyaruka/mailroom/web/ivr"
 	_ "github.com/nyaruka/mailroom/web/org"
 	_ "github.com/nyaruka/mailroom/web/po"
+	_ "github.com/nyaruka/mailroom/web/schedule"
 	_ "github.com/nyaruka/mailroom/web/simulation"
 	_ "github.com/nyaruka/mailroom/web/surveyor"
 	_ "github.com/nyaruka/mailroom/web/ticket"
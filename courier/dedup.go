@@ -0,0 +1,75 @@
+package courier
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/mailroom/models"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const dedupPattern = "msg_dedup:%d:%s"
+
+// DedupMessages checks the passed in messages against those recently sent, returning the messages which can be sent and
+// those which are identical to another of the messages or to a message sent to the same URN within the passed in window.
+// Retries of a message are never considered duplicates of it. Messages only count as sent once they've been recorded
+// with RecordSentMessages, so that messages which don't end up being queued don't cause others to be dropped.
+func DedupMessages(rc redis.Conn, window time.Duration, msgs []*models.Msg) ([]*models.Msg, []*models.Msg, error) {
+	if window <= 0 {
+		return msgs, nil, nil
+	}
+
+	send := make([]*models.Msg, 0, len(msgs))
+	dupes := make([]*models.Msg, 0)
+	seen := make(map[string]bool, len(msgs))
+
+	for _, msg := range msgs {
+		hash := dedupHash(msg)
+
+		existing, err := redis.String(rc.Do("get", fmt.Sprintf(dedupPattern, msg.OrgID(), hash)))
+		if err != nil && err != redis.ErrNil {
+			return nil, nil, errors.Wrapf(err, "error checking for duplicate of msg: %s", msg.UUID())
+		}
+
+		if !seen[hash] && (existing == "" || existing == string(msg.UUID())) {
+			send = append(send, msg)
+			seen[hash] = true
+		} else {
+			logrus.WithField("msg_uuid", msg.UUID()).WithField("contact_id", msg.ContactID()).WithField("urn", msg.URN().Identity()).Info("dropping duplicate msg")
+			dupes = append(dupes, msg)
+		}
+	}
+
+	return send, dupes, nil
+}
+
+// RecordSentMessages records the passed in messages as sent so that identical messages to the same URNs within the passed
+// in window are dropped as duplicates. A message which is already recorded for a URN isn't replaced.
+func RecordSentMessages(rc redis.Conn, window time.Duration, msgs []*models.Msg) error {
+	if window <= 0 || len(msgs) == 0 {
+		return nil
+	}
+
+	rc.Send("multi")
+	for _, msg := range msgs {
+		rc.Send("set", fmt.Sprintf(dedupPattern, msg.OrgID(), dedupHash(msg)), string(msg.UUID()), "px", int64(window/time.Millisecond), "nx")
+	}
+	_, err := rc.Do("exec")
+	return errors.Wrapf(err, "error recording sent msgs for dedup")
+}
+
+// dedupHash returns a hash of what the recipient of the passed in message will see
+func dedupHash(msg *models.Msg) string {
+	attachments := make([]string, len(msg.Attachments()))
+	for i, a := range msg.Attachments() {
+		attachments[i] = string(a)
+	}
+
+	hash := sha1.Sum([]byte(strings.Join([]string{string(msg.URN().Identity()), msg.Text(), strings.Join(attachments, "\n")}, "\x00")))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,78 @@
+package courier
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/mailroom/models"
+	"github.com/nyaruka/mailroom/testsuite"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDedupMessages(t *testing.T) {
+	testsuite.ResetRP()
+	rc := testsuite.RC()
+	defer rc.Close()
+
+	newMsg := func(contactID models.ContactID, text string) *models.Msg {
+		out := flows.NewMsgOut(urns.URN(fmt.Sprintf("tel:+25070000000%d?id=%d", contactID, contactID)), nil, text, nil, nil, nil, flows.NilMsgTopic)
+		msg, err := models.NewOutgoingMsg(models.Org1, nil, contactID, out, time.Now())
+		require.NoError(t, err)
+		return msg
+	}
+
+	// no window, everything goes
+	msgs := []*models.Msg{newMsg(1, "hello"), newMsg(1, "hello")}
+	send, dupes, err := DedupMessages(rc, 0, msgs)
+	assert.NoError(t, err)
+	assert.Equal(t, msgs, send)
+	assert.Len(t, dupes, 0)
+
+	// repeated text to the same URN is dropped, but not different text or the same text to a different URN
+	msgs = []*models.Msg{newMsg(1, "hello"), newMsg(1, "hello"), newMsg(1, "goodbye"), newMsg(2, "hello")}
+	send, dupes, err = DedupMessages(rc, time.Hour, msgs)
+	assert.NoError(t, err)
+	assert.Equal(t, []*models.Msg{msgs[0], msgs[2], msgs[3]}, send)
+	assert.Equal(t, []*models.Msg{msgs[1]}, dupes)
+
+	// until they're recorded as sent, msgs don't cause later ones to be dropped, e.g. if they were deferred
+	send, dupes, err = DedupMessages(rc, time.Hour, []*models.Msg{newMsg(2, "hello")})
+	assert.NoError(t, err)
+	assert.Len(t, send, 1)
+	assert.Len(t, dupes, 0)
+
+	err = RecordSentMessages(rc, time.Hour, []*models.Msg{msgs[0], msgs[2], msgs[3]})
+	assert.NoError(t, err)
+
+	// a msg which has already been sent can be retried
+	send, dupes, err = DedupMessages(rc, time.Hour, []*models.Msg{msgs[0]})
+	assert.NoError(t, err)
+	assert.Len(t, send, 1)
+	assert.Len(t, dupes, 0)
+
+	// and a new identical msg is now dropped
+	send, dupes, err = DedupMessages(rc, time.Hour, []*models.Msg{newMsg(2, "hello")})
+	assert.NoError(t, err)
+	assert.Len(t, send, 0)
+	assert.Len(t, dupes, 1)
+
+	// recording another msg with the same content doesn't replace the one already sent
+	err = RecordSentMessages(rc, time.Hour, []*models.Msg{newMsg(2, "hello")})
+	assert.NoError(t, err)
+
+	send, dupes, err = DedupMessages(rc, time.Hour, []*models.Msg{msgs[3]})
+	assert.NoError(t, err)
+	assert.Len(t, send, 1)
+	assert.Len(t, dupes, 0)
+
+	// duplicates are only tracked for as long as the window
+	ttl, err := redis.Int(rc.Do("pttl", fmt.Sprintf("msg_dedup:%d:%s", models.Org1, dedupHash(msgs[0]))))
+	assert.NoError(t, err)
+	assert.True(t, ttl > 0 && ttl <= 3600000)
+}
@@ -0,0 +1,128 @@
+package courier
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/mailroom/models"
+	"github.com/nyaruka/mailroom/queue"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const capPattern = "contact_msgs:%d"
+
+// CappedMsg is a message which would take its contact over their frequency cap, along with when the oldest message
+// counting towards the cap leaves the window, i.e. when the contact can next be sent to
+type CappedMsg struct {
+	Msg        *models.Msg
+	UnderCapOn time.Time
+}
+
+// CapMessages checks the passed in messages against the passed in frequency cap, returning the messages which can be
+// sent and those which are over the cap. Messages which can be sent are counted towards the cap of their contact, except
+// for responses to incoming messages which are always sent and never counted.
+func CapMessages(rc redis.Conn, fc *models.FrequencyCap, msgs []*models.Msg, now time.Time) ([]*models.Msg, []*CappedMsg, error) {
+	if fc == nil {
+		return msgs, nil, nil
+	}
+
+	send := make([]*models.Msg, 0, len(msgs))
+	capped := make([]*CappedMsg, 0)
+
+	nowMS := now.UnixNano() / int64(time.Millisecond)
+	windowMS := int64(fc.Window / time.Millisecond)
+
+	for _, msg := range msgs {
+		if msg.IsResponse() {
+			send = append(send, msg)
+			continue
+		}
+
+		oldest, err := redis.Int64(capMsg.Do(rc, fmt.Sprintf(capPattern, msg.ContactID()), nowMS, windowMS, fc.Max, string(msg.UUID())))
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "error checking frequency cap for contact: %d", msg.ContactID())
+		}
+
+		if oldest == 0 {
+			send = append(send, msg)
+		} else {
+			capped = append(capped, &CappedMsg{Msg: msg, UnderCapOn: time.Unix(0, (oldest+windowMS)*int64(time.Millisecond))})
+		}
+	}
+
+	return send, capped, nil
+}
+
+// DeferredMsgsTask is the task queued to send messages which were deferred because of a frequency cap
+type DeferredMsgsTask struct {
+	MsgIDs []models.MsgID `json:"msg_ids"`
+}
+
+// handleCapped drops or defers the passed in capped messages
+func handleCapped(ctx context.Context, db models.Queryer, rc redis.Conn, oa *models.OrgAssets, capped []*CappedMsg) error {
+	log := logrus.WithField("org_id", oa.OrgID()).WithField("count", len(capped))
+
+	if oa.Org().FrequencyCap().Action == models.FrequencyCapActionDrop {
+		msgs := make([]*models.Msg, len(capped))
+		for i, c := range capped {
+			msgs[i] = c.Msg
+		}
+
+		log.Info("dropping messages over frequency cap")
+		return models.FailMessages(ctx, db, msgs, models.FailedReasonFrequencyCap)
+	}
+
+	// group our deferred messages by when they can be sent, which for each contact will be the same
+	deferred := make(map[time.Time][]*models.Msg)
+	for _, c := range capped {
+		deferred[c.UnderCapOn] = append(deferred[c.UnderCapOn], c.Msg)
+	}
+
+	log.Info("deferring messages over frequency cap")
+
+	for sendOn, msgs := range deferred {
+		// messages wait as pending until they can be sent, so that they can be cancelled like any other pending message
+		if err := models.DeferMessages(ctx, db, msgs, sendOn); err != nil {
+			return err
+		}
+
+		ids := make([]models.MsgID, len(msgs))
+		for i, msg := range msgs {
+			ids[i] = models.MsgID(msg.ID())
+		}
+
+		err := queue.AddDelayedTask(rc, queue.HandlerQueue, queue.SendDeferredMsgs, int(oa.OrgID()), &DeferredMsgsTask{MsgIDs: ids}, sendOn)
+		if err != nil {
+			return errors.Wrapf(err, "error queuing deferred messages")
+		}
+	}
+	return nil
+}
+
+var capMsg = redis.NewScript(1, `
+-- KEYS: [ContactKey]
+-- ARGV: [NowMS, WindowMS, Max, MsgUUID]
+local key, now, window, max = KEYS[1], tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+
+-- forget messages which have left our window
+redis.call("zremrangebyscore", key, "-inf", now - window)
+
+-- already counted? (e.g. a retry) then it can go
+if redis.call("zscore", key, ARGV[4]) then
+  return 0
+end
+
+-- under our cap? then count this message and let it go
+if redis.call("zcard", key) < max then
+  redis.call("zadd", key, now, ARGV[4])
+  redis.call("pexpire", key, window)
+  return 0
+end
+
+-- otherwise return when our oldest message was sent
+local oldest = redis.call("zrange", key, 0, 0, "withscores")
+return tonumber(oldest[2])
+`)
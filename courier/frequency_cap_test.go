@@ -0,0 +1,73 @@
+package courier
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/mailroom/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/null"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCapMessages(t *testing.T) {
+	testsuite.ResetRP()
+	rc := testsuite.RC()
+	defer rc.Close()
+
+	newMsg := func(contactID models.ContactID, isResponse bool) *models.Msg {
+		out := flows.NewMsgOut(urns.URN(fmt.Sprintf("tel:+250700000001?id=%d", contactID)), nil, "hello", nil, nil, nil, flows.NilMsgTopic)
+		msg, err := models.NewOutgoingMsg(models.Org1, nil, contactID, out, time.Now())
+		require.NoError(t, err)
+		if isResponse {
+			msg.SetResponseTo(models.MsgID(123), null.NullString)
+		}
+		return msg
+	}
+
+	// no cap, everything goes
+	msgs := []*models.Msg{newMsg(1, false), newMsg(1, false), newMsg(1, false)}
+	send, capped, err := CapMessages(rc, nil, msgs, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, msgs, send)
+	assert.Len(t, capped, 0)
+
+	fc := &models.FrequencyCap{Max: 2, Window: time.Hour, Action: models.FrequencyCapActionDefer}
+	start := time.Date(2020, 1, 21, 10, 0, 0, 0, time.UTC)
+
+	// contact 1 gets two msgs and a response, contact 2 gets one
+	msgs = []*models.Msg{newMsg(1, false), newMsg(1, false), newMsg(1, true), newMsg(2, false)}
+	send, capped, err = CapMessages(rc, fc, msgs, start)
+	assert.NoError(t, err)
+	assert.Equal(t, msgs, send)
+	assert.Len(t, capped, 0)
+
+	// half an hour later contact 1 is at their cap but contact 2 isn't, responses are still sent
+	later := start.Add(time.Minute * 30)
+	msgs = []*models.Msg{newMsg(1, false), newMsg(1, true), newMsg(2, false), newMsg(2, false)}
+	send, capped, err = CapMessages(rc, fc, msgs, later)
+	assert.NoError(t, err)
+	assert.Equal(t, []*models.Msg{msgs[1], msgs[2]}, send)
+	require.Len(t, capped, 2)
+	assert.Equal(t, msgs[0], capped[0].Msg)
+	assert.Equal(t, start.Add(time.Hour), capped[0].UnderCapOn.UTC())
+	assert.Equal(t, msgs[3], capped[1].Msg)
+	assert.Equal(t, start.Add(time.Hour), capped[1].UnderCapOn.UTC())
+
+	// a msg which has already been counted can be retried
+	send, capped, err = CapMessages(rc, fc, []*models.Msg{msgs[2]}, later)
+	assert.NoError(t, err)
+	assert.Len(t, send, 1)
+	assert.Len(t, capped, 0)
+
+	// once our first msgs leave the window, contact 1 can be sent to again
+	send, capped, err = CapMessages(rc, fc, []*models.Msg{newMsg(1, false), newMsg(1, false)}, start.Add(time.Hour+time.Second))
+	assert.NoError(t, err)
+	assert.Len(t, send, 2)
+	assert.Len(t, capped, 0)
+}
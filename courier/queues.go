@@ -0,0 +1,248 @@
+package courier
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/goflow/assets"
+	"github.com/nyaruka/mailroom/models"
+	"github.com/pkg/errors"
+)
+
+const (
+	msgsActiveKey    = "msgs:active"
+	msgsThrottledKey = "msgs:throttled"
+)
+
+// matches the priority queues created by our queue script, e.g. msgs:74729f45-7f29-4868-9dc4-90e491e3c7d8|10/1
+var priorityQueueRegex = regexp.MustCompile(`^msgs:([0-9a-fA-F-]{36})\|(\d+)/([01])$`)
+
+// ChannelQueue is the state of the courier queue for a channel
+type ChannelQueue struct {
+	ChannelUUID    assets.ChannelUUID `json:"channel_uuid"`
+	TPS            int                `json:"tps"`
+	Size           int                `json:"size"`
+	HighPriority   int                `json:"high_priority"`
+	Batches        int                `json:"batches"`
+	Active         bool               `json:"active"`
+	Throttled      bool               `json:"throttled"`
+	OldestQueuedOn *time.Time         `json:"oldest_queued_on"`
+
+	keys []string
+}
+
+// GetQueues returns the state of all the courier queues which have messages in them, ordered by size, largest first
+func GetQueues(rc redis.Conn) ([]*ChannelQueue, error) {
+	return getQueues(rc, "msgs:*|*/*")
+}
+
+// GetQueue returns the state of the courier queue for the passed in channel, or nil if it has no messages queued
+func GetQueue(rc redis.Conn, uuid assets.ChannelUUID) (*ChannelQueue, error) {
+	queues, err := getQueues(rc, fmt.Sprintf("msgs:%s|*/*", uuid))
+	if err != nil || len(queues) == 0 {
+		return nil, err
+	}
+	return queues[0], nil
+}
+
+func getQueues(rc redis.Conn, pattern string) ([]*ChannelQueue, error) {
+	keys, err := scanKeys(rc, pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	byChannel := make(map[assets.ChannelUUID]*ChannelQueue)
+	queues := make([]*ChannelQueue, 0)
+
+	for _, key := range keys {
+		match := priorityQueueRegex.FindStringSubmatch(key)
+		if match == nil {
+			continue
+		}
+		uuid := assets.ChannelUUID(match[1])
+		tps, _ := strconv.Atoi(match[2])
+		queueKey := key[:len(key)-2]
+
+		q := byChannel[uuid]
+		if q == nil {
+			q = &ChannelQueue{ChannelUUID: uuid, TPS: tps}
+			byChannel[uuid] = q
+			queues = append(queues, q)
+		}
+		q.keys = append(q.keys, key)
+
+		batches, err := redis.Values(rc.Do("zrange", key, 0, -1, "withscores"))
+		if err != nil {
+			return nil, errors.Wrapf(err, "error reading courier queue: %s", key)
+		}
+
+		for i := 0; i < len(batches); i += 2 {
+			ids, err := batchMsgIDs(batches[i])
+			if err != nil {
+				return nil, errors.Wrapf(err, "error reading batch in courier queue: %s", key)
+			}
+			q.Size += len(ids)
+			q.Batches++
+			if match[3] == strconv.Itoa(highPriority) {
+				q.HighPriority += len(ids)
+			}
+
+			score, _ := redis.Float64(batches[i+1], nil)
+			queuedOn := time.Unix(0, int64(score*float64(time.Second))).UTC()
+			if q.OldestQueuedOn == nil || queuedOn.Before(*q.OldestQueuedOn) {
+				q.OldestQueuedOn = &queuedOn
+			}
+		}
+
+		// our queue is active or throttled as a whole, i.e. msgs:uuid|tps
+		active, err := rc.Do("zscore", msgsActiveKey, queueKey)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error checking whether courier queue is active: %s", queueKey)
+		}
+		q.Active = q.Active || active != nil
+
+		throttled, err := rc.Do("zscore", msgsThrottledKey, queueKey)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error checking whether courier queue is throttled: %s", queueKey)
+		}
+		sent, err := redis.Int(rc.Do("get", fmt.Sprintf("%s:tps:%d", queueKey, now.Unix())))
+		if err != nil && err != redis.ErrNil {
+			return nil, errors.Wrapf(err, "error checking courier queue tps: %s", queueKey)
+		}
+		q.Throttled = q.Throttled || throttled != nil || (tps > 0 && sent >= tps)
+	}
+
+	sort.SliceStable(queues, func(i, j int) bool { return queues[i].Size > queues[j].Size })
+	return queues, nil
+}
+
+// PurgeQueue removes all messages from the courier queue for the passed in channel, returning the ids of the messages
+// which were removed
+func PurgeQueue(rc redis.Conn, uuid assets.ChannelUUID) ([]models.MsgID, error) {
+	q, err := GetQueue(rc, uuid)
+	if err != nil || q == nil {
+		return nil, err
+	}
+
+	ids := make([]models.MsgID, 0, q.Size)
+	for _, key := range q.keys {
+		batches, err := redis.Values(purgeQueue.Do(rc, key, msgsActiveKey, msgsThrottledKey))
+		if err != nil {
+			return nil, errors.Wrapf(err, "error purging courier queue: %s", key)
+		}
+		for _, batch := range batches {
+			batchIDs, err := batchMsgIDs(batch)
+			if err != nil {
+				return nil, errors.Wrapf(err, "error reading batch in courier queue: %s", key)
+			}
+			ids = append(ids, batchIDs...)
+		}
+	}
+	return ids, nil
+}
+
+var purgeQueue = redis.NewScript(3, `
+-- KEYS: [PriorityQueueKey, ActiveKey, ThrottledKey]
+local batches = redis.call("zrange", KEYS[1], 0, -1)
+redis.call("del", KEYS[1])
+
+-- if neither priority queue has anything left, our queue no longer needs to be active
+local queueKey = string.sub(KEYS[1], 1, -3)
+if redis.call("exists", queueKey .. "/0") == 0 and redis.call("exists", queueKey .. "/1") == 0 then
+  redis.call("zrem", KEYS[2], queueKey)
+  redis.call("zrem", KEYS[3], queueKey)
+end
+
+return batches
+`)
+
+// PrioritizeQueue moves all messages in the courier queue for the passed in channel to the high or default priority
+// queue, keeping their order, returning the number of batches moved
+func PrioritizeQueue(rc redis.Conn, uuid assets.ChannelUUID, high bool) (int, error) {
+	q, err := GetQueue(rc, uuid)
+	if err != nil || q == nil {
+		return 0, err
+	}
+
+	from, to := highPriority, defaultPriority
+	if high {
+		from, to = defaultPriority, highPriority
+	}
+	suffix := fmt.Sprintf("/%d", from)
+
+	moved := 0
+	for _, key := range q.keys {
+		if key[len(key)-2:] != suffix {
+			continue
+		}
+
+		target := fmt.Sprintf("%s/%d", key[:len(key)-2], to)
+		count, err := redis.Int(moveQueue.Do(rc, key, target))
+		if err != nil {
+			return 0, errors.Wrapf(err, "error moving courier queue: %s", key)
+		}
+		moved += count
+	}
+	return moved, nil
+}
+
+var moveQueue = redis.NewScript(2, `
+-- KEYS: [FromKey, ToKey]
+local batches = redis.call("zrange", KEYS[1], 0, -1, "withscores")
+for i = 1, #batches, 2 do
+  redis.call("zadd", KEYS[2], batches[i + 1], batches[i])
+end
+redis.call("del", KEYS[1])
+return #batches / 2
+`)
+
+// scanKeys returns all the keys matching the passed in pattern
+func scanKeys(rc redis.Conn, pattern string) ([]string, error) {
+	keys := make([]string, 0)
+	cursor := 0
+
+	for {
+		values, err := redis.Values(rc.Do("scan", cursor, "match", pattern, "count", 1000))
+		if err != nil {
+			return nil, errors.Wrapf(err, "error scanning for keys: %s", pattern)
+		}
+
+		cursor, _ = redis.Int(values[0], nil)
+		batch, _ := redis.Strings(values[1], nil)
+		keys = append(keys, batch...)
+
+		if cursor == 0 {
+			break
+		}
+	}
+
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// batchMsgIDs returns the ids of the messages in the passed in queued batch
+func batchMsgIDs(batch interface{}) ([]models.MsgID, error) {
+	batchJSON, err := redis.Bytes(batch, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	msgs := make([]struct {
+		ID models.MsgID `json:"id"`
+	}, 0)
+	if err := json.Unmarshal(batchJSON, &msgs); err != nil {
+		return nil, err
+	}
+
+	ids := make([]models.MsgID, len(msgs))
+	for i := range msgs {
+		ids[i] = msgs[i].ID
+	}
+	return ids, nil
+}
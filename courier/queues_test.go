@@ -0,0 +1,101 @@
+package courier
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/nyaruka/goflow/assets"
+	"github.com/nyaruka/mailroom/models"
+	"github.com/nyaruka/mailroom/testsuite"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueues(t *testing.T) {
+	testsuite.ResetRP()
+	rc := testsuite.RC()
+	defer rc.Close()
+
+	twilio := assets.ChannelUUID("74729f45-7f29-4868-9dc4-90e491e3c7d8")
+	nexmo := assets.ChannelUUID("19012bfd-3ce3-4cae-9bb9-76cf92c73d49")
+
+	// lays out a batch the same way our queue script does
+	queueBatch := func(epoch string, uuid assets.ChannelUUID, tps int, priority int, batch string) {
+		queueKey := fmt.Sprintf("msgs:%s|%d", uuid, tps)
+		_, err := rc.Do("zadd", fmt.Sprintf("%s/%d", queueKey, priority), epoch, batch)
+		require.NoError(t, err)
+		_, err = rc.Do("zincrby", "msgs:active", 0, queueKey)
+		require.NoError(t, err)
+	}
+
+	queues, err := GetQueues(rc)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(queues))
+
+	queueBatch("1579615200.000000", twilio, 10, defaultPriority, `[{"id": 1}, {"id": 2}]`)
+	queueBatch("1579615201.000000", twilio, 10, defaultPriority, `[{"id": 3}]`)
+	queueBatch("1579615202.000000", twilio, 10, highPriority, `[{"id": 4}]`)
+	queueBatch("1579615203.000000", nexmo, 5, defaultPriority, `[{"id": 5}]`)
+
+	// mark nexmo as throttled
+	_, err = rc.Do("zadd", "msgs:throttled", 0, "msgs:"+string(nexmo)+"|5")
+	require.NoError(t, err)
+
+	queues, err = GetQueues(rc)
+	assert.NoError(t, err)
+	require.Equal(t, 2, len(queues))
+
+	assert.Equal(t, twilio, queues[0].ChannelUUID)
+	assert.Equal(t, 10, queues[0].TPS)
+	assert.Equal(t, 4, queues[0].Size)
+	assert.Equal(t, 1, queues[0].HighPriority)
+	assert.Equal(t, 3, queues[0].Batches)
+	assert.True(t, queues[0].Active)
+	assert.False(t, queues[0].Throttled)
+	assert.Equal(t, "2020-01-21T14:00:00Z", queues[0].OldestQueuedOn.Format("2006-01-02T15:04:05Z07:00"))
+
+	assert.Equal(t, nexmo, queues[1].ChannelUUID)
+	assert.Equal(t, 1, queues[1].Size)
+	assert.True(t, queues[1].Throttled)
+
+	// move all twilio msgs to high priority
+	moved, err := PrioritizeQueue(rc, twilio, true)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, moved)
+
+	queue, err := GetQueue(rc, twilio)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, queue.Size)
+	assert.Equal(t, 4, queue.HighPriority)
+
+	// and back again
+	moved, err = PrioritizeQueue(rc, twilio, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, moved)
+
+	queue, _ = GetQueue(rc, twilio)
+	assert.Equal(t, 0, queue.HighPriority)
+
+	// purge twilio
+	ids, err := PurgeQueue(rc, twilio)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []models.MsgID{1, 2, 3, 4}, ids)
+
+	queue, err = GetQueue(rc, twilio)
+	assert.NoError(t, err)
+	assert.Nil(t, queue)
+
+	active, err := rc.Do("zscore", "msgs:active", "msgs:"+string(twilio)+"|10")
+	assert.NoError(t, err)
+	assert.Nil(t, active)
+
+	// purging an empty queue is a noop
+	ids, err = PurgeQueue(rc, twilio)
+	assert.NoError(t, err)
+	assert.Len(t, ids, 0)
+
+	queues, err = GetQueues(rc)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(queues))
+}
@@ -0,0 +1,104 @@
+package courier
+
+import (
+	"context"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/goflow/assets"
+	"github.com/nyaruka/mailroom/models"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// SendMessages queues messages to courier after applying the policies of the passed in org. Messages identical to one
+// recently sent to the same URN are marked as failed if the org drops duplicates, messages whose channel is unhealthy
+// are re-routed to another channel if the org uses failover, and messages which would take a contact over the org's
+// frequency cap are either marked as failed or deferred until the contact is back under it.
+func SendMessages(ctx context.Context, db models.Queryer, rc redis.Conn, oa *models.OrgAssets, msgs []*models.Msg) error {
+	msgs, dupes, err := DedupMessages(rc, oa.Org().MsgDedupWindow(), msgs)
+	if err != nil {
+		return err
+	}
+
+	if len(dupes) > 0 {
+		if err := models.FailMessages(ctx, db, dupes, models.FailedReasonDuplicate); err != nil {
+			return err
+		}
+	}
+
+	if oa.Org().ChannelFailover() {
+		if err := failoverUnhealthy(ctx, db, rc, oa, msgs); err != nil {
+			return err
+		}
+	}
+
+	send, capped, err := CapMessages(rc, oa.Org().FrequencyCap(), msgs, time.Now())
+	if err != nil {
+		return err
+	}
+
+	if len(capped) > 0 {
+		if err := handleCapped(ctx, db, rc, oa, capped); err != nil {
+			return err
+		}
+	}
+
+	if err := QueueMessages(rc, send); err != nil {
+		return err
+	}
+
+	// only messages which were actually queued count towards dropping later duplicates
+	return RecordSentMessages(rc, oa.Org().MsgDedupWindow(), send)
+}
+
+// failoverUnhealthy re-routes any of the passed in messages whose channel is marked as unhealthy to another channel. If
+// there is no other channel for a message, it stays on its channel.
+func failoverUnhealthy(ctx context.Context, db models.Queryer, rc redis.Conn, oa *models.OrgAssets, msgs []*models.Msg) error {
+	channels, _ := oa.Channels()
+	uuids := make([]assets.ChannelUUID, len(channels))
+	for i, c := range channels {
+		uuids[i] = c.UUID()
+	}
+
+	unhealthy, err := models.UnhealthyChannels(rc, uuids)
+	if err != nil {
+		return err
+	}
+	if len(unhealthy) == 0 {
+		return nil
+	}
+
+	rerouted := make([]*models.Msg, 0)
+	for _, msg := range msgs {
+		if !unhealthy[msg.ChannelUUID()] {
+			continue
+		}
+
+		exclude := make(map[assets.ChannelUUID]bool, len(unhealthy))
+		for uuid := range unhealthy {
+			exclude[uuid] = true
+		}
+		for _, uuid := range msg.FailedOverFrom() {
+			exclude[uuid] = true
+		}
+
+		channel := models.FailoverChannel(oa, msg.URN(), exclude)
+		if channel == nil {
+			continue
+		}
+
+		logrus.WithField("msg_uuid", msg.UUID()).WithField("from", msg.ChannelUUID()).WithField("to", channel.UUID()).Info("failing over msg from unhealthy channel")
+
+		msg.Failover(channel, models.FailoverReasonUnhealthy)
+		rerouted = append(rerouted, msg)
+	}
+
+	if len(rerouted) > 0 {
+		err := models.UpdateMessageRoutes(ctx, db, rerouted)
+		if err != nil {
+			return errors.Wrapf(err, "error updating routes of failed over messages")
+		}
+	}
+	return nil
+}
@@ -1,7 +1,9 @@
 package cron
 
 import (
+	"context"
 	"fmt"
+	"os"
 	"time"
 
 	"github.com/apex/log"
@@ -10,61 +12,50 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-// Function is the function that will be called on our schedule
-type Function func(lockName string, lockValue string) error
+// Function is the function that will be called on our schedule. The passed in context is cancelled if the cron's lock
+// is lost, and can be checked with locker.CheckContext before making writes which must not be made twice.
+type Function func(ctx context.Context, lockName string, lockValue string) error
 
-// StartCron calls the passed in function every minute, making sure it acquires a
-// lock so that only one process is running at once. Note that across processes
-// crons may be called more often than duration as there is no inter-process
-// coordination of cron fires. (this might be a worthy addition)
+// StartCron calls the passed in function every interval, see StartScheduledCron
 func StartCron(quit chan bool, rp *redis.Pool, name string, interval time.Duration, cronFunc Function) {
+	StartScheduledCron(quit, rp, name, Every(interval), cronFunc)
+}
+
+// StartScheduledCron calls the passed in function according to the passed in schedule, making sure it acquires a
+// lock so that only one process is running at once. The next fire time is stored in redis so that across processes
+// the cron is never fired before it is due or more than once for the same fire time.
+func StartScheduledCron(quit chan bool, rp *redis.Pool, name string, schedule Schedule, cronFunc Function) {
 	lockName := fmt.Sprintf("%s_lock", name)
 	wait := time.Duration(0)
-	lastFire := time.Now()
 
 	log := logrus.WithField("cron", name).WithField("lockName", lockName)
 
 	go func() {
 		defer log.Info("exiting")
 
-		// we run expiration every minute on the minute
 		for true {
+			var next time.Time
+
 			select {
 			case <-quit:
 				// we are exiting, return so our goroutine can exit
 				return
 
 			case <-time.After(wait):
-				// try to insert our expiring lock to redis
-				lastFire = time.Now()
-
-				lock, err := locker.GrabLock(rp, lockName, time.Minute*5, 0)
-				if err != nil {
-					break
-				}
-				log := log.WithField("lock", lock)
-
-				if lock == "" {
-					log.Debug("lock already present, sleeping")
-					break
-				}
-
-				// ok, got the lock, run our cron function
-				err = fireCron(cronFunc, lockName, lock)
+				var err error
+				next, err = fireIfDue(rp, name, lockName, schedule, cronFunc)
 				if err != nil {
-					log.WithError(err).Error("error while running cron")
+					log.WithError(err).Error("error coordinating cron")
 				}
+			}
 
-				// release our lock
-				err = locker.ReleaseLock(rp, lockName, lock)
-				if err != nil {
-					log.WithError(err).Error("error releasing lock")
-				}
+			// nothing stored that tells us when to fire next, so calculate it ourselves
+			now := time.Now()
+			if !next.After(now) {
+				next = schedule.Next(now)
 			}
 
-			// calculate our next fire time
-			nextFire := nextFire(lastFire, interval)
-			wait = nextFire.Sub(time.Now())
+			wait = next.Sub(now)
 			if wait < time.Duration(0) {
 				wait = time.Duration(0)
 			}
@@ -72,19 +63,86 @@ func StartCron(quit chan bool, rp *redis.Pool, name string, interval time.Durati
 	}()
 }
 
+// fireIfDue fires the passed in cron function if we can grab its lock and it is due according to the next fire time
+// stored in redis. It returns the time the cron is next due.
+func fireIfDue(rp *redis.Pool, name string, lockName string, schedule Schedule, cronFunc Function) (time.Time, error) {
+	// try to insert our expiring lock to redis, this is renewed for as long as our cron function runs
+	lock, err := locker.AcquireLock(context.Background(), rp, lockName, time.Minute*5, 0)
+	if err != nil {
+		return time.Time{}, err
+	}
+	log := logrus.WithField("cron", name).WithField("lockName", lockName)
+
+	if lock == nil {
+		log.Debug("lock already present, sleeping")
+		return readNextFire(rp, name)
+	}
+	log = log.WithField("lock", lock.Value())
+
+	defer func() {
+		// release our lock
+		if err := lock.Release(); err != nil {
+			log.WithError(err).Error("error releasing lock")
+		}
+	}()
+
+	// another process may have fired this cron since we last checked
+	next, err := readNextFire(rp, name)
+	if err != nil {
+		return time.Time{}, err
+	}
+	start := time.Now()
+	if next.After(start) {
+		return next, nil
+	}
+
+	// calculate our next fire from when we were due so that we don't drift, unless we've fallen too far behind
+	due := next
+	if due.IsZero() {
+		due = start
+	}
+	next = schedule.Next(due)
+	if !next.After(start) {
+		next = schedule.Next(start)
+	}
+
+	// record our next fire before firing so that a crash can't cause us to fire twice, but only if nobody has taken
+	// our lock from us since we read when we were due
+	if err := lock.Check(); err != nil {
+		return time.Time{}, err
+	}
+	if err := recordFire(rp, name, start, next); err != nil {
+		return time.Time{}, err
+	}
+
+	// ok, got the lock and we're due, run our cron function
+	fireErr := fireCron(lock.Context(), cronFunc, lockName, lock.Value())
+	if fireErr != nil {
+		log.WithError(fireErr).Error("error while running cron")
+	}
+
+	// if we lost our lock while running, another process may already be firing so leave the result to it
+	if err := lock.Check(); err != nil {
+		return next, err
+	}
+
+	return next, recordResult(rp, name, time.Since(start), fireErr)
+}
+
 // fireCron is just a wrapper around the cron function we will call for the purposes of
 // catching and logging panics
-func fireCron(cronFunc Function, lockName string, lockValue string) error {
+func fireCron(ctx context.Context, cronFunc Function, lockName string, lockValue string) (err error) {
 	log := log.WithField("lockValue", lockValue).WithField("func", cronFunc)
 	defer func() {
 		// catch any panics and recover
 		panicLog := recover()
 		if panicLog != nil {
 			log.Errorf("panic running cron: %s", panicLog)
+			err = fmt.Errorf("panic running cron: %s", panicLog)
 		}
 	}()
 
-	return cronFunc(lockName, lockValue)
+	return cronFunc(ctx, lockName, lockValue)
 }
 
 // nextFire returns the next time we should fire based on the passed in time and interval
@@ -100,3 +158,9 @@ func nextFire(last time.Time, interval time.Duration) time.Time {
 		return last.Add(interval)
 	}
 }
+
+// hostname of this process, recorded against the fires it makes
+var host = func() string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s:%d", hostname, os.Getpid())
+}()
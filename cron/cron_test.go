@@ -1,10 +1,13 @@
 package cron
 
 import (
+	"context"
+	"errors"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/nyaruka/mailroom/locker"
 	"github.com/nyaruka/mailroom/testsuite"
 	"github.com/stretchr/testify/assert"
 )
@@ -19,8 +22,9 @@ func TestCron(t *testing.T) {
 	fired := 0
 	quit := make(chan bool)
 
-	// our cron worker is just going to increment an int on every fire
-	increment := func(lockName string, lockValue string) error {
+	// our cron worker is just going to increment an int on every fire, and is passed the context of its lock
+	increment := func(ctx context.Context, lockName string, lockValue string) error {
+		assert.NoError(t, locker.CheckContext(ctx))
 		mutex.Lock()
 		fired++
 		mutex.Unlock()
@@ -36,6 +40,51 @@ func TestCron(t *testing.T) {
 	close(quit)
 }
 
+func TestCronCoordination(t *testing.T) {
+	testsuite.ResetRP()
+	rp := testsuite.RP()
+	rc := testsuite.RC()
+	defer rc.Close()
+
+	mutex := sync.RWMutex{}
+	fired := 0
+	quit := make(chan bool)
+
+	increment := func(ctx context.Context, lockName string, lockValue string) error {
+		mutex.Lock()
+		fired++
+		mutex.Unlock()
+		return errors.New("boom")
+	}
+
+	// two processes running the same cron shouldn't fire it any more often than one
+	StartCron(quit, rp, "test", time.Millisecond*100, increment)
+	StartCron(quit, rp, "test", time.Millisecond*100, increment)
+
+	time.Sleep(time.Millisecond * 350)
+	close(quit)
+
+	mutex.RLock()
+	assert.Equal(t, 4, fired)
+	mutex.RUnlock()
+
+	status, err := GetStatus(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, "test", status.Name)
+	assert.NotNil(t, status.LastFire)
+	assert.True(t, status.NextFire.After(*status.LastFire))
+	assert.Equal(t, "boom", status.LastError)
+	assert.NotEqual(t, "", status.LastHost)
+
+	statuses, err := GetStatuses(rc)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(statuses))
+
+	status, err = GetStatus(rc, "unknown")
+	assert.NoError(t, err)
+	assert.Nil(t, status)
+}
+
 func TestNextFire(t *testing.T) {
 	tcs := []struct {
 		last     time.Time
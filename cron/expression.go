@@ -0,0 +1,208 @@
+package cron
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Schedule is something which can calculate when a cron should next fire
+type Schedule interface {
+	// Next returns the next fire time strictly after the passed in time
+	Next(last time.Time) time.Time
+}
+
+// Every returns a schedule which fires at the passed in interval, aligned as per nextFire
+func Every(interval time.Duration) Schedule {
+	return every(interval)
+}
+
+type every time.Duration
+
+func (e every) Next(last time.Time) time.Time { return nextFire(last, time.Duration(e)) }
+
+// Expression is a parsed standard five field cron expression, i.e. minute, hour, day of month, month and
+// day of week. Each field can be a *, a value, a range like 1-5, a step like */15 or 0-30/10, or a comma
+// separated list of these. Months and days of week can also be given as names like JAN or MON.
+type Expression struct {
+	source string
+
+	minutes     []bool
+	hours       []bool
+	daysOfMonth []bool
+	months      []bool
+	daysOfWeek  []bool
+
+	// whether the day of month and day of week fields were restricted, if both are then either can match
+	domRestricted bool
+	dowRestricted bool
+}
+
+var macros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var monthNames = map[string]int{
+	"JAN": 1, "FEB": 2, "MAR": 3, "APR": 4, "MAY": 5, "JUN": 6,
+	"JUL": 7, "AUG": 8, "SEP": 9, "OCT": 10, "NOV": 11, "DEC": 12,
+}
+
+var dayNames = map[string]int{
+	"SUN": 0, "MON": 1, "TUE": 2, "WED": 3, "THU": 4, "FRI": 5, "SAT": 6,
+}
+
+// ParseExpression parses the passed in cron expression
+func ParseExpression(expr string) (*Expression, error) {
+	source := strings.TrimSpace(expr)
+	if macro, isMacro := macros[strings.ToLower(source)]; isMacro {
+		expr = macro
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, errors.Errorf("cron expression '%s' must have 5 fields, found %d", source, len(fields))
+	}
+
+	e := &Expression{source: source}
+	var err error
+
+	if e.minutes, err = parseField(fields[0], 0, 59, nil); err != nil {
+		return nil, errors.Wrapf(err, "invalid minute field in cron expression '%s'", source)
+	}
+	if e.hours, err = parseField(fields[1], 0, 23, nil); err != nil {
+		return nil, errors.Wrapf(err, "invalid hour field in cron expression '%s'", source)
+	}
+	if e.daysOfMonth, err = parseField(fields[2], 1, 31, nil); err != nil {
+		return nil, errors.Wrapf(err, "invalid day of month field in cron expression '%s'", source)
+	}
+	if e.months, err = parseField(fields[3], 1, 12, monthNames); err != nil {
+		return nil, errors.Wrapf(err, "invalid month field in cron expression '%s'", source)
+	}
+	if e.daysOfWeek, err = parseField(fields[4], 0, 7, dayNames); err != nil {
+		return nil, errors.Wrapf(err, "invalid day of week field in cron expression '%s'", source)
+	}
+
+	// 7 is also sunday
+	if e.daysOfWeek[7] {
+		e.daysOfWeek[0] = true
+	}
+
+	e.domRestricted = !strings.HasPrefix(fields[2], "*")
+	e.dowRestricted = !strings.HasPrefix(fields[4], "*")
+
+	return e, nil
+}
+
+// String returns the expression as it was parsed
+func (e *Expression) String() string { return e.source }
+
+// Next returns the next time strictly after the passed in time which matches this expression, in the location
+// of the passed in time. Local times skipped by daylight savings transitions never match. It returns the zero time
+// if there is no matching time in the next five years.
+func (e *Expression) Next(last time.Time) time.Time {
+	loc := last.Location()
+
+	// start at the next whole minute
+	t := last.Add(time.Minute - time.Duration(last.Second())*time.Second - time.Duration(last.Nanosecond()))
+	yearLimit := t.Year() + 5
+
+	for t.Year() <= yearLimit {
+		if !e.months[t.Month()] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !e.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !e.hours[t.Hour()] {
+			t = t.Add(time.Hour - time.Duration(t.Minute())*time.Minute)
+			continue
+		}
+		if !e.minutes[t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+
+	return time.Time{}
+}
+
+// matchesDay returns whether the day of the passed in time matches our day of month and day of week fields
+func (e *Expression) matchesDay(t time.Time) bool {
+	dom := e.daysOfMonth[t.Day()]
+	dow := e.daysOfWeek[t.Weekday()]
+
+	if e.domRestricted && e.dowRestricted {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// parseField parses a single field of a cron expression into a slice of which values are included
+func parseField(field string, min int, max int, names map[string]int) ([]bool, error) {
+	values := make([]bool, max+1)
+
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+
+		if slash := strings.Index(part, "/"); slash >= 0 {
+			var err error
+			rangePart = part[:slash]
+			step, err = strconv.Atoi(part[slash+1:])
+			if err != nil || step < 1 {
+				return nil, errors.Errorf("invalid step in '%s'", part)
+			}
+		}
+
+		start, end := min, max
+		if rangePart != "*" {
+			bounds := strings.SplitN(rangePart, "-", 2)
+
+			var err error
+			if start, err = parseValue(bounds[0], names); err != nil {
+				return nil, err
+			}
+
+			if len(bounds) == 2 {
+				if end, err = parseValue(bounds[1], names); err != nil {
+					return nil, err
+				}
+			} else if step == 1 {
+				end = start
+			}
+		}
+
+		if start < min || end > max || start > end {
+			return nil, errors.Errorf("'%s' is outside of range %d-%d", part, min, max)
+		}
+
+		for v := start; v <= end; v += step {
+			values[v] = true
+		}
+	}
+
+	return values, nil
+}
+
+// parseValue parses a single value which can be a number or one of the passed in names
+func parseValue(value string, names map[string]int) (int, error) {
+	if v, isName := names[strings.ToUpper(value)]; isName {
+		return v, nil
+	}
+
+	v, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, errors.Errorf("invalid value '%s'", value)
+	}
+	return v, nil
+}
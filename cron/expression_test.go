@@ -0,0 +1,65 @@
+package cron
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseExpression(t *testing.T) {
+	tcs := []struct {
+		expr  string
+		error string
+	}{
+		{"* * * * *", ""},
+		{"*/15 0-6,22 1 JAN-MAR mon-fri", ""},
+		{"@daily", ""},
+		{"0 0 * * 7", ""},
+		{"* * * *", "cron expression '* * * *' must have 5 fields, found 4"},
+		{"60 * * * *", "invalid minute field in cron expression '60 * * * *': '60' is outside of range 0-59"},
+		{"* * 0 * *", "invalid day of month field in cron expression '* * 0 * *': '0' is outside of range 1-31"},
+		{"* * * FOO *", "invalid month field in cron expression '* * * FOO *': invalid value 'FOO'"},
+		{"*/0 * * * *", "invalid minute field in cron expression '*/0 * * * *': invalid step in '*/0'"},
+		{"5-1 * * * *", "invalid minute field in cron expression '5-1 * * * *': '5-1' is outside of range 0-59"},
+	}
+
+	for _, tc := range tcs {
+		expr, err := ParseExpression(tc.expr)
+		if tc.error == "" {
+			assert.NoError(t, err, "unexpected error parsing '%s'", tc.expr)
+			assert.Equal(t, tc.expr, expr.String())
+		} else {
+			assert.EqualError(t, err, tc.error)
+		}
+	}
+}
+
+func TestExpressionNext(t *testing.T) {
+	ny, _ := time.LoadLocation("America/New_York")
+
+	tcs := []struct {
+		expr string
+		last time.Time
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2020, 1, 1, 10, 30, 15, 0, time.UTC), time.Date(2020, 1, 1, 10, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2020, 1, 1, 10, 30, 0, 0, time.UTC), time.Date(2020, 1, 1, 10, 45, 0, 0, time.UTC)},
+		{"0 9 * * MON-FRI", time.Date(2020, 1, 3, 9, 0, 0, 0, time.UTC), time.Date(2020, 1, 6, 9, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2020, 1, 31, 23, 59, 0, 0, time.UTC), time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 12 13 * 5", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2020, 1, 3, 12, 0, 0, 0, time.UTC)},
+		{"30 2 * * *", time.Date(2020, 3, 7, 12, 0, 0, 0, ny), time.Date(2020, 3, 9, 2, 30, 0, 0, ny)}, // 2:30 doesn't exist on the 8th
+		{"0 8 * * *", time.Date(2020, 3, 7, 12, 0, 0, 0, ny), time.Date(2020, 3, 8, 8, 0, 0, 0, ny)},
+		{"0 0 31 2 *", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), time.Time{}},
+	}
+
+	for _, tc := range tcs {
+		expr, err := ParseExpression(tc.expr)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.next, expr.Next(tc.last), "next mismatch for '%s' after %s", tc.expr, tc.last)
+	}
+
+	// intervals are schedules too
+	assert.Equal(t, time.Date(2000, 1, 1, 1, 1, 15, 0, time.UTC), Every(time.Second*15).Next(time.Date(2000, 1, 1, 1, 1, 4, 0, time.UTC)))
+}
@@ -0,0 +1,114 @@
+package cron
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/mailroom/redisutils"
+	"github.com/pkg/errors"
+)
+
+const (
+	// the set of the names of all crons which have fired, and the hash of the status of each, these are kept apart
+	// from each other so that no cron name can clash with our set
+	jobsKey    = "cron:jobs"
+	jobPattern = "cron:jobs:%s"
+)
+
+// Status is the state of a cron as recorded in redis
+type Status struct {
+	Name           string     `json:"name"`
+	LastFire       *time.Time `json:"last_fire"`
+	LastHost       string     `json:"last_host,omitempty"`
+	LastDurationMS int64      `json:"last_duration_ms"`
+	LastError      string     `json:"last_error,omitempty"`
+	NextFire       *time.Time `json:"next_fire"`
+}
+
+// readNextFire reads the next fire time of the named cron, returning the zero time if it has never fired
+func readNextFire(rp *redis.Pool, name string) (time.Time, error) {
+	rc := rp.Get()
+	defer rc.Close()
+
+	nanos, err := redis.Int64(rc.Do("hget", fmt.Sprintf(jobPattern, name), "next_fire"))
+	if err == redis.ErrNil {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "error reading next fire of cron: %s", name)
+	}
+	return time.Unix(0, nanos), nil
+}
+
+// recordFire records that the named cron is being fired and when it should next fire
+func recordFire(rp *redis.Pool, name string, fired time.Time, next time.Time) error {
+	rc := rp.Get()
+	defer rc.Close()
+
+	rc.Send("multi")
+	rc.Send("sadd", jobsKey, name)
+	rc.Send("hmset", fmt.Sprintf(jobPattern, name), "last_fire", fired.UnixNano(), "last_host", host, "next_fire", next.UnixNano())
+	_, err := rc.Do("exec")
+	return errors.Wrapf(err, "error recording fire of cron: %s", name)
+}
+
+// recordResult records the duration and result of the last fire of the named cron
+func recordResult(rp *redis.Pool, name string, duration time.Duration, fireErr error) error {
+	rc := rp.Get()
+	defer rc.Close()
+
+	lastError := ""
+	if fireErr != nil {
+		lastError = fireErr.Error()
+	}
+
+	_, err := rc.Do("hmset", fmt.Sprintf(jobPattern, name), "last_duration", int64(duration), "last_error", lastError)
+	return errors.Wrapf(err, "error recording result of cron: %s", name)
+}
+
+// GetStatus returns the status of the named cron, or nil if it has never fired
+func GetStatus(rc redis.Conn, name string) (*Status, error) {
+	values, err := redis.StringMap(rc.Do("hgetall", fmt.Sprintf(jobPattern, name)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading status of cron: %s", name)
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	status := &Status{
+		Name:      name,
+		LastFire:  redisutils.ParseNanos(values["last_fire"]),
+		LastHost:  values["last_host"],
+		LastError: values["last_error"],
+		NextFire:  redisutils.ParseNanos(values["next_fire"]),
+	}
+	if duration, err := strconv.ParseInt(values["last_duration"], 10, 64); err == nil {
+		status.LastDurationMS = int64(time.Duration(duration) / time.Millisecond)
+	}
+	return status, nil
+}
+
+// GetStatuses returns the status of all crons which have fired, ordered by name
+func GetStatuses(rc redis.Conn) ([]*Status, error) {
+	names, err := redis.Strings(rc.Do("smembers", jobsKey))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading cron names")
+	}
+	sort.Strings(names)
+
+	statuses := make([]*Status, 0, len(names))
+	for _, name := range names {
+		status, err := GetStatus(rc, name)
+		if err != nil {
+			return nil, err
+		}
+		if status != nil {
+			statuses = append(statuses, status)
+		}
+	}
+	return statuses, nil
+}
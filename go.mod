@@ -23,6 +23,7 @@ require (
 	github.com/nyaruka/librato v1.0.0
 	github.com/nyaruka/logrus_sentry v0.8.2-0.20190129182604-c2962b80ba7d
 	github.com/nyaruka/null v1.2.0
+	github.com/nyaruka/phonenumbers v1.0.55
 	github.com/olivere/elastic v6.2.33+incompatible
 	github.com/patrickmn/go-cache v2.1.0+incompatible
 	github.com/pkg/errors v0.9.1
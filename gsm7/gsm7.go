@@ -1,5 +1,9 @@
 package gsm7
 
+import (
+	"strings"
+)
+
 // base gsm7 characters in our normal table
 var baseGSM7 = map[rune]byte{
 	'@':  0x00,
@@ -147,45 +151,65 @@ var extendedGSM7 = map[rune]byte{
 }
 
 // Characters we replace in GSM7 with versions that can actually be encoded
-var gsm7Replacements = map[rune]rune{
-	'á': 'a',
-	'ê': 'e',
-	'ã': 'a',
-	'â': 'a',
-	'ç': 'c',
-	'í': 'i',
-	'î': 'i',
-	'ú': 'u',
-	'û': 'u',
-	'õ': 'o',
-	'ô': 'o',
-	'ó': 'o',
-
-	'Á': 'A',
-	'Â': 'A',
-	'Ã': 'A',
-	'À': 'A',
-	'Ç': 'C',
-	'È': 'E',
-	'Ê': 'E',
-	'Í': 'I',
-	'Î': 'I',
-	'Ì': 'I',
-	'Ó': 'O',
-	'Ô': 'O',
-	'Ò': 'O',
-	'Õ': 'O',
-	'Ú': 'U',
-	'Ù': 'U',
-	'Û': 'U',
+var gsm7Replacements = map[rune]string{
+	'á': "a",
+	'ê': "e",
+	'ã': "a",
+	'â': "a",
+	'ç': "c",
+	'í': "i",
+	'î': "i",
+	'ú': "u",
+	'û': "u",
+	'õ': "o",
+	'ô': "o",
+	'ó': "o",
+	'ë': "e",
+	'ï': "i",
+	'ý': "y",
+	'ÿ': "y",
+
+	'Á': "A",
+	'Â': "A",
+	'Ã': "A",
+	'À': "A",
+	'È': "E",
+	'Ê': "E",
+	'Ë': "E",
+	'Í': "I",
+	'Î': "I",
+	'Ì': "I",
+	'Ï': "I",
+	'Ó': "O",
+	'Ô': "O",
+	'Ò': "O",
+	'Õ': "O",
+	'Ú': "U",
+	'Ù': "U",
+	'Û': "U",
+	'Ý': "Y",
 
 	// shit Word likes replacing automatically
-	'’':    '\'',
-	'‘':    '\'',
-	'“':    '"',
-	'”':    '"',
-	'–':    '-',
-	'\xa0': ' ',
+	'’':      "'",
+	'‘':      "'",
+	'‚':      "'",
+	'′':      "'",
+	'“':      "\"",
+	'”':      "\"",
+	'„':      "\"",
+	'″':      "\"",
+	'«':      "\"",
+	'»':      "\"",
+	'–':      "-",
+	'—':      "-",
+	'‐':      "-",
+	'−':      "-",
+	'…':      "...",
+	'•':      "*",
+	'\xa0':   " ",
+	'\u2009': " ",
+	'\u200b': "",
+	'\t':     " ",
 }
 
 // esc is our escape byte for the extended charset
@@ -215,17 +239,138 @@ func init() {
 // IsValid returns whether the passed in string is made up of entirely GSM7 characters
 func IsValid(text string) bool {
 	for _, r := range text {
-		_, present := baseGSM7[r]
-		if !present {
-			_, present = extendedGSM7[r]
-			if !present {
-				return false
-			}
+		if !isGSM7(r) {
+			return false
 		}
 	}
 	return true
 }
 
+// ReplaceSubstitutions replaces any characters which can't be encoded in GSM7 with their GSM7 equivalents
+// where we know them, e.g. smart quotes with plain quotes. Characters with no equivalent are left as is.
+func ReplaceSubstitutions(text string) string {
+	var b strings.Builder
+	b.Grow(len(text))
+
+	for _, r := range text {
+		if !isGSM7(r) {
+			if replacement, found := gsm7Replacements[r]; found {
+				b.WriteString(replacement)
+				continue
+			}
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// InvalidChars returns the unique characters in the passed in text which can't be encoded in GSM7, and
+// which will therefore force it to be sent as UCS2, in the order they first appear
+func InvalidChars(text string) []rune {
+	invalid := make([]rune, 0)
+	seen := make(map[rune]bool)
+
+	for _, r := range text {
+		if !isGSM7(r) && !seen[r] {
+			invalid = append(invalid, r)
+			seen[r] = true
+		}
+	}
+	return invalid
+}
+
+// Encode encodes the passed in text as unpacked GSM7 septets, one per byte. Extended characters are
+// preceded by our escape and characters which can't be encoded are replaced with '?'
+func Encode(text string) []byte {
+	septets := make([]byte, 0, len(text))
+
+	for _, r := range text {
+		if b, isBase := baseGSM7[r]; isBase {
+			septets = append(septets, b)
+		} else if b, isExtended := extendedGSM7[r]; isExtended {
+			septets = append(septets, esc, b)
+		} else {
+			septets = append(septets, unknown)
+		}
+	}
+	return septets
+}
+
+// Decode decodes the passed in unpacked GSM7 septets to a string. Unknown escaped values are decoded
+// as a space as per the spec, and values which aren't valid septets as '?'
+func Decode(septets []byte) string {
+	var b strings.Builder
+	b.Grow(len(septets))
+
+	for i := 0; i < len(septets); i++ {
+		if septets[i] > max {
+			b.WriteByte(unknown)
+			continue
+		}
+
+		if septets[i] == esc {
+			if i+1 < len(septets) {
+				i++
+				if r, isExtended := gsm7ToExtended[septets[i]]; isExtended {
+					b.WriteRune(r)
+					continue
+				}
+			}
+			b.WriteByte(' ')
+			continue
+		}
+
+		b.WriteRune(gsm7ToBase[septets[i]])
+	}
+	return b.String()
+}
+
+// Pack packs the passed in septets into octets, 8 septets taking up 7 bytes
+func Pack(septets []byte) []byte {
+	packed := make([]byte, (len(septets)*7+7)/8)
+
+	for i, s := range septets {
+		bit := i * 7
+		idx, shift := bit/8, uint(bit%8)
+
+		packed[idx] |= (s & max) << shift
+		if shift > 1 {
+			packed[idx+1] |= (s & max) >> (8 - shift)
+		}
+	}
+	return packed
+}
+
+// Unpack unpacks the passed in octets into count septets. The count is needed as 7 packed septets leave
+// 7 spare bits at the end which are indistinguishable from an eighth septet of '@'
+func Unpack(packed []byte, count int) []byte {
+	if available := len(packed) * 8 / 7; count > available {
+		count = available
+	}
+
+	septets := make([]byte, count)
+	for i := range septets {
+		bit := i * 7
+		idx, shift := bit/8, uint(bit%8)
+
+		s := packed[idx] >> shift
+		if shift > 1 {
+			s |= packed[idx+1] << (8 - shift)
+		}
+		septets[i] = s & max
+	}
+	return septets
+}
+
+// isGSM7 returns whether the passed in rune can be encoded in GSM7
+func isGSM7(r rune) bool {
+	if _, isBase := baseGSM7[r]; isBase {
+		return true
+	}
+	_, isExtended := extendedGSM7[r]
+	return isExtended
+}
+
 // Segments calculates the number of SMS segments it will take to send the passed in text.
 // This automatically figures out if the text is GSM7 or UCS2 and then calculates how many segments it
 // will break up into.
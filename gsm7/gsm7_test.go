@@ -1,6 +1,7 @@
 package gsm7
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -36,3 +37,69 @@ func TestSegments(t *testing.T) {
 		assert.Equal(t, tc.Segments, Segments(tc.Text), "unexpected num of segments for: %s", tc.Text)
 	}
 }
+
+func TestReplaceSubstitutions(t *testing.T) {
+	tcs := []struct {
+		Text    string
+		Replace string
+		Invalid []rune
+	}{
+		{"", "", []rune{}},
+		{"hello world", "hello world", []rune{}},
+		{"“word”", "\"word\"", []rune{'“', '”'}},
+		{"I’m – fine…", "I'm - fine...", []rune{'’', '–', '…'}},
+		{"Olá, você está?", "Ola, voce esta?", []rune{'á', 'ê'}},
+		{"café è ü", "café è ü", []rune{}},
+		{"smile ☺ ☺", "smile ☺ ☺", []rune{'☺'}},
+		{"{€}", "{€}", []rune{}},
+	}
+
+	for _, tc := range tcs {
+		assert.Equal(t, tc.Replace, ReplaceSubstitutions(tc.Text), "unexpected replacement for: %s", tc.Text)
+		assert.Equal(t, tc.Invalid, InvalidChars(tc.Text), "unexpected invalid chars for: %s", tc.Text)
+	}
+
+	// substituting can bring a message back down from UCS2 segments to GSM7 segments
+	text := strings.Repeat("“quote”", 20)
+	assert.Equal(t, 3, Segments(text))
+	assert.Equal(t, 1, Segments(ReplaceSubstitutions(text)))
+	assert.True(t, IsValid(ReplaceSubstitutions(text)))
+}
+
+func TestEncoding(t *testing.T) {
+	tcs := []struct {
+		Text    string
+		Septets []byte
+		Packed  []byte
+		Decoded string
+	}{
+		{"", []byte{}, []byte{}, ""},
+		{"@", []byte{0x00}, []byte{0x00}, "@"},
+		{"hello", []byte{0x68, 0x65, 0x6C, 0x6C, 0x6F}, []byte{0xE8, 0x32, 0x9B, 0xFD, 0x06}, "hello"},
+		{"hellohello", []byte{0x68, 0x65, 0x6C, 0x6C, 0x6F, 0x68, 0x65, 0x6C, 0x6C, 0x6F}, []byte{0xE8, 0x32, 0x9B, 0xFD, 0x46, 0x97, 0xD9, 0xEC, 0x37}, "hellohello"},
+		{"€5", []byte{0x1B, 0x65, 0x35}, []byte{0x9B, 0x72, 0x0D}, "€5"},
+		{"a☺b", []byte{0x61, 0x3F, 0x62}, []byte{0xE1, 0x9F, 0x18}, "a?b"},
+	}
+
+	for _, tc := range tcs {
+		septets := Encode(tc.Text)
+		assert.Equal(t, tc.Septets, septets, "unexpected septets for: %s", tc.Text)
+
+		packed := Pack(septets)
+		assert.Equal(t, tc.Packed, packed, "unexpected packing for: %s", tc.Text)
+
+		unpacked := Unpack(packed, len(septets))
+		assert.Equal(t, septets, unpacked, "unexpected unpacking for: %s", tc.Text)
+		assert.Equal(t, tc.Decoded, Decode(unpacked), "unexpected decoding for: %s", tc.Text)
+	}
+
+	// 8 septets pack into 7 bytes, and we can't unpack more septets than are there
+	packed := Pack(Encode("12345678"))
+	assert.Equal(t, 7, len(packed))
+	assert.Equal(t, "12345678", Decode(Unpack(packed, 8)))
+	assert.Equal(t, "12345678", Decode(Unpack(packed, 20)))
+
+	// unknown escapes decode as spaces and invalid septets as ?
+	assert.Equal(t, "a b?", Decode([]byte{0x61, 0x1B, 0x01, 0x62, 0x80}))
+	assert.Equal(t, "a ", Decode([]byte{0x61, 0x1B}))
+}
@@ -2,11 +2,13 @@ package hooks
 
 import (
 	"context"
+	"time"
 
 	"github.com/gomodule/redigo/redis"
 	"github.com/jmoiron/sqlx"
 	"github.com/nyaruka/goflow/flows"
 	"github.com/nyaruka/goflow/flows/events"
+	"github.com/nyaruka/mailroom/config"
 	"github.com/nyaruka/mailroom/models"
 	"github.com/nyaruka/mailroom/queue"
 	"github.com/pkg/errors"
@@ -27,26 +29,39 @@ func (h *StartBroadcastsHook) Apply(ctx context.Context, tx *sqlx.Tx, rp *redis.
 	rc := rp.Get()
 	defer rc.Close()
 
+	dedupWindow := time.Second * time.Duration(config.Mailroom.TaskDedupWindow)
+
 	// for each of our scene
-	for _, es := range scenes {
+	for s, es := range scenes {
 		for _, e := range es {
 			event := e.(*events.BroadcastCreatedEvent)
 
-			bcast, err := models.NewBroadcastFromEvent(ctx, tx, oa, event)
-			if err != nil {
-				return errors.Wrapf(err, "error creating broadcast")
-			}
-
 			taskQ := queue.HandlerQueue
 			priority := queue.DefaultPriority
 
 			// if we are starting groups, queue to our batch queue instead, but with high priority
-			if len(bcast.GroupIDs()) > 0 {
+			if len(event.Groups) > 0 {
 				taskQ = queue.BatchQueue
 				priority = queue.HighPriority
 			}
 
-			err = queue.AddTask(rc, taskQ, queue.SendBroadcast, int(oa.OrgID()), bcast, priority)
+			// key our task on the event which created this broadcast so it can't be sent twice if that event is
+			// handled again, and don't bother creating the broadcast if it was already queued
+			dedupKey := eventDedupKey("send_broadcast", s, event)
+			queued, err := queue.HasDedupKey(rc, taskQ, dedupKey)
+			if err != nil {
+				return errors.Wrapf(err, "error checking whether broadcast was already queued")
+			}
+			if queued {
+				continue
+			}
+
+			bcast, err := models.NewBroadcastFromEvent(ctx, tx, oa, event)
+			if err != nil {
+				return errors.Wrapf(err, "error creating broadcast")
+			}
+
+			_, err = queue.AddUniqueTask(rc, taskQ, queue.SendBroadcast, int(oa.OrgID()), bcast, priority, dedupKey, dedupWindow)
 			if err != nil {
 				return errors.Wrapf(err, "error queuing broadcast")
 			}
@@ -68,7 +68,7 @@ func (h *SendMessagesHook) Apply(ctx context.Context, tx *sqlx.Tx, rp *redis.Poo
 
 			log := log.WithField("messages", courierMsgs).WithField("scene", s.SessionID)
 
-			err := courier.QueueMessages(rc, courierMsgs)
+			err := courier.SendMessages(ctx, tx, rc, oa, courierMsgs)
 
 			// not being able to queue a message isn't the end of the world, log but don't return an error
 			if err != nil {
@@ -223,6 +223,13 @@ func handleMsgCreated(ctx context.Context, tx *sqlx.Tx, rp *redis.Pool, oa *mode
 	// set our reply to as well (will be noop in cases when there is no incoming message)
 	msg.SetResponseTo(scene.Session().IncomingMsgID(), scene.Session().IncomingMsgExternalID())
 
+	// if the flow wants this message sent later, commit it as pending and leave it for our cron to send
+	if sendOn := sendLaterFor(oa, scene, event); sendOn != nil {
+		msg.ScheduleSend(*sendOn, scene.SessionID())
+		scene.AppendToEventPreCommitHook(commitMessagesHook, msg)
+		return nil
+	}
+
 	// register to have this message committed
 	scene.AppendToEventPreCommitHook(commitMessagesHook, msg)
 
@@ -263,8 +270,47 @@ func handlePreMsgCreated(ctx context.Context, tx *sqlx.Tx, rp *redis.Pool, oa *m
 		return nil
 	}
 
+	// as do messages which will be sent later
+	if sendLaterFor(oa, scene, event) != nil {
+		return nil
+	}
+
 	// everybody else gets their timeout cleared, will be set by courier
 	scene.Session().ClearTimeoutOn()
 
 	return nil
 }
+
+// sendLaterFor returns when the message of the passed in event should be sent, if the flow saved a send later result
+// after creating its previous message
+func sendLaterFor(oa *models.OrgAssets, scene *models.Scene, event *events.MsgCreatedEvent) *time.Time {
+	sprint := scene.Session().Sprint()
+	if sprint == nil {
+		return nil
+	}
+	evts := sprint.Events()
+
+	for i := range evts {
+		if evts[i] != event {
+			continue
+		}
+
+		// look back for a send later result, stopping at any earlier message
+		for j := i - 1; j >= 0; j-- {
+			switch e := evts[j].(type) {
+			case *events.MsgCreatedEvent:
+				return nil
+			case *events.RunResultChangedEvent:
+				if models.IsSendLaterResult(e.Name) {
+					sendOn, valid := models.ParseSendLater(oa.Env(), e.Value, e.CreatedOn())
+					if !valid || !sendOn.After(event.CreatedOn()) {
+						return nil
+					}
+					return &sendOn
+				}
+			}
+		}
+		return nil
+	}
+	return nil
+}
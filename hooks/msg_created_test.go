@@ -110,6 +110,45 @@ func TestMsgCreated(t *testing.T) {
 	assert.Equal(t, 1, count)
 }
 
+func TestMsgCreatedSendLater(t *testing.T) {
+	testsuite.Reset()
+
+	tcs := []HookTestCase{
+		HookTestCase{
+			Actions: ContactActionMap{
+				models.CathyID: []flows.Action{
+					actions.NewSetRunResult(newActionUUID(), "Send Later", "2h", ""),
+					actions.NewSendMsg(newActionUUID(), "Reminder", nil, nil, false),
+					actions.NewSendMsg(newActionUUID(), "Right away", nil, nil, false),
+				},
+				models.GeorgeID: []flows.Action{
+					actions.NewSetRunResult(newActionUUID(), "Send Later", "soon", ""),
+					actions.NewSendMsg(newActionUUID(), "Invalid delay", nil, nil, false),
+				},
+			},
+			SQLAssertions: []SQLAssertion{
+				{
+					SQL:   "SELECT COUNT(*) FROM msgs_msg WHERE text = 'Reminder' AND contact_id = $1 AND status = 'P' AND next_attempt > NOW() + INTERVAL '1 hour' AND metadata LIKE '%send_on%'",
+					Args:  []interface{}{models.CathyID},
+					Count: 1,
+				},
+				{
+					SQL:   "SELECT COUNT(*) FROM msgs_msg WHERE text = 'Right away' AND contact_id = $1 AND status = 'Q'",
+					Args:  []interface{}{models.CathyID},
+					Count: 1,
+				},
+				{
+					SQL:   "SELECT COUNT(*) FROM msgs_msg WHERE text = 'Invalid delay' AND contact_id = $1 AND status = 'Q'",
+					Args:  []interface{}{models.GeorgeID},
+					Count: 1,
+				},
+			},
+		},
+	}
+
+	RunHookTestCases(t, tcs)
+}
+
 func TestNoTopup(t *testing.T) {
 	testsuite.Reset()
 	db := testsuite.DB()
@@ -2,12 +2,15 @@ package hooks
 
 import (
 	"context"
+	"fmt"
+	"time"
 
 	"github.com/gomodule/redigo/redis"
 	"github.com/jmoiron/sqlx"
 	"github.com/nyaruka/goflow/flows"
 	"github.com/nyaruka/goflow/flows/events"
 	"github.com/nyaruka/goflow/utils/jsonx"
+	"github.com/nyaruka/mailroom/config"
 	"github.com/nyaruka/mailroom/models"
 	"github.com/nyaruka/mailroom/queue"
 	"github.com/pkg/errors"
@@ -28,26 +31,34 @@ type InsertStartHook struct{}
 
 var insertStartHook = &InsertStartHook{}
 
+// a flow start which is queued once committed, along with where it's queued and the key used to make sure it's only
+// queued once
+type queuedStart struct {
+	start    *models.FlowStart
+	queue    string
+	priority queue.Priority
+	dedupKey string
+}
+
+// eventDedupKey returns a key which identifies the passed in event in the passed in scene, and so stays the same if
+// that event ends up being handled more than once
+func eventDedupKey(prefix string, scene *models.Scene, e flows.Event) string {
+	return fmt.Sprintf("%s:%d:%s:%d", prefix, scene.SessionID(), e.StepUUID(), e.CreatedOn().UnixNano())
+}
+
 // Apply queues up our flow starts
 func (h *StartStartHook) Apply(ctx context.Context, tx *sqlx.Tx, rp *redis.Pool, oa *models.OrgAssets, scenes map[*models.Scene][]interface{}) error {
 	rc := rp.Get()
 	defer rc.Close()
 
+	dedupWindow := time.Second * time.Duration(config.Mailroom.TaskDedupWindow)
+
 	// for each of our scene
 	for _, es := range scenes {
 		for _, e := range es {
-			start := e.(*models.FlowStart)
-
-			taskQ := queue.HandlerQueue
-			priority := queue.DefaultPriority
-
-			// if we are starting groups, queue to our batch queue instead, but with high priority
-			if len(start.GroupIDs()) > 0 || start.Query() != "" {
-				taskQ = queue.BatchQueue
-				priority = queue.HighPriority
-			}
+			qs := e.(*queuedStart)
 
-			err := queue.AddTask(rc, taskQ, queue.StartFlow, int(oa.OrgID()), start, priority)
+			_, err := queue.AddUniqueTask(rc, qs.queue, queue.StartFlow, int(oa.OrgID()), qs.start, qs.priority, qs.dedupKey, dedupWindow)
 			if err != nil {
 				return errors.Wrapf(err, "error queuing flow start")
 			}
@@ -69,6 +80,26 @@ func (h *InsertStartHook) Apply(ctx context.Context, tx *sqlx.Tx, rp *redis.Pool
 		for _, e := range es {
 			event := e.(*events.SessionTriggeredEvent)
 
+			taskQ := queue.HandlerQueue
+			priority := queue.DefaultPriority
+
+			// if we are starting groups, queue to our batch queue instead, but with high priority
+			if len(event.Groups) > 0 || event.ContactQuery != "" {
+				taskQ = queue.BatchQueue
+				priority = queue.HighPriority
+			}
+
+			// our start is keyed on the event which triggered it, so if that event is being handled again and its
+			// start was already queued, we don't insert it again
+			dedupKey := eventDedupKey("start_flow", s, event)
+			queued, err := queue.HasDedupKey(rc, taskQ, dedupKey)
+			if err != nil {
+				return errors.Wrapf(err, "error checking whether flow start was already queued")
+			}
+			if queued {
+				continue
+			}
+
 			// look up our flow
 			f, err := oa.Flow(event.Flow.UUID)
 			if err != nil {
@@ -109,7 +140,7 @@ func (h *InsertStartHook) Apply(ctx context.Context, tx *sqlx.Tx, rp *redis.Pool
 			starts = append(starts, start)
 
 			// this will add our task for our start after we commit
-			s.AppendToEventPostCommitHook(startStartHook, start)
+			s.AppendToEventPostCommitHook(startStartHook, &queuedStart{start: start, queue: taskQ, priority: priority, dedupKey: dedupKey})
 		}
 	}
 
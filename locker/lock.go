@@ -0,0 +1,203 @@
+package locker
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Lock is a held lock which renews its own expiration in the background until it is released. Each acquisition
+// of a lock is given a fencing token which is greater than that of any previous acquisition of the same key, so
+// writes made under a lock can be rejected if a later holder has since acquired it.
+type Lock struct {
+	rp         *redis.Pool
+	key        string
+	value      string
+	token      int64
+	expiration time.Duration
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	stop   chan bool
+	wg     sync.WaitGroup
+	once   sync.Once
+}
+
+var acquireScript = redis.NewScript(2, `
+    -- KEYS: [Key, TokenKey] ARGV: [Value, Expiration]
+	if redis.call("set", KEYS[1], ARGV[1], "EX", ARGV[2], "NX") then
+      return redis.call("incr", KEYS[2])
+    else
+      return 0
+    end
+`)
+
+// AcquireLock grabs the passed in lock from redis, retrying until the retry period. It returns nil if the lock
+// could not be acquired in that time. Once acquired the lock is renewed every third of its expiration until it is
+// released, and the context of the lock is cancelled if it is ever lost.
+func AcquireLock(ctx context.Context, rp *redis.Pool, key string, expiration time.Duration, retry time.Duration) (*Lock, error) {
+	value := makeRandom(10)
+
+	// convert our expiration to seconds
+	seconds := int(expiration / time.Second)
+	if seconds < 1 {
+		return nil, errors.Errorf("can't grab lock with expiration less than a second")
+	}
+
+	var token int64
+	start := time.Now()
+	for {
+		rc := rp.Get()
+		var err error
+		token, err = redis.Int64(acquireScript.Do(rc, fmt.Sprintf("lock:%s", key), tokenKey(key), value, seconds))
+		rc.Close()
+
+		if err != nil {
+			return nil, errors.Wrapf(err, "error trying to get lock")
+		}
+
+		if token > 0 {
+			break
+		}
+
+		if time.Since(start) > retry {
+			return nil, nil
+		}
+
+		time.Sleep(sleep)
+	}
+
+	lock := &Lock{
+		rp:         rp,
+		key:        key,
+		value:      value,
+		token:      token,
+		expiration: expiration,
+		stop:       make(chan bool),
+	}
+
+	// our context carries the lock so that whoever we hand it to can check it's still held before writing
+	lock.ctx, lock.cancel = context.WithCancel(context.WithValue(ctx, lockContextKey{}, lock))
+
+	lock.wg.Add(1)
+	go lock.renew()
+
+	return lock, nil
+}
+
+// Key returns the key of this lock
+func (l *Lock) Key() string { return l.key }
+
+// Value returns the random value of this lock which identifies the holder
+func (l *Lock) Value() string { return l.value }
+
+// Token returns the fencing token of this lock
+func (l *Lock) Token() int64 { return l.token }
+
+// Context returns a context which is cancelled when this lock is lost or released
+func (l *Lock) Context() context.Context { return l.ctx }
+
+// Lost returns whether this lock has been lost or released
+func (l *Lock) Lost() bool { return l.ctx.Err() != nil }
+
+// Check returns an error if this lock has been lost or released, or if it has since been acquired by another holder
+// with a greater fencing token. Holders should call this before making writes which must not be made twice.
+func (l *Lock) Check() error {
+	if l.Lost() {
+		return errors.Errorf("lock %s has been lost", l.key)
+	}
+
+	current, err := CurrentToken(l.rp, l.key)
+	if err != nil {
+		return err
+	}
+	if current > l.token {
+		return errors.Errorf("lock %s has been acquired by another holder with token %d", l.key, current)
+	}
+	return nil
+}
+
+// Release stops renewing this lock and releases it. It is safe to call more than once.
+func (l *Lock) Release() error {
+	var err error
+	l.once.Do(func() {
+		close(l.stop)
+		l.wg.Wait()
+		l.cancel()
+
+		err = ReleaseLock(l.rp, l.key, l.value)
+	})
+	return err
+}
+
+// renew extends our lock every third of its expiration until we are stopped or lose the lock
+func (l *Lock) renew() {
+	defer l.wg.Done()
+
+	log := logrus.WithField("lock", l.key).WithField("token", l.token)
+	lastRenewed := time.Now()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+
+		case <-l.ctx.Done():
+			return
+
+		case <-time.After(l.expiration / 3):
+			renewed, err := extendLock(l.rp, l.key, l.value, l.expiration)
+			if err != nil {
+				log.WithError(err).Error("error renewing lock")
+
+				// we can keep trying until the lock would have expired
+				if time.Since(lastRenewed) < l.expiration {
+					continue
+				}
+			} else if renewed {
+				lastRenewed = time.Now()
+				continue
+			}
+
+			log.Error("lock lost")
+			l.cancel()
+			return
+		}
+	}
+}
+
+// CurrentToken returns the fencing token of the latest acquisition of the passed in lock, holders whose token is
+// less than this no longer hold the lock
+func CurrentToken(rp *redis.Pool, key string) (int64, error) {
+	rc := rp.Get()
+	defer rc.Close()
+
+	token, err := redis.Int64(rc.Do("get", tokenKey(key)))
+	if err != nil && err != redis.ErrNil {
+		return 0, errors.Wrapf(err, "error reading fencing token for lock: %s", key)
+	}
+	return token, nil
+}
+
+type lockContextKey struct{}
+
+// CheckContext checks that the passed in context hasn't been cancelled and that the lock it was created from is still
+// held, see Lock.Check. Contexts which don't come from a lock are only checked for cancellation.
+func CheckContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if lock, _ := ctx.Value(lockContextKey{}).(*Lock); lock != nil {
+		return lock.Check()
+	}
+	return nil
+}
+
+func tokenKey(key string) string {
+	return fmt.Sprintf("lock:%s:token", key)
+}
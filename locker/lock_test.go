@@ -0,0 +1,101 @@
+package locker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLock(t *testing.T) {
+	testsuite.ResetRP()
+	rp := testsuite.RP()
+	rc := rp.Get()
+	defer rc.Close()
+
+	lock1, err := AcquireLock(context.Background(), rp, "test", time.Second*3, 0)
+	require.NoError(t, err)
+	require.NotNil(t, lock1)
+	assert.Equal(t, "test", lock1.Key())
+	assert.Equal(t, int64(1), lock1.Token())
+	assert.False(t, lock1.Lost())
+
+	token, err := CurrentToken(rp, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), token)
+
+	// wait longer than the expiration, our lock should have been renewed
+	time.Sleep(time.Second * 4)
+	assert.False(t, lock1.Lost())
+
+	lock2, err := AcquireLock(context.Background(), rp, "test", time.Second*3, 0)
+	assert.NoError(t, err)
+	assert.Nil(t, lock2)
+
+	// can't grab it the old way either
+	value, err := GrabLock(rp, "test", time.Second*3, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "", value)
+
+	// release it and it can be acquired again with a greater token
+	assert.NoError(t, lock1.Release())
+	assert.NoError(t, lock1.Release())
+	assert.True(t, lock1.Lost())
+
+	lock3, err := AcquireLock(context.Background(), rp, "test", time.Second*3, 0)
+	require.NoError(t, err)
+	require.NotNil(t, lock3)
+	assert.Equal(t, int64(2), lock3.Token())
+	assert.NoError(t, lock3.Check())
+	assert.NoError(t, CheckContext(lock3.Context()))
+
+	// contexts derived from the lock's context can be checked too
+	derived, cancelDerived := context.WithTimeout(lock3.Context(), time.Minute)
+	assert.NoError(t, CheckContext(derived))
+	cancelDerived()
+	assert.EqualError(t, CheckContext(derived), "context canceled")
+
+	// a later acquisition of the same key fences us off even while we still appear to hold it
+	_, err = rc.Do("incr", "lock:test:token")
+	require.NoError(t, err)
+	assert.EqualError(t, lock3.Check(), "lock test has been acquired by another holder with token 3")
+	assert.EqualError(t, CheckContext(lock3.Context()), "lock test has been acquired by another holder with token 3")
+	_, err = rc.Do("decr", "lock:test:token")
+	require.NoError(t, err)
+
+	// contexts not created from locks are only checked for cancellation
+	assert.NoError(t, CheckContext(context.Background()))
+
+	// if someone else takes the lock from us, our context is cancelled on the next renewal
+	_, err = rc.Do("set", "lock:test", "stolen")
+	require.NoError(t, err)
+
+	select {
+	case <-lock3.Context().Done():
+	case <-time.After(time.Second * 3):
+		assert.Fail(t, "lock context not cancelled after lock was lost")
+	}
+	assert.True(t, lock3.Lost())
+	assert.EqualError(t, lock3.Check(), "lock test has been lost")
+
+	// releasing a lost lock doesn't touch the new holder's lock
+	assert.NoError(t, lock3.Release())
+	value, err = redis.String(rc.Do("get", "lock:test"))
+	assert.NoError(t, err)
+	assert.Equal(t, "stolen", value)
+
+	// cancelling the parent context also cancels the lock context
+	ctx, cancel := context.WithCancel(context.Background())
+	lock4, err := AcquireLock(ctx, rp, "test2", time.Second*3, 0)
+	require.NoError(t, err)
+	cancel()
+	assert.True(t, lock4.Lost())
+	assert.NoError(t, lock4.Release())
+
+	_, err = AcquireLock(context.Background(), rp, "test3", time.Millisecond*500, 0)
+	assert.EqualError(t, err, "can't grab lock with expiration less than a second")
+}
@@ -42,7 +42,7 @@ func GrabLock(rp *redis.Pool, key string, expiration time.Duration, retry time.D
 			return "", nil
 		}
 
-		time.Sleep(time.Second)
+		time.Sleep(sleep)
 	}
 
 	return value, nil
@@ -79,18 +79,24 @@ var expireScript = redis.NewScript(3, `
 
 // ExtendLock extends our lock expiration by the passed in number of seconds
 func ExtendLock(rp *redis.Pool, key string, value string, expiration time.Duration) error {
+	_, err := extendLock(rp, key, value, expiration)
+	return err
+}
+
+// extendLock extends our lock expiration, returning whether we still own the lock
+func extendLock(rp *redis.Pool, key string, value string, expiration time.Duration) (bool, error) {
 	rc := rp.Get()
 	defer rc.Close()
 
 	// convert our expiration to seconds
 	seconds := int(expiration / time.Second)
 	if seconds < 1 {
-		return errors.Errorf("can't grab lock with expiration less than a second")
+		return false, errors.Errorf("can't grab lock with expiration less than a second")
 	}
 
 	// we use lua here because we only want to set the expiration time if we own it
-	_, err := expireScript.Do(rc, fmt.Sprintf("lock:%s", key), value, seconds)
-	return err
+	extended, err := redis.Int(expireScript.Do(rc, fmt.Sprintf("lock:%s", key), value, seconds))
+	return extended == 1, err
 }
 
 const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
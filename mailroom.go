@@ -40,12 +40,22 @@ func AddInitFunction(initFunc InitFunction) {
 type TaskFunction func(ctx context.Context, mr *Mailroom, task *queue.Task) error
 
 var taskFunctions = make(map[string]TaskFunction)
+var retryableTasks = make(map[string]bool)
 
-// AddTaskFunction adds an task function that will be called for a type of task
+// AddTaskFunction adds an task function that will be called for a type of task, failed tasks of this type are
+// moved straight to the dead letters
 func AddTaskFunction(taskType string, taskFunc TaskFunction) {
 	taskFunctions[taskType] = taskFunc
 }
 
+// AddRetryableTaskFunction adds a task function like AddTaskFunction, but failed tasks of this type are retried
+// with backoff before being moved to the dead letters. Only task functions which are safe to run more than once
+// for the same task should be added this way.
+func AddRetryableTaskFunction(taskType string, taskFunc TaskFunction) {
+	taskFunctions[taskType] = taskFunc
+	retryableTasks[taskType] = true
+}
+
 // Mailroom is a service for handling RapidPro events
 type Mailroom struct {
 	Config        *config.Config
@@ -53,6 +63,7 @@ type Mailroom struct {
 	RP            *redis.Pool
 	ElasticClient *elastic.Client
 	S3Client      s3iface.S3API
+	Queue         queue.Backend
 
 	Quit      chan bool
 	CTX       context.Context
@@ -73,8 +84,8 @@ func NewMailroom(config *config.Config) *Mailroom {
 		WaitGroup: &sync.WaitGroup{},
 	}
 	mr.CTX, mr.Cancel = context.WithCancel(context.Background())
-	mr.batchForeman = NewForeman(mr, queue.BatchQueue, config.BatchWorkers)
-	mr.handlerForeman = NewForeman(mr, queue.HandlerQueue, config.HandlerWorkers)
+	mr.batchForeman = NewForeman(mr, queue.BatchQueue, config.BatchWorkers, config.BatchMaxWorkers)
+	mr.handlerForeman = NewForeman(mr, queue.HandlerQueue, config.HandlerWorkers, config.HandlerMaxWorkers)
 
 	return mr
 }
@@ -153,6 +164,16 @@ func (mr *Mailroom) Start() error {
 	}
 	mr.RP = redisPool
 
+	// our task queues live in redis unless we've been configured to keep them in memory
+	switch mr.Config.Queue {
+	case "redis":
+		mr.Queue = queue.NewRedisBackend(redisPool)
+	case "memory":
+		mr.Queue = queue.NewMemoryBackend()
+	default:
+		return fmt.Errorf("invalid queue backend: '%s', must be redis or memory", mr.Config.Queue)
+	}
+
 	// test our redis connection
 	conn := redisPool.Get()
 	defer conn.Close()
@@ -224,6 +245,12 @@ func (mr *Mailroom) Stop() error {
 	logrus.Info("mailroom stopping")
 	mr.batchForeman.Stop()
 	mr.handlerForeman.Stop()
+
+	// give our workers a bounded amount of time to finish their in-flight tasks
+	deadline := time.Now().Add(time.Second * time.Duration(mr.Config.ShutdownTimeout))
+	mr.batchForeman.Drain(deadline)
+	mr.handlerForeman.Drain(deadline)
+
 	librato.Stop()
 	close(mr.Quit)
 	mr.Cancel()
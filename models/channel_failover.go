@@ -0,0 +1,246 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/goflow/assets"
+	"github.com/nyaruka/goflow/envs"
+	"github.com/pkg/errors"
+)
+
+const (
+	configChannelFailover = "channel_failover"
+
+	unhealthyChannelPattern = "channel_unhealthy:%s"
+
+	// FailoverReasonUnhealthy is the failover reason recorded when a message's channel was marked unhealthy
+	FailoverReasonUnhealthy = "unhealthy"
+
+	// FailoverReasonFailed is the failover reason recorded when a message failed permanently on its channel
+	FailoverReasonFailed = "failed"
+
+	// FailedReasonNoFailover is the failure reason recorded on failed messages with no channel left to fail over to
+	FailedReasonNoFailover = "no_failover_channel"
+)
+
+// ChannelFailover returns whether this org wants messages re-routed to other channels when their channel fails
+func (o *Org) ChannelFailover() bool {
+	failover, _ := o.o.Config.Get(configChannelFailover, false).(bool)
+	return failover
+}
+
+// MarkChannelUnhealthy marks the passed in channel as unhealthy for the passed in duration, during which messages will
+// be re-routed away from it if their org uses failover
+func MarkChannelUnhealthy(rc redis.Conn, uuid assets.ChannelUUID, duration time.Duration) error {
+	_, err := rc.Do("set", fmt.Sprintf(unhealthyChannelPattern, uuid), time.Now().UnixNano(), "px", int64(duration/time.Millisecond))
+	return errors.Wrapf(err, "error marking channel %s as unhealthy", uuid)
+}
+
+// MarkChannelHealthy clears any unhealthy mark on the passed in channel
+func MarkChannelHealthy(rc redis.Conn, uuid assets.ChannelUUID) error {
+	_, err := rc.Do("del", fmt.Sprintf(unhealthyChannelPattern, uuid))
+	return errors.Wrapf(err, "error marking channel %s as healthy", uuid)
+}
+
+// UnhealthyChannels returns which of the passed in channels are currently marked as unhealthy
+func UnhealthyChannels(rc redis.Conn, uuids []assets.ChannelUUID) (map[assets.ChannelUUID]bool, error) {
+	unhealthy := make(map[assets.ChannelUUID]bool)
+	if len(uuids) == 0 {
+		return unhealthy, nil
+	}
+
+	keys := make([]interface{}, len(uuids))
+	for i, uuid := range uuids {
+		keys[i] = fmt.Sprintf(unhealthyChannelPattern, uuid)
+	}
+
+	values, err := redis.Values(rc.Do("mget", keys...))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error checking channel health")
+	}
+
+	for i, value := range values {
+		if value != nil {
+			unhealthy[uuids[i]] = true
+		}
+	}
+	return unhealthy, nil
+}
+
+// FailoverChannel returns the first channel, in order of creation, which can send to the passed in URN and which isn't
+// excluded. Android channels and channels with a parent are never used for failover. For tel URNs the channel must
+// be in the same country as the URN, or allow international sending.
+func FailoverChannel(oa *OrgAssets, urn urns.URN, exclude map[assets.ChannelUUID]bool) *Channel {
+	channels, _ := oa.Channels()
+
+	country := envs.NilCountry
+	if urn.Scheme() == urns.TelScheme {
+		country = envs.DeriveCountryFromTel(urn.Path())
+	}
+
+	for _, a := range channels {
+		c := a.(*Channel)
+
+		if exclude[c.UUID()] || c.Type() == ChannelTypeAndroid || c.Parent() != nil {
+			continue
+		}
+		if !c.hasRole(assets.ChannelRoleSend) || !c.supportsScheme(urn.Scheme()) {
+			continue
+		}
+		if country != envs.NilCountry && c.Country() != envs.NilCountry && c.Country() != country && !c.AllowInternational() {
+			continue
+		}
+		return c
+	}
+	return nil
+}
+
+func (c *Channel) hasRole(role assets.ChannelRole) bool {
+	for _, r := range c.c.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Channel) supportsScheme(scheme string) bool {
+	for _, s := range c.c.Schemes {
+		if s == scheme {
+			return true
+		}
+	}
+	return false
+}
+
+// FailedOverFrom returns the channels this message has previously been re-routed away from
+func (m *Msg) FailedOverFrom() []assets.ChannelUUID {
+	history, _ := m.Metadata()["failover"].([]interface{})
+
+	uuids := make([]assets.ChannelUUID, 0, len(history))
+	for _, h := range history {
+		if entry, isMap := h.(map[string]interface{}); isMap {
+			if from, isString := entry["from"].(string); isString {
+				uuids = append(uuids, assets.ChannelUUID(from))
+			}
+		}
+	}
+	return uuids
+}
+
+// Failover re-routes this message to the passed in channel, recording the change and its reason in the metadata of the
+// message so that it can be seen and so that we never fail back over to the same channel
+func (m *Msg) Failover(channel *Channel, reason string) {
+	metadata := m.m.Metadata.Map()
+	history, _ := metadata["failover"].([]interface{})
+
+	metadata["failover"] = append(history, map[string]interface{}{
+		"from":   string(m.m.ChannelUUID),
+		"to":     string(channel.UUID()),
+		"reason": reason,
+		"on":     time.Now().UTC().Format(time.RFC3339),
+	})
+
+	m.m.ChannelUUID = channel.UUID()
+	m.m.ChannelID = channel.ID()
+	m.m.Status = MsgStatusQueued
+	m.m.ErrorCount = 0
+	m.channel = channel
+}
+
+// UpdateMessageRoutes updates the channel, status and metadata of the passed in messages after they have been failed over
+func UpdateMessageRoutes(ctx context.Context, db Queryer, msgs []*Msg) error {
+	is := make([]interface{}, len(msgs))
+	for i, msg := range msgs {
+		is[i] = &msg.m
+	}
+
+	err := BulkSQL(ctx, "updating message routes", db, updateMsgRoutesSQL, is)
+	return errors.Wrapf(err, "error updating message routes")
+}
+
+const updateMsgRoutesSQL = `
+UPDATE
+	msgs_msg
+SET
+	channel_id = m.channel_id::int,
+	status = m.status,
+	error_count = m.error_count::int,
+	metadata = m.metadata,
+	modified_on = now()
+FROM (
+	VALUES(:id, :channel_id, :status, :error_count, :metadata)
+) AS
+	m(id, channel_id, status, error_count, metadata)
+WHERE
+	msgs_msg.id = m.id::int
+`
+
+// LoadMessagesForFailover loads outgoing messages which failed permanently since the passed in time, for orgs which use
+// channel failover. Messages which were failed by mailroom itself, e.g. because of a frequency cap, aren't included.
+func LoadMessagesForFailover(ctx context.Context, db Queryer, since time.Time, limit int) ([]*Msg, error) {
+	rows, err := db.QueryxContext(ctx, selectMsgsForFailoverSQL, since, limit)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error querying messages for failover")
+	}
+	defer rows.Close()
+
+	msgs := make([]*Msg, 0)
+	for rows.Next() {
+		msg := &Msg{}
+		err := readJSONRow(rows, &msg.m)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error reading message for failover")
+		}
+		msgs = append(msgs, msg)
+	}
+
+	return msgs, nil
+}
+
+const selectMsgsForFailoverSQL = `
+SELECT ROW_TO_JSON(r) FROM (SELECT
+	m.id as id,
+	m.broadcast_id as broadcast_id,
+	m.uuid as uuid,
+	m.text as text,
+	m.high_priority as high_priority,
+	m.created_on as created_on,
+	m.modified_on as modified_on,
+	m.queued_on as queued_on,
+	m.direction as direction,
+	m.status as status,
+	m.visibility as visibility,
+	m.msg_count as tps_cost,
+	m.error_count as error_count,
+	m.external_id as external_id,
+	m.attachments as attachments,
+	NULLIF(m.metadata, '')::json as metadata,
+	m.channel_id as channel_id,
+	c.uuid as channel_uuid,
+	m.contact_id as contact_id,
+	m.contact_urn_id as contact_urn_id,
+	m.response_to_id as response_to_id,
+	u.identity || '?id=' || u.id as urn,
+	u.auth as urn_auth,
+	m.org_id as org_id
+FROM
+	msgs_msg m
+	JOIN channels_channel c ON c.id = m.channel_id
+	JOIN contacts_contacturn u ON u.id = m.contact_urn_id
+	JOIN orgs_org o ON o.id = m.org_id
+WHERE
+	m.direction = 'O' AND
+	m.status = 'F' AND
+	m.modified_on > $1 AND
+	NULLIF(o.config, '')::json->>'channel_failover' = 'true' AND
+	NULLIF(m.metadata, '')::json->>'failed_reason' IS NULL
+ORDER BY
+	m.modified_on ASC
+LIMIT $2
+) r;
+`
@@ -0,0 +1,108 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/goflow/assets"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/mailroom/testsuite"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChannelHealth(t *testing.T) {
+	testsuite.ResetRP()
+	rc := testsuite.RC()
+	defer rc.Close()
+
+	unhealthy, err := UnhealthyChannels(rc, []assets.ChannelUUID{TwilioChannelUUID, NexmoChannelUUID})
+	assert.NoError(t, err)
+	assert.Equal(t, map[assets.ChannelUUID]bool{}, unhealthy)
+
+	err = MarkChannelUnhealthy(rc, TwilioChannelUUID, time.Minute)
+	assert.NoError(t, err)
+
+	unhealthy, err = UnhealthyChannels(rc, []assets.ChannelUUID{TwilioChannelUUID, NexmoChannelUUID})
+	assert.NoError(t, err)
+	assert.Equal(t, map[assets.ChannelUUID]bool{TwilioChannelUUID: true}, unhealthy)
+
+	err = MarkChannelHealthy(rc, TwilioChannelUUID)
+	assert.NoError(t, err)
+
+	unhealthy, err = UnhealthyChannels(rc, []assets.ChannelUUID{TwilioChannelUUID, NexmoChannelUUID})
+	assert.NoError(t, err)
+	assert.Equal(t, map[assets.ChannelUUID]bool{}, unhealthy)
+}
+
+func TestMsgFailover(t *testing.T) {
+	twilio := &Channel{}
+	twilio.c.ID = TwilioChannelID
+	twilio.c.UUID = TwilioChannelUUID
+
+	nexmo := &Channel{}
+	nexmo.c.ID = NexmoChannelID
+	nexmo.c.UUID = NexmoChannelUUID
+
+	out := flows.NewMsgOut(urns.URN("tel:+12065551212?id=10000"), twilio.ChannelReference(), "hello", nil, []string{"yes", "no"}, nil, flows.NilMsgTopic)
+	msg, err := NewOutgoingMsg(Org1, twilio, CathyID, out, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, []assets.ChannelUUID{}, msg.FailedOverFrom())
+
+	msg.Failover(nexmo, FailoverReasonFailed)
+
+	assert.Equal(t, nexmo, msg.Channel())
+	assert.Equal(t, NexmoChannelID, msg.ChannelID())
+	assert.Equal(t, NexmoChannelUUID, msg.ChannelUUID())
+	assert.Equal(t, MsgStatusQueued, msg.Status())
+	assert.Equal(t, []assets.ChannelUUID{TwilioChannelUUID}, msg.FailedOverFrom())
+
+	// other metadata is untouched
+	assert.Equal(t, []string{"yes", "no"}, msg.Metadata()["quick_replies"])
+
+	// history survives being written and read back
+	msgJSON, err := msg.MarshalJSON()
+	require.NoError(t, err)
+
+	msg2 := &Msg{}
+	require.NoError(t, msg2.UnmarshalJSON(msgJSON))
+	msg2.Failover(twilio, FailoverReasonUnhealthy)
+	assert.Equal(t, []assets.ChannelUUID{TwilioChannelUUID, NexmoChannelUUID}, msg2.FailedOverFrom())
+
+	history := msg2.Metadata()["failover"].([]interface{})
+	assert.Equal(t, "unhealthy", history[1].(map[string]interface{})["reason"])
+}
+
+func TestFailoverChannel(t *testing.T) {
+	ctx := testsuite.CTX()
+	db := testsuite.DB()
+
+	oa, err := GetOrgAssets(ctx, db, Org1)
+	require.NoError(t, err)
+
+	cathyURN := urns.URN("tel:+12065551212?id=10000")
+	twitterURN := urns.URN("twitter:bobby?id=10001")
+
+	tcs := []struct {
+		URN      urns.URN
+		Exclude  map[assets.ChannelUUID]bool
+		Expected assets.ChannelUUID
+	}{
+		{cathyURN, nil, TwilioChannelUUID},
+		{cathyURN, map[assets.ChannelUUID]bool{TwilioChannelUUID: true}, NexmoChannelUUID},
+		{cathyURN, map[assets.ChannelUUID]bool{TwilioChannelUUID: true, NexmoChannelUUID: true}, ""},
+		{twitterURN, nil, TwitterChannelUUID},
+		{twitterURN, map[assets.ChannelUUID]bool{TwitterChannelUUID: true}, ""},
+	}
+
+	for _, tc := range tcs {
+		channel := FailoverChannel(oa, tc.URN, tc.Exclude)
+		if tc.Expected == "" {
+			assert.Nil(t, channel, "expected no channel for %s", tc.URN)
+		} else if assert.NotNil(t, channel, "expected channel for %s", tc.URN) {
+			assert.Equal(t, tc.Expected, channel.UUID())
+		}
+	}
+}
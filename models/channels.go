@@ -27,7 +27,9 @@ type ChannelType string
 
 // channel type constants
 const (
-	ChannelTypeAndroid = ChannelType("A")
+	ChannelTypeAndroid   = ChannelType("A")
+	ChannelTypeWhatsApp  = ChannelType("WA")
+	ChannelTypeDialog360 = ChannelType("D3")
 )
 
 // config key constants
@@ -35,6 +37,7 @@ const (
 	ChannelConfigCallbackDomain      = "callback_domain"
 	ChannelConfigMaxConcurrentEvents = "max_concurrent_events"
 	ChannelConfigFCMID               = "FCM_ID"
+	ChannelConfigGSM7Substitution    = "gsm7_substitution"
 )
 
 // Channel is the mailroom struct that represents channels
@@ -114,6 +117,11 @@ func (c *Channel) ConfigValue(key string, def string) string {
 	return def
 }
 
+// RequiresTemplate returns whether messages sent on this channel outside of a conversation must use an approved template
+func (c *Channel) RequiresTemplate() bool {
+	return c.c.ChannelType == ChannelTypeWhatsApp || c.c.ChannelType == ChannelTypeDialog360
+}
+
 // ChannelReference return a channel reference for this channel
 func (c *Channel) ChannelReference() *assets.ChannelReference {
 	return assets.NewChannelReference(c.UUID(), c.Name())
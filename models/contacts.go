@@ -272,6 +272,23 @@ func ContactIDsForQueryPage(ctx context.Context, client *elastic.Client, org *Or
 	return parsed, ids, results.Hits.TotalHits, nil
 }
 
+// FindSeenSinceOverlap returns the list of contact ids which overlap with those passed in which have sent us a message
+// since the passed in time
+func FindSeenSinceOverlap(ctx context.Context, db *sqlx.DB, contacts []ContactID, since time.Time) ([]ContactID, error) {
+	return selectContactOverlap(ctx, db, seenSinceOverlapSQL, contacts, since)
+}
+
+const seenSinceOverlapSQL = `
+SELECT
+	DISTINCT(contact_id)
+FROM
+	msgs_msg
+WHERE
+	contact_id = ANY($1) AND
+	direction = 'I' AND
+	created_on >= $2
+`
+
 // ContactIDsForQuery returns the ids of all the contacts that match the passed in query
 func ContactIDsForQuery(ctx context.Context, client *elastic.Client, org *OrgAssets, query string) ([]ContactID, error) {
 	env := org.Env()
@@ -541,6 +558,44 @@ WHERE
 // ContactIDsFromURNs will fetch or create the contacts for the passed in URNs, returning a map the same length as
 // the passed in URNs with the ids of the contacts.
 func ContactIDsFromURNs(ctx context.Context, db *sqlx.DB, org *OrgAssets, us []urns.URN) (map[urns.URN]ContactID, error) {
+	// build a map of our urns to contact id
+	urnMap, err := LookupContactIDsFromURNs(ctx, db, org, us)
+	if err != nil {
+		return nil, err
+	}
+
+	// and another map from URN identity to the passed in URN
+	urnIdentities := make(map[urns.URN]urns.URN, len(us))
+	for _, u := range us {
+		urnIdentities[u.Identity()] = u
+	}
+
+	// if we didn't find some contacts
+	if len(urnMap) < len(us) {
+		// create the contacts that are missing
+		for _, u := range us {
+			if urnMap[u] == NilContactID {
+				id, err := CreateContact(ctx, db, org, u)
+				if err != nil {
+					return nil, errors.Wrapf(err, "error while creating contact")
+				}
+
+				original, found := urnIdentities[u]
+				if !found {
+					return nil, errors.Wrapf(err, "unable to find original URN from identity")
+				}
+				urnMap[original] = ContactID(id)
+			}
+		}
+	}
+
+	// return our map of urns to ids
+	return urnMap, nil
+}
+
+// LookupContactIDsFromURNs fetches the ids of the existing contacts for the passed in URNs, returning a map which
+// only contains the URNs which have contacts.
+func LookupContactIDsFromURNs(ctx context.Context, db Queryer, org *OrgAssets, us []urns.URN) (map[urns.URN]ContactID, error) {
 	// build a map of our urns to contact id
 	urnMap := make(map[urns.URN]ContactID, len(us))
 
@@ -587,26 +642,6 @@ func ContactIDsFromURNs(ctx context.Context, db *sqlx.DB, org *OrgAssets, us []u
 		urnMap[original] = id
 	}
 
-	// if we didn't find some contacts
-	if len(urnMap) < len(us) {
-		// create the contacts that are missing
-		for _, u := range us {
-			if urnMap[u] == NilContactID {
-				id, err := CreateContact(ctx, db, org, u)
-				if err != nil {
-					return nil, errors.Wrapf(err, "error while creating contact")
-				}
-
-				original, found := urnIdentities[u]
-				if !found {
-					return nil, errors.Wrapf(err, "unable to find original URN from identity")
-				}
-				urnMap[original] = ContactID(id)
-			}
-		}
-	}
-
-	// return our map of urns to ids
 	return urnMap, nil
 }
 
@@ -0,0 +1,157 @@
+package models
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/nyaruka/goflow/utils/dates"
+	"github.com/nyaruka/phonenumbers"
+	"github.com/pkg/errors"
+)
+
+// DeliveryWindow is the window of local time of day in which messages can be delivered to contacts, e.g. 08:00 to
+// 20:00 so that contacts aren't messaged in the middle of the night. If start is after end, the window spans midnight
+// and if they are equal, the window is always open.
+type DeliveryWindow struct {
+	Start         string `json:"start"`
+	End           string `json:"end"`
+	TimezoneField string `json:"timezone_field,omitempty"`
+}
+
+const deliveryWindowLayout = "15:04"
+
+// parse parses the start and end of this window
+func (w *DeliveryWindow) parse() (dates.TimeOfDay, dates.TimeOfDay, error) {
+	start, err := dates.ParseTimeOfDay(deliveryWindowLayout, w.Start)
+	if err != nil {
+		return dates.ZeroTimeOfDay, dates.ZeroTimeOfDay, errors.Wrapf(err, "invalid delivery window start: %s", w.Start)
+	}
+	end, err := dates.ParseTimeOfDay(deliveryWindowLayout, w.End)
+	if err != nil {
+		return dates.ZeroTimeOfDay, dates.ZeroTimeOfDay, errors.Wrapf(err, "invalid delivery window end: %s", w.End)
+	}
+	return start, end, nil
+}
+
+// Validate checks that the start and end of this window are valid times of day
+func (w *DeliveryWindow) Validate() error {
+	_, _, err := w.parse()
+	return err
+}
+
+// NextOpen returns the passed in time if it falls inside this window in the passed in timezone, otherwise the next
+// time that this window opens in that timezone
+func (w *DeliveryWindow) NextOpen(now time.Time, tz *time.Location) (time.Time, error) {
+	start, end, err := w.parse()
+	if err != nil {
+		return now, err
+	}
+
+	local := now.In(tz)
+	tod := dates.ExtractTimeOfDay(local)
+
+	afterStart := tod.Compare(start) >= 0
+	beforeEnd := tod.Compare(end) < 0
+
+	if start.Equal(end) {
+		return now, nil
+	} else if start.Compare(end) < 0 {
+		if afterStart && beforeEnd {
+			return now, nil
+		}
+	} else if afterStart || beforeEnd {
+		return now, nil
+	}
+
+	opens := time.Date(local.Year(), local.Month(), local.Day(), start.Hour, start.Minute, 0, 0, tz)
+	if !opens.After(local) {
+		opens = time.Date(local.Year(), local.Month(), local.Day()+1, start.Hour, start.Minute, 0, 0, tz)
+	}
+	return opens, nil
+}
+
+// LoadContactTimezones loads the timezone of each of the passed in contacts for this window. This is read from the
+// window's timezone field if the contact has a valid value for it, otherwise it is inferred from the contact's first
+// phone number, falling back to the timezone of the org. Only those values are selected rather than whole contacts.
+func (w *DeliveryWindow) LoadContactTimezones(ctx context.Context, db Queryer, oa *OrgAssets, ids []ContactID) (map[ContactID]*time.Location, error) {
+	fieldUUID := ""
+	if w.TimezoneField != "" {
+		if field := oa.FieldByKey(w.TimezoneField); field != nil {
+			fieldUUID = string(field.UUID())
+		}
+	}
+
+	rows, err := db.QueryxContext(ctx, selectContactTimezoneValuesSQL, pq.Array(ids), oa.OrgID(), fieldUUID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error selecting contact timezone values")
+	}
+	defer rows.Close()
+
+	timezones := make(map[ContactID]*time.Location, len(ids))
+	for rows.Next() {
+		var contactID ContactID
+		var fieldValue, telPath string
+		if err := rows.Scan(&contactID, &fieldValue, &telPath); err != nil {
+			return nil, errors.Wrapf(err, "error scanning contact timezone values")
+		}
+		timezones[contactID] = contactTimezone(oa.Env().Timezone(), fieldValue, telPath)
+	}
+	return timezones, rows.Err()
+}
+
+const selectContactTimezoneValuesSQL = `
+SELECT
+	c.id,
+	COALESCE(c.fields->$3->>'text', '') AS field_value,
+	COALESCE((
+		SELECT u.path FROM contacts_contacturn u
+		WHERE u.contact_id = c.id AND u.scheme = 'tel'
+		ORDER BY u.priority DESC, u.id ASC LIMIT 1
+	), '') AS tel_path
+FROM
+	contacts_contact c
+WHERE
+	c.id = ANY($1) AND
+	c.is_active = TRUE AND
+	c.org_id = $2
+`
+
+// contactTimezone returns the timezone in the passed in timezone field value if it is valid, otherwise the timezone
+// inferred from the passed in phone number, falling back to the passed in org timezone
+func contactTimezone(orgTimezone *time.Location, fieldValue string, telPath string) *time.Location {
+	if fieldValue != "" {
+		tz, err := time.LoadLocation(strings.TrimSpace(fieldValue))
+		if err == nil {
+			return tz
+		}
+	}
+
+	if telPath != "" {
+		if tz := timezoneForTel(telPath); tz != nil {
+			return tz
+		}
+	}
+
+	return orgTimezone
+}
+
+// timezoneForTel infers the timezone of the passed in phone number, returning nil if it can't be inferred
+func timezoneForTel(number string) *time.Location {
+	parsed, err := phonenumbers.Parse(number, "")
+	if err != nil {
+		return nil
+	}
+
+	tzs, err := phonenumbers.GetTimezonesForNumber(parsed)
+	if err != nil || len(tzs) == 0 || tzs[0] == phonenumbers.UNKNOWN_TIMEZONE {
+		return nil
+	}
+
+	tz, err := time.LoadLocation(tzs[0])
+	if err != nil {
+		return nil
+	}
+	return tz
+}
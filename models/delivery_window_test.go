@@ -0,0 +1,61 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeliveryWindowNextOpen(t *testing.T) {
+	kigali, _ := time.LoadLocation("Africa/Kigali")
+	la, _ := time.LoadLocation("America/Los_Angeles")
+
+	day := &DeliveryWindow{Start: "08:00", End: "20:00"}
+	night := &DeliveryWindow{Start: "20:00", End: "06:30"}
+
+	tcs := []struct {
+		window *DeliveryWindow
+		now    time.Time
+		tz     *time.Location
+		opens  time.Time
+	}{
+		{day, time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC), kigali, time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC)},   // 12:00 in Kigali
+		{day, time.Date(2020, 5, 1, 1, 0, 0, 0, time.UTC), kigali, time.Date(2020, 5, 1, 8, 0, 0, 0, kigali)},       // 03:00 in Kigali
+		{day, time.Date(2020, 5, 1, 18, 0, 0, 0, time.UTC), kigali, time.Date(2020, 5, 2, 8, 0, 0, 0, kigali)},      // 20:00 in Kigali
+		{day, time.Date(2020, 5, 1, 18, 0, 0, 0, time.UTC), la, time.Date(2020, 5, 1, 18, 0, 0, 0, time.UTC)},       // 11:00 in LA
+		{day, time.Date(2020, 5, 1, 5, 59, 0, 0, time.UTC), la, time.Date(2020, 5, 1, 8, 0, 0, 0, la)},              // 22:59 in LA
+		{night, time.Date(2020, 5, 1, 22, 0, 0, 0, time.UTC), kigali, time.Date(2020, 5, 1, 22, 0, 0, 0, time.UTC)}, // 00:00 in Kigali
+		{night, time.Date(2020, 5, 1, 4, 0, 0, 0, time.UTC), kigali, time.Date(2020, 5, 1, 4, 0, 0, 0, time.UTC)},   // 06:00 in Kigali
+		{night, time.Date(2020, 5, 1, 5, 0, 0, 0, time.UTC), kigali, time.Date(2020, 5, 1, 20, 0, 0, 0, kigali)},    // 07:00 in Kigali
+		{&DeliveryWindow{Start: "08:00", End: "08:00"}, time.Date(2020, 5, 1, 5, 0, 0, 0, time.UTC), time.UTC, time.Date(2020, 5, 1, 5, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tc := range tcs {
+		opens, err := tc.window.NextOpen(tc.now, tc.tz)
+		assert.NoError(t, err)
+		assert.True(t, tc.opens.Equal(opens), "next open mismatch for %s, expected %s, got %s", tc.now, tc.opens, opens)
+	}
+
+	_, err := (&DeliveryWindow{Start: "8am", End: "20:00"}).NextOpen(time.Now(), time.UTC)
+	assert.EqualError(t, err, `invalid delivery window start: 8am: parsing time "8am" as "15:04": cannot parse "am" as ":"`)
+
+	assert.NoError(t, day.Validate())
+	assert.Error(t, (&DeliveryWindow{Start: "08:00", End: "25:00"}).Validate())
+}
+
+func TestContactTimezone(t *testing.T) {
+	kigali, _ := time.LoadLocation("Africa/Kigali")
+
+	assert.Equal(t, "America/New_York", contactTimezone(kigali, " America/New_York ", "+12065551212").String())
+	assert.Equal(t, "America/Los_Angeles", contactTimezone(kigali, "Mars/Olympus", "+12065551212").String())
+	assert.Equal(t, "America/Los_Angeles", contactTimezone(kigali, "", "+12065551212").String())
+	assert.Equal(t, "Africa/Kigali", contactTimezone(kigali, "", "12345").String())
+	assert.Equal(t, "Africa/Kigali", contactTimezone(kigali, "", "").String())
+}
+
+func TestTimezoneForTel(t *testing.T) {
+	assert.Equal(t, "Africa/Kigali", timezoneForTel("+250788123123").String())
+	assert.Equal(t, "America/Los_Angeles", timezoneForTel("+12065551212").String())
+	assert.Nil(t, timezoneForTel("12345"))
+}
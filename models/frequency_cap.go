@@ -0,0 +1,205 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// FrequencyCapAction is what happens to messages which would take a contact over their org's frequency cap
+type FrequencyCapAction string
+
+// possible frequency cap actions
+const (
+	FrequencyCapActionDefer = FrequencyCapAction("defer")
+	FrequencyCapActionDrop  = FrequencyCapAction("drop")
+)
+
+const (
+	configFrequencyCapMax    = "frequency_cap_max"
+	configFrequencyCapHours  = "frequency_cap_hours"
+	configFrequencyCapAction = "frequency_cap_action"
+
+	defaultFrequencyCapHours = 24
+
+	// FailedReasonFrequencyCap is the failure reason recorded on messages dropped because of a frequency cap
+	FailedReasonFrequencyCap = "frequency_cap"
+)
+
+// FrequencyCap limits the number of messages a contact can be sent in a window of time. Responses to incoming
+// messages are exempt and don't count towards the cap.
+type FrequencyCap struct {
+	Max    int
+	Window time.Duration
+	Action FrequencyCapAction
+}
+
+// FrequencyCap returns the frequency cap configured for this org, or nil if it doesn't have one
+func (o *Org) FrequencyCap() *FrequencyCap {
+	max, _ := o.o.Config.Get(configFrequencyCapMax, 0.0).(float64)
+	if max <= 0 {
+		return nil
+	}
+
+	hours, _ := o.o.Config.Get(configFrequencyCapHours, float64(defaultFrequencyCapHours)).(float64)
+	if hours <= 0 {
+		hours = defaultFrequencyCapHours
+	}
+
+	action := FrequencyCapAction(o.ConfigValue(configFrequencyCapAction, string(FrequencyCapActionDefer)))
+	if action != FrequencyCapActionDrop {
+		action = FrequencyCapActionDefer
+	}
+
+	return &FrequencyCap{
+		Max:    int(max),
+		Window: time.Duration(hours * float64(time.Hour)),
+		Action: action,
+	}
+}
+
+// IsResponse returns whether this message is a response to an incoming message
+func (m *Msg) IsResponse() bool {
+	return m.m.ResponseToID != NilMsgID || m.m.ResponseToExternalID != ""
+}
+
+// FailMessages marks the passed in messages as failed, recording the reason in their metadata
+func FailMessages(ctx context.Context, db Queryer, msgs []*Msg, reason string) error {
+	is := make([]interface{}, len(msgs))
+	for i, msg := range msgs {
+		m := &msg.m
+		m.Status = MsgStatusFailed
+		m.Metadata.Map()["failed_reason"] = reason
+		is[i] = m
+	}
+
+	err := BulkSQL(ctx, "failing messages", db, failMsgsSQL, is)
+	return errors.Wrapf(err, "error marking messages as failed")
+}
+
+const failMsgsSQL = `
+UPDATE
+	msgs_msg
+SET
+	status = m.status,
+	metadata = m.metadata,
+	modified_on = now()
+FROM (
+	VALUES(:id, :status, :metadata)
+) AS
+	m(id, status, metadata)
+WHERE
+	msgs_msg.id = m.id::int
+`
+
+// Defer makes this message wait as pending until the passed in time, when it will be sent unless its contact is still
+// over their frequency cap
+func (m *Msg) Defer(until time.Time) {
+	m.m.Metadata.Map()["deferred_until"] = until.UTC().Format(time.RFC3339Nano)
+	m.m.Status = MsgStatusPending
+	m.m.NextAttempt = until
+}
+
+// DeferredUntil returns when this message was last deferred until, if it has been deferred by a frequency cap
+func (m *Msg) DeferredUntil() *time.Time {
+	value, _ := m.Metadata()["deferred_until"].(string)
+	until, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return nil
+	}
+	return &until
+}
+
+// DeferMessages marks the passed in messages as deferred until the passed in time
+func DeferMessages(ctx context.Context, db Queryer, msgs []*Msg, until time.Time) error {
+	is := make([]interface{}, len(msgs))
+	for i, msg := range msgs {
+		msg.Defer(until)
+		is[i] = &msg.m
+	}
+
+	err := BulkSQL(ctx, "deferring messages", db, deferMsgsSQL, is)
+	return errors.Wrapf(err, "error marking messages as deferred")
+}
+
+const deferMsgsSQL = `
+UPDATE
+	msgs_msg
+SET
+	status = m.status,
+	metadata = m.metadata,
+	next_attempt = m.next_attempt::timestamp with time zone,
+	modified_on = now()
+FROM (
+	VALUES(:id, :status, :metadata, :next_attempt)
+) AS
+	m(id, status, metadata, next_attempt)
+WHERE
+	msgs_msg.id = m.id::int
+`
+
+// LoadDeferredMessages loads the passed in messages for the passed in org, if they are still deferred, i.e. they haven't
+// been failed or queued since they were deferred
+func LoadDeferredMessages(ctx context.Context, db Queryer, orgID OrgID, ids []MsgID) ([]*Msg, error) {
+	rows, err := db.QueryxContext(ctx, selectDeferredMsgsSQL, orgID, pq.Array(ids))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error querying deferred messages")
+	}
+	defer rows.Close()
+
+	msgs := make([]*Msg, 0, len(ids))
+	for rows.Next() {
+		msg := &Msg{}
+		err := readJSONRow(rows, &msg.m)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error reading deferred message")
+		}
+		msgs = append(msgs, msg)
+	}
+
+	return msgs, nil
+}
+
+const selectDeferredMsgsSQL = `
+SELECT ROW_TO_JSON(r) FROM (SELECT
+	m.id as id,
+	m.broadcast_id as broadcast_id,
+	m.uuid as uuid,
+	m.text as text,
+	m.high_priority as high_priority,
+	m.created_on as created_on,
+	m.modified_on as modified_on,
+	m.queued_on as queued_on,
+	m.direction as direction,
+	m.status as status,
+	m.visibility as visibility,
+	m.msg_count as tps_cost,
+	m.error_count as error_count,
+	m.next_attempt as next_attempt,
+	m.external_id as external_id,
+	m.attachments as attachments,
+	NULLIF(m.metadata, '')::json as metadata,
+	m.channel_id as channel_id,
+	c.uuid as channel_uuid,
+	m.contact_id as contact_id,
+	m.contact_urn_id as contact_urn_id,
+	m.response_to_id as response_to_id,
+	u.identity || '?id=' || u.id as urn,
+	u.auth as urn_auth,
+	m.org_id as org_id
+FROM
+	msgs_msg m
+	JOIN channels_channel c ON c.id = m.channel_id
+	JOIN contacts_contacturn u ON u.id = m.contact_urn_id
+WHERE
+	m.org_id = $1 AND
+	m.id = ANY($2) AND
+	m.direction = 'O' AND
+	m.status = 'P' AND
+	NULLIF(m.metadata, '')::json->>'deferred_until' IS NOT NULL
+ORDER BY
+	m.id ASC
+) r;
+`
@@ -0,0 +1,64 @@
+package models
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/mailroom/testsuite"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeferMessages(t *testing.T) {
+	ctx := testsuite.CTX()
+	db := testsuite.DB()
+
+	oa, err := GetOrgAssets(ctx, db, Org1)
+	require.NoError(t, err)
+
+	channel := oa.ChannelByUUID(TwilioChannelUUID)
+
+	newMsg := func(text string) *Msg {
+		out := flows.NewMsgOut(urns.URN(fmt.Sprintf("tel:+250700000001?id=%d", CathyURNID)), channel.ChannelReference(), text, nil, nil, nil, flows.NilMsgTopic)
+		msg, err := NewOutgoingMsg(Org1, channel, CathyID, out, time.Now())
+		require.NoError(t, err)
+		return msg
+	}
+
+	msg1, msg2, msg3 := newMsg("one"), newMsg("two"), newMsg("three")
+	err = InsertMessages(ctx, db, []*Msg{msg1, msg2, msg3})
+	require.NoError(t, err)
+
+	until := time.Date(2021, 3, 4, 12, 30, 0, 0, time.UTC)
+
+	err = DeferMessages(ctx, db, []*Msg{msg1, msg2}, until)
+	require.NoError(t, err)
+
+	assert.Equal(t, MsgStatusPending, msg1.Status())
+	assert.Equal(t, until, *msg1.DeferredUntil())
+	assert.Nil(t, msg3.DeferredUntil())
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM msgs_msg WHERE status = 'P' AND next_attempt = $1 AND metadata LIKE '%deferred_until%'`, []interface{}{until}, 2)
+
+	// the second message is cancelled before it can be sent
+	err = FailMessages(ctx, db, []*Msg{msg2}, FailedReasonCancelled)
+	require.NoError(t, err)
+
+	// only messages which are still deferred are loaded, and only for the right org
+	ids := []MsgID{MsgID(msg1.ID()), MsgID(msg2.ID()), MsgID(msg3.ID())}
+
+	msgs, err := LoadDeferredMessages(ctx, db, Org1, ids)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(msgs))
+	assert.Equal(t, msg1.ID(), msgs[0].ID())
+	assert.Equal(t, TwilioChannelUUID, msgs[0].ChannelUUID())
+	assert.Equal(t, until, *msgs[0].DeferredUntil())
+
+	msgs, err = LoadDeferredMessages(ctx, db, Org2, ids)
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(msgs))
+}
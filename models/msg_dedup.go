@@ -0,0 +1,22 @@
+package models
+
+import (
+	"time"
+)
+
+const (
+	configMsgDedupSeconds = "msg_dedup_seconds"
+
+	// FailedReasonDuplicate is the failure reason recorded on messages dropped because they duplicate a recent message
+	FailedReasonDuplicate = "duplicate"
+)
+
+// MsgDedupWindow returns how long after a message is sent this org wants identical messages to the same URN dropped,
+// or zero if it doesn't want duplicates dropped
+func (o *Org) MsgDedupWindow() time.Duration {
+	seconds, _ := o.o.Config.Get(configMsgDedupSeconds, 0.0).(float64)
+	if seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
@@ -166,6 +166,7 @@ func (m *Msg) ContactURNID() *URNID             { return m.m.ContactURNID }
 
 func (m *Msg) SetTopup(topupID TopupID)               { m.m.TopupID = topupID }
 func (m *Msg) SetChannelID(channelID ChannelID)       { m.m.ChannelID = channelID }
+func (m *Msg) SetChannel(channel *Channel)            { m.channel = channel }
 func (m *Msg) SetBroadcastID(broadcastID BroadcastID) { m.m.BroadcastID = broadcastID }
 
 func (m *Msg) SetURN(urn urns.URN) error {
@@ -211,6 +212,10 @@ func (m *Msg) MarshalJSON() ([]byte, error) {
 	return json.Marshal(m.m)
 }
 
+func (m *Msg) UnmarshalJSON(data []byte) error {
+	return json.Unmarshal(data, &m.m)
+}
+
 // NewIncomingIVR creates a new incoming IVR message for the passed in text and attachment
 func NewIncomingIVR(orgID OrgID, conn *ChannelConnection, in *flows.MsgIn, createdOn time.Time) *Msg {
 	msg := &Msg{}
@@ -336,6 +341,14 @@ func NewOutgoingMsg(orgID OrgID, channel *Channel, contactID ContactID, out *flo
 
 	// calculate msg count
 	if m.URN.Scheme() == urns.TelScheme {
+		// if our channel allows it, swap characters like smart quotes for GSM7 equivalents when that keeps us out of UCS2
+		if channel != nil && channel.ConfigValue(ChannelConfigGSM7Substitution, "") == "true" && !gsm7.IsValid(m.Text) {
+			substituted := gsm7.ReplaceSubstitutions(m.Text)
+			if gsm7.IsValid(substituted) {
+				m.Text = substituted
+			}
+		}
+
 		m.MsgCount = gsm7.Segments(m.Text) + len(m.Attachments)
 	} else {
 		m.MsgCount = 1
@@ -453,6 +466,37 @@ func MarkMessagesPending(ctx context.Context, tx *sqlx.Tx, msgs []*Msg) error {
 	return updateMessageStatus(ctx, tx, msgs, MsgStatusPending)
 }
 
+// FailedReasonPurged is the failure reason recorded on messages purged from the courier queue
+const FailedReasonPurged = "purged"
+
+// FailQueuedMessages marks the passed in messages as failed if they are still waiting to be sent, recording the reason
+// in their metadata. It returns the number of messages which were failed.
+func FailQueuedMessages(ctx context.Context, db Queryer, ids []MsgID, reason string) (int, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	res, err := db.ExecContext(ctx, failQueuedMsgsSQL, pq.Array(ids), reason)
+	if err != nil {
+		return 0, errors.Wrapf(err, "error failing queued messages")
+	}
+	failed, _ := res.RowsAffected()
+	return int(failed), nil
+}
+
+const failQueuedMsgsSQL = `
+UPDATE
+	msgs_msg
+SET
+	status = 'F',
+	metadata = (COALESCE(NULLIF(metadata, ''), '{}')::jsonb || jsonb_build_object('failed_reason', $2::text))::text,
+	modified_on = now()
+WHERE
+	id = ANY($1) AND
+	direction = 'O' AND
+	status IN ('P', 'Q', 'E')
+`
+
 // MarkMessagesQueued marks the passed in messages as queued
 func MarkMessagesQueued(ctx context.Context, tx *sqlx.Tx, msgs []*Msg) error {
 	return updateMessageStatus(ctx, tx, msgs, MsgStatusQueued)
@@ -503,6 +547,8 @@ type Broadcast struct {
 		GroupIDs      []GroupID                               `json:"group_ids,omitempty"`
 		OrgID         OrgID                                   `json:"org_id"                 db:"org_id"`
 		ParentID      BroadcastID                             `json:"parent_id,omitempty"    db:"parent_id"`
+		Window        *DeliveryWindow                         `json:"delivery_window,omitempty"`
+		Templating    *BroadcastTemplating                    `json:"templating,omitempty"`
 	}
 }
 
@@ -514,6 +560,14 @@ func (b *Broadcast) OrgID() OrgID                                          { ret
 func (b *Broadcast) BaseLanguage() envs.Language                           { return b.b.BaseLanguage }
 func (b *Broadcast) Translations() map[envs.Language]*BroadcastTranslation { return b.b.Translations }
 func (b *Broadcast) TemplateState() TemplateState                          { return b.b.TemplateState }
+func (b *Broadcast) DeliveryWindow() *DeliveryWindow                       { return b.b.Window }
+func (b *Broadcast) Templating() *BroadcastTemplating                      { return b.b.Templating }
+
+// SetDeliveryWindow sets the window of local time in which this broadcast can be delivered to contacts
+func (b *Broadcast) SetDeliveryWindow(window *DeliveryWindow) { b.b.Window = window }
+
+// SetTemplating sets the message template this broadcast should be sent with on channels which support them
+func (b *Broadcast) SetTemplating(templating *BroadcastTemplating) { b.b.Templating = templating }
 
 func (b *Broadcast) MarshalJSON() ([]byte, error)    { return json.Marshal(b.b) }
 func (b *Broadcast) UnmarshalJSON(data []byte) error { return json.Unmarshal(data, &b.b) }
@@ -548,8 +602,10 @@ func InsertChildBroadcast(ctx context.Context, db Queryer, parent *Broadcast) (*
 		parent.b.ContactIDs,
 		parent.b.GroupIDs,
 	)
-	// populate our parent id
+	// populate our parent id, delivery window and templating
 	child.b.ParentID = parent.BroadcastID()
+	child.b.Window = parent.b.Window
+	child.b.Templating = parent.b.Templating
 
 	// populate text from our translations
 	child.b.Text.Map = make(map[string]sql.NullString)
@@ -695,6 +751,7 @@ func (b *Broadcast) CreateBatch(contactIDs []ContactID) *BroadcastBatch {
 	batch.b.BaseLanguage = b.b.BaseLanguage
 	batch.b.Translations = b.b.Translations
 	batch.b.TemplateState = b.b.TemplateState
+	batch.b.Templating = b.b.Templating
 	batch.b.OrgID = b.b.OrgID
 	batch.b.ContactIDs = contactIDs
 	return batch
@@ -707,6 +764,7 @@ type BroadcastBatch struct {
 		Translations  map[envs.Language]*BroadcastTranslation `json:"translations"`
 		BaseLanguage  envs.Language                           `json:"base_language"`
 		TemplateState TemplateState                           `json:"template_state"`
+		Templating    *BroadcastTemplating                    `json:"templating,omitempty"`
 		URNs          map[ContactID]urns.URN                  `json:"urns,omitempty"`
 		ContactIDs    []ContactID                             `json:"contact_ids,omitempty"`
 		IsLast        bool                                    `json:"is_last"`
@@ -722,15 +780,58 @@ func (b *BroadcastBatch) OrgID() OrgID                        { return b.b.OrgID
 func (b *BroadcastBatch) Translations() map[envs.Language]*BroadcastTranslation {
 	return b.b.Translations
 }
-func (b *BroadcastBatch) TemplateState() TemplateState { return b.b.TemplateState }
-func (b *BroadcastBatch) BaseLanguage() envs.Language  { return b.b.BaseLanguage }
-func (b *BroadcastBatch) IsLast() bool                 { return b.b.IsLast }
-func (b *BroadcastBatch) SetIsLast(last bool)          { b.b.IsLast = last }
+func (b *BroadcastBatch) TemplateState() TemplateState     { return b.b.TemplateState }
+func (b *BroadcastBatch) Templating() *BroadcastTemplating { return b.b.Templating }
+func (b *BroadcastBatch) BaseLanguage() envs.Language      { return b.b.BaseLanguage }
+func (b *BroadcastBatch) IsLast() bool                     { return b.b.IsLast }
+func (b *BroadcastBatch) SetIsLast(last bool)              { b.b.IsLast = last }
 
 func (b *BroadcastBatch) MarshalJSON() ([]byte, error)    { return json.Marshal(b.b) }
 func (b *BroadcastBatch) UnmarshalJSON(data []byte) error { return json.Unmarshal(data, &b.b) }
 
-func CreateBroadcastMessages(ctx context.Context, db Queryer, rp *redis.Pool, oa *OrgAssets, bcast *BroadcastBatch) ([]*Msg, error) {
+// CreateBroadcastMessages builds the messages for the passed in broadcast batch and inserts them, also returning the
+// contacts who weren't sent a message because no approved template matched them
+func CreateBroadcastMessages(ctx context.Context, db Queryer, rp *redis.Pool, oa *OrgAssets, bcast *BroadcastBatch) ([]*Msg, []ContactID, error) {
+	msgs, _, noTemplate, err := buildBroadcastMessages(ctx, db, oa, bcast)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(noTemplate) > 0 {
+		logrus.WithField("broadcast_id", bcast.BroadcastID()).WithField("template_uuid", bcast.Templating().Template.UUID).WithField("contact_ids", noTemplate).Warn("no approved template matched contacts for broadcast")
+	}
+
+	// allocate a topup for these message if org uses topups
+	topup, err := AllocateTopups(ctx, db, rp, oa.Org(), len(msgs))
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "error allocating topup for broadcast messages")
+	}
+
+	// if we have an active topup, assign it to our messages
+	if topup != NilTopupID {
+		for _, m := range msgs {
+			m.SetTopup(topup)
+		}
+	}
+
+	// insert them in a single request
+	err = InsertMessages(ctx, db, msgs)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "error inserting broadcast messages")
+	}
+
+	return msgs, noTemplate, nil
+}
+
+// PreviewBroadcastMessages builds the messages for the passed in broadcast batch without inserting them, also
+// returning the language of the translation used for each message and the contacts no approved template matched
+func PreviewBroadcastMessages(ctx context.Context, db Queryer, oa *OrgAssets, bcast *BroadcastBatch) ([]*Msg, map[*Msg]envs.Language, []ContactID, error) {
+	return buildBroadcastMessages(ctx, db, oa, bcast)
+}
+
+// buildBroadcastMessages builds the messages for the passed in broadcast batch, the language used for each and the
+// contacts who can't be sent a message because no approved template matched them
+func buildBroadcastMessages(ctx context.Context, db Queryer, oa *OrgAssets, bcast *BroadcastBatch) ([]*Msg, map[*Msg]envs.Language, []ContactID, error) {
 	repeatedContacts := make(map[ContactID]bool)
 	broadcastURNs := bcast.URNs()
 
@@ -759,13 +860,15 @@ func CreateBroadcastMessages(ctx context.Context, db Queryer, rp *redis.Pool, oa
 	// load all our contacts
 	contacts, err := LoadContacts(ctx, db, oa, contactIDs)
 	if err != nil {
-		return nil, errors.Wrapf(err, "error loading contacts for broadcast")
+		return nil, nil, nil, errors.Wrapf(err, "error loading contacts for broadcast")
 	}
 
 	channels := oa.SessionAssets().Channels()
 
 	// for each contact, build our message
 	msgs := make([]*Msg, 0, len(contacts))
+	languages := make(map[*Msg]envs.Language, len(contacts))
+	noTemplate := make([]ContactID, 0)
 
 	// utility method to build up our message
 	buildMessage := func(c *Contact, forceURN urns.URN) (*Msg, error) {
@@ -835,12 +938,14 @@ func CreateBroadcastMessages(ctx context.Context, db Queryer, rp *redis.Pool, oa
 
 		// not found? try org default language
 		if t == nil {
-			t = trans[oa.Env().DefaultLanguage()]
+			lang = oa.Env().DefaultLanguage()
+			t = trans[lang]
 		}
 
 		// not found? use broadcast base language
 		if t == nil {
-			t = trans[bcast.BaseLanguage()]
+			lang = bcast.BaseLanguage()
+			t = trans[lang]
 		}
 
 		if t == nil {
@@ -848,27 +953,50 @@ func CreateBroadcastMessages(ctx context.Context, db Queryer, rp *redis.Pool, oa
 			return nil, nil
 		}
 
-		template := ""
+		// evaluates the passed in text according to our template state
+		evaluate := func(text string) string {
+			template := ""
+
+			// if this is a legacy template, migrate it forward
+			if bcast.TemplateState() == TemplateStateLegacy {
+				template, _ = expressions.MigrateTemplate(text, nil)
+			} else if bcast.TemplateState() == TemplateStateUnevaluated {
+				template = text
+			}
 
-		// if this is a legacy template, migrate it forward
-		if bcast.TemplateState() == TemplateStateLegacy {
-			template, _ = expressions.MigrateTemplate(t.Text, nil)
-		} else if bcast.TemplateState() == TemplateStateUnevaluated {
-			template = t.Text
+			// if we have a template, evaluate it
+			if template != "" {
+				// build up the minimum viable context for templates
+				templateCtx := types.NewXObject(map[string]types.XValue{
+					"contact": flows.Context(oa.Env(), contact),
+					"fields":  flows.Context(oa.Env(), contact.Fields()),
+					"globals": flows.Context(oa.Env(), oa.SessionAssets().Globals()),
+					"urns":    flows.ContextFunc(oa.Env(), contact.URNs().MapContext),
+				})
+				text, _ = excellent.EvaluateTemplate(oa.Env(), templateCtx, template, nil)
+			}
+			return text
 		}
 
-		text := t.Text
-
-		// if we have a template, evaluate it
-		if template != "" {
-			// build up the minimum viable context for templates
-			templateCtx := types.NewXObject(map[string]types.XValue{
-				"contact": flows.Context(oa.Env(), contact),
-				"fields":  flows.Context(oa.Env(), contact.Fields()),
-				"globals": flows.Context(oa.Env(), oa.SessionAssets().Globals()),
-				"urns":    flows.ContextFunc(oa.Env(), contact.URNs().MapContext),
-			})
-			text, _ = excellent.EvaluateTemplate(oa.Env(), templateCtx, template, nil)
+		text := evaluate(t.Text)
+
+		// if we have a message template, look for an approved translation of it for this contact and channel
+		var templating *flows.MsgTemplating
+		if bcast.Templating() != nil {
+			variables := make([]string, len(bcast.Templating().Variables))
+			for i, v := range bcast.Templating().Variables {
+				variables[i] = evaluate(v)
+			}
+
+			translation := bcast.Templating().Match(oa, contact, channel, variables)
+			if translation != nil {
+				text = translation.Substitute(variables)
+				templating = flows.NewMsgTemplating(bcast.Templating().Template, translation.Language(), variables)
+			} else if channel.RequiresTemplate() {
+				// the channel would reject this message so don't create it
+				noTemplate = append(noTemplate, c.ID())
+				return nil, nil
+			}
 		}
 
 		// don't do anything if we have no text or attachments
@@ -877,13 +1005,14 @@ func CreateBroadcastMessages(ctx context.Context, db Queryer, rp *redis.Pool, oa
 		}
 
 		// create our outgoing message
-		out := flows.NewMsgOut(urn, channel.ChannelReference(), text, t.Attachments, t.QuickReplies, nil, flows.NilMsgTopic)
+		out := flows.NewMsgOut(urn, channel.ChannelReference(), text, t.Attachments, t.QuickReplies, templating, flows.NilMsgTopic)
 		msg, err := NewOutgoingMsg(oa.OrgID(), channel, c.ID(), out, time.Now())
 		msg.SetBroadcastID(bcast.BroadcastID())
 		if err != nil {
 			return nil, errors.Wrapf(err, "error creating outgoing message")
 		}
 
+		languages[msg] = lang
 		return msg, nil
 	}
 
@@ -893,7 +1022,7 @@ func CreateBroadcastMessages(ctx context.Context, db Queryer, rp *redis.Pool, oa
 		urn := broadcastURNs[c.ID()]
 		msg, err := buildMessage(c, urn)
 		if err != nil {
-			return nil, errors.Wrapf(err, "error creating broadcast message")
+			return nil, nil, nil, errors.Wrapf(err, "error creating broadcast message")
 		}
 		if msg != nil {
 			msgs = append(msgs, msg)
@@ -903,7 +1032,7 @@ func CreateBroadcastMessages(ctx context.Context, db Queryer, rp *redis.Pool, oa
 		if repeatedContacts[c.ID()] {
 			m2, err := buildMessage(c, urns.NilURN)
 			if err != nil {
-				return nil, errors.Wrapf(err, "error creating broadcast message")
+				return nil, nil, nil, errors.Wrapf(err, "error creating broadcast message")
 			}
 
 			// add this message if it isn't a duplicate
@@ -913,26 +1042,17 @@ func CreateBroadcastMessages(ctx context.Context, db Queryer, rp *redis.Pool, oa
 		}
 	}
 
-	// allocate a topup for these message if org uses topups
-	topup, err := AllocateTopups(ctx, db, rp, oa.Org(), len(msgs))
-	if err != nil {
-		return nil, errors.Wrapf(err, "error allocating topup for broadcast messages")
-	}
-
-	// if we have an active topup, assign it to our messages
-	if topup != NilTopupID {
-		for _, m := range msgs {
-			m.SetTopup(topup)
-		}
-	}
+	return msgs, languages, noTemplate, nil
+}
 
-	// insert them in a single request
-	err = InsertMessages(ctx, db, msgs)
+// BroadcastExists returns whether the passed in broadcast exists and belongs to the passed in org
+func BroadcastExists(ctx context.Context, db Queryer, orgID OrgID, id BroadcastID) (bool, error) {
+	var exists bool
+	err := db.GetContext(ctx, &exists, `SELECT EXISTS(SELECT 1 FROM msgs_broadcast WHERE id = $1 AND org_id = $2)`, id, orgID)
 	if err != nil {
-		return nil, errors.Wrapf(err, "error inserting broadcast messages")
+		return false, errors.Wrapf(err, "error checking whether broadcast %d exists", id)
 	}
-
-	return msgs, nil
+	return exists, nil
 }
 
 // MarkBroadcastSent marks the passed in broadcast as sent
@@ -949,6 +1069,23 @@ func MarkBroadcastSent(ctx context.Context, db *sqlx.DB, id BroadcastID) error {
 	return nil
 }
 
+// BroadcastStatusCancelled is the status of broadcasts which were cancelled before all their messages were sent
+const BroadcastStatusCancelled = "C"
+
+// MarkBroadcastCancelled marks the passed in broadcast as cancelled
+func MarkBroadcastCancelled(ctx context.Context, db *sqlx.DB, id BroadcastID) error {
+	// noop if it is a nil id
+	if id == NilBroadcastID {
+		return nil
+	}
+
+	_, err := db.ExecContext(ctx, `UPDATE msgs_broadcast SET status = $2, modified_on = now() WHERE id = $1`, id, BroadcastStatusCancelled)
+	if err != nil {
+		return errors.Wrapf(err, "error setting broadcast with id %d as cancelled", id)
+	}
+	return nil
+}
+
 // NilID implementations
 
 // MarshalJSON marshals into JSON. 0 values will become null
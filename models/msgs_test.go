@@ -1,12 +1,15 @@
 package models
 
 import (
+	"encoding/json"
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/nyaruka/gocommon/urns"
 	"github.com/nyaruka/goflow/assets"
+	"github.com/nyaruka/goflow/envs"
 	"github.com/nyaruka/goflow/flows"
 	"github.com/nyaruka/goflow/utils"
 	"github.com/nyaruka/mailroom/config"
@@ -124,6 +127,42 @@ func TestMsgs(t *testing.T) {
 	}
 }
 
+func TestOutgoingMsgGSM7Substitution(t *testing.T) {
+	plain := &Channel{}
+	plain.c.UUID = assets.ChannelUUID("74729f45-7f29-4868-9dc4-90e491e3c7d8")
+
+	substituting := &Channel{}
+	substituting.c.UUID = assets.ChannelUUID("74729f45-7f29-4868-9dc4-90e491e3c7d8")
+	substituting.c.Config = map[string]interface{}{ChannelConfigGSM7Substitution: true}
+
+	tcs := []struct {
+		Channel          *Channel
+		URN              urns.URN
+		Text             string
+		ExpectedText     string
+		ExpectedMsgCount int
+	}{
+		{plain, urns.URN("tel:+250700000001?id=10000"), "“Hi” – it’s me", "“Hi” – it’s me", 1},
+		{substituting, urns.URN("tel:+250700000001?id=10000"), "“Hi” – it’s me", "\"Hi\" - it's me", 1},
+		{plain, urns.URN("tel:+250700000001?id=10000"), strings.Repeat("“Hi” ", 20), strings.Repeat("“Hi” ", 20), 2},
+		{substituting, urns.URN("tel:+250700000001?id=10000"), strings.Repeat("“Hi” ", 20), strings.Repeat("\"Hi\" ", 20), 1},
+
+		// substitution wouldn't avoid UCS2 so text is left as is
+		{substituting, urns.URN("tel:+250700000001?id=10000"), "“Hi” ☺", "“Hi” ☺", 1},
+
+		// only applies to tel URNs
+		{substituting, urns.URN("twitter:bobby?id=10000"), "“Hi”", "“Hi”", 1},
+	}
+
+	for _, tc := range tcs {
+		flowMsg := flows.NewMsgOut(tc.URN, assets.NewChannelReference(tc.Channel.UUID(), "Test Channel"), tc.Text, nil, nil, nil, flows.NilMsgTopic)
+		msg, err := NewOutgoingMsg(OrgID(1), tc.Channel, CathyID, flowMsg, time.Now())
+		assert.NoError(t, err)
+		assert.Equal(t, tc.ExpectedText, msg.Text(), "unexpected text for: %s", tc.Text)
+		assert.Equal(t, tc.ExpectedMsgCount, msg.MsgCount(), "unexpected msg count for: %s", tc.Text)
+	}
+}
+
 func TestNormalizeAttachment(t *testing.T) {
 	config.Mailroom.AttachmentDomain = "foo.bar.com"
 	defer func() { config.Mailroom.AttachmentDomain = "" }()
@@ -143,3 +182,66 @@ func TestNormalizeAttachment(t *testing.T) {
 		assert.Equal(t, tc.normalized, string(NormalizeAttachment(utils.Attachment(tc.raw))))
 	}
 }
+
+func TestBroadcastTemplating(t *testing.T) {
+	testsuite.Reset()
+	ctx := testsuite.CTX()
+	db := testsuite.DB()
+
+	// give cathy an english twitter handle which she'll be sent to first
+	db.MustExec(`UPDATE contacts_contact SET language = 'eng' WHERE id = $1`, CathyID)
+	db.MustExec(
+		`INSERT INTO contacts_contacturn(org_id, contact_id, scheme, path, identity, priority) 
+								  VALUES(1, $1, 'twitter', 'cathy', 'twitter:cathy', 1000)`, CathyID)
+
+	eng := envs.Language("eng")
+	translations := map[envs.Language]*BroadcastTranslation{eng: {Text: "hello @contact.name"}}
+	revive := &assets.TemplateReference{UUID: "9c22b594-fcab-4b29-9bcb-ce4404894a80", Name: "revive_issue"}
+
+	tcs := []struct {
+		ChannelType        ChannelType
+		Variables          []string
+		ExpectedText       string
+		ExpectedTemplating string
+		ExpectedNoTemplate []ContactID
+	}{
+		{"TT", []string{"@contact.name", "tooth"}, "Hi Cathy, are you still experiencing problems with tooth?", `{"template":{"uuid":"9c22b594-fcab-4b29-9bcb-ce4404894a80","name":"revive_issue"},"language":"eng","variables":["Cathy","tooth"]}`, []ContactID{}},
+		{"TT", []string{"@contact.name"}, "hello Cathy", "", []ContactID{}},
+		{"WA", []string{"@contact.name", "tooth"}, "Hi Cathy, are you still experiencing problems with tooth?", `{"template":{"uuid":"9c22b594-fcab-4b29-9bcb-ce4404894a80","name":"revive_issue"},"language":"eng","variables":["Cathy","tooth"]}`, []ContactID{}},
+		{"WA", []string{"@contact.name"}, "", "", []ContactID{CathyID}},
+		{"WA", []string{"@contact.name", "@fields.unknown"}, "", "", []ContactID{CathyID}},
+	}
+
+	for i, tc := range tcs {
+		db.MustExec(`UPDATE channels_channel SET channel_type = $2 WHERE id = $1`, TwitterChannelID, tc.ChannelType)
+
+		oa, err := GetOrgAssetsWithRefresh(ctx, db, Org1, RefreshChannels)
+		assert.NoError(t, err)
+
+		bcast := NewBroadcast(Org1, NilBroadcastID, translations, TemplateStateUnevaluated, eng, nil, []ContactID{CathyID}, nil)
+		bcast.SetTemplating(&BroadcastTemplating{Template: revive, Variables: tc.Variables})
+
+		msgs, _, noTemplate, err := PreviewBroadcastMessages(ctx, db, oa, bcast.CreateBatch([]ContactID{CathyID}))
+		assert.NoError(t, err, "%d: unexpected error", i)
+		assert.Equal(t, tc.ExpectedNoTemplate, noTemplate, "%d: no template contacts mismatch", i)
+
+		if tc.ExpectedText == "" {
+			assert.Equal(t, 0, len(msgs), "%d: expected no messages", i)
+			continue
+		}
+
+		if assert.Equal(t, 1, len(msgs), "%d: expected one message", i) {
+			assert.Equal(t, TwitterChannelUUID, msgs[0].ChannelUUID(), "%d: channel mismatch", i)
+			assert.Equal(t, tc.ExpectedText, msgs[0].Text(), "%d: text mismatch", i)
+
+			if tc.ExpectedTemplating != "" {
+				templating, _ := json.Marshal(msgs[0].Metadata()["templating"])
+				assert.Equal(t, tc.ExpectedTemplating, string(templating), "%d: templating mismatch", i)
+			} else {
+				assert.Nil(t, msgs[0].Metadata()["templating"], "%d: unexpected templating", i)
+			}
+		}
+	}
+
+	db.MustExec(`UPDATE channels_channel SET channel_type = 'TT' WHERE id = $1`, TwitterChannelID)
+}
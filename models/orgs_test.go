@@ -6,6 +6,7 @@ import (
 
 	"github.com/nyaruka/goflow/envs"
 	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/null"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -53,3 +54,50 @@ func TestOrgs(t *testing.T) {
 	_, err = loadOrg(ctx, tx, 99)
 	assert.Error(t, err)
 }
+
+func TestOrgConfig(t *testing.T) {
+	msgDedupWindow := func(o *Org) interface{} { return o.MsgDedupWindow() }
+	keywordEditDistance := func(o *Org) interface{} { return o.KeywordEditDistance() }
+	frequencyCap := func(o *Org) interface{} { return o.FrequencyCap() }
+
+	tcs := []struct {
+		Setting  string
+		Accessor func(*Org) interface{}
+		Config   map[string]interface{}
+		Expected interface{}
+	}{
+		{"msg dedup window", msgDedupWindow, nil, time.Duration(0)},
+		{"msg dedup window", msgDedupWindow, map[string]interface{}{"msg_dedup_seconds": "60"}, time.Duration(0)},
+		{"msg dedup window", msgDedupWindow, map[string]interface{}{"msg_dedup_seconds": -5.0}, time.Duration(0)},
+		{"msg dedup window", msgDedupWindow, map[string]interface{}{"msg_dedup_seconds": 60.0}, time.Minute},
+		{"msg dedup window", msgDedupWindow, map[string]interface{}{"msg_dedup_seconds": 1.5}, time.Millisecond * 1500},
+
+		{"keyword edit distance", keywordEditDistance, nil, 0},
+		{"keyword edit distance", keywordEditDistance, map[string]interface{}{"keyword_edit_distance": "1"}, 0},
+		{"keyword edit distance", keywordEditDistance, map[string]interface{}{"keyword_edit_distance": -1.0}, 0},
+		{"keyword edit distance", keywordEditDistance, map[string]interface{}{"keyword_edit_distance": 1.0}, 1},
+		{"keyword edit distance", keywordEditDistance, map[string]interface{}{"keyword_edit_distance": 2.0}, 2},
+
+		{"frequency cap", frequencyCap, nil, (*FrequencyCap)(nil)},
+		{"frequency cap", frequencyCap, map[string]interface{}{"frequency_cap_max": 0.0}, (*FrequencyCap)(nil)},
+		{"frequency cap", frequencyCap, map[string]interface{}{"frequency_cap_max": "3"}, (*FrequencyCap)(nil)},
+		{"frequency cap", frequencyCap, map[string]interface{}{"frequency_cap_max": 3.0}, &FrequencyCap{Max: 3, Window: time.Hour * 24, Action: FrequencyCapActionDefer}},
+		{
+			"frequency cap", frequencyCap,
+			map[string]interface{}{"frequency_cap_max": 5.0, "frequency_cap_hours": 1.5, "frequency_cap_action": "drop"},
+			&FrequencyCap{Max: 5, Window: time.Minute * 90, Action: FrequencyCapActionDrop},
+		},
+		{
+			"frequency cap", frequencyCap,
+			map[string]interface{}{"frequency_cap_max": 5.0, "frequency_cap_hours": -1.0, "frequency_cap_action": "xxx"},
+			&FrequencyCap{Max: 5, Window: time.Hour * 24, Action: FrequencyCapActionDefer},
+		},
+	}
+
+	for _, tc := range tcs {
+		org := &Org{}
+		org.o.Config = null.NewMap(tc.Config)
+
+		assert.Equal(t, tc.Expected, tc.Accessor(org), "%s mismatch for config: %v", tc.Setting, tc.Config)
+	}
+}
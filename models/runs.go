@@ -859,6 +859,39 @@ WHERE
 	flow_id = $2
 `
 
+// FindStartedByStartOverlap returns the list of contact ids which overlap with those passed in which have already been
+// started by the passed in flow start
+func FindStartedByStartOverlap(ctx context.Context, db *sqlx.DB, startID StartID, contacts []ContactID) ([]ContactID, error) {
+	return selectContactOverlap(ctx, db, startedByStartOverlapSQL, contacts, startID)
+}
+
+const startedByStartOverlapSQL = `
+SELECT
+	DISTINCT(contact_id)
+FROM
+	flows_flowrun
+WHERE
+	contact_id = ANY($1) AND
+	start_id = $2
+`
+
+// FindFlowStartedSinceOverlap returns the list of contact ids which overlap with those passed in which have been started
+// in the passed in flow since the passed in time
+func FindFlowStartedSinceOverlap(ctx context.Context, db *sqlx.DB, flowID FlowID, contacts []ContactID, since time.Time) ([]ContactID, error) {
+	return selectContactOverlap(ctx, db, flowStartedSinceOverlapSQL, contacts, flowID, since)
+}
+
+const flowStartedSinceOverlapSQL = `
+SELECT
+	DISTINCT(contact_id)
+FROM
+	flows_flowrun
+WHERE
+	contact_id = ANY($1) AND
+	flow_id = $2 AND
+	created_on >= $3
+`
+
 // FindActiveSessionOverlap returns the list of contact ids which overlap with those passed in which are active in any other flows
 func FindActiveSessionOverlap(ctx context.Context, db *sqlx.DB, flowType FlowType, contacts []ContactID) ([]ContactID, error) {
 	var overlap []ContactID
@@ -925,6 +958,14 @@ func ExitSessions(ctx context.Context, tx Queryer, sessionIDs []SessionID, exitT
 	rows, _ = res.RowsAffected()
 	logrus.WithField("count", rows).WithField("elapsed", time.Since(start)).Debug("exited sessions")
 
+	// contacts which didn't complete their flows shouldn't get the messages those flows scheduled
+	if exitType != ExitCompleted {
+		err = CancelScheduledSessionMessages(ctx, tx, sessionIDs)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -964,6 +1005,12 @@ func InterruptContactRuns(ctx context.Context, tx Queryer, sessionType FlowType,
 		return err
 	}
 
+	// cancel any messages the sessions we're about to interrupt have scheduled
+	err = Exec(ctx, "cancelling scheduled messages of interrupted sessions", tx, cancelInterruptedSessionMsgsSQL, sessionType, pq.Array(contactIDs), FailedReasonCancelled)
+	if err != nil {
+		return err
+	}
+
 	err = Exec(ctx, "interrupting contact sessions", tx, interruptContactSessionsSQL, sessionType, pq.Array(contactIDs), now)
 	if err != nil {
 		return err
@@ -1029,6 +1076,12 @@ func ExpireRunsAndSessions(ctx context.Context, db *sqlx.DB, runIDs []FlowRunID,
 			tx.Rollback()
 			return errors.Wrapf(err, "error expiring sessions")
 		}
+
+		err = CancelScheduledSessionMessages(ctx, tx, sessionIDs)
+		if err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "error cancelling scheduled messages of expired sessions")
+		}
 	}
 
 	err = tx.Commit()
@@ -0,0 +1,250 @@
+package models
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nyaruka/goflow/envs"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/goflow/utils"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+const (
+	// ResultSendLater is the key of the run result which, when saved by a flow, delays the next message it sends
+	ResultSendLater = "send_later"
+
+	// FailedReasonCancelled is the failure reason recorded on scheduled messages which were cancelled before being sent
+	FailedReasonCancelled = "cancelled"
+
+	// longest a message can be scheduled for
+	maxSendLater = time.Hour * 24 * 30
+)
+
+// IsSendLaterResult returns whether the passed in run result name is the one used to schedule messages
+func IsSendLaterResult(name string) bool {
+	return utils.Snakify(name) == ResultSendLater
+}
+
+// ParseSendLater parses the value of a send later result, which can be a duration like 2h or 90m, a number of minutes
+// or a date time. It returns false if the value can't be parsed or is more than 30 days in the future. Values in the
+// past are returned as is and messages scheduled for them are sent straight away.
+func ParseSendLater(env envs.Environment, value string, now time.Time) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+	var sendOn time.Time
+
+	if minutes, err := strconv.Atoi(value); err == nil {
+		sendOn = now.Add(time.Duration(minutes) * time.Minute)
+	} else if duration, err := time.ParseDuration(value); err == nil {
+		sendOn = now.Add(duration)
+	} else if date, err := envs.DateTimeFromString(env, value, false); err == nil {
+		sendOn = date
+	} else {
+		return time.Time{}, false
+	}
+
+	if sendOn.Sub(now) > maxSendLater {
+		return time.Time{}, false
+	}
+	return sendOn, true
+}
+
+// ScheduleSend makes this message wait as pending until the passed in time, when it will be sent by our cron. Messages
+// scheduled from a session are cancelled if that session is interrupted or expires.
+func (m *Msg) ScheduleSend(sendOn time.Time, sessionID SessionID) {
+	metadata := m.m.Metadata.Map()
+	metadata["send_on"] = sendOn.UTC().Format(time.RFC3339Nano)
+	if sessionID != SessionID(0) {
+		metadata["session_id"] = sessionID
+	}
+
+	m.m.Status = MsgStatusPending
+	m.m.NextAttempt = sendOn
+}
+
+// SendOn returns when this message is scheduled to be sent, if it is scheduled
+func (m *Msg) SendOn() *time.Time {
+	value, _ := m.Metadata()["send_on"].(string)
+	sendOn, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return nil
+	}
+	return &sendOn
+}
+
+// LoadScheduledMessagesDue loads scheduled messages which are due to be sent as of the passed in time, oldest first
+func LoadScheduledMessagesDue(ctx context.Context, db Queryer, now time.Time, limit int) ([]*Msg, error) {
+	rows, err := db.QueryxContext(ctx, selectScheduledMsgsDueSQL, now, limit)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error querying scheduled messages")
+	}
+	defer rows.Close()
+
+	msgs := make([]*Msg, 0)
+	for rows.Next() {
+		msg := &Msg{}
+		err := readJSONRow(rows, &msg.m)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error reading scheduled message")
+		}
+		msgs = append(msgs, msg)
+	}
+
+	return msgs, nil
+}
+
+const selectScheduledMsgsDueSQL = `
+SELECT ROW_TO_JSON(r) FROM (SELECT
+	m.id as id,
+	m.broadcast_id as broadcast_id,
+	m.uuid as uuid,
+	m.text as text,
+	m.high_priority as high_priority,
+	m.created_on as created_on,
+	m.modified_on as modified_on,
+	m.queued_on as queued_on,
+	m.direction as direction,
+	m.status as status,
+	m.visibility as visibility,
+	m.msg_count as tps_cost,
+	m.error_count as error_count,
+	m.next_attempt as next_attempt,
+	m.external_id as external_id,
+	m.attachments as attachments,
+	NULLIF(m.metadata, '')::json as metadata,
+	m.channel_id as channel_id,
+	c.uuid as channel_uuid,
+	m.contact_id as contact_id,
+	m.contact_urn_id as contact_urn_id,
+	m.response_to_id as response_to_id,
+	u.identity || '?id=' || u.id as urn,
+	u.auth as urn_auth,
+	m.org_id as org_id
+FROM
+	msgs_msg m
+	JOIN channels_channel c ON c.id = m.channel_id
+	JOIN contacts_contacturn u ON u.id = m.contact_urn_id
+WHERE
+	m.direction = 'O' AND
+	m.status = 'P' AND
+	m.next_attempt <= $1 AND
+	NULLIF(m.metadata, '')::json->>'send_on' IS NOT NULL
+ORDER BY
+	m.next_attempt ASC
+LIMIT $2
+) r;
+`
+
+// MarkPendingMessagesQueued marks the passed in scheduled or deferred messages as queued, returning those which were
+// still waiting to be sent, i.e. which haven't been cancelled or queued by someone else in the meantime
+func MarkPendingMessagesQueued(ctx context.Context, db Queryer, msgs []*Msg) ([]*Msg, error) {
+	ids := make([]flows.MsgID, len(msgs))
+	for i, m := range msgs {
+		ids[i] = m.ID()
+	}
+
+	rows, err := db.QueryxContext(ctx, queueScheduledMsgsSQL, pq.Array(ids))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error marking scheduled messages as queued")
+	}
+	defer rows.Close()
+
+	queued := make(map[flows.MsgID]bool, len(msgs))
+	for rows.Next() {
+		var id flows.MsgID
+		if err := rows.Scan(&id); err != nil {
+			return nil, errors.Wrapf(err, "error reading queued message id")
+		}
+		queued[id] = true
+	}
+
+	still := make([]*Msg, 0, len(queued))
+	for _, m := range msgs {
+		if queued[m.ID()] {
+			m.m.Status = MsgStatusQueued
+			still = append(still, m)
+		}
+	}
+	return still, nil
+}
+
+const queueScheduledMsgsSQL = `
+UPDATE
+	msgs_msg
+SET
+	status = 'Q',
+	queued_on = NOW(),
+	modified_on = NOW()
+WHERE
+	id = ANY($1) AND
+	status = 'P'
+RETURNING
+	id
+`
+
+// CancelScheduledMessages cancels all the messages waiting to be sent later to the passed in contacts
+func CancelScheduledMessages(ctx context.Context, db Queryer, contactIDs []ContactID) error {
+	if len(contactIDs) == 0 {
+		return nil
+	}
+
+	return Exec(ctx, "cancelling scheduled messages", db, cancelScheduledMsgsSQL, pq.Array(contactIDs), FailedReasonCancelled)
+}
+
+const cancelScheduledMsgsSQL = `
+UPDATE
+	msgs_msg
+SET
+	status = 'F',
+	metadata = (NULLIF(metadata, '')::jsonb || jsonb_build_object('failed_reason', $2::text))::text,
+	modified_on = NOW()
+WHERE
+	contact_id = ANY($1) AND
+	direction = 'O' AND
+	status = 'P' AND
+	NULLIF(metadata, '')::json->>'send_on' IS NOT NULL
+`
+
+// CancelScheduledSessionMessages cancels all the messages waiting to be sent later which were scheduled by the passed
+// in sessions
+func CancelScheduledSessionMessages(ctx context.Context, db Queryer, sessionIDs []SessionID) error {
+	if len(sessionIDs) == 0 {
+		return nil
+	}
+
+	return Exec(ctx, "cancelling scheduled session messages", db, cancelScheduledSessionMsgsSQL, pq.Array(sessionIDs), FailedReasonCancelled)
+}
+
+const cancelScheduledSessionMsgsSQL = `
+UPDATE
+	msgs_msg
+SET
+	status = 'F',
+	metadata = (NULLIF(metadata, '')::jsonb || jsonb_build_object('failed_reason', $2::text))::text,
+	modified_on = NOW()
+WHERE
+	contact_id IN (SELECT contact_id FROM flows_flowsession WHERE id = ANY($1)) AND
+	direction = 'O' AND
+	status = 'P' AND
+	(NULLIF(metadata, '')::json->>'session_id')::int = ANY($1)
+`
+
+const cancelInterruptedSessionMsgsSQL = `
+UPDATE
+	msgs_msg
+SET
+	status = 'F',
+	metadata = (NULLIF(metadata, '')::jsonb || jsonb_build_object('failed_reason', $3::text))::text,
+	modified_on = NOW()
+WHERE
+	contact_id = ANY($2) AND
+	direction = 'O' AND
+	status = 'P' AND
+	(NULLIF(metadata, '')::json->>'session_id')::int = ANY(
+		SELECT id FROM flows_flowsession WHERE session_type = $1 AND contact_id = ANY($2) AND status = 'W'
+	)
+`
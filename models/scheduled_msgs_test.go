@@ -0,0 +1,107 @@
+package models
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/goflow/envs"
+	"github.com/nyaruka/goflow/utils/uuids"
+	"github.com/nyaruka/mailroom/testsuite"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSendLater(t *testing.T) {
+	env := envs.NewBuilder().WithDateFormat(envs.DateFormatDayMonthYear).Build()
+	now := time.Date(2020, 5, 22, 12, 30, 0, 0, time.UTC)
+
+	tcs := []struct {
+		Value  string
+		SendOn time.Time
+		Valid  bool
+	}{
+		{"90", now.Add(time.Minute * 90), true},
+		{" 2h ", now.Add(time.Hour * 2), true},
+		{"1h30m", now.Add(time.Minute * 90), true},
+		{"24/05/2020 10:00", time.Date(2020, 5, 24, 10, 0, 0, 0, time.UTC), true},
+		{"2020-05-22T12:00:00Z", time.Date(2020, 5, 22, 12, 0, 0, 0, time.UTC), true},
+		{"-5", now.Add(-time.Minute * 5), true},
+		{"1000h", time.Time{}, false},
+		{"soon", time.Time{}, false},
+		{"", time.Time{}, false},
+	}
+
+	for _, tc := range tcs {
+		sendOn, valid := ParseSendLater(env, tc.Value, now)
+		assert.Equal(t, tc.Valid, valid, "valid mismatch for value: %s", tc.Value)
+		assert.True(t, tc.SendOn.Equal(sendOn), "send on mismatch for value: %s, got: %s", tc.Value, sendOn)
+	}
+
+	assert.True(t, IsSendLaterResult("Send Later"))
+	assert.True(t, IsSendLaterResult("send_later"))
+	assert.False(t, IsSendLaterResult("Send"))
+}
+
+func TestScheduledMsgs(t *testing.T) {
+	testsuite.Reset()
+	ctx := testsuite.CTX()
+	db := testsuite.DB()
+
+	insertSession := func(contactID ContactID) SessionID {
+		var id SessionID
+		err := db.Get(&id,
+			`INSERT INTO flows_flowsession(uuid, session_type, org_id, contact_id, status, responded, created_on, current_flow_id)
+			 VALUES($1, 'M', $2, $3, 'W', FALSE, NOW(), $4) RETURNING id`, uuids.New(), Org1, contactID, FavoritesFlowID)
+		require.NoError(t, err)
+		return id
+	}
+
+	insertScheduled := func(contactID ContactID, urnID URNID, sendOn time.Time, sessionID SessionID) MsgID {
+		var id MsgID
+		err := db.Get(&id,
+			`INSERT INTO msgs_msg(uuid, text, high_priority, created_on, modified_on, direction, status, visibility, msg_type, msg_count, error_count, next_attempt, metadata, channel_id, contact_id, contact_urn_id, org_id)
+			 VALUES($1, 'reminder', FALSE, NOW(), NOW(), 'O', 'P', 'V', 'F', 1, 0, $2, $3, $4, $5, $6, $7) RETURNING id`,
+			uuids.New(), sendOn, fmt.Sprintf(`{"send_on": "%s", "session_id": %d}`, sendOn.UTC().Format(time.RFC3339Nano), sessionID), TwilioChannelID, contactID, urnID, Org1)
+		require.NoError(t, err)
+		return id
+	}
+
+	cathySessionID := insertSession(CathyID)
+	georgeSessionID := insertSession(GeorgeID)
+
+	now := time.Now()
+	msg1 := insertScheduled(CathyID, CathyURNID, now.Add(-time.Minute), cathySessionID)
+	msg2 := insertScheduled(CathyID, CathyURNID, now.Add(time.Hour), cathySessionID)
+	msg3 := insertScheduled(GeorgeID, GeorgeURNID, now.Add(-time.Minute), georgeSessionID)
+
+	// a regular pending message isn't scheduled
+	db.MustExec(`INSERT INTO msgs_msg(uuid, text, high_priority, created_on, modified_on, direction, status, visibility, msg_type, msg_count, error_count, next_attempt, channel_id, contact_id, contact_urn_id, org_id)
+	             VALUES($1, 'pending', FALSE, NOW(), NOW(), 'O', 'P', 'V', 'F', 1, 0, NOW(), $2, $3, $4, $5)`, uuids.New(), TwilioChannelID, BobID, BobURNID, Org1)
+
+	msgs, err := LoadScheduledMessagesDue(ctx, db, now, 100)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(msgs))
+	assert.Equal(t, TwilioChannelUUID, msgs[0].ChannelUUID())
+	assert.NotNil(t, msgs[0].SendOn())
+
+	// george's session is interrupted before we get to send his message
+	err = CancelScheduledSessionMessages(ctx, db, []SessionID{georgeSessionID})
+	assert.NoError(t, err)
+
+	queued, err := MarkPendingMessagesQueued(ctx, db, msgs)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(queued))
+	assert.Equal(t, MsgStatusQueued, queued[0].Status())
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM msgs_msg WHERE id = $1 AND status = 'Q'`, []interface{}{msg1}, 1)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM msgs_msg WHERE id = $1 AND status = 'F' AND metadata LIKE '%"failed_reason": "cancelled"%'`, []interface{}{msg3}, 1)
+
+	// cathy responds so her other scheduled message is cancelled
+	err = CancelScheduledMessages(ctx, db, []ContactID{CathyID})
+	assert.NoError(t, err)
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM msgs_msg WHERE id = $1 AND status = 'F'`, []interface{}{msg2}, 1)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM msgs_msg WHERE text = 'pending' AND status = 'P'`, nil, 1)
+}
@@ -3,10 +3,12 @@ package models
 import (
 	"context"
 	"database/sql/driver"
+	"encoding/json"
 	"fmt"
 	"time"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/nyaruka/mailroom/cron"
 	"github.com/nyaruka/null"
 	"github.com/pkg/errors"
 )
@@ -23,6 +25,11 @@ const RepeatPeriodNever = RepeatPeriod("O")
 const RepeatPeriodDaily = RepeatPeriod("D")
 const RepeatPeriodWeekly = RepeatPeriod("W")
 const RepeatPeriodMonthly = RepeatPeriod("M")
+const RepeatPeriodYearly = RepeatPeriod("Y")
+const RepeatPeriodCron = RepeatPeriod("C")
+
+// LastWeekOfMonth is the week of month for schedules which repeat on the last given weekday of each month
+const LastWeekOfMonth = -1
 
 const Monday = 'M'
 const Tuesday = 'T'
@@ -51,12 +58,21 @@ type Schedule struct {
 		MinuteOfHour *int         `json:"repeat_minute_of_hour"`
 		DayOfMonth   *int         `json:"repeat_day_of_month"`
 		DaysOfWeek   null.String  `json:"repeat_days_of_week"`
+		WeekOfMonth  *int         `json:"repeat_week_of_month"`
+		MonthOfYear  *int         `json:"repeat_month_of_year"`
+		Cron         null.String  `json:"repeat_cron"`
 		NextFire     *time.Time   `json:"next_fire"`
 		LastFire     *time.Time   `json:"last_fire"`
 		OrgID        OrgID        `json:"org_id"`
 
-		// Timezone of our org
-		Timezone string `json:"timezone"`
+		// schedules stop after their end date or after firing a maximum number of times
+		EndDate   *time.Time `json:"end_date"`
+		MaxFires  *int       `json:"max_fires"`
+		FireCount *int       `json:"fire_count"`
+
+		// Timezone of our schedule if it has its own, otherwise we use that of our org
+		Timezone    string `json:"timezone"`
+		OrgTimezone string `json:"org_timezone"`
 
 		// associated broadcast if any
 		Broadcast *Broadcast `json:"broadcast,omitempty"`
@@ -70,28 +86,105 @@ func (s *Schedule) ID() ScheduleID        { return s.s.ID }
 func (s *Schedule) OrgID() OrgID          { return s.s.OrgID }
 func (s *Schedule) Broadcast() *Broadcast { return s.s.Broadcast }
 func (s *Schedule) FlowStart() *FlowStart { return s.s.FlowStart }
+func (s *Schedule) NextFire() *time.Time  { return s.s.NextFire }
 func (s *Schedule) Timezone() (*time.Location, error) {
-	return time.LoadLocation(s.s.Timezone)
+	if s.s.Timezone != "" {
+		return time.LoadLocation(s.s.Timezone)
+	}
+	return time.LoadLocation(s.s.OrgTimezone)
 }
+func (s *Schedule) HasTimezone() bool { return s.s.Timezone != "" }
 
-// UpdateFires updates the next and last fire for a shedule on the db
+func (s *Schedule) MarshalJSON() ([]byte, error)    { return json.Marshal(s.s) }
+func (s *Schedule) UnmarshalJSON(data []byte) error { return json.Unmarshal(data, &s.s) }
+
+// UpdateFires updates the next and last fire for a shedule on the db, counting the fire and deactivating the schedule
+// if it has reached its end
 func (s *Schedule) UpdateFires(ctx context.Context, tx Queryer, last time.Time, next *time.Time) error {
-	_, err := tx.ExecContext(ctx, `UPDATE schedules_schedule SET last_fire = $2, next_fire = $3 WHERE id = $1`,
-		s.s.ID, last, next,
-	)
+	isActive := next != nil || !s.hasEnd()
+
+	// we can only count fires if our schedule was loaded with a fire_count, i.e. the column exists
+	var err error
+	if s.s.FireCount != nil {
+		_, err = tx.ExecContext(ctx, `UPDATE schedules_schedule SET last_fire = $2, next_fire = $3, fire_count = fire_count + 1, is_active = $4 WHERE id = $1`,
+			s.s.ID, last, next, isActive,
+		)
+	} else {
+		_, err = tx.ExecContext(ctx, `UPDATE schedules_schedule SET last_fire = $2, next_fire = $3, is_active = $4 WHERE id = $1`,
+			s.s.ID, last, next, isActive,
+		)
+	}
 	if err != nil {
 		return errors.Wrapf(err, "error updating schedule fire dates for: %d", s.s.ID)
 	}
 	return nil
 }
 
-// GetNextFire returns the next fire for this schedule (if any)
+// whether this schedule has an end date or a maximum number of fires
+func (s *Schedule) hasEnd() bool {
+	return s.s.EndDate != nil || s.s.MaxFires != nil
+}
+
+// the number of times this schedule has fired, zero if we don't know
+func (s *Schedule) fireCount() int {
+	if s.s.FireCount == nil {
+		return 0
+	}
+	return *s.s.FireCount
+}
+
+// GetNextFire returns the next fire for this schedule (if any), taking into account its end date and the maximum number
+// of times it can fire
 func (s *Schedule) GetNextFire(tz *time.Location, now time.Time) (*time.Time, error) {
+	// the fire being handled is our fire_count + 1th
+	return s.nextFireAfter(tz, now, s.fireCount()+1)
+}
+
+// nextFireAfter returns the next fire for this schedule after the passed in time (if any), given the number of times it
+// has fired by then
+func (s *Schedule) nextFireAfter(tz *time.Location, now time.Time, fired int) (*time.Time, error) {
+	next, err := s.nextFire(tz, now)
+	if err != nil || next == nil {
+		return next, err
+	}
+
+	if s.s.EndDate != nil && next.After(*s.s.EndDate) {
+		return nil, nil
+	}
+
+	// if we've reached our max, there is no next one
+	if s.s.MaxFires != nil && fired >= *s.s.MaxFires {
+		return nil, nil
+	}
+
+	return next, nil
+}
+
+// nextFire returns the next time this schedule repeats after the passed in time
+func (s *Schedule) nextFire(tz *time.Location, now time.Time) (*time.Time, error) {
 	// Never repeats? no next fire
 	if s.s.RepeatPeriod == RepeatPeriodNever {
 		return nil, nil
 	}
 
+	// cron expressions describe their own times
+	if s.s.RepeatPeriod == RepeatPeriodCron {
+		if s.s.Cron == "" {
+			return nil, errors.Errorf("schedule %d repeats by cron but has no repeat_cron", s.s.ID)
+		}
+		expression, err := cron.ParseExpression(string(s.s.Cron))
+		if err != nil {
+			return nil, errors.Wrapf(err, "schedule %d has invalid repeat_cron", s.s.ID)
+		}
+
+		// increment now by a minute for the same reason as below
+		next := expression.Next(now.Add(time.Minute).In(tz))
+		if next.IsZero() {
+			return nil, nil
+		}
+		return &next, nil
+	}
+
 	// should have hour and minute on everything else
 	if s.s.HourOfDay == nil {
 		return nil, errors.Errorf("schedule %d has no repeat_hour_of_day set", s.s.ID)
@@ -114,8 +207,9 @@ func (s *Schedule) GetNextFire(tz *time.Location, now time.Time) (*time.Time, er
 	switch s.s.RepeatPeriod {
 
 	case RepeatPeriodDaily:
+		// step using our hour and minute rather than the previous fire, as that may have been moved by a DST change
 		for !next.After(now) {
-			next = next.AddDate(0, 0, 1)
+			next = time.Date(next.Year(), next.Month(), next.Day()+1, hour, minute, 0, 0, tz)
 		}
 		return &next, nil
 
@@ -136,12 +230,16 @@ func (s *Schedule) GetNextFire(tz *time.Location, now time.Time) (*time.Time, er
 
 		// until we are in the future, increment a day until we reach a day of week we send on
 		for !next.After(now) || !sendDays[next.Weekday()] {
-			next = next.AddDate(0, 0, 1)
+			next = time.Date(next.Year(), next.Month(), next.Day()+1, hour, minute, 0, 0, tz)
 		}
 
 		return &next, nil
 
 	case RepeatPeriodMonthly:
+		if s.s.WeekOfMonth != nil {
+			return s.nextWeekdayOfMonth(tz, now, hour, minute)
+		}
+
 		if s.s.DayOfMonth == nil {
 			return nil, errors.Errorf("schedule %d repeats monthly but has no repeat_day_of_month", s.s.ID)
 		}
@@ -167,11 +265,111 @@ func (s *Schedule) GetNextFire(tz *time.Location, now time.Time) (*time.Time, er
 		}
 
 		return &next, nil
+
+	case RepeatPeriodYearly:
+		if s.s.MonthOfYear == nil || s.s.DayOfMonth == nil {
+			return nil, errors.Errorf("schedule %d repeats yearly but has no repeat_month_of_year or repeat_day_of_month", s.s.ID)
+		}
+		month := time.Month(*s.s.MonthOfYear)
+		if month < time.January || month > time.December {
+			return nil, errors.Errorf("schedule %d has invalid repeat_month_of_year: %d", s.s.ID, month)
+		}
+
+		// like monthly repeats, days past the end of the month fire on its last day, i.e. Feb 29th on non leap years
+		for year := start.Year(); ; year++ {
+			day := *s.s.DayOfMonth
+			maxDay := daysInMonth(time.Date(year, month, 1, 0, 0, 0, 0, tz))
+			if day > maxDay {
+				day = maxDay
+			}
+			next = time.Date(year, month, day, hour, minute, 0, 0, tz)
+			if next.After(now) {
+				return &next, nil
+			}
+		}
+
 	default:
 		return nil, fmt.Errorf("unknown repeat period: %s", s.s.RepeatPeriod)
 	}
 }
 
+// nextWeekdayOfMonth returns the next fire of a monthly schedule which repeats on the nth weekday of each month, e.g. the
+// second Tuesday, or the last weekday of the month if its week of month is LastWeekOfMonth
+func (s *Schedule) nextWeekdayOfMonth(tz *time.Location, now time.Time, hour int, minute int) (*time.Time, error) {
+	week := *s.s.WeekOfMonth
+	if week != LastWeekOfMonth && (week < 1 || week > 4) {
+		return nil, errors.Errorf("schedule %d has invalid repeat_week_of_month: %d", s.s.ID, week)
+	}
+	if len(s.s.DaysOfWeek) != 1 {
+		return nil, errors.Errorf("schedule %d repeats on a week of the month but doesn't have a single repeat_days_of_week", s.s.ID)
+	}
+	weekday, found := dayStrToDayInt[s.s.DaysOfWeek[0]]
+	if !found {
+		return nil, errors.Errorf("schedule %d has unknown day of week: %s", s.s.ID, string(s.s.DaysOfWeek[0]))
+	}
+
+	start := now.In(tz)
+	for month := 0; ; month++ {
+		first := time.Date(start.Year(), start.Month()+time.Month(month), 1, hour, minute, 0, 0, tz)
+
+		var next time.Time
+		if week == LastWeekOfMonth {
+			last := time.Date(first.Year(), first.Month(), daysInMonth(first), hour, minute, 0, 0, tz)
+			next = last.AddDate(0, 0, -((int(last.Weekday()) - int(weekday) + 7) % 7))
+		} else {
+			next = first.AddDate(0, 0, (int(weekday)-int(first.Weekday())+7)%7+(week-1)*7)
+		}
+
+		if next.After(now) {
+			return &next, nil
+		}
+	}
+}
+
+// ScheduleFire is an upcoming fire of a schedule, flagged if it isn't at the exact time or day the schedule asks for
+type ScheduleFire struct {
+	Time time.Time `json:"time"`
+
+	// the schedule's day of month doesn't exist in this month so the fire is on its last day instead
+	Clamped bool `json:"clamped,omitempty"`
+
+	// the schedule's time of day doesn't exist on this day because of a daylight savings change so the fire is moved
+	DSTSkipped bool `json:"dst_skipped,omitempty"`
+}
+
+// Preview returns up to count of the next fires of this schedule after the passed in time, calculated exactly as they
+// will be when the schedule fires
+func (s *Schedule) Preview(tz *time.Location, after time.Time, count int) ([]*ScheduleFire, error) {
+	// the first fire we preview is our fire_count + 1th, so before it we've fired fire_count times
+	fired := s.fireCount()
+
+	fires := make([]*ScheduleFire, 0, count)
+	for len(fires) < count {
+		next, err := s.nextFireAfter(tz, after, fired)
+		if err != nil {
+			return nil, err
+		}
+		if next == nil {
+			break
+		}
+
+		fire := &ScheduleFire{Time: next.In(tz)}
+
+		// cron expressions never match skipped times and don't have a day of month to clamp
+		if s.s.RepeatPeriod != RepeatPeriodCron {
+			fire.DSTSkipped = fire.Time.Hour() != *s.s.HourOfDay || fire.Time.Minute() != *s.s.MinuteOfHour
+			fire.Clamped = s.s.DayOfMonth != nil && s.s.WeekOfMonth == nil && fire.Time.Day() < *s.s.DayOfMonth &&
+				(s.s.RepeatPeriod == RepeatPeriodMonthly || s.s.RepeatPeriod == RepeatPeriodYearly)
+		}
+
+		fires = append(fires, fire)
+		after = *next
+		fired++
+	}
+
+	return fires, nil
+}
+
 // returns number of days in the month for the passed in date using crazy golang date magic
 func daysInMonth(t time.Time) int {
 	// day 0 of a month is previous day of previous month, months can be > 12 and roll years
@@ -179,19 +377,13 @@ func daysInMonth(t time.Time) int {
 	return lastDay.Day()
 }
 
+// newer schedule columns (repeat_week_of_month, repeat_month_of_year, repeat_cron, end_date, max_fires, fire_count and
+// timezone) may not exist in every database yet, so rather than select them by name, we select each schedule's whole row
+// and any which don't exist are just read as unset. A broadcast's delivery window and templating are kept in its metadata.
 const selectUnfiredSchedules = `
-SELECT ROW_TO_JSON(s) FROM (SELECT
-	s.id as id,
-	s.repeat_hour_of_day as repeat_hour_of_day,
-	s.repeat_minute_of_hour as repeat_minute_of_hour,
-	s.repeat_day_of_month as repeat_day_of_month,
-	s.repeat_days_of_week as repeat_days_of_week,
-	s.repeat_period as repeat_period,
-	s.next_fire as next_fire,
-	s.last_fire as last_fire,
-	s.org_id as org_id,
-	o.timezone as timezone,
-	(SELECT ROW_TO_JSON(sb) FROM (
+SELECT TO_JSONB(s) || JSONB_BUILD_OBJECT(
+	'org_timezone', o.timezone,
+	'broadcast', (SELECT ROW_TO_JSON(sb) FROM (
 		SELECT
 			b.id as broadcast_id,
 			(SELECT JSON_OBJECT_AGG(ts.key, ts.value) FROM (SELECT key, JSON_BUILD_OBJECT('text', t.value) as value FROM each(b.text) t) ts) as translations,
@@ -222,13 +414,15 @@ SELECT ROW_TO_JSON(s) FROM (SELECT
 					contacts_contacturn cu ON cu.id = bus.contacturn_id
 				WHERE
 					bus.broadcast_id = b.id
-			) bu) as urns
+			) bu) as urns,
+			NULLIF(b.metadata, '')::jsonb->'delivery_window' as delivery_window,
+			NULLIF(b.metadata, '')::jsonb->'templating' as templating
 		FROM
 			msgs_broadcast b
 		WHERE
 			b.schedule_id = s.id
-	) sb) as broadcast,
-	(SELECT ROW_TO_JSON(st) FROM (
+	) sb),
+	'start', (SELECT ROW_TO_JSON(st) FROM (
 		SELECT
 			t.id as id,
 			s.org_id as org_id,
@@ -260,7 +454,8 @@ SELECT ROW_TO_JSON(s) FROM (SELECT
 			t.schedule_id = s.id AND
 			t.is_active = TRUE AND
 			t.is_archived = FALSE
-	) st) as start
+	) st)
+)
 FROM
 	schedules_schedule s JOIN
 	orgs_org o ON s.org_id = o.id
@@ -269,7 +464,6 @@ WHERE
 	s.next_fire < NOW()
 ORDER BY
     s.next_fire ASC
-) s;
 `
 
 // GetUnfiredSchedules returns all unfired schedules
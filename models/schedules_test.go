@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/goflow/assets"
 	"github.com/nyaruka/goflow/envs"
 	"github.com/nyaruka/mailroom/testsuite"
 	"github.com/nyaruka/null"
@@ -27,8 +28,8 @@ func TestGetExpired(t *testing.T) {
 	var b1 BroadcastID
 	err = db.Get(
 		&b1,
-		`INSERT INTO msgs_broadcast(status, text, base_language, is_active, created_on, modified_on, send_all, created_by_id, modified_by_id, org_id, schedule_id)
-			VALUES('P', hstore(ARRAY['eng','Test message', 'fra', 'Un Message']), 'eng', TRUE, NOW(), NOW(), TRUE, 1, 1, $1, $2) RETURNING id`,
+		`INSERT INTO msgs_broadcast(status, text, base_language, is_active, created_on, modified_on, send_all, created_by_id, modified_by_id, org_id, schedule_id, metadata)
+			VALUES('P', hstore(ARRAY['eng','Test message', 'fra', 'Un Message']), 'eng', TRUE, NOW(), NOW(), TRUE, 1, 1, $1, $2, '{"delivery_window": {"start": "08:00", "end": "20:00"}, "templating": {"template": {"uuid": "9c22b594-fcab-4b29-9bcb-ce4404894a80", "name": "revive_issue"}, "variables": ["@contact.name"]}}') RETURNING id`,
 		Org1, s1,
 	)
 	assert.NoError(t, err)
@@ -86,6 +87,15 @@ func TestGetExpired(t *testing.T) {
 	assert.NotNil(t, schedules[0].s.NextFire)
 	assert.Nil(t, schedules[0].s.LastFire)
 
+	// our schema doesn't have the newer schedule columns so they're read as unset and we use our org's timezone
+	assert.Nil(t, schedules[0].s.FireCount)
+	assert.Nil(t, schedules[0].s.MaxFires)
+	assert.Nil(t, schedules[0].s.EndDate)
+	assert.False(t, schedules[0].HasTimezone())
+	tz, err := schedules[0].Timezone()
+	assert.NoError(t, err)
+	assert.Equal(t, "America/Los_Angeles", tz.String())
+
 	assert.Equal(t, s2, schedules[1].ID())
 	assert.Nil(t, schedules[1].Broadcast())
 	start := schedules[1].FlowStart()
@@ -107,6 +117,9 @@ func TestGetExpired(t *testing.T) {
 	assert.Equal(t, []ContactID{CathyID, GeorgeID}, bcast.ContactIDs())
 	assert.Equal(t, []GroupID{DoctorsGroupID}, bcast.GroupIDs())
 	assert.Equal(t, []urns.URN{urns.URN("tel:+16055741111?id=10000")}, bcast.URNs())
+	assert.Equal(t, &DeliveryWindow{Start: "08:00", End: "20:00"}, bcast.DeliveryWindow())
+	assert.Equal(t, assets.NewTemplateReference("9c22b594-fcab-4b29-9bcb-ce4404894a80", "revive_issue"), bcast.Templating().Template)
+	assert.Equal(t, []string{"@contact.name"}, bcast.Templating().Variables)
 }
 
 func TestNextFire(t *testing.T) {
@@ -131,6 +144,11 @@ func TestNextFire(t *testing.T) {
 		MinuteOfHour *int
 		DayOfMonth   *int
 		DaysOfWeek   null.String
+		WeekOfMonth  *int
+		MonthOfYear  *int
+		Cron         null.String
+		EndDate      *time.Time
+		MaxFires     *int
 		Next         []*time.Time
 		Error        string
 	}{
@@ -218,6 +236,19 @@ func TestNextFire(t *testing.T) {
 				dp(2019, 11, 4, 12, 30, la),
 			},
 		},
+		{
+			Label:        "daily repeat at time skipped by DST start",
+			Now:          time.Date(2019, 3, 9, 3, 0, 0, 0, la),
+			Location:     la,
+			Period:       RepeatPeriodDaily,
+			HourOfDay:    ip(2),
+			MinuteOfHour: ip(30),
+			Next: []*time.Time{
+				dp(2019, 3, 10, 1, 30, la),
+				dp(2019, 3, 11, 2, 30, la),
+				dp(2019, 3, 12, 2, 30, la),
+			},
+		},
 		{
 			Label:        "weekly repeat missing days of week",
 			Now:          time.Date(2019, 8, 20, 13, 57, 0, 0, la),
@@ -278,6 +309,20 @@ func TestNextFire(t *testing.T) {
 			DaysOfWeek:   null.String("MTWRFSU"),
 			Next:         []*time.Time{dp(2019, 3, 10, 12, 30, la)},
 		},
+		{
+			Label:        "weekly repeat at time skipped by DST start",
+			Now:          time.Date(2019, 3, 9, 3, 0, 0, 0, la),
+			Location:     la,
+			Period:       RepeatPeriodWeekly,
+			HourOfDay:    ip(2),
+			MinuteOfHour: ip(30),
+			DaysOfWeek:   null.String("UM"),
+			Next: []*time.Time{
+				dp(2019, 3, 10, 1, 30, la),
+				dp(2019, 3, 11, 2, 30, la),
+				dp(2019, 3, 17, 2, 30, la),
+			},
+		},
 		{
 			Label:        "weekly repeat to day in next week",
 			Now:          time.Date(2019, 8, 20, 13, 57, 0, 0, la),
@@ -362,6 +407,133 @@ func TestNextFire(t *testing.T) {
 			DayOfMonth:   ip(10),
 			Next:         []*time.Time{dp(2019, 3, 10, 12, 30, la)},
 		},
+		{
+			Label:        "monthly repeat on second tuesday",
+			Now:          time.Date(2019, 8, 20, 13, 57, 0, 0, la),
+			Location:     la,
+			Period:       RepeatPeriodMonthly,
+			HourOfDay:    ip(12),
+			MinuteOfHour: ip(35),
+			DaysOfWeek:   null.String("T"),
+			WeekOfMonth:  ip(2),
+			Next: []*time.Time{
+				dp(2019, 9, 10, 12, 35, la),
+				dp(2019, 10, 8, 12, 35, la),
+				dp(2019, 11, 12, 12, 35, la),
+			},
+		},
+		{
+			Label:        "monthly repeat on last friday",
+			Now:          time.Date(2019, 8, 20, 13, 57, 0, 0, la),
+			Location:     la,
+			Period:       RepeatPeriodMonthly,
+			HourOfDay:    ip(12),
+			MinuteOfHour: ip(35),
+			DaysOfWeek:   null.String("F"),
+			WeekOfMonth:  ip(LastWeekOfMonth),
+			Next: []*time.Time{
+				dp(2019, 8, 30, 12, 35, la),
+				dp(2019, 9, 27, 12, 35, la),
+				dp(2019, 10, 25, 12, 35, la),
+			},
+		},
+		{
+			Label:        "monthly repeat on week of month with several days",
+			Now:          time.Date(2019, 8, 20, 13, 57, 0, 0, la),
+			Location:     la,
+			Period:       RepeatPeriodMonthly,
+			HourOfDay:    ip(12),
+			MinuteOfHour: ip(35),
+			DaysOfWeek:   null.String("TF"),
+			WeekOfMonth:  ip(2),
+			Next:         []*time.Time{nil},
+			Error:        "schedule 0 repeats on a week of the month but doesn't have a single repeat_days_of_week",
+		},
+		{
+			Label:        "yearly repeat on leap day",
+			Now:          time.Date(2019, 8, 20, 13, 57, 0, 0, la),
+			Location:     la,
+			Period:       RepeatPeriodYearly,
+			HourOfDay:    ip(12),
+			MinuteOfHour: ip(0),
+			DayOfMonth:   ip(29),
+			MonthOfYear:  ip(2),
+			Next: []*time.Time{
+				dp(2020, 2, 29, 12, 0, la),
+				dp(2021, 2, 28, 12, 0, la),
+				dp(2022, 2, 28, 12, 0, la),
+			},
+		},
+		{
+			Label:        "yearly repeat later this year",
+			Now:          time.Date(2019, 8, 20, 13, 57, 0, 0, la),
+			Location:     la,
+			Period:       RepeatPeriodYearly,
+			HourOfDay:    ip(9),
+			MinuteOfHour: ip(0),
+			DayOfMonth:   ip(25),
+			MonthOfYear:  ip(12),
+			Next:         []*time.Time{dp(2019, 12, 25, 9, 0, la), dp(2020, 12, 25, 9, 0, la)},
+		},
+		{
+			Label:        "yearly repeat with no month",
+			Now:          time.Date(2019, 8, 20, 13, 57, 0, 0, la),
+			Location:     la,
+			Period:       RepeatPeriodYearly,
+			HourOfDay:    ip(9),
+			MinuteOfHour: ip(0),
+			DayOfMonth:   ip(25),
+			Next:         []*time.Time{nil},
+			Error:        "schedule 0 repeats yearly but has no repeat_month_of_year or repeat_day_of_month",
+		},
+		{
+			Label:    "cron repeat on weekday mornings",
+			Now:      time.Date(2019, 8, 23, 10, 0, 0, 0, la),
+			Location: la,
+			Period:   RepeatPeriodCron,
+			Cron:     null.String("30 9 * * MON-FRI"),
+			Next: []*time.Time{
+				dp(2019, 8, 26, 9, 30, la),
+				dp(2019, 8, 27, 9, 30, la),
+			},
+		},
+		{
+			Label:    "cron repeat with no expression",
+			Now:      time.Date(2019, 8, 23, 10, 0, 0, 0, la),
+			Location: la,
+			Period:   RepeatPeriodCron,
+			Next:     []*time.Time{nil},
+			Error:    "schedule 0 repeats by cron but has no repeat_cron",
+		},
+		{
+			Label:    "cron repeat with invalid expression",
+			Now:      time.Date(2019, 8, 23, 10, 0, 0, 0, la),
+			Location: la,
+			Period:   RepeatPeriodCron,
+			Cron:     null.String("61 * * * *"),
+			Next:     []*time.Time{nil},
+			Error:    "schedule 0 has invalid repeat_cron: invalid minute field in cron expression '61 * * * *': '61' is outside of range 0-59",
+		},
+		{
+			Label:        "daily repeat until end date",
+			Now:          time.Date(2019, 8, 20, 13, 57, 0, 0, la),
+			Location:     la,
+			Period:       RepeatPeriodDaily,
+			HourOfDay:    ip(12),
+			MinuteOfHour: ip(35),
+			EndDate:      dp(2019, 8, 22, 12, 0, la),
+			Next:         []*time.Time{dp(2019, 8, 21, 12, 35, la), nil},
+		},
+		{
+			Label:        "daily repeat with max fires",
+			Now:          time.Date(2019, 8, 20, 13, 57, 0, 0, la),
+			Location:     la,
+			Period:       RepeatPeriodDaily,
+			HourOfDay:    ip(12),
+			MinuteOfHour: ip(35),
+			MaxFires:     ip(3),
+			Next:         []*time.Time{dp(2019, 8, 21, 12, 35, la), dp(2019, 8, 22, 12, 35, la), nil},
+		},
 	}
 
 tests:
@@ -374,6 +546,14 @@ tests:
 		s.MinuteOfHour = tc.MinuteOfHour
 		s.DayOfMonth = tc.DayOfMonth
 		s.DaysOfWeek = tc.DaysOfWeek
+		s.WeekOfMonth = tc.WeekOfMonth
+		s.MonthOfYear = tc.MonthOfYear
+		s.Cron = tc.Cron
+		s.EndDate = tc.EndDate
+		s.MaxFires = tc.MaxFires
+
+		fireCount := 0
+		s.FireCount = &fireCount
 
 		now := tc.Now
 
@@ -392,6 +572,77 @@ tests:
 			if n != nil {
 				now = *n
 			}
+			fireCount++
+		}
+	}
+}
+
+func TestSchedulePreview(t *testing.T) {
+	la, err := time.LoadLocation("America/Los_Angeles")
+	assert.NoError(t, err)
+
+	tcs := []struct {
+		Schedule string
+		After    time.Time
+		Count    int
+		Fires    []*ScheduleFire
+	}{
+		{
+			Schedule: `{"repeat_period": "D", "repeat_hour_of_day": 2, "repeat_minute_of_hour": 30}`,
+			After:    time.Date(2019, 3, 9, 3, 0, 0, 0, la),
+			Count:    3,
+			Fires: []*ScheduleFire{
+				{Time: time.Date(2019, 3, 10, 1, 30, 0, 0, la), DSTSkipped: true},
+				{Time: time.Date(2019, 3, 11, 2, 30, 0, 0, la)},
+				{Time: time.Date(2019, 3, 12, 2, 30, 0, 0, la)},
+			},
+		},
+		{
+			Schedule: `{"repeat_period": "M", "repeat_hour_of_day": 12, "repeat_minute_of_hour": 0, "repeat_day_of_month": 31}`,
+			After:    time.Date(2019, 8, 20, 13, 57, 0, 0, la),
+			Count:    3,
+			Fires: []*ScheduleFire{
+				{Time: time.Date(2019, 8, 31, 12, 0, 0, 0, la)},
+				{Time: time.Date(2019, 9, 30, 12, 0, 0, 0, la), Clamped: true},
+				{Time: time.Date(2019, 10, 31, 12, 0, 0, 0, la)},
+			},
+		},
+		{
+			Schedule: `{"repeat_period": "W", "repeat_hour_of_day": 9, "repeat_minute_of_hour": 15, "repeat_days_of_week": "MF", "max_fires": 3, "fire_count": 1}`,
+			After:    time.Date(2019, 8, 20, 13, 57, 0, 0, la),
+			Count:    5,
+			Fires: []*ScheduleFire{
+				{Time: time.Date(2019, 8, 23, 9, 15, 0, 0, la)},
+				{Time: time.Date(2019, 8, 26, 9, 15, 0, 0, la)},
+			},
+		},
+		{
+			Schedule: `{"repeat_period": "O"}`,
+			After:    time.Date(2019, 8, 20, 13, 57, 0, 0, la),
+			Count:    5,
+			Fires:    []*ScheduleFire{},
+		},
+	}
+
+	for _, tc := range tcs {
+		sched := &Schedule{}
+		assert.NoError(t, sched.UnmarshalJSON([]byte(tc.Schedule)))
+
+		fireCount := sched.s.FireCount
+
+		fires, err := sched.Preview(la, tc.After, tc.Count)
+		assert.NoError(t, err)
+		assert.Equal(t, len(tc.Fires), len(fires), "fire count mismatch for schedule: %s", tc.Schedule)
+
+		for i := range tc.Fires {
+			if i < len(fires) {
+				assert.True(t, tc.Fires[i].Time.Equal(fires[i].Time), "fire time mismatch for schedule: %s, expected %s, got %s", tc.Schedule, tc.Fires[i].Time, fires[i].Time)
+				assert.Equal(t, tc.Fires[i].Clamped, fires[i].Clamped, "clamped mismatch for schedule: %s", tc.Schedule)
+				assert.Equal(t, tc.Fires[i].DSTSkipped, fires[i].DSTSkipped, "dst skipped mismatch for schedule: %s", tc.Schedule)
+			}
 		}
+
+		// previewing doesn't change our fire count
+		assert.Equal(t, fireCount, sched.s.FireCount)
 	}
 }
@@ -82,6 +82,15 @@ func MarkStartFailed(ctx context.Context, db *sqlx.DB, startID StartID) error {
 	return nil
 }
 
+// StartExclusions are the criteria for contacts which a flow start should skip, even if they are included by its contacts,
+// groups, URNs or query
+type StartExclusions struct {
+	GroupIDs          []GroupID `json:"group_ids,omitempty"`
+	Query             string    `json:"query,omitempty"`
+	NotSeenSinceDays  int       `json:"not_seen_since_days,omitempty"`
+	StartedWithinDays int       `json:"started_within_days,omitempty"`
+}
+
 // FlowStartBatch represents a single flow batch that needs to be started
 type FlowStartBatch struct {
 	b struct {
@@ -111,6 +120,7 @@ func (b *FlowStartBatch) OrgID() OrgID                             { return b.b.
 func (b *FlowStartBatch) CreatedBy() string                        { return b.b.CreatedBy }
 func (b *FlowStartBatch) FlowID() FlowID                           { return b.b.FlowID }
 func (b *FlowStartBatch) ContactIDs() []ContactID                  { return b.b.ContactIDs }
+func (b *FlowStartBatch) SetContactIDs(contactIDs []ContactID)     { b.b.ContactIDs = contactIDs }
 func (b *FlowStartBatch) RestartParticipants() RestartParticipants { return b.b.RestartParticipants }
 func (b *FlowStartBatch) IncludeActive() IncludeActive             { return b.b.IncludeActive }
 func (b *FlowStartBatch) IsLast() bool                             { return b.b.IsLast }
@@ -140,6 +150,10 @@ type FlowStart struct {
 
 		CreateContact bool `json:"create_contact"`
 
+		Exclusions *StartExclusions `json:"exclusions,omitempty"`
+
+		ContactsPerMinute int `json:"contacts_per_minute,omitempty"`
+
 		RestartParticipants RestartParticipants `json:"restart_participants" db:"restart_participants"`
 		IncludeActive       IncludeActive       `json:"include_active"       db:"include_active"`
 
@@ -189,6 +203,19 @@ func (s *FlowStart) WithCreateContact(create bool) *FlowStart {
 	return s
 }
 
+func (s *FlowStart) Exclusions() *StartExclusions { return s.s.Exclusions }
+func (s *FlowStart) WithExclusions(exclusions *StartExclusions) *FlowStart {
+	s.s.Exclusions = exclusions
+	return s
+}
+
+// ContactsPerMinute returns the maximum rate at which contacts should be started, or zero if the start isn't throttled
+func (s *FlowStart) ContactsPerMinute() int { return s.s.ContactsPerMinute }
+func (s *FlowStart) WithContactsPerMinute(rate int) *FlowStart {
+	s.s.ContactsPerMinute = rate
+	return s
+}
+
 func (s *FlowStart) ParentSummary() json.RawMessage { return json.RawMessage(s.s.ParentSummary) }
 func (s *FlowStart) WithParentSummary(sum json.RawMessage) *FlowStart {
 	s.s.ParentSummary = null.JSON(sum)
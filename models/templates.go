@@ -7,6 +7,7 @@ import (
 
 	"github.com/nyaruka/goflow/assets"
 	"github.com/nyaruka/goflow/envs"
+	"github.com/nyaruka/goflow/flows"
 	"github.com/nyaruka/null"
 
 	"github.com/jmoiron/sqlx"
@@ -60,6 +61,35 @@ func (t *TemplateTranslation) Country() envs.Country            { return envs.Co
 func (t *TemplateTranslation) Content() string                  { return t.t.Content }
 func (t *TemplateTranslation) VariableCount() int               { return t.t.VariableCount }
 
+// BroadcastTemplating is the message template a broadcast should be sent with. Variables may contain expressions which are
+// evaluated for each contact in the same way as the broadcast text.
+type BroadcastTemplating struct {
+	Template  *assets.TemplateReference `json:"template"  validate:"required"`
+	Variables []string                  `json:"variables"`
+}
+
+// Match returns the approved translation of this template for the passed in contact and channel, trying the contact's
+// locale then the org's default locale, or nil if there is none which the passed in evaluated variables can fill in
+func (t *BroadcastTemplating) Match(oa *OrgAssets, contact *flows.Contact, channel *Channel, variables []string) *flows.TemplateTranslation {
+	locales := []envs.Locale{
+		contact.Locale(oa.Env()),
+		oa.Env().DefaultLocale(),
+	}
+
+	translation := oa.SessionAssets().Templates().FindTranslation(t.Template.UUID, channel.ChannelReference(), locales)
+	if translation == nil || len(variables) != translation.VariableCount() {
+		return nil
+	}
+
+	// channels reject templates with empty variables
+	for _, v := range variables {
+		if v == "" {
+			return nil
+		}
+	}
+	return translation
+}
+
 // loads the templates for the passed in org
 func loadTemplates(ctx context.Context, db sqlx.Queryer, orgID OrgID) ([]assets.Template, error) {
 	start := time.Now()
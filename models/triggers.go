@@ -2,8 +2,10 @@ package models
 
 import (
 	"context"
+	"regexp"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/nyaruka/goflow/flows"
 	"github.com/nyaruka/goflow/flows/triggers"
@@ -37,8 +39,17 @@ const (
 
 // match type constants
 const (
-	MatchFirst = "F"
-	MatchOnly  = "O"
+	MatchFirst  = "F"
+	MatchOnly   = "O"
+	MatchPhrase = "P"
+	MatchRegex  = "R"
+)
+
+const (
+	configKeywordEditDistance = "keyword_edit_distance"
+
+	// fuzzy matching only applies to keywords with more than this many characters per allowed edit
+	fuzzyCharsPerEdit = 3
 )
 
 // NilTriggerID is the nil value for trigger IDs
@@ -57,6 +68,10 @@ type Trigger struct {
 		GroupIDs    []GroupID   `json:"group_ids"`
 		ContactIDs  []ContactID `json:"contact_ids,omitempty"`
 	}
+
+	// the words of a phrase trigger and the compiled pattern of a regex trigger
+	phrase []string
+	regex  *regexp.Regexp
 }
 
 // ID returns the id of this trigger
@@ -71,7 +86,8 @@ func (t *Trigger) ReferrerID() string       { return t.t.ReferrerID }
 func (t *Trigger) GroupIDs() []GroupID      { return t.t.GroupIDs }
 func (t *Trigger) ContactIDs() []ContactID  { return t.t.ContactIDs }
 func (t *Trigger) KeywordMatchType() triggers.KeywordMatchType {
-	if t.t.MatchType == MatchFirst {
+	// phrases are matched against the first words of messages
+	if t.t.MatchType == MatchFirst || t.t.MatchType == MatchPhrase {
 		return triggers.KeywordMatchTypeFirstWord
 	}
 	return triggers.KeywordMatchTypeOnlyWord
@@ -79,7 +95,8 @@ func (t *Trigger) KeywordMatchType() triggers.KeywordMatchType {
 
 // Match returns the match for this trigger, if any
 func (t *Trigger) Match() *triggers.KeywordMatch {
-	if t.Keyword() != "" {
+	// the keyword of a regex trigger is a pattern rather than a keyword the message matched
+	if t.Keyword() != "" && t.MatchType() != MatchRegex {
 		return &triggers.KeywordMatch{
 			Type:    t.KeywordMatchType(),
 			Keyword: t.Keyword(),
@@ -105,6 +122,7 @@ func loadTriggers(ctx context.Context, db *sqlx.DB, orgID OrgID) ([]*Trigger, er
 		if err != nil {
 			return nil, errors.Wrap(err, "error scanning label row")
 		}
+		trigger.prepare()
 		triggers = append(triggers, trigger)
 	}
 
@@ -113,6 +131,31 @@ func loadTriggers(ctx context.Context, db *sqlx.DB, orgID OrgID) ([]*Trigger, er
 	return triggers, nil
 }
 
+// prepare parses the keyword of a phrase or regex trigger so it doesn't need parsing for every message
+func (t *Trigger) prepare() {
+	switch t.t.MatchType {
+	case MatchPhrase:
+		t.phrase = lowerWords(t.t.Keyword)
+	case MatchRegex:
+		regex, err := regexp.Compile("(?i)" + t.t.Keyword)
+		if err != nil {
+			logrus.WithError(err).WithField("trigger_id", t.t.ID).Warn("ignoring trigger with invalid regex")
+			return
+		}
+		t.regex = regex
+	}
+}
+
+// KeywordEditDistance returns how many edits a keyword in a message can be from a keyword trigger and still match it,
+// zero meaning that keywords must match exactly
+func (o *Org) KeywordEditDistance() int {
+	distance, _ := o.o.Config.Get(configKeywordEditDistance, 0.0).(float64)
+	if distance <= 0 {
+		return 0
+	}
+	return int(distance)
+}
+
 // FindMatchingNewConversationTrigger returns the matching trigger for the passed in trigger type
 func FindMatchingNewConversationTrigger(org *OrgAssets, channel *Channel) *Trigger {
 	var match *Trigger
@@ -204,51 +247,81 @@ func FindMatchingReferralTrigger(org *OrgAssets, channel *Channel, referrerID st
 	return match
 }
 
-// FindMatchingMsgTrigger returns the matching trigger (if any) for the passed in text and channel id
+// quality of keyword trigger matches, only used to pick between equally scoped triggers. Exact matches beat first word
+// matches which beat regex matches which beat fuzzy matches. Phrases rank as first word matches plus one for each
+// extra word matched, so a phrase beats a single keyword when its extra words match too.
+const (
+	matchQualityOnly  = 5000
+	matchQualityFirst = 4000
+	matchQualityRegex = 2000
+	matchQualityFuzzy = 1000
+)
+
+// scope of keyword triggers, group scoped triggers beat channel scoped triggers which beat unscoped triggers, however
+// well they match
+const (
+	matchScopeGroup   = 2
+	matchScopeChannel = 1
+)
+
+// FindMatchingMsgTrigger returns the best matching trigger (if any) for the passed in text, sent to the passed
+// in channel. If channel is nil, triggers aren't filtered by channel.
 // TODO: with a different structure this could probably be a lot faster.. IE, we could have a map
 // of list of triggers by keyword that is built when we load the triggers, then just evaluate against that.
-func FindMatchingMsgTrigger(org *OrgAssets, contact *flows.Contact, text string) *Trigger {
+func FindMatchingMsgTrigger(org *OrgAssets, channel *Channel, contact *flows.Contact, text string) *Trigger {
 	// build a set of the groups this contact is in
 	groupIDs := make(map[GroupID]bool, 10)
 	for _, g := range contact.Groups().All() {
 		groupIDs[g.Asset().(*Group).ID()] = true
 	}
 
-	// determine our message keyword
-	words := utils.TokenizeString(text)
-	keyword := ""
-	only := false
-	if len(words) > 0 {
-		// our keyword is our first word
-		keyword = strings.ToLower(words[0])
-		only = len(words) == 1
-	}
+	words := lowerWords(text)
+	editDistance := org.Org().KeywordEditDistance()
 
 	var match, catchAll, groupCatchAll *Trigger
+	bestScope, bestQuality := 0, 0
+
 	for _, t := range org.Triggers() {
+		// triggers for other channels never match
+		if channel != nil && t.ChannelID() != NilChannelID && t.ChannelID() != channel.ID() {
+			continue
+		}
+
 		if t.TriggerType() == KeywordTriggerType {
-			// does this match based on the rules of the trigger?
-			matched := (t.Keyword() == keyword && (t.MatchType() == MatchFirst || (t.MatchType() == MatchOnly && only)))
+			// does this match based on the rules of the trigger? and if so how closely?
+			quality := t.matchQuality(text, words, editDistance)
 
 			// no match? move on
-			if !matched {
+			if quality == 0 {
 				continue
 			}
 
-			// this trigger has no groups, it's a match!
-			if len(t.GroupIDs()) == 0 {
-				if match == nil {
-					match = t
+			scope := 0
+
+			// if this trigger has groups, we must be part of one of them
+			if len(t.GroupIDs()) > 0 {
+				inGroup := false
+				for _, g := range t.GroupIDs() {
+					if groupIDs[g] {
+						inGroup = true
+						break
+					}
 				}
-				continue
+				if !inGroup {
+					continue
+				}
+				scope += matchScopeGroup
 			}
 
-			// test whether we are part of this trigger's group
-			for _, g := range t.GroupIDs() {
-				if groupIDs[g] {
-					// group keyword matches always take precedence, can return right away
-					return t
-				}
+			// channel scoped triggers are only more specific if we know the channel they matched
+			if channel != nil && t.ChannelID() != NilChannelID {
+				scope += matchScopeChannel
+			}
+
+			// more specifically scoped triggers win, then better matches, and for equal triggers, the first wins
+			if scope > bestScope || (scope == bestScope && quality > bestQuality) {
+				match = t
+				bestScope, bestQuality = scope, quality
 			}
 		} else if t.TriggerType() == CatchallTriggerType {
 			// if this catch all is on no groups, save it as our catch all
@@ -285,6 +358,94 @@ func FindMatchingMsgTrigger(org *OrgAssets, contact *flows.Contact, text string)
 	return catchAll
 }
 
+// matchQuality returns how well this keyword trigger matches the passed in message text and its lowercase words, or zero
+// if it doesn't match
+func (t *Trigger) matchQuality(text string, words []string, editDistance int) int {
+	switch t.MatchType() {
+	case MatchFirst, MatchOnly:
+		if len(words) == 0 || (t.MatchType() == MatchOnly && len(words) > 1) {
+			return 0
+		}
+
+		base := matchQualityFirst
+		if t.MatchType() == MatchOnly {
+			base = matchQualityOnly
+		}
+
+		if words[0] == t.Keyword() {
+			return base
+		}
+
+		// allow misspellings of longer keywords if the org wants that, closer misspellings being more specific
+		if editDistance > 0 && utf8.RuneCountInString(t.Keyword()) > editDistance*fuzzyCharsPerEdit {
+			if distance := editDistanceBetween(words[0], t.Keyword()); distance <= editDistance {
+				return matchQualityFuzzy - distance
+			}
+		}
+
+	case MatchPhrase:
+		if len(t.phrase) == 0 || len(words) < len(t.phrase) {
+			return 0
+		}
+		for i, w := range t.phrase {
+			if words[i] != w {
+				return 0
+			}
+		}
+
+		// longer phrases are more specific
+		return matchQualityFirst + len(t.phrase) - 1
+
+	case MatchRegex:
+		if t.regex != nil && t.regex.MatchString(strings.TrimSpace(text)) {
+			return matchQualityRegex
+		}
+	}
+
+	return 0
+}
+
+// lowerWords tokenizes the passed in text into lowercase words
+func lowerWords(text string) []string {
+	words := utils.TokenizeString(text)
+	for i := range words {
+		words[i] = strings.ToLower(words[i])
+	}
+	return words
+}
+
+// editDistanceBetween returns the Levenshtein distance between the two passed in strings
+func editDistanceBetween(s1 string, s2 string) int {
+	r1, r2 := []rune(s1), []rune(s2)
+
+	prev := make([]int, len(r2)+1)
+	curr := make([]int, len(r2)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(r1); i++ {
+		curr[0] = i
+		for j := 1; j <= len(r2); j++ {
+			cost := 1
+			if r1[i-1] == r2[j-1] {
+				cost = 0
+			}
+			curr[j] = minInt(minInt(prev[j]+1, curr[j-1]+1), prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+
+	return prev[len(r2)]
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
 const selectTriggersSQL = `
 SELECT ROW_TO_JSON(r) FROM (SELECT
 	t.id as id, 
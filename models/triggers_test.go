@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/goflow/flows/triggers"
 	"github.com/nyaruka/mailroom/testsuite"
 
 	"github.com/jmoiron/sqlx"
@@ -80,10 +81,20 @@ func TestTriggers(t *testing.T) {
 	ctx := testsuite.CTX()
 
 	joinID := insertTrigger(t, db, true, FavoritesFlowID, KeywordTriggerType, "join", MatchFirst, nil, nil, "", NilChannelID)
+	joinOnlyID := insertTrigger(t, db, true, FavoritesFlowID, KeywordTriggerType, "join", MatchOnly, nil, nil, "", NilChannelID)
+	doctorsJoinID := insertTrigger(t, db, true, SingleMessageFlowID, KeywordTriggerType, "join", MatchFirst, []GroupID{DoctorsGroupID}, nil, "", NilChannelID)
 	resistID := insertTrigger(t, db, true, SingleMessageFlowID, KeywordTriggerType, "resist", MatchOnly, nil, nil, "", NilChannelID)
 	farmersID := insertTrigger(t, db, true, SingleMessageFlowID, KeywordTriggerType, "resist", MatchOnly, []GroupID{DoctorsGroupID}, nil, "", NilChannelID)
 	farmersAllID := insertTrigger(t, db, true, SingleMessageFlowID, CatchallTriggerType, "", MatchOnly, []GroupID{DoctorsGroupID}, nil, "", NilChannelID)
 	othersAllID := insertTrigger(t, db, true, SingleMessageFlowID, CatchallTriggerType, "", MatchOnly, nil, nil, "", NilChannelID)
+	orderID := insertTrigger(t, db, true, FavoritesFlowID, KeywordTriggerType, `^order \d+$`, MatchRegex, nil, nil, "", NilChannelID)
+	stopID := insertTrigger(t, db, true, FavoritesFlowID, KeywordTriggerType, "stop", MatchFirst, nil, nil, "", NilChannelID)
+	stopAllID := insertTrigger(t, db, true, SingleMessageFlowID, KeywordTriggerType, "stop all", MatchPhrase, nil, nil, "", NilChannelID)
+	doctorsStopID := insertTrigger(t, db, true, SingleMessageFlowID, KeywordTriggerType, `^stop`, MatchRegex, []GroupID{DoctorsGroupID}, nil, "", NilChannelID)
+	endAllID := insertTrigger(t, db, true, SingleMessageFlowID, KeywordTriggerType, "end all", MatchPhrase, nil, nil, "", NilChannelID)
+	endAllNowID := insertTrigger(t, db, true, SingleMessageFlowID, KeywordTriggerType, "end all now", MatchPhrase, nil, nil, "", NilChannelID)
+	twitterJoinID := insertTrigger(t, db, true, SingleMessageFlowID, KeywordTriggerType, "join", MatchFirst, nil, nil, "", TwitterChannelID)
+	insertTrigger(t, db, true, SingleMessageFlowID, KeywordTriggerType, "(unclosed", MatchRegex, nil, nil, "", NilChannelID)
 
 	FlushCache()
 
@@ -100,26 +111,48 @@ func TestTriggers(t *testing.T) {
 	george, err := contacts[1].FlowContact(org)
 	assert.NoError(t, err)
 
+	twilio := org.ChannelByID(TwilioChannelID)
+	twitter := org.ChannelByID(TwitterChannelID)
+
 	tcs := []struct {
 		Text      string
+		Channel   *Channel
 		Contact   *flows.Contact
 		TriggerID TriggerID
 	}{
-		{"join", cathy, joinID},
-		{"join this", cathy, joinID},
-		{"resist", george, resistID},
-		{"resist", cathy, farmersID},
-		{"resist this", cathy, farmersAllID},
-		{"other", cathy, farmersAllID},
-		{"other", george, othersAllID},
-		{"", george, othersAllID},
+		{"join", nil, cathy, doctorsJoinID},
+		{"join this", nil, cathy, doctorsJoinID},
+		{"join", twitter, cathy, doctorsJoinID},
+		{"join", nil, george, joinOnlyID},
+		{"join this", nil, george, joinID},
+		{"join", twilio, george, joinOnlyID},
+		{"join", twitter, george, twitterJoinID},
+		{"resist", nil, george, resistID},
+		{"resist", nil, cathy, farmersID},
+		{"resist this", nil, cathy, farmersAllID},
+		{"other", nil, cathy, farmersAllID},
+		{"other", nil, george, othersAllID},
+		{"", nil, george, othersAllID},
+		{"Order 123", nil, george, orderID},
+		{"order 123 please", nil, george, othersAllID},
+		{"(unclosed", nil, george, othersAllID},
+		{"stop", nil, george, stopID},
+		{"stop it", nil, george, stopID},
+		{"Stop all", nil, george, stopAllID},
+		{"stop all", nil, cathy, doctorsStopID},
+		{"stop", nil, cathy, doctorsStopID},
+		{"stopping", nil, cathy, doctorsStopID},
+		{"stopping", nil, george, othersAllID},
+		{"End all", nil, george, endAllID},
+		{"end all now please", nil, george, endAllNowID},
+		{"end, all!", nil, george, endAllID},
 	}
 
 	for _, tc := range tcs {
 		testID := fmt.Sprintf("'%s' sent by %s", tc.Text, tc.Contact.Name())
 
 		actualTriggerID := NilTriggerID
-		actualTrigger := FindMatchingMsgTrigger(org, tc.Contact, tc.Text)
+		actualTrigger := FindMatchingMsgTrigger(org, tc.Channel, tc.Contact, tc.Text)
 		if actualTrigger != nil {
 			actualTriggerID = actualTrigger.ID()
 		}
@@ -156,3 +189,83 @@ func TestArchiveContactTriggers(t *testing.T) {
 	assertTriggerArchived(cathyAndGroupID, false)
 	assertTriggerArchived(georgeOnlyID, false)
 }
+
+func TestTriggerMatch(t *testing.T) {
+	tcs := []struct {
+		Keyword   string
+		MatchType MatchType
+		Expected  *triggers.KeywordMatch
+	}{
+		{"join", MatchFirst, &triggers.KeywordMatch{Type: triggers.KeywordMatchTypeFirstWord, Keyword: "join"}},
+		{"join", MatchOnly, &triggers.KeywordMatch{Type: triggers.KeywordMatchTypeOnlyWord, Keyword: "join"}},
+		{"stop all", MatchPhrase, &triggers.KeywordMatch{Type: triggers.KeywordMatchTypeFirstWord, Keyword: "stop all"}},
+		{`^order \d+$`, MatchRegex, nil},
+		{"", MatchFirst, nil},
+	}
+
+	for _, tc := range tcs {
+		trigger := &Trigger{}
+		trigger.t.TriggerType = KeywordTriggerType
+		trigger.t.Keyword = tc.Keyword
+		trigger.t.MatchType = tc.MatchType
+
+		assert.Equal(t, tc.Expected, trigger.Match(), "match mismatch for %s trigger '%s'", tc.MatchType, tc.Keyword)
+	}
+}
+
+func TestTriggerMatchQuality(t *testing.T) {
+	newTrigger := func(keyword string, matchType MatchType) *Trigger {
+		trigger := &Trigger{}
+		trigger.t.TriggerType = KeywordTriggerType
+		trigger.t.Keyword = keyword
+		trigger.t.MatchType = matchType
+		trigger.prepare()
+		return trigger
+	}
+
+	tcs := []struct {
+		Keyword      string
+		MatchType    MatchType
+		Text         string
+		EditDistance int
+		Expected     int
+	}{
+		{"join", MatchFirst, "join", 0, matchQualityFirst},
+		{"join", MatchFirst, "join now", 0, matchQualityFirst},
+		{"join", MatchFirst, "", 0, 0},
+		{"join", MatchOnly, "JOIN", 0, matchQualityOnly},
+		{"join", MatchOnly, "join now", 0, 0},
+		{"join", MatchFirst, "jion", 1, 0}, // too short to allow an edit
+		{"register", MatchFirst, "regster", 1, matchQualityFuzzy - 1},
+		{"register", MatchFirst, "regster", 0, 0},
+		{"register", MatchFirst, "rgstr", 2, 0},
+		{"register", MatchOnly, "registr", 2, matchQualityFuzzy - 1},
+		{"register", MatchOnly, "registr now", 2, 0},
+		{"stop all", MatchPhrase, "stop all", 0, matchQualityFirst + 1},
+		{"stop all", MatchPhrase, "STOP ALL messages", 0, matchQualityFirst + 1},
+		{"stop", MatchPhrase, "stop all", 0, matchQualityFirst},
+		{"stop all", MatchPhrase, "stop", 0, 0},
+		{"stop all", MatchPhrase, "please stop all", 0, 0},
+		{"", MatchPhrase, "stop", 0, 0},
+		{`^order \d+$`, MatchRegex, " Order 12 ", 0, matchQualityRegex},
+		{`^order \d+$`, MatchRegex, "order twelve", 0, 0},
+		{`(unclosed`, MatchRegex, "(unclosed", 0, 0},
+	}
+
+	for _, tc := range tcs {
+		trigger := newTrigger(tc.Keyword, tc.MatchType)
+		actual := trigger.matchQuality(tc.Text, lowerWords(tc.Text), tc.EditDistance)
+
+		assert.Equal(t, tc.Expected, actual, "quality mismatch for %s trigger '%s' and text '%s'", tc.MatchType, tc.Keyword, tc.Text)
+	}
+}
+
+func TestEditDistanceBetween(t *testing.T) {
+	assert.Equal(t, 0, editDistanceBetween("", ""))
+	assert.Equal(t, 3, editDistanceBetween("abc", ""))
+	assert.Equal(t, 0, editDistanceBetween("join", "join"))
+	assert.Equal(t, 1, editDistanceBetween("regster", "register"))
+	assert.Equal(t, 2, editDistanceBetween("jion", "join"))
+	assert.Equal(t, 3, editDistanceBetween("kitten", "sitting"))
+	assert.Equal(t, 1, editDistanceBetween("café", "cafe"))
+}
@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"gopkg.in/go-playground/validator.v9"
@@ -89,6 +90,32 @@ func Exec(ctx context.Context, label string, tx Queryer, sql string, args ...int
 	return nil
 }
 
+// max number of contact ids we pass to a single overlap query
+const overlapBatchSize = 10000
+
+// selectContactOverlap runs the passed in query, whose first argument is an array of contact ids, against the passed in
+// contacts in batches of overlapBatchSize, returning the combined contact ids selected
+func selectContactOverlap(ctx context.Context, db *sqlx.DB, query string, contacts []ContactID, args ...interface{}) ([]ContactID, error) {
+	overlap := make([]ContactID, 0)
+
+	for len(contacts) > 0 {
+		batch := contacts
+		if len(batch) > overlapBatchSize {
+			batch = batch[:overlapBatchSize]
+		}
+		contacts = contacts[len(batch):]
+
+		var batchOverlap []ContactID
+		err := db.SelectContext(ctx, &batchOverlap, query, append([]interface{}{pq.Array(batch)}, args...)...)
+		if err != nil {
+			return nil, err
+		}
+		overlap = append(overlap, batchOverlap...)
+	}
+
+	return overlap, nil
+}
+
 // BulkSQL runs the SQL passed in for the passed in interfaces, replacing any variables in the SQL as needed
 func BulkSQL(ctx context.Context, label string, tx Queryer, sql string, vs []interface{}) error {
 	// no values, nothing to do
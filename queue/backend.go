@@ -0,0 +1,132 @@
+package queue
+
+import (
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Backend is the interface for a store of queued tasks which workers pop tasks from
+type Backend interface {
+	// AddTask adds the passed in task to the named queue for execution
+	AddTask(queue string, taskType string, orgID int, task interface{}, priority Priority) error
+
+	// AddUniqueTask adds the passed in task to the named queue unless a task with the same dedup key was added within
+	// the window, returning whether it was added
+	AddUniqueTask(queue string, taskType string, orgID int, task interface{}, priority Priority, dedupKey string, window time.Duration) (bool, error)
+
+	// AddDelayedTask adds the passed in task to the named queue to be executed at the passed in time
+	AddDelayedTask(queue string, taskType string, orgID int, task interface{}, runAt time.Time) error
+
+	// PopNextTask pops the next task off the named queue, claiming it for the passed in owner for the duration of
+	// the lease. It returns nil if there are no tasks to pop.
+	PopNextTask(queue string, owner string, lease time.Duration) (*Task, error)
+
+	// RenewClaim extends the lease on the task claimed by the passed in owner, returning false if it no longer has one
+	RenewClaim(queue string, owner string, lease time.Duration) (bool, error)
+
+	// MarkTaskComplete marks the task claimed by the passed in owner as complete
+	MarkTaskComplete(queue string, owner string, orgID int) error
+
+	// RetryTask schedules the passed in failed task to be retried after the passed in delay
+	RetryTask(queue string, task *Task, delay time.Duration) error
+
+	// DeadLetterTask moves the passed in failed task to the dead letters for the named queue
+	DeadLetterTask(queue string, task *Task, reason string) (int64, error)
+
+	// PromoteDelayedTasks moves delayed tasks which are now due into the named queue
+	PromoteDelayedTasks(queue string) (int, error)
+
+	// ReapExpiredClaims requeues claimed tasks whose leases have expired
+	ReapExpiredClaims(queue string) (int, error)
+
+	// Size returns the number of tasks in the named queue
+	Size(queue string) (int, error)
+}
+
+// RedisBackend is a queue backend which stores tasks in Redis
+type RedisBackend struct {
+	rp *redis.Pool
+}
+
+// NewRedisBackend creates a new Redis queue backend using the passed in pool
+func NewRedisBackend(rp *redis.Pool) *RedisBackend {
+	return &RedisBackend{rp: rp}
+}
+
+// AddTask adds the passed in task to the named queue for execution
+func (b *RedisBackend) AddTask(queue string, taskType string, orgID int, task interface{}, priority Priority) error {
+	rc := b.rp.Get()
+	defer rc.Close()
+	return AddTask(rc, queue, taskType, orgID, task, priority)
+}
+
+// AddUniqueTask adds the passed in task to the named queue unless it is a duplicate within the window
+func (b *RedisBackend) AddUniqueTask(queue string, taskType string, orgID int, task interface{}, priority Priority, dedupKey string, window time.Duration) (bool, error) {
+	rc := b.rp.Get()
+	defer rc.Close()
+	return AddUniqueTask(rc, queue, taskType, orgID, task, priority, dedupKey, window)
+}
+
+// AddDelayedTask adds the passed in task to the named queue to be executed at the passed in time
+func (b *RedisBackend) AddDelayedTask(queue string, taskType string, orgID int, task interface{}, runAt time.Time) error {
+	rc := b.rp.Get()
+	defer rc.Close()
+	return AddDelayedTask(rc, queue, taskType, orgID, task, runAt)
+}
+
+// PopNextTask pops and claims the next task off the named queue
+func (b *RedisBackend) PopNextTask(queue string, owner string, lease time.Duration) (*Task, error) {
+	rc := b.rp.Get()
+	defer rc.Close()
+	return ClaimNextTask(rc, queue, owner, lease)
+}
+
+// RenewClaim extends the lease on the task claimed by the passed in owner
+func (b *RedisBackend) RenewClaim(queue string, owner string, lease time.Duration) (bool, error) {
+	rc := b.rp.Get()
+	defer rc.Close()
+	return RenewClaim(rc, queue, owner, lease)
+}
+
+// MarkTaskComplete marks the task claimed by the passed in owner as complete
+func (b *RedisBackend) MarkTaskComplete(queue string, owner string, orgID int) error {
+	rc := b.rp.Get()
+	defer rc.Close()
+	return MarkClaimedTaskComplete(rc, queue, owner, orgID)
+}
+
+// RetryTask schedules the passed in failed task to be retried after the passed in delay
+func (b *RedisBackend) RetryTask(queue string, task *Task, delay time.Duration) error {
+	rc := b.rp.Get()
+	defer rc.Close()
+	return RetryTask(rc, queue, task, delay)
+}
+
+// DeadLetterTask moves the passed in failed task to the dead letters for the named queue
+func (b *RedisBackend) DeadLetterTask(queue string, task *Task, reason string) (int64, error) {
+	rc := b.rp.Get()
+	defer rc.Close()
+	return DeadLetterTask(rc, queue, task, reason)
+}
+
+// PromoteDelayedTasks moves delayed tasks which are now due into the named queue
+func (b *RedisBackend) PromoteDelayedTasks(queue string) (int, error) {
+	rc := b.rp.Get()
+	defer rc.Close()
+	return PromoteDelayedTasks(rc, queue)
+}
+
+// ReapExpiredClaims requeues claimed tasks whose leases have expired
+func (b *RedisBackend) ReapExpiredClaims(queue string) (int, error) {
+	rc := b.rp.Get()
+	defer rc.Close()
+	return ReapExpiredClaims(rc, queue)
+}
+
+// Size returns the number of tasks in the named queue
+func (b *RedisBackend) Size(queue string) (int, error) {
+	rc := b.rp.Get()
+	defer rc.Close()
+	return Size(rc, queue)
+}
@@ -0,0 +1,126 @@
+package queue
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackends(t *testing.T) {
+	rp := &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", "localhost:6379")
+		},
+	}
+	rc := rp.Get()
+	rc.Do("del", "test:active", "test:workers", "test:1", "test:2", "test:delayed", "test:claims", "test:leases", "test:limits", "test:weights", "test:dedup:bcast:1")
+	rc.Close()
+
+	testBackend(t, NewRedisBackend(rp))
+	testBackend(t, NewMemoryBackend())
+}
+
+func testBackend(t *testing.T, b Backend) {
+	pop := func(owner string) (int, string) {
+		task, err := b.PopNextTask("test", owner, time.Minute)
+		assert.NoError(t, err)
+		if task == nil {
+			return 0, ""
+		}
+		var value string
+		assert.NoError(t, json.Unmarshal(task.Task, &value))
+		return task.OrgID, value
+	}
+
+	assert.NoError(t, b.AddTask("test", "campaign", 1, "task1", DefaultPriority))
+	assert.NoError(t, b.AddTask("test", "campaign", 1, "task2", DefaultPriority))
+	assert.NoError(t, b.AddTask("test", "campaign", 2, "task3", DefaultPriority))
+	assert.NoError(t, b.AddTask("test", "campaign", 2, "task4", HighPriority))
+	assert.NoError(t, b.AddDelayedTask("test", "campaign", 1, "task5", time.Now().Add(-time.Second)))
+	assert.NoError(t, b.AddDelayedTask("test", "campaign", 1, "task6", time.Now().Add(time.Hour)))
+
+	size, err := b.Size("test")
+	assert.NoError(t, err)
+	assert.Equal(t, 4, size)
+
+	count, err := b.PromoteDelayedTasks("test")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	// orgs take turns, with high priority tasks first
+	orgID, value := pop("w1")
+	assert.Equal(t, 1, orgID)
+	assert.Equal(t, "task5", value)
+
+	orgID, value = pop("w2")
+	assert.Equal(t, 2, orgID)
+	assert.Equal(t, "task4", value)
+
+	renewed, err := b.RenewClaim("test", "w1", time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, renewed)
+
+	assert.NoError(t, b.MarkTaskComplete("test", "w1", 1))
+
+	renewed, err = b.RenewClaim("test", "w1", time.Minute)
+	assert.NoError(t, err)
+	assert.False(t, renewed)
+
+	orgID, value = pop("w1")
+	assert.Equal(t, 1, orgID)
+	assert.Equal(t, "task1", value)
+
+	assert.NoError(t, b.MarkTaskComplete("test", "w1", 1))
+	assert.NoError(t, b.MarkTaskComplete("test", "w2", 2))
+
+	size, err = b.Size("test")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, size)
+
+	// retry a failed task, it comes back once due with its error count incremented
+	task, err := b.PopNextTask("test", "w1", time.Minute)
+	assert.NoError(t, err)
+	assert.NoError(t, b.RetryTask("test", task, -time.Second))
+	assert.NoError(t, b.MarkTaskComplete("test", "w1", task.OrgID))
+
+	count, err = b.PromoteDelayedTasks("test")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	size, err = b.Size("test")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, size)
+
+	for i := 0; i < 2; i++ {
+		task, err = b.PopNextTask("test", "w1", time.Minute)
+		assert.NoError(t, err)
+		assert.NoError(t, b.MarkTaskComplete("test", "w1", task.OrgID))
+	}
+
+	task, err = b.PopNextTask("test", "w1", time.Minute)
+	assert.NoError(t, err)
+	assert.Nil(t, task)
+
+	_, err = b.DeadLetterTask("test", &Task{Type: "campaign", OrgID: 1}, "boom")
+	assert.NoError(t, err)
+
+	count, err = b.ReapExpiredClaims("test")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	// a task with a dedup key is only added once within the window
+	added, err := b.AddUniqueTask("test", "send_broadcast", 1, "task7", DefaultPriority, "bcast:1", time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, added)
+
+	added, err = b.AddUniqueTask("test", "send_broadcast", 1, "task7", DefaultPriority, "bcast:1", time.Minute)
+	assert.NoError(t, err)
+	assert.False(t, added)
+
+	size, err = b.Size("test")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, size)
+}
@@ -0,0 +1,183 @@
+package queue
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+const (
+	deadPattern      = "%s:dead"
+	deadTasksPattern = "%s:dead:tasks"
+)
+
+// DeadTask is a task which failed permanently and was moved to the dead letter set for its queue
+type DeadTask struct {
+	ID     int64     `json:"id"`
+	Task   *Task     `json:"task"`
+	Error  string    `json:"error"`
+	DeadOn time.Time `json:"dead_on"`
+}
+
+var deadLetter = redis.NewScript(1, `-- KEYS: [QueueName] ARGV: [Now, Payload]
+	local id = redis.call("incr", KEYS[1] .. ":dead:seq")
+	redis.call("hset", KEYS[1] .. ":dead:tasks", id, ARGV[2])
+	redis.call("zadd", KEYS[1] .. ":dead", ARGV[1], id)
+	return id
+`)
+
+// DeadLetterTask moves the passed in task to the dead letter set for the passed in queue, recording the
+// error which caused it to fail. It returns the id of the new dead task.
+func DeadLetterTask(rc redis.Conn, queue string, task *Task, reason string) (int64, error) {
+	now := time.Now()
+	payload, err := json.Marshal(&DeadTask{Task: task, Error: reason, DeadOn: now})
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := redis.Int64(deadLetter.Do(rc, queue, now.Unix(), payload))
+	if err != nil {
+		return 0, errors.Wrapf(err, "error dead lettering task for: %s", queue)
+	}
+	return id, nil
+}
+
+// DeadSize returns the number of dead tasks for the passed in queue
+func DeadSize(rc redis.Conn, queue string) (int, error) {
+	return redis.Int(rc.Do("zcard", fmt.Sprintf(deadPattern, queue)))
+}
+
+// GetDeadTasks returns up to limit dead tasks for the passed in queue, oldest first, starting at offset
+func GetDeadTasks(rc redis.Conn, queue string, offset int, limit int) ([]*DeadTask, error) {
+	ids, err := redis.Int64s(rc.Do("zrange", fmt.Sprintf(deadPattern, queue), offset, offset+limit-1))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting dead task ids for: %s", queue)
+	}
+	if len(ids) == 0 {
+		return []*DeadTask{}, nil
+	}
+
+	args := redis.Args{}.Add(fmt.Sprintf(deadTasksPattern, queue)).AddFlat(ids)
+	payloads, err := redis.ByteSlices(rc.Do("hmget", args...))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting dead tasks for: %s", queue)
+	}
+
+	tasks := make([]*DeadTask, 0, len(ids))
+	for i, payload := range payloads {
+		if payload == nil {
+			continue
+		}
+		task, err := decodeDeadTask(ids[i], payload)
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, nil
+}
+
+// GetDeadTask returns the dead task with the passed in id, or nil if it doesn't exist
+func GetDeadTask(rc redis.Conn, queue string, id int64) (*DeadTask, error) {
+	payload, err := redis.Bytes(rc.Do("hget", fmt.Sprintf(deadTasksPattern, queue), id))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting dead task %d for: %s", id, queue)
+	}
+	return decodeDeadTask(id, payload)
+}
+
+var removeDead = redis.NewScript(1, `-- KEYS: [QueueName] ARGV: [ID]
+	local payload = redis.call("hget", KEYS[1] .. ":dead:tasks", ARGV[1])
+	if not payload then
+		return false
+	end
+
+	redis.call("hdel", KEYS[1] .. ":dead:tasks", ARGV[1])
+	redis.call("zrem", KEYS[1] .. ":dead", ARGV[1])
+	return payload
+`)
+
+// removeDeadTask atomically removes the dead task with the passed in id, returning it or nil if it didn't exist
+func removeDeadTask(rc redis.Conn, queue string, id int64) (*DeadTask, error) {
+	payload, err := redis.Bytes(removeDead.Do(rc, queue, id))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error removing dead task %d for: %s", id, queue)
+	}
+	return decodeDeadTask(id, payload)
+}
+
+// ReplayDeadTask removes the dead task with the passed in id and adds it back to the queue with its error
+// count reset. It returns whether the task was found.
+func ReplayDeadTask(rc redis.Conn, queue string, id int64) (bool, error) {
+	dead, err := removeDeadTask(rc, queue, id)
+	if err != nil || dead == nil {
+		return false, err
+	}
+
+	dead.Task.ErrorCount = 0
+	err = queueTask(rc, queue, dead.Task, DefaultPriority)
+	if err != nil {
+		return false, errors.Wrapf(err, "error requeuing dead task %d for: %s", id, queue)
+	}
+	return true, nil
+}
+
+// ReplayDeadTasks replays all the dead tasks for the passed in queue, returning the number replayed
+func ReplayDeadTasks(rc redis.Conn, queue string) (int, error) {
+	ids, err := redis.Int64s(rc.Do("zrange", fmt.Sprintf(deadPattern, queue), 0, -1))
+	if err != nil {
+		return 0, errors.Wrapf(err, "error getting dead task ids for: %s", queue)
+	}
+
+	replayed := 0
+	for _, id := range ids {
+		found, err := ReplayDeadTask(rc, queue, id)
+		if err != nil {
+			return replayed, err
+		}
+		if found {
+			replayed++
+		}
+	}
+	return replayed, nil
+}
+
+// PurgeDeadTask permanently deletes the dead task with the passed in id, returning whether it was found
+func PurgeDeadTask(rc redis.Conn, queue string, id int64) (bool, error) {
+	dead, err := removeDeadTask(rc, queue, id)
+	return dead != nil, err
+}
+
+// PurgeDeadTasks permanently deletes all the dead tasks for the passed in queue, returning the number deleted
+func PurgeDeadTasks(rc redis.Conn, queue string) (int, error) {
+	count, err := DeadSize(rc, queue)
+	if err != nil {
+		return 0, errors.Wrapf(err, "error getting dead task count for: %s", queue)
+	}
+
+	_, err = rc.Do("del", fmt.Sprintf(deadPattern, queue), fmt.Sprintf(deadTasksPattern, queue))
+	if err != nil {
+		return 0, errors.Wrapf(err, "error purging dead tasks for: %s", queue)
+	}
+	return count, nil
+}
+
+// decodeDeadTask decodes the passed in dead task payload, setting its id
+func decodeDeadTask(id int64, payload []byte) (*DeadTask, error) {
+	task := &DeadTask{}
+	err := json.Unmarshal(payload, task)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error unmarshalling dead task: %d", id)
+	}
+	task.ID = id
+	return task, nil
+}
@@ -0,0 +1,199 @@
+package queue
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+// OrgQueue describes the state of the queue for a single org
+type OrgQueue struct {
+	OrgID          int        `json:"org_id"`
+	Size           int        `json:"size"`
+	Workers        int        `json:"workers"`
+	OldestQueuedOn *time.Time `json:"oldest_queued_on"`
+}
+
+// QueuedTask is a task which is waiting in the queue for an org, its ID is derived from its payload
+type QueuedTask struct {
+	ID   string `json:"id"`
+	Task *Task  `json:"task"`
+}
+
+// GetOrgQueues returns the state of the queue for each active org in the passed in queue
+func GetOrgQueues(rc redis.Conn, queue string) ([]*OrgQueue, error) {
+	orgIDs, err := redis.Ints(rc.Do("zrange", fmt.Sprintf(activePattern, queue), 0, -1))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting active orgs for: %s", queue)
+	}
+
+	orgs := make([]*OrgQueue, 0, len(orgIDs))
+	for _, orgID := range orgIDs {
+		workers, err := redis.Int(rc.Do("hget", fmt.Sprintf(workersPattern, queue), orgID))
+		if err != nil && err != redis.ErrNil {
+			return nil, errors.Wrapf(err, "error getting workers for org %d in: %s", orgID, queue)
+		}
+
+		size, err := redis.Int(rc.Do("zcard", fmt.Sprintf(queuePattern, queue, orgID)))
+		if err != nil {
+			return nil, errors.Wrapf(err, "error getting size of queue for org %d in: %s", orgID, queue)
+		}
+
+		oldest, err := oldestQueuedOn(rc, queue, orgID)
+		if err != nil {
+			return nil, err
+		}
+
+		orgs = append(orgs, &OrgQueue{OrgID: orgID, Size: size, Workers: workers, OldestQueuedOn: oldest})
+	}
+	return orgs, nil
+}
+
+// oldestQueuedOn returns when the oldest task in the queue for the passed in org was queued. Tasks are ordered
+// by when they were queued within each priority, so we only need to look at the first task of each priority.
+func oldestQueuedOn(rc redis.Conn, queue string, orgID int) (*time.Time, error) {
+	now := time.Now()
+	bounds := []string{
+		"-inf",
+		timeScore(now, HighPriority/2),
+		timeScore(now, LowPriority/2),
+		"+inf",
+	}
+
+	var oldest *time.Time
+	for i := 0; i < len(bounds)-1; i++ {
+		payloads, err := redis.ByteSlices(rc.Do("zrangebyscore", fmt.Sprintf(queuePattern, queue, orgID), bounds[i], "("+bounds[i+1], "LIMIT", 0, 1))
+		if err != nil {
+			return nil, errors.Wrapf(err, "error getting oldest task for org %d in: %s", orgID, queue)
+		}
+		if len(payloads) == 0 {
+			continue
+		}
+
+		task := &Task{}
+		if err := json.Unmarshal(payloads[0], task); err != nil {
+			return nil, errors.Wrapf(err, "error unmarshalling task for org %d in: %s", orgID, queue)
+		}
+		if oldest == nil || task.QueuedOn.Before(*oldest) {
+			oldest = &task.QueuedOn
+		}
+	}
+	return oldest, nil
+}
+
+// PeekOrgTasks returns the next count tasks in the queue for the passed in org, in the order they will be popped
+func PeekOrgTasks(rc redis.Conn, queue string, orgID int, count int) ([]*QueuedTask, error) {
+	payloads, err := redis.ByteSlices(rc.Do("zrange", fmt.Sprintf(queuePattern, queue, orgID), 0, count-1))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error peeking tasks for org %d in: %s", orgID, queue)
+	}
+
+	tasks := make([]*QueuedTask, len(payloads))
+	for i, payload := range payloads {
+		tasks[i], err = decodeQueuedTask(payload)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error unmarshalling task for org %d in: %s", orgID, queue)
+		}
+	}
+	return tasks, nil
+}
+
+// RemoveOrgTasks removes the tasks with the passed in ids from the queue for the passed in org, returning
+// the tasks that were removed
+func RemoveOrgTasks(rc redis.Conn, queue string, orgID int, ids []string) ([]*Task, error) {
+	queueKey := fmt.Sprintf(queuePattern, queue, orgID)
+
+	payloads, err := redis.ByteSlices(rc.Do("zrange", queueKey, 0, -1))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading tasks for org %d in: %s", orgID, queue)
+	}
+
+	remove := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		remove[id] = true
+	}
+
+	removed := make([]*Task, 0, len(ids))
+	for _, payload := range payloads {
+		queued, err := decodeQueuedTask(payload)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error unmarshalling task for org %d in: %s", orgID, queue)
+		}
+		if !remove[queued.ID] {
+			continue
+		}
+
+		// only consider it removed if it was still there, it may have been popped in the meantime
+		count, err := redis.Int(rc.Do("zrem", queueKey, payload))
+		if err != nil {
+			return nil, errors.Wrapf(err, "error removing task for org %d in: %s", orgID, queue)
+		}
+		if count == 1 {
+			removed = append(removed, queued.Task)
+		}
+	}
+	return removed, nil
+}
+
+var requeueTask = redis.NewScript(1, `-- KEYS: [OrgQueue] ARGV: [Score, Payload]
+	-- only move the task if it's still queued, it may have been popped in the meantime
+	if not redis.call("zscore", KEYS[1], ARGV[2]) then
+		return 0
+	end
+
+	redis.call("zadd", KEYS[1], ARGV[1], ARGV[2])
+	return 1
+`)
+
+// RequeueOrgTasks moves the tasks with the passed in ids to a new position in the queue for the passed in
+// org, as if they were added now with the passed in priority. It returns the number of tasks requeued. Each
+// task is moved in place so a failure part way through never loses any tasks.
+func RequeueOrgTasks(rc redis.Conn, queue string, orgID int, ids []string, priority Priority) (int, error) {
+	queueKey := fmt.Sprintf(queuePattern, queue, orgID)
+
+	payloads, err := redis.ByteSlices(rc.Do("zrange", queueKey, 0, -1))
+	if err != nil {
+		return 0, errors.Wrapf(err, "error reading tasks for org %d in: %s", orgID, queue)
+	}
+
+	requeue := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		requeue[id] = true
+	}
+
+	requeued := 0
+	for _, payload := range payloads {
+		queued, err := decodeQueuedTask(payload)
+		if err != nil {
+			return requeued, errors.Wrapf(err, "error unmarshalling task for org %d in: %s", orgID, queue)
+		}
+		if !requeue[queued.ID] {
+			continue
+		}
+
+		moved, err := redis.Bool(requeueTask.Do(rc, queueKey, timeScore(time.Now(), priority), payload))
+		if err != nil {
+			return requeued, errors.Wrapf(err, "error requeuing task for org %d in: %s", orgID, queue)
+		}
+		if moved {
+			requeued++
+		}
+	}
+	return requeued, nil
+}
+
+// decodeQueuedTask decodes the passed in queued task payload, deriving its id from a hash of the payload
+func decodeQueuedTask(payload []byte) (*QueuedTask, error) {
+	task := &Task{}
+	if err := json.Unmarshal(payload, task); err != nil {
+		return nil, err
+	}
+
+	hash := sha1.Sum(payload)
+	return &QueuedTask{ID: hex.EncodeToString(hash[:]), Task: task}, nil
+}
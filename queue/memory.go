@@ -0,0 +1,249 @@
+package queue
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// MemoryBackend is a queue backend which keeps tasks in memory. It's useful for unit tests and for single node
+// deployments where all tasks are added through the backend. Tasks don't survive a restart of the process so
+// claims never need reaping.
+type MemoryBackend struct {
+	mutex  sync.Mutex
+	queues map[string]*memoryQueue
+	dedups map[string]time.Time
+	deadID int64
+}
+
+type memoryTask struct {
+	task  *Task
+	score float64
+}
+
+type memoryQueue struct {
+	orgs    map[int][]*memoryTask
+	workers map[int]int
+	delayed []*memoryTask
+	claims  map[string]*Task
+	dead    []*DeadTask
+}
+
+// NewMemoryBackend creates a new empty in-memory queue backend
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{queues: make(map[string]*memoryQueue), dedups: make(map[string]time.Time)}
+}
+
+// queue returns the queue with the passed in name, creating it if necessary, callers must hold our mutex
+func (b *MemoryBackend) queue(name string) *memoryQueue {
+	q := b.queues[name]
+	if q == nil {
+		q = &memoryQueue{
+			orgs:    make(map[int][]*memoryTask),
+			workers: make(map[int]int),
+			claims:  make(map[string]*Task),
+		}
+		b.queues[name] = q
+	}
+	return q
+}
+
+// AddTask adds the passed in task to the named queue for execution
+func (b *MemoryBackend) AddTask(queue string, taskType string, orgID int, task interface{}, priority Priority) error {
+	payload, err := newTask(taskType, orgID, task)
+	if err != nil {
+		return err
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.queue(queue).push(payload, taskScore(time.Now(), priority))
+	return nil
+}
+
+// AddUniqueTask adds the passed in task to the named queue unless a task with the same dedup key was added within
+// the window, returning whether it was added
+func (b *MemoryBackend) AddUniqueTask(queue string, taskType string, orgID int, task interface{}, priority Priority, dedupKey string, window time.Duration) (bool, error) {
+	payload, err := newTask(taskType, orgID, task)
+	if err != nil {
+		return false, err
+	}
+
+	if window < time.Millisecond {
+		return false, errors.Errorf("dedup window for task must be at least a millisecond")
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := time.Now()
+	key := queue + ":" + dedupKey
+	if expiresOn, found := b.dedups[key]; found && now.Before(expiresOn) {
+		return false, nil
+	}
+	b.dedups[key] = now.Add(window)
+
+	b.queue(queue).push(payload, taskScore(now, priority))
+	return true, nil
+}
+
+// AddDelayedTask adds the passed in task to the named queue to be executed at the passed in time
+func (b *MemoryBackend) AddDelayedTask(queue string, taskType string, orgID int, task interface{}, runAt time.Time) error {
+	payload, err := newTask(taskType, orgID, task)
+	if err != nil {
+		return err
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.queue(queue).delay(payload, runAt)
+	return nil
+}
+
+// PopNextTask pops the next task off the named queue, picking the org with the fewest workers
+func (b *MemoryBackend) PopNextTask(queue string, owner string, lease time.Duration) (*Task, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	q := b.queue(queue)
+
+	orgID := -1
+	for id, tasks := range q.orgs {
+		if len(tasks) == 0 {
+			continue
+		}
+		if orgID == -1 || q.workers[id] < q.workers[orgID] || (q.workers[id] == q.workers[orgID] && id < orgID) {
+			orgID = id
+		}
+	}
+	if orgID == -1 {
+		return nil, nil
+	}
+
+	task := q.orgs[orgID][0].task
+	q.orgs[orgID] = q.orgs[orgID][1:]
+	q.workers[orgID]++
+
+	if owner != "" {
+		q.claims[owner] = task
+	}
+	return task, nil
+}
+
+// RenewClaim returns whether the passed in owner still has a claim, leases never expire in memory
+func (b *MemoryBackend) RenewClaim(queue string, owner string, lease time.Duration) (bool, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	_, found := b.queue(queue).claims[owner]
+	return found, nil
+}
+
+// MarkTaskComplete marks the task claimed by the passed in owner as complete
+func (b *MemoryBackend) MarkTaskComplete(queue string, owner string, orgID int) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	q := b.queue(queue)
+	delete(q.claims, owner)
+
+	if q.workers[orgID] > 0 {
+		q.workers[orgID]--
+	}
+	return nil
+}
+
+// RetryTask schedules the passed in failed task to be retried after the passed in delay
+func (b *MemoryBackend) RetryTask(queue string, task *Task, delay time.Duration) error {
+	retry := *task
+	retry.ErrorCount++
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.queue(queue).delay(&retry, time.Now().Add(delay))
+	return nil
+}
+
+// DeadLetterTask moves the passed in failed task to the dead letters for the named queue
+func (b *MemoryBackend) DeadLetterTask(queue string, task *Task, reason string) (int64, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.deadID++
+	q := b.queue(queue)
+	q.dead = append(q.dead, &DeadTask{ID: b.deadID, Task: task, Error: reason, DeadOn: time.Now()})
+	return b.deadID, nil
+}
+
+// DeadTasks returns the dead tasks for the named queue, oldest first
+func (b *MemoryBackend) DeadTasks(queue string) []*DeadTask {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return append([]*DeadTask{}, b.queue(queue).dead...)
+}
+
+// PromoteDelayedTasks moves delayed tasks which are now due into the named queue and forgets expired dedup keys
+func (b *MemoryBackend) PromoteDelayedTasks(queue string) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	q := b.queue(queue)
+	now := taskScore(time.Now(), DefaultPriority)
+
+	count := 0
+	for len(q.delayed) > 0 && q.delayed[0].score <= now {
+		q.push(q.delayed[0].task, q.delayed[0].score)
+		q.delayed = q.delayed[1:]
+		count++
+	}
+
+	// forget any dedup keys whose windows have passed
+	for key, expiresOn := range b.dedups {
+		if !time.Now().Before(expiresOn) {
+			delete(b.dedups, key)
+		}
+	}
+	return count, nil
+}
+
+// ReapExpiredClaims is a noop as claims never expire in memory
+func (b *MemoryBackend) ReapExpiredClaims(queue string) (int, error) {
+	return 0, nil
+}
+
+// Size returns the number of tasks in the named queue
+func (b *MemoryBackend) Size(queue string) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	size := 0
+	for _, tasks := range b.queue(queue).orgs {
+		size += len(tasks)
+	}
+	return size, nil
+}
+
+// push adds the passed in task to the queue for its org, ordered by score
+func (q *memoryQueue) push(task *Task, score float64) {
+	q.orgs[task.OrgID] = insertByScore(q.orgs[task.OrgID], &memoryTask{task: task, score: score})
+}
+
+// delay adds the passed in task to our delayed tasks, ordered by when it is due
+func (q *memoryQueue) delay(task *Task, runAt time.Time) {
+	q.delayed = insertByScore(q.delayed, &memoryTask{task: task, score: taskScore(runAt, DefaultPriority)})
+}
+
+// insertByScore inserts the passed in task after all tasks with the same or lower score
+func insertByScore(tasks []*memoryTask, task *memoryTask) []*memoryTask {
+	i := sort.Search(len(tasks), func(i int) bool { return tasks[i].score > task.score })
+	tasks = append(tasks, nil)
+	copy(tasks[i+1:], tasks[i:])
+	tasks[i] = task
+	return tasks
+}
@@ -23,8 +23,15 @@ type Task struct {
 type Priority int
 
 const (
-	queuePattern  = "%s:%d"
-	activePattern = "%s:active"
+	queuePattern   = "%s:%d"
+	activePattern  = "%s:active"
+	delayedPattern = "%s:delayed"
+	workersPattern = "%s:workers"
+	limitsPattern  = "%s:limits"
+	weightsPattern = "%s:weights"
+	claimsPattern  = "%s:claims"
+	leasesPattern  = "%s:leases"
+	dedupPattern   = "%s:dedup:%s"
 
 	// DefaultPriority is the default priority for tasks
 	DefaultPriority = Priority(0)
@@ -67,6 +74,9 @@ const (
 
 	// PopulateDynamicGroup is our task to populate the contacts for a dynamic group
 	PopulateDynamicGroup = "populate_dynamic_group"
+
+	// SendDeferredMsgs is our task for sending messages which were deferred by a frequency cap
+	SendDeferredMsgs = "send_deferred_msgs"
 )
 
 // Size returns the number of tasks for the passed in queue
@@ -92,67 +102,271 @@ func Size(rc redis.Conn, queue string) (int, error) {
 
 // AddTask adds the passed in task to our queue for execution
 func AddTask(rc redis.Conn, queue string, taskType string, orgID int, task interface{}, priority Priority) error {
-	score := strconv.FormatFloat(float64(time.Now().UnixNano()/int64(time.Microsecond))/float64(1000000)+float64(priority), 'f', 6, 64)
+	payload, err := newTask(taskType, orgID, task)
+	if err != nil {
+		return err
+	}
+
+	return queueTask(rc, queue, payload, priority)
+}
+
+// AddUniqueTask adds the passed in task to our queue for execution unless a task with the same dedup key was
+// added to the queue within the passed in window. It returns whether the task was added.
+func AddUniqueTask(rc redis.Conn, queue string, taskType string, orgID int, task interface{}, priority Priority, dedupKey string, window time.Duration) (bool, error) {
+	payload, err := newTask(taskType, orgID, task)
+	if err != nil {
+		return false, err
+	}
+
+	return addTask(rc, queue, payload, priority, dedupKey, window)
+}
+
+// ClaimDedupKey claims the passed in dedup key on our queue for the passed in window, returning false if it has already
+// been claimed within that window. Callers which need to do work before queuing a unique task, such as inserting what
+// the task operates on, can claim its key first and then queue it with AddTask.
+func ClaimDedupKey(rc redis.Conn, queue string, dedupKey string, window time.Duration) (bool, error) {
+	if window < time.Millisecond {
+		return false, errors.Errorf("dedup window for task must be at least a millisecond")
+	}
+
+	reply, err := rc.Do("set", fmt.Sprintf(dedupPattern, queue, dedupKey), "1", "NX", "PX", int64(window/time.Millisecond))
+	if err != nil {
+		return false, errors.Wrapf(err, "error claiming dedup key for: %s", queue)
+	}
+	return reply != nil, nil
+}
+
+// ReleaseDedupKey releases the passed in dedup key on our queue so that it can be claimed again, used when the work
+// it was claimed for fails
+func ReleaseDedupKey(rc redis.Conn, queue string, dedupKey string) error {
+	_, err := rc.Do("del", fmt.Sprintf(dedupPattern, queue, dedupKey))
+	if err != nil {
+		return errors.Wrapf(err, "error releasing dedup key for: %s", queue)
+	}
+	return nil
+}
 
+// HasDedupKey returns whether a unique task with the passed in dedup key has been added to our queue within its window
+func HasDedupKey(rc redis.Conn, queue string, dedupKey string) (bool, error) {
+	exists, err := redis.Bool(rc.Do("exists", fmt.Sprintf(dedupPattern, queue, dedupKey)))
+	if err != nil {
+		return false, errors.Wrapf(err, "error checking dedup key for: %s", queue)
+	}
+	return exists, nil
+}
+
+// newTask builds a new task with the passed in type, org and body
+func newTask(taskType string, orgID int, task interface{}) (*Task, error) {
 	taskBody, err := json.Marshal(task)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	payload := &Task{
+	return &Task{
 		Type:     taskType,
 		OrgID:    orgID,
 		Task:     taskBody,
 		QueuedOn: time.Now(),
+	}, nil
+}
+
+// queueTask pushes the passed in already built task onto the queue for its org
+func queueTask(rc redis.Conn, queue string, task *Task, priority Priority) error {
+	_, err := addTask(rc, queue, task, priority, "", 0)
+	return err
+}
+
+// rescoreOrg is a Lua function shared by our scripts which updates the position of an org in our active orgs after
+// its workers, limit or weight have changed. Orgs are ordered by how many workers they have relative to their weight,
+// and orgs which are at their limit of workers are moved to the back so that popping only ever needs to look at the
+// org at the front.
+const rescoreOrg = `
+	local function rescoreOrg(queue, org)
+		local workers = tonumber(redis.call("hget", queue .. ":workers", org)) or 0
+		local weight = tonumber(redis.call("hget", queue .. ":weights", org)) or 1
+		local limit = tonumber(redis.call("hget", queue .. ":limits", org))
+
+		local score = workers / weight
+		if limit and limit > 0 and workers >= limit then
+			score = score + ` + atLimitScore + `
+		end
+		redis.call("zadd", queue .. ":active", score, org)
+	end
+`
+
+// atLimitScore is added to the score of orgs which are at their limit of workers
+const atLimitScore = "1000000000"
+
+var pushTask = redis.NewScript(1, `-- KEYS: [QueueName] ARGV: [OrgID, Score, Payload, DedupKey, DedupWindowMS]
+	`+rescoreOrg+`
+	-- if we have a dedup key, only continue if it hasn't been set within our window
+	if ARGV[4] ~= "" then
+		if not redis.call("set", KEYS[1] .. ":dedup:" .. ARGV[4], "1", "NX", "PX", ARGV[5]) then
+			return 0
+		end
+	end
+
+	redis.call("zadd", KEYS[1] .. ":" .. ARGV[1], ARGV[2], ARGV[3])
+	rescoreOrg(KEYS[1], ARGV[1])
+	return 1
+`)
+
+// addTask pushes the passed in already built task onto the queue for its org, returning whether it was added
+func addTask(rc redis.Conn, queue string, task *Task, priority Priority, dedupKey string, window time.Duration) (bool, error) {
+	jsonPayload, err := json.Marshal(task)
+	if err != nil {
+		return false, err
+	}
+
+	if dedupKey != "" && window < time.Millisecond {
+		return false, errors.Errorf("dedup window for task must be at least a millisecond")
+	}
+
+	added, err := redis.Bool(pushTask.Do(rc, queue, task.OrgID, timeScore(time.Now(), priority), jsonPayload, dedupKey, int64(window/time.Millisecond)))
+	if err != nil {
+		return false, errors.Wrapf(err, "error adding task to: %s", queue)
+	}
+	return added, nil
+}
+
+// timeScore returns the score for the passed in time and priority, this is the time in seconds with
+// microsecond precision offset by the priority
+func timeScore(t time.Time, priority Priority) string {
+	return strconv.FormatFloat(taskScore(t, priority), 'f', 6, 64)
+}
+
+// taskScore returns the numeric score for the passed in time and priority
+func taskScore(t time.Time, priority Priority) float64 {
+	return float64(t.UnixNano()/int64(time.Microsecond))/float64(1000000) + float64(priority)
+}
+
+// AddDelayedTask adds the passed in task to our queue to be executed at the passed in time. Delayed tasks
+// are moved into the queue for their org by PromoteDelayedTasks once they are due.
+func AddDelayedTask(rc redis.Conn, queue string, taskType string, orgID int, task interface{}, runAt time.Time) error {
+	payload, err := newTask(taskType, orgID, task)
+	if err != nil {
+		return err
 	}
-	jsonPayload, err := json.Marshal(payload)
+
+	return delayTask(rc, queue, payload, runAt)
+}
+
+// RetryTask schedules the passed in task to be added back to its queue once the passed in delay has
+// elapsed, incrementing its error count
+func RetryTask(rc redis.Conn, queue string, task *Task, delay time.Duration) error {
+	retry := *task
+	retry.ErrorCount++
+
+	return delayTask(rc, queue, &retry, time.Now().Add(delay))
+}
+
+// delayTask adds the passed in already built task to the delayed set for the passed in queue
+func delayTask(rc redis.Conn, queue string, task *Task, runAt time.Time) error {
+	jsonPayload, err := json.Marshal(task)
 	if err != nil {
 		return err
 	}
 
-	rc.Send("zadd", fmt.Sprintf(queuePattern, queue, orgID), score, jsonPayload)
-	rc.Send("zincrby", fmt.Sprintf(activePattern, queue), 0, orgID)
-	_, err = rc.Do("")
-	return err
+	_, err = rc.Do("zadd", fmt.Sprintf(delayedPattern, queue), timeScore(runAt, DefaultPriority), jsonPayload)
+	if err != nil {
+		return errors.Wrapf(err, "error adding delayed task for: %s", queue)
+	}
+	return nil
 }
 
-var popTask = redis.NewScript(1, `-- KEYS: [QueueName]
-    -- first get what is the active queue
-	local result = redis.call("zrange", KEYS[1] .. ":active", 0, 0, "WITHSCORES")
+var promoteDelayed = redis.NewScript(1, `-- KEYS: [QueueName] ARGV: [Now, Limit]
+	`+rescoreOrg+`
+	local delayedKey = KEYS[1] .. ":delayed"
+	local due = redis.call("zrangebyscore", delayedKey, "-inf", ARGV[1], "WITHSCORES", "LIMIT", 0, ARGV[2])
 
-	-- nothing? return nothing
+	for i = 1, #due, 2 do
+		local payload = due[i]
+		local orgID = cjson.decode(payload)["org_id"]
+
+		-- add to the queue for this org, scored by when it was due, and make sure that org is active
+		redis.call("zadd", KEYS[1] .. ":" .. orgID, due[i + 1], payload)
+		rescoreOrg(KEYS[1], orgID)
+		redis.call("zrem", delayedKey, payload)
+	end
+
+	return #due / 2
+`)
+
+// PromoteDelayedTasks moves delayed tasks which are now due into the passed in queue, returning the
+// number of tasks which were moved
+func PromoteDelayedTasks(rc redis.Conn, queue string) (int, error) {
+	count, err := redis.Int(promoteDelayed.Do(rc, queue, timeScore(time.Now(), DefaultPriority), 1000))
+	if err != nil {
+		return 0, errors.Wrapf(err, "error promoting delayed tasks for: %s", queue)
+	}
+	return count, nil
+}
+
+// DelayedSize returns the number of tasks waiting to become due for the passed in queue, including
+// failed tasks waiting to be retried
+func DelayedSize(rc redis.Conn, queue string) (int, error) {
+	return redis.Int(rc.Do("zcard", fmt.Sprintf(delayedPattern, queue)))
+}
+
+var popTask = redis.NewScript(1, `-- KEYS: [QueueName] ARGV: [Owner, LeaseExpiry]
+	`+rescoreOrg+`
+	local activeKey = KEYS[1] .. ":active"
+
+	-- get the org with the fewest workers relative to its weight
+	local result = redis.call("zrange", activeKey, 0, 0, "WITHSCORES")
+
+	-- nothing? or everything at its limit? return nothing
 	local group = result[1]
-	if not group then
+	if not group or tonumber(result[2]) >= `+atLimitScore+` then
 		return {"empty", ""}
 	end
 
 	local queue = KEYS[1] .. ":" .. group
 
 	-- pop off our queue
-	local result = redis.call("zrangebyscore", queue, 0, "+inf", "WITHSCORES", "LIMIT", 0, 1)
-
-	-- found a result?
-	if result[1] then
-		-- then remove it from the queue
-		redis.call('zremrangebyrank', queue, 0, 0)
+	local result = redis.call("zrange", queue, 0, 0)
+
+	-- nothing queued for this org, remove it from our active orgs and try again. Unless it has a limit to enforce, we
+	-- also forget how many workers it has so it starts afresh when it next has tasks queued.
+	if not result[1] then
+		redis.call("zrem", activeKey, group)
+		if not redis.call("hget", KEYS[1] .. ":limits", group) then
+			redis.call("hdel", KEYS[1] .. ":workers", group)
+		end
+		return {"retry", ""}
+	end
 
-		-- and add a worker to this queue
-		redis.call("zincrby", KEYS[1] .. ":active", 1, group)
+	redis.call("zremrangebyrank", queue, 0, 0)
 
-		return {group, result[1]}
-	else
-		-- no result found, remove this group from active queues
-		redis.call("zrem", KEYS[1] .. ":active", group)
+	-- and add a worker to this org
+	redis.call("hincrby", KEYS[1] .. ":workers", group, 1)
+	rescoreOrg(KEYS[1], group)
 
-		return {"retry", ""}
+	-- if we have an owner, record our claim on this task until its lease expires
+	if ARGV[1] ~= "" then
+		redis.call("hset", KEYS[1] .. ":claims", ARGV[1], result[1])
+		redis.call("zadd", KEYS[1] .. ":leases", ARGV[2], ARGV[1])
 	end
+
+	return {group, result[1]}
 `)
 
-// PopNextTask pops the next task off our queue
+// PopNextTask pops the next task off our queue. Orgs are picked fairly by whichever has the fewest workers
+// relative to its weight, skipping any org which is already at its limit of workers.
 func PopNextTask(rc redis.Conn, queue string) (*Task, error) {
-	task := Task{}
+	return popNextTask(rc, queue, "", time.Time{})
+}
+
+// ClaimNextTask pops the next task off our queue like PopNextTask, but also records a claim on it by the passed
+// in owner. If the claim's lease expires before the task is marked complete with MarkClaimedTaskComplete, the
+// task will be added back to the queue by ReapExpiredClaims. Owners can only hold a single claim at once.
+func ClaimNextTask(rc redis.Conn, queue string, owner string, lease time.Duration) (*Task, error) {
+	return popNextTask(rc, queue, owner, time.Now().Add(lease))
+}
+
+func popNextTask(rc redis.Conn, queue string, owner string, leaseExpiry time.Time) (*Task, error) {
 	for {
-		values, err := redis.Strings(popTask.Do(rc, queue))
+		values, err := redis.Strings(popTask.Do(rc, queue, owner, timeScore(leaseExpiry, DefaultPriority)))
 		if err != nil {
 			return nil, err
 		}
@@ -165,24 +379,148 @@ func PopNextTask(rc redis.Conn, queue string) (*Task, error) {
 			continue
 		}
 
-		err = json.Unmarshal([]byte(values[1]), &task)
-		return &task, err
+		task := &Task{}
+		err = json.Unmarshal([]byte(values[1]), task)
+		return task, err
 	}
 }
 
-var markComplete = redis.NewScript(2, `-- KEYS: [QueueName] [TaskGroup]
-	-- decrement our active
-	local active = tonumber(redis.call("zincrby", KEYS[1] .. ":active", -1, KEYS[2]))
+var markComplete = redis.NewScript(2, `-- KEYS: [QueueName] [TaskGroup] ARGV: [Owner]
+	`+rescoreOrg+`
+	-- if we have an owner, release its claim, if it no longer has one our task was reaped and requeued
+	if ARGV[1] ~= "" then
+		redis.call("zrem", KEYS[1] .. ":leases", ARGV[1])
+		if redis.call("hdel", KEYS[1] .. ":claims", ARGV[1]) == 0 then
+			return
+		end
+	end
 
-	-- reset to zero if we somehow go below
-	if active < 0 then
-		redis.call("zadd", KEYS[1] .. ":active", 0, KEYS[2])
+	-- decrement our workers, resetting to zero if we somehow go below
+	local workers = redis.call("hincrby", KEYS[1] .. ":workers", KEYS[2], -1)
+	if workers < 0 then
+		redis.call("hset", KEYS[1] .. ":workers", KEYS[2], 0)
 	end
+
+	rescoreOrg(KEYS[1], KEYS[2])
 `)
 
 // MarkTaskComplete marks the passed in task as complete. Callers must call this in order
 // to maintain fair workers across orgs
 func MarkTaskComplete(rc redis.Conn, queue string, orgID int) error {
-	_, err := markComplete.Do(rc, queue, strconv.FormatInt(int64(orgID), 10))
+	_, err := markComplete.Do(rc, queue, strconv.FormatInt(int64(orgID), 10), "")
 	return err
 }
+
+// MarkClaimedTaskComplete marks the task claimed by the passed in owner as complete, releasing the claim
+func MarkClaimedTaskComplete(rc redis.Conn, queue string, owner string, orgID int) error {
+	_, err := markComplete.Do(rc, queue, strconv.FormatInt(int64(orgID), 10), owner)
+	return err
+}
+
+// RenewClaim extends the lease on the task currently claimed by the passed in owner. It returns false if
+// the owner no longer has a claim, which means its task was reaped and requeued.
+func RenewClaim(rc redis.Conn, queue string, owner string, lease time.Duration) (bool, error) {
+	updated, err := redis.Int(rc.Do("zadd", fmt.Sprintf(leasesPattern, queue), "XX", "CH", timeScore(time.Now().Add(lease), DefaultPriority), owner))
+	if err != nil {
+		return false, errors.Wrapf(err, "error renewing claim for %s in: %s", owner, queue)
+	}
+	return updated == 1, nil
+}
+
+var reapClaims = redis.NewScript(1, `-- KEYS: [QueueName] ARGV: [Now]
+	`+rescoreOrg+`
+	local leasesKey = KEYS[1] .. ":leases"
+	local claimsKey = KEYS[1] .. ":claims"
+	local expired = redis.call("zrangebyscore", leasesKey, "-inf", ARGV[1])
+	local count = 0
+
+	for i, owner in ipairs(expired) do
+		local payload = redis.call("hget", claimsKey, owner)
+		if payload then
+			local orgID = cjson.decode(payload)["org_id"]
+
+			-- put the task back on the queue for its org
+			redis.call("zadd", KEYS[1] .. ":" .. orgID, ARGV[1], payload)
+
+			-- and give back the worker slot its owner was using
+			local workers = redis.call("hincrby", KEYS[1] .. ":workers", orgID, -1)
+			if workers < 0 then
+				redis.call("hset", KEYS[1] .. ":workers", orgID, 0)
+			end
+			rescoreOrg(KEYS[1], orgID)
+
+			redis.call("hdel", claimsKey, owner)
+			count = count + 1
+		end
+		redis.call("zrem", leasesKey, owner)
+	end
+
+	return count
+`)
+
+// ReapExpiredClaims adds any claimed tasks whose leases have expired back to the passed in queue, returning
+// the number of tasks requeued. Leases expire when the process that claimed a task dies before completing it.
+func ReapExpiredClaims(rc redis.Conn, queue string) (int, error) {
+	count, err := redis.Int(reapClaims.Do(rc, queue, timeScore(time.Now(), DefaultPriority)))
+	if err != nil {
+		return 0, errors.Wrapf(err, "error reaping expired claims for: %s", queue)
+	}
+	return count, nil
+}
+
+var setOrgLimit = redis.NewScript(1, `-- KEYS: [QueueName] ARGV: [Limit, OrgID, Value]
+	`+rescoreOrg+`
+	local limitKey = KEYS[1] .. ":" .. ARGV[1]
+
+	if tonumber(ARGV[3]) <= 0 then
+		redis.call("hdel", limitKey, ARGV[2])
+	else
+		redis.call("hset", limitKey, ARGV[2], ARGV[3])
+	end
+
+	-- if this org is active, update its position
+	if redis.call("zscore", KEYS[1] .. ":active", ARGV[2]) then
+		rescoreOrg(KEYS[1], ARGV[2])
+	end
+`)
+
+// SetOrgMaxWorkers sets the maximum number of workers which can be handling tasks for the passed in org at
+// once. A value of zero removes any limit.
+func SetOrgMaxWorkers(rc redis.Conn, queue string, orgID int, maxWorkers int) error {
+	_, err := setOrgLimit.Do(rc, queue, "limits", orgID, maxWorkers)
+	return errors.Wrapf(err, "error setting max workers for org %d in: %s", orgID, queue)
+}
+
+// SetOrgWeight sets the weight for the passed in org, an org with a weight of 2 will get twice as many workers
+// as an org with the default weight of 1 when both have tasks queued. A value of zero restores the default.
+func SetOrgWeight(rc redis.Conn, queue string, orgID int, weight float64) error {
+	_, err := setOrgLimit.Do(rc, queue, "weights", orgID, strconv.FormatFloat(weight, 'f', -1, 64))
+	return errors.Wrapf(err, "error setting weight for org %d in: %s", orgID, queue)
+}
+
+// OrgLimits are the concurrency settings for an org in a queue
+type OrgLimits struct {
+	MaxWorkers int     `json:"max_workers"`
+	Weight     float64 `json:"weight"`
+}
+
+// GetOrgLimits returns the concurrency settings for the passed in org
+func GetOrgLimits(rc redis.Conn, queue string, orgID int) (*OrgLimits, error) {
+	rc.Send("hget", fmt.Sprintf(limitsPattern, queue), orgID)
+	rc.Send("hget", fmt.Sprintf(weightsPattern, queue), orgID)
+	rc.Flush()
+
+	maxWorkers, err := redis.Int(rc.Receive())
+	if err != nil && err != redis.ErrNil {
+		return nil, errors.Wrapf(err, "error getting max workers for org %d in: %s", orgID, queue)
+	}
+
+	weight, err := redis.Float64(rc.Receive())
+	if err == redis.ErrNil {
+		weight = 1
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "error getting weight for org %d in: %s", orgID, queue)
+	}
+
+	return &OrgLimits{MaxWorkers: maxWorkers, Weight: weight}, nil
+}
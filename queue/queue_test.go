@@ -3,6 +3,7 @@ package queue
 import (
 	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/gomodule/redigo/redis"
 	"github.com/stretchr/testify/assert"
@@ -11,7 +12,7 @@ import (
 func TestQueues(t *testing.T) {
 	rc, err := redis.Dial("tcp", "localhost:6379")
 	assert.NoError(t, err)
-	rc.Do("del", "test:active", "test:1", "test:2", "test:3")
+	rc.Do("del", "test:active", "test:workers", "test:1", "test:2", "test:3", "test:limits", "test:weights")
 
 	popPriority := Priority(-1)
 	markCompletePriority := Priority(-2)
@@ -41,6 +42,16 @@ func TestQueues(t *testing.T) {
 		{"test", 2, "campaign", "task6", popPriority, 1},
 		{"test", 1, "campaign", "task5", popPriority, 0},
 		{"test", 1, "campaign", "", popPriority, 0},
+
+		// orgs with fewer workers are popped first, and workers are given back when their tasks are marked complete
+		{"test", 3, "campaign", "task7", DefaultPriority, 1},
+		{"test", 3, "campaign", "task8", DefaultPriority, 2},
+		{"test", 3, "campaign", "task7", popPriority, 1},
+		{"test", 2, "campaign", "task9", DefaultPriority, 2},
+		{"test", 2, "campaign", "task9", popPriority, 1},
+		{"test", 3, "campaign", "", markCompletePriority, 1},
+		{"test", 3, "campaign", "task8", popPriority, 0},
+		{"test", 3, "campaign", "", popPriority, 0},
 	}
 
 	for i, tc := range tcs {
@@ -75,3 +86,415 @@ func TestQueues(t *testing.T) {
 		assert.Equal(t, tc.Size, size, "%d: mismatch", i)
 	}
 }
+
+func TestRetries(t *testing.T) {
+	rc, err := redis.Dial("tcp", "localhost:6379")
+	assert.NoError(t, err)
+	rc.Do("del", "test:active", "test:workers", "test:1", "test:delayed")
+
+	assert.NoError(t, AddTask(rc, "test", "campaign", 1, "task1", DefaultPriority))
+	assert.NoError(t, AddTask(rc, "test", "campaign", 1, "task2", DefaultPriority))
+
+	task, err := PopNextTask(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, task.ErrorCount)
+	assert.NoError(t, MarkTaskComplete(rc, "test", 1))
+
+	task2, err := PopNextTask(rc, "test")
+	assert.NoError(t, err)
+	assert.NoError(t, MarkTaskComplete(rc, "test", 1))
+
+	// schedule one retry in the past and one in the future
+	assert.NoError(t, RetryTask(rc, "test", task, -time.Second))
+	assert.NoError(t, RetryTask(rc, "test", task2, time.Hour))
+
+	size, err := DelayedSize(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, size)
+
+	// only the due one should be promoted
+	count, err := PromoteDelayedTasks(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	size, err = Size(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, size)
+
+	size, err = DelayedSize(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, size)
+
+	retried, err := PopNextTask(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, retried.OrgID)
+	assert.Equal(t, "campaign", retried.Type)
+	assert.Equal(t, 1, retried.ErrorCount)
+	assert.Equal(t, task.Task, retried.Task)
+}
+
+func TestDeadLetters(t *testing.T) {
+	rc, err := redis.Dial("tcp", "localhost:6379")
+	assert.NoError(t, err)
+	rc.Do("del", "test:active", "test:workers", "test:1", "test:2", "test:dead", "test:dead:tasks", "test:dead:seq")
+
+	task1 := &Task{Type: "campaign", OrgID: 1, Task: json.RawMessage(`"task1"`), ErrorCount: 3}
+	task2 := &Task{Type: "campaign", OrgID: 2, Task: json.RawMessage(`"task2"`), ErrorCount: 3}
+
+	id1, err := DeadLetterTask(rc, "test", task1, "boom")
+	assert.NoError(t, err)
+	id2, err := DeadLetterTask(rc, "test", task2, "bang")
+	assert.NoError(t, err)
+	assert.NotEqual(t, id1, id2)
+
+	size, err := DeadSize(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, size)
+
+	dead, err := GetDeadTasks(rc, "test", 0, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(dead))
+	assert.Equal(t, id1, dead[0].ID)
+	assert.Equal(t, "boom", dead[0].Error)
+	assert.Equal(t, 1, dead[0].Task.OrgID)
+	assert.Equal(t, id2, dead[1].ID)
+
+	// replay our first task, should end up back in our queue with no errors
+	found, err := ReplayDeadTask(rc, "test", id1)
+	assert.NoError(t, err)
+	assert.True(t, found)
+
+	// can't replay it twice
+	found, err = ReplayDeadTask(rc, "test", id1)
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	replayed, err := PopNextTask(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, replayed.OrgID)
+	assert.Equal(t, 0, replayed.ErrorCount)
+
+	missing, err := GetDeadTask(rc, "test", id1)
+	assert.NoError(t, err)
+	assert.Nil(t, missing)
+
+	// purge our second
+	found, err = PurgeDeadTask(rc, "test", id2)
+	assert.NoError(t, err)
+	assert.True(t, found)
+
+	size, err = DeadSize(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, size)
+
+	// dead letter two more and purge them all
+	DeadLetterTask(rc, "test", task1, "boom")
+	DeadLetterTask(rc, "test", task2, "bang")
+
+	purged, err := PurgeDeadTasks(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, purged)
+
+	size, err = Size(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, size)
+}
+
+func TestDelayedTasks(t *testing.T) {
+	rc, err := redis.Dial("tcp", "localhost:6379")
+	assert.NoError(t, err)
+	rc.Do("del", "test:active", "test:workers", "test:1", "test:2", "test:delayed")
+
+	now := time.Now()
+	assert.NoError(t, AddDelayedTask(rc, "test", "campaign", 1, "task1", now.Add(time.Hour)))
+	assert.NoError(t, AddDelayedTask(rc, "test", "campaign", 2, "task2", now.Add(-time.Second)))
+	assert.NoError(t, AddDelayedTask(rc, "test", "campaign", 1, "task3", now.Add(-time.Minute)))
+
+	// nothing is in our queue until promoted
+	task, err := PopNextTask(rc, "test")
+	assert.NoError(t, err)
+	assert.Nil(t, task)
+
+	size, err := DelayedSize(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, size)
+
+	count, err := PromoteDelayedTasks(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	size, err = Size(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, size)
+
+	// promoting again is a noop
+	count, err = PromoteDelayedTasks(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	for _, expected := range []string{"task3", "task2"} {
+		task, err := PopNextTask(rc, "test")
+		assert.NoError(t, err)
+
+		var value string
+		assert.NoError(t, json.Unmarshal(task.Task, &value))
+		assert.Equal(t, expected, value)
+		assert.NoError(t, MarkTaskComplete(rc, "test", task.OrgID))
+	}
+
+	// our future task is still waiting
+	size, err = DelayedSize(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, size)
+}
+
+func TestOrgLimits(t *testing.T) {
+	rc, err := redis.Dial("tcp", "localhost:6379")
+	assert.NoError(t, err)
+	rc.Do("del", "test:active", "test:workers", "test:1", "test:2", "test:limits", "test:weights")
+
+	limits, err := GetOrgLimits(rc, "test", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, &OrgLimits{MaxWorkers: 0, Weight: 1}, limits)
+
+	// org 1 can only have one worker at a time
+	assert.NoError(t, SetOrgMaxWorkers(rc, "test", 1, 1))
+
+	limits, err = GetOrgLimits(rc, "test", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, &OrgLimits{MaxWorkers: 1, Weight: 1}, limits)
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, AddTask(rc, "test", "campaign", 1, "task1", DefaultPriority))
+		assert.NoError(t, AddTask(rc, "test", "campaign", 2, "task2", DefaultPriority))
+	}
+
+	popOrgs := func(n int) []int {
+		orgs := make([]int, 0, n)
+		for i := 0; i < n; i++ {
+			task, err := PopNextTask(rc, "test")
+			assert.NoError(t, err)
+			if task == nil {
+				break
+			}
+			orgs = append(orgs, task.OrgID)
+		}
+		return orgs
+	}
+
+	// org 1 gets a single worker, org 2 gets everything else, then we run out of eligible tasks
+	assert.Equal(t, []int{1, 2, 2, 2}, popOrgs(5))
+
+	// once org 1's task is complete it can get another worker
+	assert.NoError(t, MarkTaskComplete(rc, "test", 1))
+	assert.Equal(t, []int{1}, popOrgs(2))
+
+	// removing the limit lets it have as many as it wants
+	assert.NoError(t, SetOrgMaxWorkers(rc, "test", 1, 0))
+	assert.Equal(t, []int{1}, popOrgs(2))
+
+	rc.Do("del", "test:active", "test:workers", "test:1", "test:2")
+
+	// org 2 has three times the weight of org 1
+	assert.NoError(t, SetOrgWeight(rc, "test", 2, 3))
+
+	for i := 0; i < 4; i++ {
+		assert.NoError(t, AddTask(rc, "test", "campaign", 1, "task1", DefaultPriority))
+		assert.NoError(t, AddTask(rc, "test", "campaign", 2, "task2", DefaultPriority))
+	}
+
+	assert.Equal(t, []int{1, 2, 2, 2, 1, 2, 1, 1}, popOrgs(8))
+}
+
+func TestClaims(t *testing.T) {
+	rc, err := redis.Dial("tcp", "localhost:6379")
+	assert.NoError(t, err)
+	rc.Do("del", "test:active", "test:workers", "test:1", "test:claims", "test:leases", "test:limits", "test:weights")
+
+	assert.NoError(t, AddTask(rc, "test", "campaign", 1, "task1", DefaultPriority))
+	assert.NoError(t, AddTask(rc, "test", "campaign", 1, "task2", DefaultPriority))
+
+	// claim both tasks, one with a lease which has already expired
+	task1, err := ClaimNextTask(rc, "test", "worker1", time.Minute)
+	assert.NoError(t, err)
+	assert.NotNil(t, task1)
+
+	task2, err := ClaimNextTask(rc, "test", "worker2", -time.Second)
+	assert.NoError(t, err)
+	assert.NotNil(t, task2)
+
+	renewed, err := RenewClaim(rc, "test", "worker1", time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, renewed)
+
+	// reaping requeues the task with the expired lease
+	count, err := ReapExpiredClaims(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	size, err := Size(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, size)
+
+	// worker2 no longer has a claim to renew
+	renewed, err = RenewClaim(rc, "test", "worker2", time.Minute)
+	assert.NoError(t, err)
+	assert.False(t, renewed)
+
+	// org 1 should only have the one worker, and completing worker1's task takes it to zero
+	assert.NoError(t, SetOrgMaxWorkers(rc, "test", 1, 1))
+	task, err := PopNextTask(rc, "test")
+	assert.NoError(t, err)
+	assert.Nil(t, task)
+
+	assert.NoError(t, MarkClaimedTaskComplete(rc, "test", "worker1", 1))
+
+	// completing worker2's reaped task is a noop
+	assert.NoError(t, MarkClaimedTaskComplete(rc, "test", "worker2", 1))
+
+	requeued, err := ClaimNextTask(rc, "test", "worker3", time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, task2.Task, requeued.Task)
+
+	task, err = PopNextTask(rc, "test")
+	assert.NoError(t, err)
+	assert.Nil(t, task)
+
+	count, err = ReapExpiredClaims(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
+
+func TestInspect(t *testing.T) {
+	rc, err := redis.Dial("tcp", "localhost:6379")
+	assert.NoError(t, err)
+	rc.Do("del", "test:active", "test:workers", "test:1", "test:2", "test:limits", "test:weights")
+
+	assert.NoError(t, AddTask(rc, "test", "campaign", 1, "task1", DefaultPriority))
+	assert.NoError(t, AddTask(rc, "test", "campaign", 1, "task2", HighPriority))
+	assert.NoError(t, AddTask(rc, "test", "campaign", 2, "task3", LowPriority))
+
+	_, err = PopNextTask(rc, "test")
+	assert.NoError(t, err)
+
+	orgs, err := GetOrgQueues(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(orgs))
+
+	// org 2 has no workers so comes first
+	assert.Equal(t, 2, orgs[0].OrgID)
+	assert.Equal(t, 1, orgs[0].Size)
+	assert.Equal(t, 0, orgs[0].Workers)
+	assert.NotNil(t, orgs[0].OldestQueuedOn)
+
+	// org 1 had its high priority task popped, leaving task1 as its oldest
+	assert.Equal(t, 1, orgs[1].OrgID)
+	assert.Equal(t, 1, orgs[1].Size)
+	assert.Equal(t, 1, orgs[1].Workers)
+
+	peeked, err := PeekOrgTasks(rc, "test", 1, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(peeked))
+	assert.Equal(t, *orgs[1].OldestQueuedOn, peeked[0].Task.QueuedOn)
+
+	// move task3 in front of everything
+	assert.NoError(t, AddTask(rc, "test", "campaign", 2, "task4", DefaultPriority))
+	peeked, err = PeekOrgTasks(rc, "test", 2, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(peeked))
+	assert.Equal(t, json.RawMessage(`"task4"`), peeked[0].Task.Task)
+
+	requeued, err := RequeueOrgTasks(rc, "test", 2, []string{peeked[1].ID}, HighPriority)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, requeued)
+
+	peeked, err = PeekOrgTasks(rc, "test", 2, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, json.RawMessage(`"task3"`), peeked[0].Task.Task)
+
+	// requeuing a task which is no longer queued does nothing and leaves the others where they are
+	requeued, err = RequeueOrgTasks(rc, "test", 2, []string{"unknown", peeked[0].ID}, LowPriority)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, requeued)
+
+	peeked, err = PeekOrgTasks(rc, "test", 2, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(peeked))
+	assert.Equal(t, json.RawMessage(`"task4"`), peeked[0].Task.Task)
+
+	removed, err := RemoveOrgTasks(rc, "test", 2, []string{peeked[0].ID, peeked[1].ID})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(removed))
+
+	size, err := Size(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, size)
+}
+
+func TestUniqueTasks(t *testing.T) {
+	rc, err := redis.Dial("tcp", "localhost:6379")
+	assert.NoError(t, err)
+	rc.Do("del", "test:active", "test:workers", "test:1", "test:dedup:start:1", "test:dedup:start:2", "test:dedup:start:4")
+
+	added, err := AddUniqueTask(rc, "test", "start_flow", 1, "task1", DefaultPriority, "start:1", time.Second)
+	assert.NoError(t, err)
+	assert.True(t, added)
+
+	// same key within our window is dropped
+	added, err = AddUniqueTask(rc, "test", "start_flow", 1, "task1", DefaultPriority, "start:1", time.Second)
+	assert.NoError(t, err)
+	assert.False(t, added)
+
+	// different key is fine
+	added, err = AddUniqueTask(rc, "test", "start_flow", 1, "task2", DefaultPriority, "start:2", time.Second)
+	assert.NoError(t, err)
+	assert.True(t, added)
+
+	// as are tasks without keys
+	assert.NoError(t, AddTask(rc, "test", "start_flow", 1, "task1", DefaultPriority))
+
+	_, err = AddUniqueTask(rc, "test", "start_flow", 1, "task1", DefaultPriority, "start:3", 0)
+	assert.Error(t, err)
+
+	size, err := Size(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, size)
+
+	// once our window has passed and the key expired, it can be used again
+	rc.Do("del", "test:dedup:start:1")
+
+	added, err = AddUniqueTask(rc, "test", "start_flow", 1, "task1", DefaultPriority, "start:1", time.Second)
+	assert.NoError(t, err)
+	assert.True(t, added)
+
+	has, err := HasDedupKey(rc, "test", "start:1")
+	assert.NoError(t, err)
+	assert.True(t, has)
+
+	// keys can also be claimed ahead of queuing a task
+	claimed, err := ClaimDedupKey(rc, "test", "start:4", time.Second)
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+
+	claimed, err = ClaimDedupKey(rc, "test", "start:4", time.Second)
+	assert.NoError(t, err)
+	assert.False(t, claimed)
+
+	added, err = AddUniqueTask(rc, "test", "start_flow", 1, "task4", DefaultPriority, "start:4", time.Second)
+	assert.NoError(t, err)
+	assert.False(t, added)
+
+	_, err = ClaimDedupKey(rc, "test", "start:5", 0)
+	assert.Error(t, err)
+
+	// and released again if the work they were claimed for fails
+	assert.NoError(t, ReleaseDedupKey(rc, "test", "start:4"))
+
+	has, err = HasDedupKey(rc, "test", "start:4")
+	assert.NoError(t, err)
+	assert.False(t, has)
+
+	claimed, err = ClaimDedupKey(rc, "test", "start:4", time.Second)
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+}
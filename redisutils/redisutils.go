@@ -0,0 +1,23 @@
+package redisutils
+
+import (
+	"strconv"
+	"time"
+)
+
+// ParseInt parses the passed in value read from a redis hash as an int, returning zero if it is missing or invalid
+func ParseInt(value string) int {
+	i, _ := strconv.Atoi(value)
+	return i
+}
+
+// ParseNanos parses the passed in value read from a redis hash as a time stored as nanoseconds since the epoch,
+// returning nil if it is missing or invalid
+func ParseNanos(value string) *time.Time {
+	nanos, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return nil
+	}
+	t := time.Unix(0, nanos).UTC()
+	return &t
+}
@@ -0,0 +1,20 @@
+package redisutils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	assert.Equal(t, 0, ParseInt(""))
+	assert.Equal(t, 0, ParseInt("x"))
+	assert.Equal(t, 123, ParseInt("123"))
+
+	assert.Nil(t, ParseNanos(""))
+	assert.Nil(t, ParseNanos("x"))
+
+	t1 := time.Date(2020, 5, 22, 12, 30, 0, 123456789, time.UTC)
+	assert.Equal(t, &t1, ParseNanos("1590150600123456789"))
+}
@@ -84,7 +84,7 @@ func SendReply(ctx context.Context, db *sqlx.DB, rp *redis.Pool, ticket *models.
 	// we'll use a broadcast to send this message
 	bcast := models.NewBroadcast(assets.OrgID(), models.NilBroadcastID, translations, models.TemplateStateEvaluated, envs.Language("base"), nil, nil, nil)
 	batch := bcast.CreateBatch([]models.ContactID{ticket.ContactID()})
-	msgs, err := models.CreateBroadcastMessages(ctx, db, rp, assets, batch)
+	msgs, _, err := models.CreateBroadcastMessages(ctx, db, rp, assets, batch)
 	if err != nil {
 		return nil, errors.Wrapf(err, "error creating message batch")
 	}
@@ -0,0 +1,169 @@
+package broadcasts
+
+import (
+	"context"
+	"sort"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/goflow/assets"
+	"github.com/nyaruka/goflow/envs"
+	"github.com/nyaruka/mailroom/gsm7"
+	"github.com/nyaruka/mailroom/models"
+	"github.com/pkg/errors"
+)
+
+// Totals are the number of messages and segments for part of a broadcast
+type Totals struct {
+	Messages int `json:"messages"`
+	Segments int `json:"segments"`
+}
+
+// ChannelTotals are the totals for the messages a broadcast will send on a channel
+type ChannelTotals struct {
+	UUID assets.ChannelUUID `json:"uuid"`
+	Name string             `json:"name"`
+	Totals
+}
+
+// PreviewMsg is a sample message that a broadcast will send, along with any characters in it which force it to be
+// sent as UCS2
+type PreviewMsg struct {
+	ContactID   models.ContactID   `json:"contact_id"`
+	URN         urns.URN           `json:"urn"`
+	ChannelUUID assets.ChannelUUID `json:"channel_uuid"`
+	Language    envs.Language      `json:"language"`
+	Text        string             `json:"text"`
+	Segments    int                `json:"segments"`
+	UCS2Chars   []string           `json:"ucs2_chars,omitempty"`
+}
+
+// NoTemplateTotals are the contacts a broadcast can't send to because no approved template matched them
+type NoTemplateTotals struct {
+	Contacts   int                `json:"contacts"`
+	ContactIDs []models.ContactID `json:"contact_ids"`
+}
+
+// Preview is a summary of the messages a broadcast will send
+type Preview struct {
+	Contacts   int                       `json:"contacts"`
+	NewURNs    int                       `json:"new_urns"`
+	Messages   int                       `json:"messages"`
+	Segments   int                       `json:"segments"`
+	Channels   []*ChannelTotals          `json:"channels"`
+	Languages  map[envs.Language]*Totals `json:"languages"`
+	NoTemplate *NoTemplateTotals         `json:"no_template"`
+	Samples    []*PreviewMsg             `json:"samples"`
+}
+
+// PreviewBroadcast works out the messages the passed in broadcast will send, without creating any contacts or messages,
+// and summarizes them by channel and language along with up to sampleSize sample messages. URNs which don't belong to
+// existing contacts are counted as new URNs but their messages aren't included in the totals. Contacts who can't be sent
+// a message because no approved template matched them are counted, with up to sampleSize of them listed.
+func PreviewBroadcast(ctx context.Context, db *sqlx.DB, oa *models.OrgAssets, bcast *models.Broadcast, sampleSize int) (*Preview, error) {
+	urnMap, err := models.LookupContactIDsFromURNs(ctx, db, oa, bcast.URNs())
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting contact ids for urns")
+	}
+
+	contactIDs, urnContacts, repeatedContacts, err := resolveRecipients(ctx, db, bcast, urnMap)
+	if err != nil {
+		return nil, err
+	}
+
+	allIDs := make([]models.ContactID, 0, len(contactIDs)+len(urnContacts))
+	for id := range contactIDs {
+		allIDs = append(allIDs, id)
+	}
+	for id := range urnContacts {
+		allIDs = append(allIDs, id)
+	}
+	sort.Slice(allIDs, func(i, j int) bool { return allIDs[i] < allIDs[j] })
+
+	preview := &Preview{
+		Contacts:   len(allIDs),
+		NewURNs:    len(bcast.URNs()) - len(urnMap),
+		Channels:   make([]*ChannelTotals, 0),
+		Languages:  make(map[envs.Language]*Totals),
+		NoTemplate: &NoTemplateTotals{ContactIDs: make([]models.ContactID, 0, sampleSize)},
+		Samples:    make([]*PreviewMsg, 0, sampleSize),
+	}
+	channels := make(map[assets.ChannelUUID]*ChannelTotals)
+
+	for len(allIDs) > 0 {
+		chunk := allIDs
+		if len(chunk) > loadBatchSize {
+			chunk = chunk[:loadBatchSize]
+		}
+		allIDs = allIDs[len(chunk):]
+
+		msgs, languages, noTemplate, err := models.PreviewBroadcastMessages(ctx, db, oa, createBatch(bcast, chunk, urnContacts, repeatedContacts))
+		if err != nil {
+			return nil, errors.Wrapf(err, "error building broadcast messages")
+		}
+
+		preview.NoTemplate.Contacts += len(noTemplate)
+		for _, id := range noTemplate {
+			if len(preview.NoTemplate.ContactIDs) < sampleSize {
+				preview.NoTemplate.ContactIDs = append(preview.NoTemplate.ContactIDs, id)
+			}
+		}
+
+		for _, msg := range msgs {
+			// our message count already includes a segment for each attachment
+			segments := msg.MsgCount()
+			var ucs2Chars []string
+			if msg.URN().Scheme() == urns.TelScheme {
+				for _, r := range gsm7.InvalidChars(msg.Text()) {
+					ucs2Chars = append(ucs2Chars, string(r))
+				}
+			}
+			lang := languages[msg]
+
+			preview.Messages++
+			preview.Segments += segments
+
+			channel := channels[msg.ChannelUUID()]
+			if channel == nil {
+				channel = &ChannelTotals{UUID: msg.ChannelUUID()}
+				if msg.Channel() != nil {
+					channel.Name = msg.Channel().Name()
+				}
+				channels[msg.ChannelUUID()] = channel
+				preview.Channels = append(preview.Channels, channel)
+			}
+			channel.Messages++
+			channel.Segments += segments
+
+			language := preview.Languages[lang]
+			if language == nil {
+				language = &Totals{}
+				preview.Languages[lang] = language
+			}
+			language.Messages++
+			language.Segments += segments
+
+			if len(preview.Samples) < sampleSize {
+				preview.Samples = append(preview.Samples, &PreviewMsg{
+					ContactID:   msg.ContactID(),
+					URN:         msg.URN(),
+					ChannelUUID: msg.ChannelUUID(),
+					Language:    lang,
+					Text:        msg.Text(),
+					Segments:    segments,
+					UCS2Chars:   ucs2Chars,
+				})
+			}
+		}
+	}
+
+	// order our channels by how many messages they will send, busiest first
+	sort.Slice(preview.Channels, func(i, j int) bool {
+		if preview.Channels[i].Messages != preview.Channels[j].Messages {
+			return preview.Channels[i].Messages > preview.Channels[j].Messages
+		}
+		return preview.Channels[i].UUID < preview.Channels[j].UUID
+	})
+
+	return preview, nil
+}
@@ -0,0 +1,223 @@
+package broadcasts
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/goflow/utils/dates"
+	"github.com/nyaruka/mailroom/models"
+	"github.com/nyaruka/mailroom/redisutils"
+	"github.com/pkg/errors"
+)
+
+const (
+	progressPattern    = "broadcast_progress:%d"
+	progressExpiration = time.Hour * 24 * 7
+)
+
+// ProgressStatus is the status of a broadcast as recorded in its progress
+type ProgressStatus string
+
+// possible values for progress status
+const (
+	ProgressStatusQueued    = ProgressStatus("queued")
+	ProgressStatusSending   = ProgressStatus("sending")
+	ProgressStatusCompleted = ProgressStatus("completed")
+	ProgressStatusCancelled = ProgressStatus("cancelled")
+)
+
+// Progress is how far a broadcast has got in being sent, as recorded in redis
+type Progress struct {
+	BroadcastID      models.BroadcastID `json:"broadcast_id"`
+	OrgID            models.OrgID       `json:"org_id"`
+	Status           ProgressStatus     `json:"status"`
+	Contacts         int                `json:"contacts"`
+	BatchesTotal     int                `json:"batches_total"`
+	BatchesCompleted int                `json:"batches_completed"`
+	BatchesSkipped   int                `json:"batches_skipped"`
+	MsgsCreated      int                `json:"msgs_created"`
+	NoTemplate       int                `json:"no_template"`
+	QueuedOn         *time.Time         `json:"queued_on"`
+	CompletedOn      *time.Time         `json:"completed_on"`
+	CancelledOn      *time.Time         `json:"cancelled_on"`
+}
+
+// writeProgress runs the passed in commands against the progress of the passed in broadcast, refreshing its expiration
+func writeProgress(rc redis.Conn, id models.BroadcastID, commands ...[]interface{}) error {
+	// we can only track broadcasts which have an id
+	if id == models.NilBroadcastID {
+		return nil
+	}
+
+	key := fmt.Sprintf(progressPattern, id)
+
+	rc.Send("multi")
+	for _, command := range commands {
+		rc.Send(command[0].(string), append([]interface{}{key}, command[1:]...)...)
+	}
+	rc.Send("expire", key, int(progressExpiration/time.Second))
+	_, err := rc.Do("exec")
+	return errors.Wrapf(err, "error writing progress of broadcast: %d", id)
+}
+
+// recordBatchQueued records that a batch of the passed in broadcast has been queued
+func recordBatchQueued(rc redis.Conn, bcast *models.Broadcast) error {
+	return writeProgress(rc, bcast.BroadcastID(),
+		[]interface{}{"hset", "org_id", int(bcast.OrgID())},
+		[]interface{}{"hincrby", "batches_total", 1},
+	)
+}
+
+// recordBatchesQueued records that all the batches of the passed in broadcast have been queued, returning whether that
+// completed the broadcast because all its batches have already been sent or skipped
+func recordBatchesQueued(rc redis.Conn, bcast *models.Broadcast, contacts int) (bool, error) {
+	err := writeProgress(rc, bcast.BroadcastID(),
+		[]interface{}{"hmset", "org_id", int(bcast.OrgID()), "contacts", contacts, "queued_on", dates.Now().UnixNano()},
+	)
+	if err != nil {
+		return false, err
+	}
+	return checkCompleted(rc, bcast.BroadcastID())
+}
+
+// recordBatchCompleted records that the passed in batch has been sent, along with how many contacts in it weren't sent a
+// message because no approved template matched them, or that it was skipped if its broadcast was cancelled. It returns
+// whether that completed the broadcast.
+func recordBatchCompleted(rc redis.Conn, batch *models.BroadcastBatch, msgs int, noTemplate int, skipped bool) (bool, error) {
+	commands := make([][]interface{}, 0, 3)
+	if skipped {
+		commands = append(commands, []interface{}{"hincrby", "batches_skipped", 1})
+	} else {
+		commands = append(commands,
+			[]interface{}{"hincrby", "batches_completed", 1},
+			[]interface{}{"hincrby", "msgs_created", msgs},
+			[]interface{}{"hincrby", "no_template", noTemplate},
+		)
+	}
+	if err := writeProgress(rc, batch.BroadcastID(), commands...); err != nil {
+		return false, err
+	}
+	return checkCompleted(rc, batch.BroadcastID())
+}
+
+// batches can finish in any order, so a broadcast is completed once all its batches have been queued and every one of
+// them has been sent or skipped. Only the caller which completes it is told so.
+var completeProgress = redis.NewScript(1, `
+-- KEYS: [ProgressKey] ARGV: [Now]
+local p = redis.call("hmget", KEYS[1], "queued_on", "completed_on", "batches_total", "batches_completed", "batches_skipped")
+if not p[1] or p[2] then
+	return 0
+end
+if tonumber(p[4] or "0") + tonumber(p[5] or "0") < tonumber(p[3] or "0") then
+	return 0
+end
+redis.call("hset", KEYS[1], "completed_on", ARGV[1])
+return 1
+`)
+
+// checkCompleted marks the passed in broadcast as completed if all its batches are done, returning whether it did
+func checkCompleted(rc redis.Conn, id models.BroadcastID) (bool, error) {
+	if id == models.NilBroadcastID {
+		return false, nil
+	}
+
+	completed, err := redis.Bool(completeProgress.Do(rc, fmt.Sprintf(progressPattern, id), dates.Now().UnixNano()))
+	if err != nil {
+		return false, errors.Wrapf(err, "error checking whether broadcast is completed: %d", id)
+	}
+	return completed, nil
+}
+
+// CancelResult is the outcome of trying to cancel a broadcast
+type CancelResult int
+
+// possible values for cancel result
+const (
+	CancelResultNotFound  = CancelResult(0)
+	CancelResultCancelled = CancelResult(1)
+	CancelResultCompleted = CancelResult(2)
+)
+
+// a broadcast can be cancelled until it completes, keeping its first cancellation time if cancelled more than once
+var cancelProgress = redis.NewScript(1, `
+-- KEYS: [ProgressKey] ARGV: [OrgID, Now, Expiration]
+local p = redis.call("hmget", KEYS[1], "org_id", "completed_on")
+if p[1] and p[1] ~= ARGV[1] then
+	return 0
+end
+if p[2] then
+	return 2
+end
+redis.call("hset", KEYS[1], "org_id", ARGV[1])
+redis.call("hsetnx", KEYS[1], "cancelled_on", ARGV[2])
+redis.call("expire", KEYS[1], ARGV[3])
+return 1
+`)
+
+// CancelBroadcast cancels the passed in broadcast so that no further batches are created or sent. Batches already
+// being sent will complete. Broadcasts which belong to a different org aren't found and those which have already
+// completed are left unchanged.
+func CancelBroadcast(rc redis.Conn, orgID models.OrgID, id models.BroadcastID) (CancelResult, error) {
+	// we can only track broadcasts which have an id
+	if id == models.NilBroadcastID {
+		return CancelResultCancelled, nil
+	}
+
+	result, err := redis.Int(cancelProgress.Do(rc, fmt.Sprintf(progressPattern, id), int(orgID), dates.Now().UnixNano(), int(progressExpiration/time.Second)))
+	if err != nil {
+		return CancelResultNotFound, errors.Wrapf(err, "error cancelling broadcast: %d", id)
+	}
+	return CancelResult(result), nil
+}
+
+// IsCancelled returns whether the passed in broadcast has been cancelled
+func IsCancelled(rc redis.Conn, id models.BroadcastID) (bool, error) {
+	if id == models.NilBroadcastID {
+		return false, nil
+	}
+
+	cancelled, err := redis.Bool(rc.Do("hexists", fmt.Sprintf(progressPattern, id), "cancelled_on"))
+	if err != nil {
+		return false, errors.Wrapf(err, "error checking whether broadcast is cancelled: %d", id)
+	}
+	return cancelled, nil
+}
+
+// GetProgress returns the progress of the passed in broadcast, or nil if there is none
+func GetProgress(rc redis.Conn, id models.BroadcastID) (*Progress, error) {
+	values, err := redis.StringMap(rc.Do("hgetall", fmt.Sprintf(progressPattern, id)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading progress of broadcast: %d", id)
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	progress := &Progress{
+		BroadcastID:      id,
+		OrgID:            models.OrgID(redisutils.ParseInt(values["org_id"])),
+		Contacts:         redisutils.ParseInt(values["contacts"]),
+		BatchesTotal:     redisutils.ParseInt(values["batches_total"]),
+		BatchesCompleted: redisutils.ParseInt(values["batches_completed"]),
+		BatchesSkipped:   redisutils.ParseInt(values["batches_skipped"]),
+		MsgsCreated:      redisutils.ParseInt(values["msgs_created"]),
+		NoTemplate:       redisutils.ParseInt(values["no_template"]),
+		QueuedOn:         redisutils.ParseNanos(values["queued_on"]),
+		CompletedOn:      redisutils.ParseNanos(values["completed_on"]),
+		CancelledOn:      redisutils.ParseNanos(values["cancelled_on"]),
+	}
+
+	switch {
+	case progress.CancelledOn != nil:
+		progress.Status = ProgressStatusCancelled
+	case progress.CompletedOn != nil:
+		progress.Status = ProgressStatusCompleted
+	case progress.BatchesCompleted > 0:
+		progress.Status = ProgressStatusSending
+	default:
+		progress.Status = ProgressStatusQueued
+	}
+
+	return progress, nil
+}
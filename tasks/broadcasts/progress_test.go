@@ -0,0 +1,130 @@
+package broadcasts
+
+import (
+	"testing"
+
+	"github.com/nyaruka/mailroom/models"
+	"github.com/nyaruka/mailroom/testsuite"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProgress(t *testing.T) {
+	testsuite.ResetRP()
+	rc := testsuite.RC()
+	defer rc.Close()
+
+	bcast := models.NewBroadcast(models.Org1, models.BroadcastID(123), nil, models.TemplateStateEvaluated, "eng", nil, nil, nil)
+
+	// no progress yet
+	progress, err := GetProgress(rc, bcast.BroadcastID())
+	assert.NoError(t, err)
+	assert.Nil(t, progress)
+
+	// queue three batches, the second of which is sent before we've finished queuing
+	assert.NoError(t, recordBatchQueued(rc, bcast))
+	assert.NoError(t, recordBatchQueued(rc, bcast))
+
+	completed, err := recordBatchCompleted(rc, bcast.CreateBatch(nil), 50, 0, false)
+	assert.NoError(t, err)
+	assert.False(t, completed)
+
+	assert.NoError(t, recordBatchQueued(rc, bcast))
+
+	completed, err = recordBatchesQueued(rc, bcast, 250)
+	assert.NoError(t, err)
+	assert.False(t, completed)
+
+	progress, err = GetProgress(rc, bcast.BroadcastID())
+	require.NoError(t, err)
+	assert.Equal(t, ProgressStatusSending, progress.Status)
+	assert.Equal(t, models.Org1, progress.OrgID)
+	assert.Equal(t, 250, progress.Contacts)
+	assert.Equal(t, 3, progress.BatchesTotal)
+	assert.NotNil(t, progress.QueuedOn)
+	assert.Nil(t, progress.CompletedOn)
+
+	// the last batch finishing first doesn't complete our broadcast while others are still being sent
+	last := bcast.CreateBatch(nil)
+	last.SetIsLast(true)
+	completed, err = recordBatchCompleted(rc, last, 100, 3, false)
+	assert.NoError(t, err)
+	assert.False(t, completed)
+
+	progress, _ = GetProgress(rc, bcast.BroadcastID())
+	assert.Equal(t, ProgressStatusSending, progress.Status)
+	assert.Equal(t, 2, progress.BatchesCompleted)
+	assert.Equal(t, 150, progress.MsgsCreated)
+	assert.Equal(t, 3, progress.NoTemplate)
+	assert.Nil(t, progress.CompletedOn)
+
+	cancelled, err := IsCancelled(rc, bcast.BroadcastID())
+	assert.NoError(t, err)
+	assert.False(t, cancelled)
+
+	// can't cancel from another org
+	result, err := CancelBroadcast(rc, models.Org2, bcast.BroadcastID())
+	assert.NoError(t, err)
+	assert.Equal(t, CancelResultNotFound, result)
+
+	result, err = CancelBroadcast(rc, models.Org1, bcast.BroadcastID())
+	assert.NoError(t, err)
+	assert.Equal(t, CancelResultCancelled, result)
+
+	cancelled, _ = IsCancelled(rc, bcast.BroadcastID())
+	assert.True(t, cancelled)
+
+	// our remaining batch is then skipped, which completes our broadcast
+	completed, err = recordBatchCompleted(rc, bcast.CreateBatch(nil), 0, 0, true)
+	assert.NoError(t, err)
+	assert.True(t, completed)
+
+	progress, _ = GetProgress(rc, bcast.BroadcastID())
+	assert.Equal(t, ProgressStatusCancelled, progress.Status)
+	assert.Equal(t, 2, progress.BatchesCompleted)
+	assert.Equal(t, 1, progress.BatchesSkipped)
+	assert.Equal(t, 150, progress.MsgsCreated)
+	assert.NotNil(t, progress.CancelledOn)
+	assert.NotNil(t, progress.CompletedOn)
+
+	// and it can only be completed once
+	completed, err = checkCompleted(rc, bcast.BroadcastID())
+	assert.NoError(t, err)
+	assert.False(t, completed)
+
+	// a broadcast whose batches were all sent before we finished queuing is completed by finishing queuing
+	quick := models.NewBroadcast(models.Org1, models.BroadcastID(124), nil, models.TemplateStateEvaluated, "eng", nil, nil, nil)
+	assert.NoError(t, recordBatchQueued(rc, quick))
+	completed, err = recordBatchCompleted(rc, quick.CreateBatch(nil), 2, 0, false)
+	assert.NoError(t, err)
+	assert.False(t, completed)
+
+	completed, err = recordBatchesQueued(rc, quick, 2)
+	assert.NoError(t, err)
+	assert.True(t, completed)
+
+	progress, _ = GetProgress(rc, quick.BroadcastID())
+	assert.Equal(t, ProgressStatusCompleted, progress.Status)
+
+	// a completed broadcast can't be cancelled
+	result, err = CancelBroadcast(rc, models.Org1, quick.BroadcastID())
+	assert.NoError(t, err)
+	assert.Equal(t, CancelResultCompleted, result)
+
+	progress, _ = GetProgress(rc, quick.BroadcastID())
+	assert.Equal(t, ProgressStatusCompleted, progress.Status)
+	assert.Nil(t, progress.CancelledOn)
+
+	// broadcasts without ids aren't tracked
+	untracked := models.NewBroadcast(models.Org1, models.NilBroadcastID, nil, models.TemplateStateEvaluated, "eng", nil, nil, nil)
+	assert.NoError(t, recordBatchQueued(rc, untracked))
+
+	completed, err = recordBatchesQueued(rc, untracked, 1)
+	assert.NoError(t, err)
+	assert.False(t, completed)
+
+	progress, err = GetProgress(rc, models.NilBroadcastID)
+	assert.NoError(t, err)
+	assert.Nil(t, progress)
+}
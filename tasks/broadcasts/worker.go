@@ -3,6 +3,7 @@ package broadcasts
 import (
 	"context"
 	"encoding/json"
+	"sort"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
@@ -18,11 +19,14 @@ import (
 
 const (
 	startBatchSize = 100
+
+	// how many contacts we load at a time when we need more than their ids
+	loadBatchSize = 1000
 )
 
 func init() {
 	mailroom.AddTaskFunction(queue.SendBroadcast, handleSendBroadcast)
-	mailroom.AddTaskFunction(queue.SendBroadcastBatch, handleSendBroadcastBatch)
+	mailroom.AddRetryableTaskFunction(queue.SendBroadcastBatch, handleSendBroadcastBatch)
 }
 
 // handleSendBroadcast creates all the batches of contacts that need to be sent to
@@ -45,20 +49,26 @@ func handleSendBroadcast(ctx context.Context, mr *mailroom.Mailroom, task *queue
 
 // CreateBroadcastBatches takes our master broadcast and creates batches of broadcast sends for all the unique contacts
 func CreateBroadcastBatches(ctx context.Context, db *sqlx.DB, rp *redis.Pool, bcast *models.Broadcast) error {
-	// we are building a set of contact ids, start with the explicit ones
-	contactIDs := make(map[models.ContactID]bool)
-	for _, id := range bcast.ContactIDs() {
-		contactIDs[id] = true
+	oa, err := models.GetOrgAssets(ctx, db, bcast.OrgID())
+	if err != nil {
+		return errors.Wrapf(err, "error getting org assets")
 	}
 
-	groupContactIDs, err := models.ContactIDsForGroupIDs(ctx, db, bcast.GroupIDs())
-	for _, id := range groupContactIDs {
-		contactIDs[id] = true
-	}
+	rc := rp.Get()
+	defer rc.Close()
 
-	oa, err := models.GetOrgAssets(ctx, db, bcast.OrgID())
+	// if we've been cancelled before getting started, just queue an empty last batch so our broadcast is completed
+	cancelled, err := IsCancelled(rc, bcast.BroadcastID())
 	if err != nil {
-		return errors.Wrapf(err, "error getting org assets")
+		return err
+	}
+	if cancelled {
+		batch := bcast.CreateBatch(nil)
+		batch.SetIsLast(true)
+		if err := queueBatch(rc, queue.HandlerQueue, bcast, batch, time.Time{}); err != nil {
+			return err
+		}
+		return recordAllQueued(ctx, db, rc, bcast, 0)
 	}
 
 	// get the contact ids for our URNs
@@ -67,32 +77,27 @@ func CreateBroadcastBatches(ctx context.Context, db *sqlx.DB, rp *redis.Pool, bc
 		return errors.Wrapf(err, "error getting contact ids for urns")
 	}
 
-	urnContacts := make(map[models.ContactID]urns.URN)
-	repeatedContacts := make(map[models.ContactID]urns.URN)
+	contactIDs, urnContacts, repeatedContacts, err := resolveRecipients(ctx, db, bcast, urnMap)
+	if err != nil {
+		return err
+	}
 
 	q := queue.BatchQueue
 
 	// two or fewer contacts? queue to our handler queue for sending
-	if len(contactIDs) <= 2 {
+	if len(contactIDs)+len(repeatedContacts) <= 2 {
 		q = queue.HandlerQueue
 	}
 
-	// we want to remove contacts that are also present in URN sends, these will be a special case in our last batch
-	for u, id := range urnMap {
-		if contactIDs[id] {
-			repeatedContacts[id] = u
-			delete(contactIDs, id)
-		}
-		urnContacts[id] = u
+	// if our broadcast has a delivery window, contacts outside of it need their batches delayed
+	if bcast.DeliveryWindow() != nil {
+		return createWindowedBatches(ctx, db, rc, oa, bcast, q, contactIDs, urnContacts, repeatedContacts)
 	}
 
-	rc := rp.Get()
-	defer rc.Close()
-
 	contacts := make([]models.ContactID, 0, 100)
 
 	// utility functions for queueing the current set of contacts
-	queueBatch := func(isLast bool) {
+	queueContacts := func(isLast bool) {
 		// if this is our last batch include those contacts that overlap with our urns
 		if isLast {
 			for id := range repeatedContacts {
@@ -108,7 +113,7 @@ func CreateBroadcastBatches(ctx context.Context, db *sqlx.DB, rp *redis.Pool, bc
 			batch.SetURNs(urnContacts)
 		}
 
-		err = queue.AddTask(rc, q, queue.SendBroadcastBatch, int(bcast.OrgID()), batch, queue.DefaultPriority)
+		err = queueBatch(rc, q, bcast, batch, time.Time{})
 		if err != nil {
 			logrus.WithError(err).Error("error while queuing broadcast batch")
 		}
@@ -118,15 +123,200 @@ func CreateBroadcastBatches(ctx context.Context, db *sqlx.DB, rp *redis.Pool, bc
 	// build up batches of contacts to start
 	for c := range contactIDs {
 		if len(contacts) == startBatchSize {
-			queueBatch(false)
+			queueContacts(false)
+
+			// if we've been cancelled, stop creating batches, our last batch will still be queued but then skipped
+			cancelled, err := IsCancelled(rc, bcast.BroadcastID())
+			if err != nil {
+				return err
+			}
+			if cancelled {
+				contacts = contacts[:0]
+				break
+			}
 		}
 		contacts = append(contacts, c)
 	}
 
 	// queue our last batch
-	queueBatch(true)
+	queueContacts(true)
+
+	return recordAllQueued(ctx, db, rc, bcast, len(contactIDs)+len(urnContacts))
+}
+
+// recordAllQueued records that all the batches of the passed in broadcast have been queued, completing the broadcast if
+// they have all been sent already
+func recordAllQueued(ctx context.Context, db *sqlx.DB, rc redis.Conn, bcast *models.Broadcast, contacts int) error {
+	completed, err := recordBatchesQueued(rc, bcast, contacts)
+	if err != nil || !completed {
+		return err
+	}
+	return completeBroadcast(ctx, db, rc, bcast.BroadcastID())
+}
+
+// completeBroadcast marks the passed in broadcast as sent now that all its batches are done, or as cancelled if it was
+// cancelled before they were all sent
+func completeBroadcast(ctx context.Context, db *sqlx.DB, rc redis.Conn, id models.BroadcastID) error {
+	cancelled, err := IsCancelled(rc, id)
+	if err != nil {
+		return err
+	}
+	if cancelled {
+		return models.MarkBroadcastCancelled(ctx, db, id)
+	}
+	return models.MarkBroadcastSent(ctx, db, id)
+}
+
+// queueBatch queues the passed in batch of a broadcast, to be sent immediately or at the passed in time if it isn't zero
+func queueBatch(rc redis.Conn, q string, bcast *models.Broadcast, batch *models.BroadcastBatch, sendTime time.Time) error {
+	var err error
+	if sendTime.IsZero() {
+		err = queue.AddTask(rc, q, queue.SendBroadcastBatch, int(bcast.OrgID()), batch, queue.DefaultPriority)
+	} else {
+		err = queue.AddDelayedTask(rc, q, queue.SendBroadcastBatch, int(bcast.OrgID()), batch, sendTime)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "error queuing batch for broadcast: %d", bcast.BroadcastID())
+	}
+
+	return recordBatchQueued(rc, bcast)
+}
+
+// resolveRecipients works out the contacts the passed in broadcast will be sent to. It returns the contacts being sent
+// to via their preferred URN, those being sent to via a specific URN, and those which are both.
+func resolveRecipients(ctx context.Context, db *sqlx.DB, bcast *models.Broadcast, urnMap map[urns.URN]models.ContactID) (map[models.ContactID]bool, map[models.ContactID]urns.URN, map[models.ContactID]urns.URN, error) {
+	// we are building a set of contact ids, start with the explicit ones
+	contactIDs := make(map[models.ContactID]bool)
+	for _, id := range bcast.ContactIDs() {
+		contactIDs[id] = true
+	}
+
+	groupContactIDs, err := models.ContactIDsForGroupIDs(ctx, db, bcast.GroupIDs())
+	if err != nil {
+		return nil, nil, nil, errors.Wrapf(err, "error getting contact ids for groups")
+	}
+	for _, id := range groupContactIDs {
+		contactIDs[id] = true
+	}
+
+	urnContacts := make(map[models.ContactID]urns.URN)
+	repeatedContacts := make(map[models.ContactID]urns.URN)
 
-	return nil
+	// we want to remove contacts that are also present in URN sends, these will be a special case in our last batch
+	for u, id := range urnMap {
+		if contactIDs[id] {
+			repeatedContacts[id] = u
+			delete(contactIDs, id)
+		}
+		urnContacts[id] = u
+	}
+
+	return contactIDs, urnContacts, repeatedContacts, nil
+}
+
+// createWindowedBatches creates batches for a broadcast with a delivery window, grouping contacts by when the window
+// is next open in their timezone. Batches for contacts whose window is already open are queued immediately and the
+// rest are queued as delayed tasks to run when their window opens.
+func createWindowedBatches(ctx context.Context, db *sqlx.DB, rc redis.Conn, oa *models.OrgAssets, bcast *models.Broadcast, q string, contactIDs map[models.ContactID]bool, urnContacts map[models.ContactID]urns.URN, repeatedContacts map[models.ContactID]urns.URN) error {
+	window := bcast.DeliveryWindow()
+	if err := window.Validate(); err != nil {
+		return errors.Wrapf(err, "invalid delivery window for broadcast: %d", bcast.BroadcastID())
+	}
+
+	allIDs := make([]models.ContactID, 0, len(contactIDs)+len(urnContacts))
+	for id := range contactIDs {
+		allIDs = append(allIDs, id)
+	}
+	for id := range urnContacts {
+		allIDs = append(allIDs, id)
+	}
+
+	// work out when each contact can be sent to, to the minute so that contacts can share batches
+	now := time.Now()
+	sendTimes := make(map[time.Time][]models.ContactID)
+
+	for len(allIDs) > 0 {
+		chunk := allIDs
+		if len(chunk) > loadBatchSize {
+			chunk = chunk[:loadBatchSize]
+		}
+		allIDs = allIDs[len(chunk):]
+
+		timezones, err := window.LoadContactTimezones(ctx, db, oa, chunk)
+		if err != nil {
+			return errors.Wrapf(err, "error loading contact timezones for broadcast: %d", bcast.BroadcastID())
+		}
+
+		for contactID, tz := range timezones {
+			opens, err := window.NextOpen(now, tz)
+			if err != nil {
+				return err
+			}
+			if opens.After(now) {
+				opens = opens.Truncate(time.Minute)
+			} else {
+				opens = time.Time{}
+			}
+			sendTimes[opens] = append(sendTimes[opens], contactID)
+		}
+	}
+
+	// queue our batches in the order they will be sent so that the last batch is marked as such
+	times := make([]time.Time, 0, len(sendTimes))
+	for t := range sendTimes {
+		times = append(times, t)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+
+	// no contacts? still queue an empty last batch so our broadcast is marked as sent
+	if len(times) == 0 {
+		batch := bcast.CreateBatch(nil)
+		batch.SetIsLast(true)
+		if err := queueBatch(rc, q, bcast, batch, time.Time{}); err != nil {
+			return err
+		}
+		return recordAllQueued(ctx, db, rc, bcast, 0)
+	}
+
+	for i, sendTime := range times {
+		ids := sendTimes[sendTime]
+
+		for start := 0; start < len(ids); start += startBatchSize {
+			end := start + startBatchSize
+			if end > len(ids) {
+				end = len(ids)
+			}
+
+			batch := createBatch(bcast, ids[start:end], urnContacts, repeatedContacts)
+			batch.SetIsLast(i == len(times)-1 && end == len(ids))
+
+			if err := queueBatch(rc, q, bcast, batch, sendTime); err != nil {
+				logrus.WithError(err).Error("error while queuing broadcast batch")
+			}
+		}
+	}
+
+	return recordAllQueued(ctx, db, rc, bcast, len(contactIDs)+len(urnContacts))
+}
+
+// createBatch creates a batch for the passed in contacts. Contacts being sent to via a specific URN are passed as URNs,
+// and as contacts too if they are also being sent to via their preferred URN.
+func createBatch(bcast *models.Broadcast, ids []models.ContactID, urnContacts map[models.ContactID]urns.URN, repeatedContacts map[models.ContactID]urns.URN) *models.BroadcastBatch {
+	batchContacts := make([]models.ContactID, 0, len(ids))
+	batchURNs := make(map[models.ContactID]urns.URN)
+	for _, id := range ids {
+		urn, isURNContact := urnContacts[id]
+		if isURNContact {
+			batchURNs[id] = urn
+		}
+		if _, isRepeated := repeatedContacts[id]; isRepeated || !isURNContact {
+			batchContacts = append(batchContacts, id)
+		}
+	}
+
+	batch := bcast.CreateBatch(batchContacts)
+	batch.SetURNs(batchURNs)
+	return batch
 }
 
 // handleSendBroadcastBatch sends our messages
@@ -144,41 +334,80 @@ func handleSendBroadcastBatch(ctx context.Context, mr *mailroom.Mailroom, task *
 		return errors.Wrapf(err, "error unmarshalling broadcast: %s", string(task.Task))
 	}
 
-	// try to send the batch
-	return SendBroadcastBatch(ctx, mr.DB, mr.RP, broadcast)
+	// try to send the batch, if this attempt fails it's the last if we won't be retried
+	return SendBroadcastBatch(ctx, mr.DB, mr.RP, broadcast, task.ErrorCount >= mr.Config.TaskMaxRetries)
 }
 
-// SendBroadcastBatch sends the passed in broadcast batch
-func SendBroadcastBatch(ctx context.Context, db *sqlx.DB, rp *redis.Pool, bcast *models.BroadcastBatch) error {
-	// always set our broadcast as sent if it is our last
-	defer func() {
-		if bcast.IsLast() {
-			err := models.MarkBroadcastSent(ctx, db, bcast.BroadcastID())
-			if err != nil {
-				logrus.WithError(err).Error("error marking broadcast as sent")
-			}
+// SendBroadcastBatch sends the passed in broadcast batch, and if it's the last of its broadcast's batches to finish,
+// marks the broadcast as sent or cancelled. If sending fails and this isn't the last attempt, the batch isn't recorded
+// as done so that it can be retried.
+func SendBroadcastBatch(ctx context.Context, db *sqlx.DB, rp *redis.Pool, bcast *models.BroadcastBatch, lastAttempt bool) error {
+	rc := rp.Get()
+	defer rc.Close()
+
+	msgs, noTemplate, skipped, err := sendBatch(ctx, db, rp, rc, bcast)
+	if err != nil && !lastAttempt {
+		return err
+	}
+
+	// record this batch as done even if sending failed for good, so that our broadcast can still be completed
+	completed, rerr := recordBatchCompleted(rc, bcast, msgs, noTemplate, skipped)
+	if rerr == nil && completed {
+		rerr = completeBroadcast(ctx, db, rc, bcast.BroadcastID())
+	}
+
+	if err != nil {
+		if rerr != nil {
+			logrus.WithError(rerr).WithField("broadcast_id", bcast.BroadcastID()).Error("error recording failed broadcast batch")
 		}
-	}()
+		return err
+	}
+	return rerr
+}
+
+// sendBatch creates and queues the messages for the passed in batch, returning how many were created and how many
+// contacts weren't sent a message because no approved template matched them, or that it was skipped because its
+// broadcast has been cancelled
+func sendBatch(ctx context.Context, db *sqlx.DB, rp *redis.Pool, rc redis.Conn, bcast *models.BroadcastBatch) (int, int, bool, error) {
+	// if our broadcast has been cancelled, skip this batch
+	cancelled, err := IsCancelled(rc, bcast.BroadcastID())
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if cancelled {
+		logrus.WithField("broadcast_id", bcast.BroadcastID()).Info("skipping batch of cancelled broadcast")
+		return 0, 0, true, nil
+	}
 
 	oa, err := models.GetOrgAssets(ctx, db, bcast.OrgID())
 	if err != nil {
-		return errors.Wrapf(err, "error getting org assets")
+		return 0, 0, false, errors.Wrapf(err, "error getting org assets")
+	}
+
+	// create and queue our messages in a transaction, so that if we fail, we can be retried without sending twice
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, 0, false, errors.Wrapf(err, "error starting transaction")
 	}
 
 	// create this batch of messages
-	msgs, err := models.CreateBroadcastMessages(ctx, db, rp, oa, bcast)
+	msgs, noTemplate, err := models.CreateBroadcastMessages(ctx, tx, rp, oa, bcast)
 	if err != nil {
-		return errors.Wrapf(err, "error creating broadcast messages")
+		tx.Rollback()
+		return 0, 0, false, errors.Wrapf(err, "error creating broadcast messages")
 	}
 
 	// and queue them to courier for sending
-	rc := rp.Get()
-	defer rc.Close()
+	err = courier.SendMessages(ctx, tx, rc, oa, msgs)
+	if err != nil {
+		tx.Rollback()
+		return 0, 0, false, errors.Wrapf(err, "error queuing broadcast messages")
+	}
 
-	err = courier.QueueMessages(rc, msgs)
+	err = tx.Commit()
 	if err != nil {
-		return errors.Wrapf(err, "error queuing broadcast messages")
+		return 0, 0, false, errors.Wrapf(err, "error committing broadcast messages")
 	}
 
-	return nil
+	return len(msgs), len(noTemplate), false, nil
 }
@@ -105,7 +105,7 @@ func TestBroadcastEvents(t *testing.T) {
 			err = json.Unmarshal(task.Task, batch)
 			assert.NoError(t, err)
 
-			err = SendBroadcastBatch(ctx, db, rp, batch)
+			err = SendBroadcastBatch(ctx, db, rp, batch, true)
 			assert.NoError(t, err)
 		}
 
@@ -168,6 +168,13 @@ func TestBroadcastTask(t *testing.T) {
 	doctorsOnly := []models.GroupID{models.DoctorsGroupID}
 	cathyOnly := []models.ContactID{models.CathyID}
 
+	// a window which is always open and one which has just closed for cathy, whose timezone will be inferred from her
+	// +1 206 number as Los Angeles
+	la, _ := time.LoadLocation("America/Los_Angeles")
+	justClosed := time.Now().In(la).Add(-time.Minute)
+	alwaysOpen := &models.DeliveryWindow{Start: "00:00", End: "00:00"}
+	justClosedForCathy := &models.DeliveryWindow{Start: justClosed.Add(-time.Minute).Format("15:04"), End: justClosed.Format("15:04")}
+
 	// add an extra URN fo cathy
 	db.MustExec(
 		`INSERT INTO contacts_contacturn(org_id, contact_id, scheme, path, identity, priority) 
@@ -181,14 +188,18 @@ func TestBroadcastTask(t *testing.T) {
 		GroupIDs      []models.GroupID
 		ContactIDs    []models.ContactID
 		URNs          []urns.URN
+		Window        *models.DeliveryWindow
 		Queue         string
 		BatchCount    int
+		DelayedCount  int
 		MsgCount      int
 		MsgText       string
 	}{
-		{models.NilBroadcastID, evaluated, models.TemplateStateEvaluated, eng, doctorsOnly, cathyOnly, nil, queue.BatchQueue, 2, 121, "hello world"},
-		{legacyID, legacy, models.TemplateStateLegacy, eng, nil, cathyOnly, nil, queue.HandlerQueue, 1, 1, "hi Cathy legacy URN: +12065551212 Gender: F"},
-		{models.NilBroadcastID, template, models.TemplateStateUnevaluated, eng, nil, cathyOnly, nil, queue.HandlerQueue, 1, 1, "hi Cathy from Nyaruka goflow URN: tel:+12065551212 Gender: F"},
+		{models.NilBroadcastID, evaluated, models.TemplateStateEvaluated, eng, doctorsOnly, cathyOnly, nil, nil, queue.BatchQueue, 2, 0, 121, "hello world"},
+		{legacyID, legacy, models.TemplateStateLegacy, eng, nil, cathyOnly, nil, nil, queue.HandlerQueue, 1, 0, 1, "hi Cathy legacy URN: +12065551212 Gender: F"},
+		{models.NilBroadcastID, template, models.TemplateStateUnevaluated, eng, nil, cathyOnly, nil, nil, queue.HandlerQueue, 1, 0, 1, "hi Cathy from Nyaruka goflow URN: tel:+12065551212 Gender: F"},
+		{models.NilBroadcastID, evaluated, models.TemplateStateEvaluated, eng, doctorsOnly, cathyOnly, nil, alwaysOpen, queue.BatchQueue, 2, 0, 121, "hello world"},
+		{models.NilBroadcastID, evaluated, models.TemplateStateEvaluated, eng, nil, cathyOnly, nil, justClosedForCathy, queue.HandlerQueue, 0, 1, 0, "hello world"},
 	}
 
 	lastNow := time.Now()
@@ -197,6 +208,7 @@ func TestBroadcastTask(t *testing.T) {
 	for i, tc := range tcs {
 		// handle our start task
 		bcast := models.NewBroadcast(oa.OrgID(), tc.BroadcastID, tc.Translations, tc.TemplateState, tc.BaseLanguage, tc.URNs, tc.ContactIDs, tc.GroupIDs)
+		bcast.SetDeliveryWindow(tc.Window)
 		err = CreateBroadcastBatches(ctx, db, rp, bcast)
 		assert.NoError(t, err)
 
@@ -216,7 +228,7 @@ func TestBroadcastTask(t *testing.T) {
 			err = json.Unmarshal(task.Task, batch)
 			assert.NoError(t, err)
 
-			err = SendBroadcastBatch(ctx, db, rp, batch)
+			err = SendBroadcastBatch(ctx, db, rp, batch, true)
 			assert.NoError(t, err)
 		}
 
@@ -228,6 +240,11 @@ func TestBroadcastTask(t *testing.T) {
 			`SELECT count(*) FROM msgs_msg WHERE org_id = 1 AND created_on > $1 AND topup_id IS NOT NULL AND text = $2`,
 			[]interface{}{lastNow, tc.MsgText}, tc.MsgCount, "%d: unexpected msg count", i)
 
+		// contacts outside of the delivery window should have their batches delayed
+		delayed, err := queue.DelayedSize(rc, tc.Queue)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.DelayedCount, delayed, "%d: unexpected delayed batch count", i)
+
 		// make sure our broadcast is marked as sent
 		if tc.BroadcastID != models.NilBroadcastID {
 			testsuite.AssertQueryCount(t, db,
@@ -239,3 +256,80 @@ func TestBroadcastTask(t *testing.T) {
 		time.Sleep(10 * time.Millisecond)
 	}
 }
+
+func TestCancelledBroadcast(t *testing.T) {
+	testsuite.Reset()
+	ctx := testsuite.CTX()
+	rp := testsuite.RP()
+	db := testsuite.DB()
+	rc := testsuite.RC()
+	defer rc.Close()
+
+	var bcastID models.BroadcastID
+	err := db.Get(&bcastID,
+		`INSERT INTO msgs_broadcast(status, text, base_language, is_active, created_on, modified_on, send_all, created_by_id, modified_by_id, org_id)
+							 VALUES('Q', '"eng"=>"hello"'::hstore, 'eng', TRUE, NOW(), NOW(), FALSE, 1, 1, 1) RETURNING id`)
+	assert.NoError(t, err)
+
+	eng := envs.Language("eng")
+	translations := map[envs.Language]*models.BroadcastTranslation{eng: {Text: "hello cancelled"}}
+	bcast := models.NewBroadcast(models.Org1, bcastID, translations, models.TemplateStateEvaluated, eng, nil, nil, []models.GroupID{models.DoctorsGroupID})
+
+	err = CreateBroadcastBatches(ctx, db, rp, bcast)
+	assert.NoError(t, err)
+
+	progress, err := GetProgress(rc, bcastID)
+	assert.NoError(t, err)
+	assert.Equal(t, ProgressStatusQueued, progress.Status)
+	assert.Equal(t, 121, progress.Contacts)
+	assert.Equal(t, 2, progress.BatchesTotal)
+
+	// send our first batch, then cancel
+	task, err := queue.PopNextTask(rc, queue.BatchQueue)
+	assert.NoError(t, err)
+	batch := &models.BroadcastBatch{}
+	assert.NoError(t, json.Unmarshal(task.Task, batch))
+	assert.NoError(t, SendBroadcastBatch(ctx, db, rp, batch, true))
+
+	result, err := CancelBroadcast(rc, models.Org1, bcastID)
+	assert.NoError(t, err)
+	assert.Equal(t, CancelResultCancelled, result)
+
+	// our remaining batch should be skipped
+	task, err = queue.PopNextTask(rc, queue.BatchQueue)
+	assert.NoError(t, err)
+	batch = &models.BroadcastBatch{}
+	assert.NoError(t, json.Unmarshal(task.Task, batch))
+	assert.NoError(t, SendBroadcastBatch(ctx, db, rp, batch, true))
+
+	progress, err = GetProgress(rc, bcastID)
+	assert.NoError(t, err)
+	assert.Equal(t, ProgressStatusCancelled, progress.Status)
+	assert.Equal(t, 1, progress.BatchesCompleted)
+	assert.Equal(t, 1, progress.BatchesSkipped)
+	assert.True(t, progress.MsgsCreated > 0)
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM msgs_msg WHERE text = 'hello cancelled'`, nil, progress.MsgsCreated)
+
+	// and our broadcast marked as cancelled
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM msgs_broadcast WHERE id = $1 AND status = 'C'`, []interface{}{bcastID}, 1)
+
+	// a broadcast cancelled before it starts only has an empty batch which is skipped
+	bcast = models.NewBroadcast(models.Org1, bcastID+1000, translations, models.TemplateStateEvaluated, eng, nil, nil, []models.GroupID{models.DoctorsGroupID})
+	_, err = CancelBroadcast(rc, models.Org1, bcast.BroadcastID())
+	assert.NoError(t, err)
+
+	err = CreateBroadcastBatches(ctx, db, rp, bcast)
+	assert.NoError(t, err)
+
+	size, err := queue.Size(rc, queue.BatchQueue)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, size)
+
+	task, err = queue.PopNextTask(rc, queue.HandlerQueue)
+	assert.NoError(t, err)
+	batch = &models.BroadcastBatch{}
+	assert.NoError(t, json.Unmarshal(task.Task, batch))
+	assert.True(t, batch.IsLast())
+	assert.Empty(t, batch.ContactIDs())
+}
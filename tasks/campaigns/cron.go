@@ -11,6 +11,7 @@ import (
 	"github.com/nyaruka/librato"
 	"github.com/nyaruka/mailroom"
 	"github.com/nyaruka/mailroom/cron"
+	"github.com/nyaruka/mailroom/locker"
 	"github.com/nyaruka/mailroom/marker"
 	"github.com/nyaruka/mailroom/models"
 	"github.com/nyaruka/mailroom/queue"
@@ -31,8 +32,8 @@ func init() {
 // StartCampaignCron starts our cron job of firing expired campaign events
 func StartCampaignCron(mr *mailroom.Mailroom) error {
 	cron.StartCron(mr.Quit, mr.RP, campaignsLock, time.Second*60,
-		func(lockName string, lockValue string) error {
-			ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
+		func(ctx context.Context, lockName string, lockValue string) error {
+			ctx, cancel := context.WithTimeout(ctx, time.Minute*5)
 			defer cancel()
 			return fireCampaignEvents(ctx, mr.DB, mr.RP, lockName, lockValue)
 		},
@@ -74,6 +75,11 @@ func fireCampaignEvents(ctx context.Context, db *sqlx.DB, rp *redis.Pool, lockNa
 			task.FireIDs = fireIDs[:batchSize]
 			fireIDs = fireIDs[batchSize:]
 
+			// make sure we still hold our lock before queuing
+			if err := locker.CheckContext(ctx); err != nil {
+				return errors.Wrapf(err, "error checking lock")
+			}
+
 			err = queue.AddTask(rc, queue.BatchQueue, queue.FireCampaignEvent, int(task.OrgID), task, queue.DefaultPriority)
 			if err != nil {
 				return errors.Wrap(err, "error queuing task")
@@ -10,6 +10,7 @@ import (
 	"github.com/nyaruka/goflow/flows"
 	"github.com/nyaruka/mailroom"
 	"github.com/nyaruka/mailroom/cron"
+	"github.com/nyaruka/mailroom/locker"
 	"github.com/nyaruka/mailroom/marker"
 	"github.com/nyaruka/mailroom/models"
 	"github.com/nyaruka/mailroom/tasks/handler"
@@ -30,8 +31,8 @@ func init() {
 // StartExpirationCron starts our cron job of expiring runs every minute
 func StartExpirationCron(mr *mailroom.Mailroom) error {
 	cron.StartCron(mr.Quit, mr.RP, expirationLock, time.Second*60,
-		func(lockName string, lockValue string) error {
-			ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
+		func(ctx context.Context, lockName string, lockValue string) error {
+			ctx, cancel := context.WithTimeout(ctx, time.Minute*5)
 			defer cancel()
 			return expireRuns(ctx, mr.DB, mr.RP, lockName, lockValue)
 		},
@@ -103,6 +104,11 @@ func expireRuns(ctx context.Context, db *sqlx.DB, rp *redis.Pool, lockName strin
 			continue
 		}
 
+		// make sure we still hold our lock before queuing
+		if err := locker.CheckContext(ctx); err != nil {
+			return errors.Wrapf(err, "error checking lock")
+		}
+
 		// ok, queue this task
 		task := handler.NewExpirationTask(expiration.OrgID, expiration.ContactID, *expiration.SessionID, expiration.RunID, expiration.ExpiresOn)
 		err = handler.AddHandleTask(rc, expiration.ContactID, task)
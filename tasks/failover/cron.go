@@ -0,0 +1,165 @@
+package failover
+
+import (
+	"context"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/jmoiron/sqlx"
+	"github.com/nyaruka/goflow/assets"
+	"github.com/nyaruka/mailroom"
+	"github.com/nyaruka/mailroom/courier"
+	"github.com/nyaruka/mailroom/cron"
+	"github.com/nyaruka/mailroom/locker"
+	"github.com/nyaruka/mailroom/models"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	failoverLock = "failover_msgs"
+
+	// how far back we look for failed messages
+	failoverWindow = time.Hour
+
+	// max number of failed messages we process each run
+	failoverBatchSize = 1000
+
+	// a channel with this many failed messages in a run is marked as unhealthy
+	unhealthyThreshold = 10
+
+	// and stays that way for this long
+	unhealthyDuration = time.Minute * 15
+)
+
+func init() {
+	mailroom.AddInitFunction(StartFailoverCron)
+}
+
+// StartFailoverCron starts our cron job of re-routing permanently failed messages to other channels
+func StartFailoverCron(mr *mailroom.Mailroom) error {
+	cron.StartCron(mr.Quit, mr.RP, failoverLock, time.Minute,
+		func(ctx context.Context, lockName string, lockValue string) error {
+			ctx, cancel := context.WithTimeout(ctx, time.Minute*5)
+			defer cancel()
+			return failoverMsgs(ctx, mr.DB, mr.RP, lockName, lockValue)
+		},
+	)
+	return nil
+}
+
+// failoverMsgs looks for outgoing messages which have failed permanently, for orgs which use failover, and re-routes
+// them to the next eligible channel for their URN. Channels with lots of failures are also marked as unhealthy so that
+// new messages are re-routed away from them before they are sent.
+func failoverMsgs(ctx context.Context, db *sqlx.DB, rp *redis.Pool, lockName string, lockValue string) error {
+	log := logrus.WithField("comp", "failover").WithField("lock", lockValue)
+	start := time.Now()
+
+	msgs, err := models.LoadMessagesForFailover(ctx, db, start.Add(-failoverWindow), failoverBatchSize)
+	if err != nil {
+		return err
+	}
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	// mark any channels with too many failures as unhealthy
+	failures := make(map[assets.ChannelUUID]int)
+	for _, msg := range msgs {
+		failures[msg.ChannelUUID()]++
+	}
+	for uuid, count := range failures {
+		if count >= unhealthyThreshold {
+			log.WithField("channel_uuid", uuid).WithField("failures", count).Warn("marking channel as unhealthy")
+			if err := models.MarkChannelUnhealthy(rc, uuid, unhealthyDuration); err != nil {
+				return err
+			}
+		}
+	}
+
+	// group our messages by org
+	byOrg := make(map[models.OrgID][]*models.Msg)
+	for _, msg := range msgs {
+		byOrg[msg.OrgID()] = append(byOrg[msg.OrgID()], msg)
+	}
+
+	rerouted := 0
+	for orgID, orgMsgs := range byOrg {
+		oa, err := models.GetOrgAssets(ctx, db, orgID)
+		if err != nil {
+			return errors.Wrapf(err, "error loading org assets for org: %d", orgID)
+		}
+
+		// make sure we still hold our lock before re-routing
+		if err := locker.CheckContext(ctx); err != nil {
+			return errors.Wrapf(err, "error checking lock")
+		}
+
+		count, err := failoverOrgMsgs(ctx, db, rc, oa, orgMsgs)
+		if err != nil {
+			return errors.Wrapf(err, "error failing over msgs for org: %d", orgID)
+		}
+		rerouted += count
+	}
+
+	log.WithField("elapsed", time.Since(start)).WithField("failed", len(msgs)).WithField("rerouted", rerouted).Info("failover complete")
+	return nil
+}
+
+// failoverOrgMsgs re-routes the passed in failed messages for a single org, returning how many could be re-routed
+func failoverOrgMsgs(ctx context.Context, db *sqlx.DB, rc redis.Conn, oa *models.OrgAssets, msgs []*models.Msg) (int, error) {
+	channels, _ := oa.Channels()
+	uuids := make([]assets.ChannelUUID, len(channels))
+	for i, c := range channels {
+		uuids[i] = c.UUID()
+	}
+
+	unhealthy, err := models.UnhealthyChannels(rc, uuids)
+	if err != nil {
+		return 0, err
+	}
+
+	rerouted := make([]*models.Msg, 0, len(msgs))
+	exhausted := make([]*models.Msg, 0)
+
+	for _, msg := range msgs {
+		// never fail back over to a channel this message has already failed on, or one which is unhealthy
+		exclude := map[assets.ChannelUUID]bool{msg.ChannelUUID(): true}
+		for _, uuid := range msg.FailedOverFrom() {
+			exclude[uuid] = true
+		}
+		for uuid := range unhealthy {
+			exclude[uuid] = true
+		}
+
+		channel := models.FailoverChannel(oa, msg.URN(), exclude)
+		if channel == nil {
+			exhausted = append(exhausted, msg)
+			continue
+		}
+
+		msg.Failover(channel, models.FailoverReasonFailed)
+		rerouted = append(rerouted, msg)
+	}
+
+	// messages with nowhere left to go are left failed, but with a reason so we don't look at them again
+	if len(exhausted) > 0 {
+		if err := models.FailMessages(ctx, db, exhausted, models.FailedReasonNoFailover); err != nil {
+			return 0, err
+		}
+	}
+
+	if len(rerouted) == 0 {
+		return 0, nil
+	}
+
+	if err := models.UpdateMessageRoutes(ctx, db, rerouted); err != nil {
+		return 0, err
+	}
+
+	if err := courier.QueueMessages(rc, rerouted); err != nil {
+		return 0, errors.Wrapf(err, "error queuing failed over msgs")
+	}
+
+	return len(rerouted), nil
+}
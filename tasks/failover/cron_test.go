@@ -0,0 +1,73 @@
+package failover
+
+import (
+	"testing"
+
+	"github.com/nyaruka/goflow/assets"
+	"github.com/nyaruka/goflow/utils/uuids"
+	"github.com/nyaruka/mailroom/models"
+	"github.com/nyaruka/mailroom/testsuite"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFailover(t *testing.T) {
+	testsuite.Reset()
+	ctx := testsuite.CTX()
+	db := testsuite.DB()
+	rp := testsuite.RP()
+
+	insertFailed := func(orgID models.OrgID, channelID models.ChannelID, contactID models.ContactID, urnID models.URNID, metadata string) models.MsgID {
+		var id models.MsgID
+		err := db.Get(&id,
+			`INSERT INTO msgs_msg(uuid, text, high_priority, created_on, modified_on, direction, status, visibility, msg_type, msg_count, error_count, next_attempt, metadata, channel_id, contact_id, contact_urn_id, org_id)
+			 VALUES($1, 'hello', FALSE, NOW(), NOW(), 'O', 'F', 'V', 'F', 1, 3, NOW(), $2, $3, $4, $5, $6) RETURNING id`,
+			uuids.New(), metadata, channelID, contactID, urnID, orgID)
+		assert.NoError(t, err)
+		return id
+	}
+
+	// a failed msg on an org which doesn't use failover is left alone
+	msg1 := insertFailed(models.Org1, models.TwilioChannelID, models.CathyID, models.CathyURNID, "")
+
+	err := failoverMsgs(ctx, db, rp, failoverLock, "foo")
+	assert.NoError(t, err)
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM msgs_msg WHERE id = $1 AND status = 'F' AND channel_id = $2`, []interface{}{msg1, models.TwilioChannelID}, 1)
+
+	db.MustExec(`UPDATE orgs_org SET config = '{"channel_failover": true}' WHERE id = $1`, models.Org1)
+	models.FlushCache()
+
+	// msgs failed by mailroom itself are also left alone
+	msg2 := insertFailed(models.Org1, models.TwilioChannelID, models.CathyID, models.CathyURNID, `{"failed_reason": "frequency_cap"}`)
+
+	err = failoverMsgs(ctx, db, rp, failoverLock, "foo")
+	assert.NoError(t, err)
+
+	// our first msg should now be queued on our other tel channel
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM msgs_msg WHERE id = $1 AND status = 'Q' AND error_count = 0 AND channel_id = $2 AND metadata LIKE '%"reason":"failed"%'`, []interface{}{msg1, models.NexmoChannelID}, 1)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM msgs_msg WHERE id = $1 AND status = 'F' AND channel_id = $2`, []interface{}{msg2, models.TwilioChannelID}, 1)
+
+	// if it fails again, there's nowhere left to go
+	db.MustExec(`UPDATE msgs_msg SET status = 'F', modified_on = NOW() WHERE id = $1`, msg1)
+
+	err = failoverMsgs(ctx, db, rp, failoverLock, "foo")
+	assert.NoError(t, err)
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM msgs_msg WHERE id = $1 AND status = 'F' AND channel_id = $2 AND metadata LIKE '%"failed_reason":"no_failover_channel"%'`, []interface{}{msg1, models.NexmoChannelID}, 1)
+
+	// lots of failures on a channel mark it as unhealthy
+	for i := 0; i < unhealthyThreshold; i++ {
+		insertFailed(models.Org1, models.TwilioChannelID, models.CathyID, models.CathyURNID, "")
+	}
+
+	err = failoverMsgs(ctx, db, rp, failoverLock, "foo")
+	assert.NoError(t, err)
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	unhealthy, err := models.UnhealthyChannels(rc, []assets.ChannelUUID{models.TwilioChannelUUID, models.NexmoChannelUUID})
+	assert.NoError(t, err)
+	assert.Equal(t, map[assets.ChannelUUID]bool{models.TwilioChannelUUID: true}, unhealthy)
+}
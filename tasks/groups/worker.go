@@ -15,7 +15,7 @@ import (
 )
 
 func init() {
-	mailroom.AddTaskFunction(queue.PopulateDynamicGroup, handlePopulateDynamicGroup)
+	mailroom.AddRetryableTaskFunction(queue.PopulateDynamicGroup, handlePopulateDynamicGroup)
 }
 
 // PopulateTask is our definition of our group population
@@ -43,11 +43,17 @@ func handlePopulateDynamicGroup(ctx context.Context, mr *mailroom.Mailroom, task
 	}
 
 	lockKey := fmt.Sprintf(populateLockKey, t.GroupID)
-	lock, err := locker.GrabLock(mr.RP, lockKey, time.Hour, time.Minute*5)
+	lock, err := locker.AcquireLock(ctx, mr.RP, lockKey, time.Hour, time.Minute*5)
 	if err != nil {
 		return errors.Wrapf(err, "error grabbing lock to repopulate dynamic group: %d", t.GroupID)
 	}
-	defer locker.ReleaseLock(mr.RP, lockKey, lock)
+	if lock == nil {
+		return errors.Errorf("timed out waiting for lock to repopulate dynamic group: %d", t.GroupID)
+	}
+	defer lock.Release()
+
+	// if we lose our lock, stop populating as another process may now be doing the same
+	ctx = lock.Context()
 
 	start := time.Now()
 	log := logrus.WithFields(logrus.Fields{
@@ -11,6 +11,7 @@ import (
 	"github.com/nyaruka/mailroom"
 	"github.com/nyaruka/mailroom/config"
 	"github.com/nyaruka/mailroom/cron"
+	"github.com/nyaruka/mailroom/locker"
 	"github.com/nyaruka/mailroom/marker"
 	"github.com/nyaruka/mailroom/models"
 	"github.com/nyaruka/mailroom/queue"
@@ -30,8 +31,8 @@ func init() {
 // StartRetryCron starts our cron job of retrying pending incoming messages
 func StartRetryCron(mr *mailroom.Mailroom) error {
 	cron.StartCron(mr.Quit, mr.RP, retryLock, time.Minute*5,
-		func(lockName string, lockValue string) error {
-			ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
+		func(ctx context.Context, lockName string, lockValue string) error {
+			ctx, cancel := context.WithTimeout(ctx, time.Minute*5)
 			defer cancel()
 			return retryPendingMsgs(ctx, mr.DB, mr.RP, lockName, lockValue)
 		},
@@ -102,6 +103,11 @@ func retryPendingMsgs(ctx context.Context, db *sqlx.DB, rp *redis.Pool, lockName
 			QueuedOn: time.Now(),
 		}
 
+		// make sure we still hold our lock before queuing
+		if err := locker.CheckContext(ctx); err != nil {
+			return errors.Wrapf(err, "error checking lock")
+		}
+
 		// queue this event up for handling
 		err = AddHandleTask(rc, contactID, task)
 		if err != nil {
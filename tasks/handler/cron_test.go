@@ -6,6 +6,7 @@ import (
 
 	"github.com/nyaruka/goflow/utils/uuids"
 
+	"github.com/nyaruka/mailroom/config"
 	_ "github.com/nyaruka/mailroom/hooks"
 	"github.com/nyaruka/mailroom/models"
 	"github.com/nyaruka/mailroom/queue"
@@ -49,7 +50,7 @@ func TestRetryMsgs(t *testing.T) {
 	// should have one message requeued
 	task, _ := queue.PopNextTask(rc, queue.HandlerQueue)
 	assert.NotNil(t, task)
-	err = handleContactEvent(ctx, db, rp, task)
+	err = handleContactEvent(ctx, config.Mailroom, db, rp, task)
 	assert.NoError(t, err)
 
 	// message should be handled now
@@ -0,0 +1,89 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/nyaruka/mailroom"
+	"github.com/nyaruka/mailroom/courier"
+	"github.com/nyaruka/mailroom/models"
+	"github.com/nyaruka/mailroom/queue"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	mailroom.AddRetryableTaskFunction(queue.SendDeferredMsgs, handleSendDeferredMsgs)
+}
+
+// handleSendDeferredMsgs queues messages which were deferred by a frequency cap to courier, unless they are still over it
+func handleSendDeferredMsgs(ctx context.Context, mr *mailroom.Mailroom, task *queue.Task) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	if task.Type != queue.SendDeferredMsgs {
+		return errors.Errorf("unknown event type passed to deferred msgs worker: %s", task.Type)
+	}
+	t := &courier.DeferredMsgsTask{}
+	err := json.Unmarshal(task.Task, t)
+	if err != nil {
+		return errors.Wrapf(err, "error unmarshalling task: %s", string(task.Task))
+	}
+
+	oa, err := models.GetOrgAssets(ctx, mr.DB, models.OrgID(task.OrgID))
+	if err != nil {
+		return errors.Wrapf(err, "error getting org assets")
+	}
+
+	// load our messages, ignoring any which have been cancelled or sent since they were deferred
+	msgs, err := models.LoadDeferredMessages(ctx, mr.DB, oa.OrgID(), t.MsgIDs)
+	if err != nil {
+		return err
+	}
+
+	// reattach our channels, failing any messages whose channel has since been removed
+	withChannel := make([]*models.Msg, 0, len(msgs))
+	orphaned := make([]*models.Msg, 0)
+	for _, msg := range msgs {
+		channel := oa.ChannelByUUID(msg.ChannelUUID())
+		if channel == nil {
+			orphaned = append(orphaned, msg)
+			continue
+		}
+		msg.SetChannel(channel)
+		withChannel = append(withChannel, msg)
+	}
+
+	if len(orphaned) > 0 {
+		logrus.WithField("org_id", oa.OrgID()).WithField("count", len(orphaned)).Warn("cancelling deferred msgs whose channel no longer exists")
+		if err := models.FailMessages(ctx, mr.DB, orphaned, models.FailedReasonCancelled); err != nil {
+			return err
+		}
+	}
+
+	rc := mr.RP.Get()
+	defer rc.Close()
+
+	// mark our messages as queued and send them in the same transaction, so they stay deferred if sending fails
+	tx, err := mr.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		return errors.Wrapf(err, "error starting transaction")
+	}
+
+	queued, err := models.MarkPendingMessagesQueued(ctx, tx, withChannel)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := courier.SendMessages(ctx, tx, rc, oa, queued); err != nil {
+		tx.Rollback()
+		return errors.Wrapf(err, "error sending deferred msgs")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrapf(err, "error committing deferred msgs")
+	}
+	return nil
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/nyaruka/gocommon/urns"
 	"github.com/nyaruka/goflow/flows"
 	"github.com/nyaruka/goflow/utils/uuids"
+	"github.com/nyaruka/mailroom/config"
 	_ "github.com/nyaruka/mailroom/hooks"
 	"github.com/nyaruka/mailroom/models"
 	"github.com/nyaruka/mailroom/queue"
@@ -138,7 +139,7 @@ func TestMsgEvents(t *testing.T) {
 		task, err = queue.PopNextTask(rc, queue.HandlerQueue)
 		assert.NoError(t, err, "%d: error popping next task", i)
 
-		err = handleContactEvent(ctx, db, rp, task)
+		err = handleContactEvent(ctx, config.Mailroom, db, rp, task)
 		assert.NoError(t, err, "%d: error when handling event", i)
 
 		// if we are meant to have a response
@@ -171,15 +172,30 @@ func TestMsgEvents(t *testing.T) {
 	task = makeMsgTask(models.Org2, models.Org2ChannelID, models.Org2FredID, models.Org2FredURN, models.Org2FredURNID, "red")
 	AddHandleTask(rc, models.Org2FredID, task)
 
-	// should get requeued three times automatically
-	for i := 0; i < 3; i++ {
-		task, _ = queue.PopNextTask(rc, queue.HandlerQueue)
-		assert.NotNil(t, task)
-		err := handleContactEvent(ctx, db, rp, task)
-		assert.NoError(t, err)
+	fredQ := fmt.Sprintf("c:%d:%d", models.Org2, models.Org2FredID)
+
+	// should error and put our event back on Fred's queue for each retry of our task
+	task, _ = queue.PopNextTask(rc, queue.HandlerQueue)
+	assert.NotNil(t, task)
+
+	for i := 0; i < config.Mailroom.TaskMaxRetries; i++ {
+		task.ErrorCount = i
+		err := handleContactEvent(ctx, config.Mailroom, db, rp, task)
+		assert.Error(t, err)
+
+		count, _ := redis.Int(rc.Do("llen", fredQ))
+		assert.Equal(t, 1, count)
 	}
 
-	// on third error, no new task
+	// until our task has used up its retries, when the event is dropped
+	task.ErrorCount = config.Mailroom.TaskMaxRetries
+	err = handleContactEvent(ctx, config.Mailroom, db, rp, task)
+	assert.Error(t, err)
+
+	count, _ = redis.Int(rc.Do("llen", fredQ))
+	assert.Equal(t, 0, count)
+
+	// retries are handled by our workers so no new tasks were added
 	task, err = queue.PopNextTask(rc, queue.HandlerQueue)
 	assert.NoError(t, err)
 	assert.Nil(t, task)
@@ -193,7 +209,7 @@ func TestMsgEvents(t *testing.T) {
 	AddHandleTask(rc, models.Org2FredID, task)
 	task, _ = queue.PopNextTask(rc, queue.HandlerQueue)
 	assert.NotNil(t, task)
-	err = handleContactEvent(ctx, db, rp, task)
+	err = handleContactEvent(ctx, config.Mailroom, db, rp, task)
 	assert.NoError(t, err)
 
 	// should get our catch all trigger
@@ -212,7 +228,7 @@ func TestMsgEvents(t *testing.T) {
 	task = makeMsgTask(models.Org2, models.Org2ChannelID, models.Org2FredID, models.Org2FredURN, models.Org2FredURNID, "start")
 	AddHandleTask(rc, models.Org2FredID, task)
 	task, _ = queue.PopNextTask(rc, queue.HandlerQueue)
-	err = handleContactEvent(ctx, db, rp, task)
+	err = handleContactEvent(ctx, config.Mailroom, db, rp, task)
 	assert.NoError(t, err)
 
 	db.Get(&text, `SELECT text FROM msgs_msg WHERE contact_id = $1 AND direction = 'O' AND created_on > $2 ORDER BY id DESC LIMIT 1`, models.Org2FredID, previous)
@@ -287,7 +303,7 @@ func TestChannelEvents(t *testing.T) {
 		task, err = queue.PopNextTask(rc, queue.HandlerQueue)
 		assert.NoError(t, err, "%d: error popping next task", i)
 
-		err = handleContactEvent(ctx, db, rp, task)
+		err = handleContactEvent(ctx, config.Mailroom, db, rp, task)
 		assert.NoError(t, err, "%d: error when handling event", i)
 
 		// if we are meant to have a response
@@ -330,7 +346,7 @@ func TestStopEvent(t *testing.T) {
 	task, err = queue.PopNextTask(rc, queue.HandlerQueue)
 	assert.NoError(t, err, "error popping next task")
 
-	err = handleContactEvent(ctx, db, rp, task)
+	err = handleContactEvent(ctx, config.Mailroom, db, rp, task)
 	assert.NoError(t, err, "error when handling event")
 
 	// check that only george is in our group
@@ -458,7 +474,7 @@ func TestTimedEvents(t *testing.T) {
 		task, err = queue.PopNextTask(rc, queue.HandlerQueue)
 		assert.NoError(t, err, "%d: error popping next task", i)
 
-		err = handleContactEvent(ctx, db, rp, task)
+		err = handleContactEvent(ctx, config.Mailroom, db, rp, task)
 		assert.NoError(t, err, "%d: error when handling event", i)
 
 		var text string
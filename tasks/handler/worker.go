@@ -16,6 +16,7 @@ import (
 	"github.com/nyaruka/goflow/utils"
 	"github.com/nyaruka/librato"
 	"github.com/nyaruka/mailroom"
+	"github.com/nyaruka/mailroom/config"
 	"github.com/nyaruka/mailroom/locker"
 	"github.com/nyaruka/mailroom/models"
 	"github.com/nyaruka/mailroom/queue"
@@ -37,17 +38,11 @@ const (
 )
 
 func init() {
-	mailroom.AddTaskFunction(queue.HandleContactEvent, handleEvent)
+	mailroom.AddRetryableTaskFunction(queue.HandleContactEvent, handleEvent)
 }
 
 // AddHandleTask adds a single task for the passed in contact.
 func AddHandleTask(rc redis.Conn, contactID models.ContactID, task *queue.Task) error {
-	return addHandleTask(rc, contactID, task, false)
-}
-
-// addHandleTask adds a single task for the passed in contact. `front` specifies whether the task
-// should be inserted in front of all other tasks for that contact
-func addHandleTask(rc redis.Conn, contactID models.ContactID, task *queue.Task, front bool) error {
 	// marshal our task
 	taskJSON, err := json.Marshal(task)
 	if err != nil {
@@ -56,12 +51,7 @@ func addHandleTask(rc redis.Conn, contactID models.ContactID, task *queue.Task,
 
 	// first push the event on our contact queue
 	contactQ := fmt.Sprintf("c:%d:%d", task.OrgID, contactID)
-	if front {
-		_, err = redis.Int64(rc.Do("lpush", contactQ, string(taskJSON)))
-
-	} else {
-		_, err = redis.Int64(rc.Do("rpush", contactQ, string(taskJSON)))
-	}
+	_, err = redis.Int64(rc.Do("rpush", contactQ, string(taskJSON)))
 	if err != nil {
 		return errors.Wrapf(err, "error adding contact event")
 	}
@@ -78,12 +68,12 @@ func addHandleTask(rc redis.Conn, contactID models.ContactID, task *queue.Task,
 }
 
 func handleEvent(ctx context.Context, mr *mailroom.Mailroom, task *queue.Task) error {
-	return handleContactEvent(ctx, mr.DB, mr.RP, task)
+	return handleContactEvent(ctx, mr.Config, mr.DB, mr.RP, task)
 }
 
 // handleContactEvent is called when an event comes in for a contact.  to make sure we don't get into
 // a situation of being off by one, this task ingests and handles all the events for a contact, one by one
-func handleContactEvent(ctx context.Context, db *sqlx.DB, rp *redis.Pool, task *queue.Task) error {
+func handleContactEvent(ctx context.Context, config *config.Config, db *sqlx.DB, rp *redis.Pool, task *queue.Task) error {
 	ctx, cancel := context.WithTimeout(ctx, time.Minute*5)
 	defer cancel()
 
@@ -176,28 +166,19 @@ func handleContactEvent(ctx context.Context, db *sqlx.DB, rp *redis.Pool, task *
 		// and total latency for this task since it was queued
 		librato.Gauge(fmt.Sprintf("mr.%s_latency", contactEvent.Type), float64(time.Since(task.QueuedOn))/float64(time.Second))
 
-		// if we get an error processing an event, requeue it for later and return our error
+		// if we get an error processing an event, put it back in front of this contact's other events so that it is
+		// handled first when our task is retried, unless this task is about to be dead lettered
 		if err != nil {
-			log := logrus.WithFields(logrus.Fields{
-				"org_id":     task.OrgID,
-				"contact_id": eventTask.ContactID,
-				"event":      event,
-			})
-
-			contactEvent.ErrorCount++
-			if contactEvent.ErrorCount < 3 {
+			if task.ErrorCount < config.TaskMaxRetries {
 				rc := rp.Get()
-				retryErr := addHandleTask(rc, eventTask.ContactID, contactEvent, true)
-				if retryErr != nil {
-					logrus.WithError(retryErr).Error("error requeuing errored contact event")
-				}
+				_, requeueErr := rc.Do("lpush", contactQ, event)
 				rc.Close()
 
-				log.WithError(err).WithField("error_count", contactEvent.ErrorCount).Error("error handling contact event")
-				return nil
+				if requeueErr != nil {
+					logrus.WithError(requeueErr).WithField("event", event).Error("error requeuing errored contact event")
+				}
 			}
-			log.WithError(err).Error("error handling contact event, permanent failure")
-			return nil
+			return errors.Wrapf(err, "error handling contact event: %s", event)
 		}
 	}
 }
@@ -545,8 +526,14 @@ func handleMsgEvent(ctx context.Context, db *sqlx.DB, rp *redis.Pool, event *Msg
 		ticket.ForwardIncoming(ctx, db, oa, event.MsgUUID, event.Text, event.Attachments)
 	}
 
+	// the contact has responded so cancel any messages waiting to be sent to them later
+	err = models.CancelScheduledMessages(ctx, db, []models.ContactID{modelContact.ID()})
+	if err != nil {
+		return errors.Wrapf(err, "error cancelling scheduled messages for contact")
+	}
+
 	// find any matching triggers
-	trigger := models.FindMatchingMsgTrigger(oa, contact, event.Text)
+	trigger := models.FindMatchingMsgTrigger(oa, channel, contact, event.Text)
 
 	// get any active session for this contact
 	session, err := models.ActiveSessionForContact(ctx, db, oa, models.MessagingFlow, contact)
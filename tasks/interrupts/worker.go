@@ -14,7 +14,7 @@ import (
 )
 
 func init() {
-	mailroom.AddTaskFunction(queue.InterruptSessions, handleInterruptSessions)
+	mailroom.AddRetryableTaskFunction(queue.InterruptSessions, handleInterruptSessions)
 }
 
 // InterruptSessionsTask is our task for interrupting sessions
@@ -13,6 +13,8 @@ import (
 	"github.com/jmoiron/sqlx"
 	"github.com/nyaruka/mailroom"
 	"github.com/nyaruka/mailroom/cron"
+	"github.com/nyaruka/mailroom/locker"
+	"github.com/nyaruka/mailroom/tasks/starts"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
@@ -29,16 +31,16 @@ func init() {
 // StartIVRCron starts our cron job of retrying errored calls
 func StartIVRCron(mr *mailroom.Mailroom) error {
 	cron.StartCron(mr.Quit, mr.RP, retryIVRLock, time.Minute,
-		func(lockName string, lockValue string) error {
-			ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
+		func(ctx context.Context, lockName string, lockValue string) error {
+			ctx, cancel := context.WithTimeout(ctx, time.Minute*5)
 			defer cancel()
 			return retryCalls(ctx, mr.Config, mr.DB, mr.RP, retryIVRLock, lockValue)
 		},
 	)
 
 	cron.StartCron(mr.Quit, mr.RP, expireIVRLock, time.Minute,
-		func(lockName string, lockValue string) error {
-			ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
+		func(ctx context.Context, lockName string, lockValue string) error {
+			ctx, cancel := context.WithTimeout(ctx, time.Minute*5)
 			defer cancel()
 			return expireCalls(ctx, mr.Config, mr.DB, mr.RP, expireIVRLock, lockValue)
 		},
@@ -63,9 +65,20 @@ func retryCalls(ctx context.Context, config *config.Config, db *sqlx.DB, rp *red
 
 	throttledChannels := make(map[models.ChannelID]bool)
 
+	rc := rp.Get()
+	defer rc.Close()
+
+	// calls which were queued by a flow start count towards its progress until they're made
+	recordCallMade := func(conn *models.ChannelConnection) {
+		if err := starts.RecordQueuedCallMade(rc, conn.StartID()); err != nil {
+			log.WithError(err).WithField("start_id", conn.StartID()).Error("error recording queued call as made")
+		}
+	}
+
 	// schedules calls for each connection
 	for _, conn := range conns {
 		log = log.WithField("connection_id", conn.ID())
+		wasQueued := conn.Status() == models.ConnectionStatusQueued
 
 		// if the channel for this connection is throttled, move on
 		if throttledChannels[conn.ChannelID()] {
@@ -88,6 +101,8 @@ func retryCalls(ctx context.Context, config *config.Config, db *sqlx.DB, rp *red
 			err = models.UpdateChannelConnectionStatuses(ctx, db, []models.ConnectionID{conn.ID()}, models.ConnectionStatusFailed)
 			if err != nil {
 				log.WithError(err).WithField("channel_id", conn.ChannelID()).Error("error marking call as failed due to missing channel")
+			} else if wasQueued {
+				recordCallMade(conn)
 			}
 			continue
 		}
@@ -99,12 +114,21 @@ func retryCalls(ctx context.Context, config *config.Config, db *sqlx.DB, rp *red
 			continue
 		}
 
+		// make sure we still hold our lock before starting this call
+		if err := locker.CheckContext(ctx); err != nil {
+			return errors.Wrapf(err, "error checking lock")
+		}
+
 		err = ivr.RequestCallStartForConnection(ctx, config, db, channel, urn, conn)
 		if err != nil {
 			log.WithError(err).Error(err)
 			continue
 		}
 
+		if wasQueued && conn.Status() != models.ConnectionStatusQueued {
+			recordCallMade(conn)
+		}
+
 		// queued status on a connection we just tried means it is throttled, mark our channel as such
 		throttledChannels[conn.ChannelID()] = true
 	}
@@ -150,6 +174,11 @@ func expireCalls(ctx context.Context, config *config.Config, db *sqlx.DB, rp *re
 			continue
 		}
 
+		// make sure we still hold our lock before hanging up
+		if err := locker.CheckContext(ctx); err != nil {
+			return errors.Wrapf(err, "error checking lock")
+		}
+
 		// hang up our call
 		err = ivr.HangupCall(ctx, config, db, conn)
 		if err != nil {
@@ -43,7 +43,7 @@ func TestRetries(t *testing.T) {
 
 	client.callError = nil
 	client.callID = ivr.CallID("call1")
-	err = HandleFlowStartBatch(ctx, config.Mailroom, db, rp, batch)
+	_, err = HandleFlowStartBatch(ctx, config.Mailroom, db, rp, batch)
 	assert.NoError(t, err)
 	testsuite.AssertQueryCount(t, db, `SELECT COUNT(*) FROM channels_channelconnection WHERE contact_id = $1 AND status = $2 AND external_id = $3`, []interface{}{models.CathyID, models.ConnectionStatusWired, "call1"}, 1)
 
@@ -12,6 +12,7 @@ import (
 	"github.com/nyaruka/mailroom/ivr"
 	"github.com/nyaruka/mailroom/models"
 	"github.com/nyaruka/mailroom/queue"
+	"github.com/nyaruka/mailroom/tasks/starts"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
@@ -31,11 +32,26 @@ func handleFlowStartTask(ctx context.Context, mr *mailroom.Mailroom, task *queue
 		return errors.Wrapf(err, "error unmarshalling flow start batch: %s", string(task.Task))
 	}
 
-	return HandleFlowStartBatch(ctx, mr.Config, mr.DB, mr.RP, batch)
+	callsQueued, err := HandleFlowStartBatch(ctx, mr.Config, mr.DB, mr.RP, batch)
+
+	rc := mr.RP.Get()
+	defer rc.Close()
+
+	// record this batch as done even if requesting calls failed, so that our start can still be completed
+	rerr := starts.RecordIVRBatchCompleted(rc, batch, callsQueued)
+
+	if err != nil {
+		if rerr != nil {
+			logrus.WithError(rerr).WithField("start_id", batch.StartID()).Error("error recording failed start batch")
+		}
+		return err
+	}
+	return rerr
 }
 
-// HandleFlowStartBatch starts a batch of contacts in an IVR flow
-func HandleFlowStartBatch(bg context.Context, config *config.Config, db *sqlx.DB, rp *redis.Pool, batch *models.FlowStartBatch) error {
+// HandleFlowStartBatch starts a batch of contacts in an IVR flow, returning how many calls were queued rather than
+// requested because their channel is at its limit of concurrent calls
+func HandleFlowStartBatch(bg context.Context, config *config.Config, db *sqlx.DB, rp *redis.Pool, batch *models.FlowStartBatch) (int, error) {
 	ctx, cancel := context.WithTimeout(bg, time.Minute*5)
 	defer cancel()
 
@@ -47,7 +63,7 @@ func HandleFlowStartBatch(bg context.Context, config *config.Config, db *sqlx.DB
 		// find all participants that have been in this flow
 		started, err := models.FindFlowStartedOverlap(ctx, db, batch.FlowID(), batch.ContactIDs())
 		if err != nil {
-			return errors.Wrapf(err, "error finding others started flow: %d", batch.FlowID())
+			return 0, errors.Wrapf(err, "error finding others started flow: %d", batch.FlowID())
 		}
 		for _, c := range started {
 			exclude[c] = true
@@ -59,7 +75,7 @@ func HandleFlowStartBatch(bg context.Context, config *config.Config, db *sqlx.DB
 		// find all participants active in other sessions
 		active, err := models.FindActiveSessionOverlap(ctx, db, models.IVRFlow, batch.ContactIDs())
 		if err != nil {
-			return errors.Wrapf(err, "error finding other active sessions: %d", batch.FlowID())
+			return 0, errors.Wrapf(err, "error finding other active sessions: %d", batch.FlowID())
 		}
 		for _, c := range active {
 			exclude[c] = true
@@ -77,16 +93,17 @@ func HandleFlowStartBatch(bg context.Context, config *config.Config, db *sqlx.DB
 	// load our org assets
 	oa, err := models.GetOrgAssets(ctx, db, batch.OrgID())
 	if err != nil {
-		return errors.Wrapf(err, "error loading org assets for org: %d", batch.OrgID())
+		return 0, errors.Wrapf(err, "error loading org assets for org: %d", batch.OrgID())
 	}
 
 	// ok, we can initiate calls for the remaining contacts
 	contacts, err := models.LoadContacts(ctx, db, oa, contactIDs)
 	if err != nil {
-		return errors.Wrapf(err, "error loading contacts")
+		return 0, errors.Wrapf(err, "error loading contacts")
 	}
 
 	// for each contacts, request a call start
+	callsQueued := 0
 	for _, contact := range contacts {
 		start := time.Now()
 
@@ -105,6 +122,9 @@ func HandleFlowStartBatch(bg context.Context, config *config.Config, db *sqlx.DB
 			}).Info("call start skipped, no suitable channel")
 			continue
 		}
+		if session.Status() == models.ConnectionStatusQueued {
+			callsQueued++
+		}
 		logrus.WithFields(logrus.Fields{
 			"elapsed":     time.Since(start),
 			"contact_id":  contact.ID(),
@@ -118,9 +138,9 @@ func HandleFlowStartBatch(bg context.Context, config *config.Config, db *sqlx.DB
 	if batch.IsLast() {
 		err := models.MarkStartComplete(bg, db, batch.StartID())
 		if err != nil {
-			return errors.Wrapf(err, "error trying to set batch as complete")
+			return callsQueued, errors.Wrapf(err, "error trying to set batch as complete")
 		}
 	}
 
-	return nil
+	return callsQueued, nil
 }
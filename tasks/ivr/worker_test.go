@@ -50,21 +50,24 @@ func TestIVR(t *testing.T) {
 	assert.NoError(t, err)
 
 	client.callError = errors.Errorf("unable to create call")
-	err = HandleFlowStartBatch(ctx, config.Mailroom, db, rp, batch)
+	callsQueued, err := HandleFlowStartBatch(ctx, config.Mailroom, db, rp, batch)
 	assert.NoError(t, err)
+	assert.Equal(t, 0, callsQueued)
 	testsuite.AssertQueryCount(t, db, `SELECT COUNT(*) FROM channels_channelconnection WHERE contact_id = $1 AND status = $2`, []interface{}{models.CathyID, models.ConnectionStatusFailed}, 1)
 
 	client.callError = nil
 	client.callID = ivr.CallID("call1")
-	err = HandleFlowStartBatch(ctx, config.Mailroom, db, rp, batch)
+	callsQueued, err = HandleFlowStartBatch(ctx, config.Mailroom, db, rp, batch)
 	assert.NoError(t, err)
+	assert.Equal(t, 0, callsQueued)
 	testsuite.AssertQueryCount(t, db, `SELECT COUNT(*) FROM channels_channelconnection WHERE contact_id = $1 AND status = $2 AND external_id = $3`, []interface{}{models.CathyID, models.ConnectionStatusWired, "call1"}, 1)
 
 	// trying again should put us in a throttled state (queued)
 	client.callError = nil
 	client.callID = ivr.CallID("call1")
-	err = HandleFlowStartBatch(ctx, config.Mailroom, db, rp, batch)
+	callsQueued, err = HandleFlowStartBatch(ctx, config.Mailroom, db, rp, batch)
 	assert.NoError(t, err)
+	assert.Equal(t, 1, callsQueued)
 	testsuite.AssertQueryCount(t, db, `SELECT COUNT(*) FROM channels_channelconnection WHERE contact_id = $1 AND status = $2 AND next_attempt IS NOT NULL;`, []interface{}{models.CathyID, models.ConnectionStatusQueued}, 1)
 }
 
@@ -2,12 +2,15 @@ package schedules
 
 import (
 	"context"
+	"fmt"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
 	"github.com/jmoiron/sqlx"
 	"github.com/nyaruka/mailroom"
+	"github.com/nyaruka/mailroom/config"
 	"github.com/nyaruka/mailroom/cron"
+	"github.com/nyaruka/mailroom/locker"
 	"github.com/nyaruka/mailroom/models"
 	"github.com/nyaruka/mailroom/queue"
 	"github.com/pkg/errors"
@@ -25,8 +28,8 @@ func init() {
 // StartCheckSchedules starts our cron job of firing schedules every minute
 func StartCheckSchedules(mr *mailroom.Mailroom) error {
 	cron.StartCron(mr.Quit, mr.RP, scheduleLock, time.Minute*1,
-		func(lockName string, lockValue string) error {
-			ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
+		func(ctx context.Context, lockName string, lockValue string) error {
+			ctx, cancel := context.WithTimeout(ctx, time.Minute*5)
 			defer cancel()
 			// we sleep 1 second since we fire right on the minute and want to make sure to fire
 			// things that are schedules right at the minute as well (and DB time may be slightly drifted)
@@ -51,6 +54,8 @@ func checkSchedules(ctx context.Context, db *sqlx.DB, rp *redis.Pool, lockName s
 		return errors.Wrapf(err, "error while getting unfired schedules")
 	}
 
+	dedupWindow := time.Second * time.Duration(config.Mailroom.TaskDedupWindow)
+
 	// for each unfired schedule
 	broadcasts := 0
 	triggers := 0
@@ -60,6 +65,12 @@ func checkSchedules(ctx context.Context, db *sqlx.DB, rp *redis.Pool, lockName s
 		log := log.WithField("schedule_id", s.ID())
 		now := time.Now()
 
+		// the fire we are handling, schedules are only unfired if they have a next fire
+		firedOn := now
+		if s.NextFire() != nil {
+			firedOn = *s.NextFire()
+		}
+
 		// grab our timezone
 		tz, err := s.Timezone()
 		if err != nil {
@@ -74,10 +85,41 @@ func checkSchedules(ctx context.Context, db *sqlx.DB, rp *redis.Pool, lockName s
 			continue
 		}
 
+		// make sure we still hold our lock before firing this schedule
+		if err := locker.CheckContext(ctx); err != nil {
+			return errors.Wrapf(err, "error checking lock")
+		}
+
+		// claim this fire before inserting anything for it, so that we only ever create and queue one broadcast or
+		// start for each fire of this schedule
+		dedupKey := fmt.Sprintf("schedule:%d:%d", s.ID(), firedOn.Unix())
+		claimed := false
+		if s.Broadcast() != nil || s.FlowStart() != nil {
+			claimed, err = queue.ClaimDedupKey(rc, queue.BatchQueue, dedupKey, dedupWindow)
+			if err != nil {
+				log.WithError(err).Error("error claiming schedule fire")
+				continue
+			}
+			if !claimed {
+				log.WithField("fired_on", firedOn).Warn("schedule fire already handled, ignoring")
+				continue
+			}
+		}
+
+		// release gives up our claim on this fire if we fail to handle it, so that it can be retried
+		release := func() {
+			if claimed {
+				if err := queue.ReleaseDedupKey(rc, queue.BatchQueue, dedupKey); err != nil {
+					log.WithError(err).Error("error releasing schedule fire")
+				}
+			}
+		}
+
 		// open a transaction for committing all the items for this fire
 		tx, err := db.BeginTxx(ctx, nil)
 		if err != nil {
 			log.WithError(err).Error("error starting transaction for schedule fire")
+			release()
 			continue
 		}
 
@@ -91,6 +133,7 @@ func checkSchedules(ctx context.Context, db *sqlx.DB, rp *redis.Pool, lockName s
 			if err != nil {
 				log.WithError(err).Error("error inserting new broadcast for schedule")
 				tx.Rollback()
+				release()
 				continue
 			}
 
@@ -107,6 +150,7 @@ func checkSchedules(ctx context.Context, db *sqlx.DB, rp *redis.Pool, lockName s
 			if err != nil {
 				log.WithError(err).Error("error inserting new flow start for schedule")
 				tx.Rollback()
+				release()
 				continue
 			}
 
@@ -124,6 +168,7 @@ func checkSchedules(ctx context.Context, db *sqlx.DB, rp *redis.Pool, lockName s
 		if err != nil {
 			log.WithError(err).Error("error updating next fire for schedule")
 			tx.Rollback()
+			release()
 			continue
 		}
 
@@ -132,10 +177,11 @@ func checkSchedules(ctx context.Context, db *sqlx.DB, rp *redis.Pool, lockName s
 		if err != nil {
 			log.WithError(err).Error("error comitting schedule transaction")
 			tx.Rollback()
+			release()
 			continue
 		}
 
-		// add our task if we have one
+		// add our task if we have one, we've already claimed this fire so it doesn't need deduping
 		if task != nil {
 			err = queue.AddTask(rc, queue.BatchQueue, taskName, int(s.OrgID()), task, queue.HighPriority)
 			if err != nil {
@@ -1,8 +1,12 @@
 package schedules
 
 import (
+	"encoding/json"
+	"fmt"
 	"testing"
+	"time"
 
+	"github.com/nyaruka/goflow/assets"
 	"github.com/nyaruka/mailroom/models"
 	"github.com/nyaruka/mailroom/queue"
 	"github.com/nyaruka/mailroom/testsuite"
@@ -126,3 +130,155 @@ func TestCheckSchedules(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Nil(t, task)
 }
+
+func TestCheckSchedulesEnding(t *testing.T) {
+	testsuite.Reset()
+	ctx := testsuite.CTX()
+	rp := testsuite.RP()
+	db := testsuite.DB()
+
+	// our RapidPro schema doesn't have these schedule columns yet so add them
+	db.MustExec(`ALTER TABLE schedules_schedule
+		ADD COLUMN repeat_week_of_month integer,
+		ADD COLUMN repeat_month_of_year integer,
+		ADD COLUMN repeat_cron character varying(255),
+		ADD COLUMN end_date timestamp with time zone,
+		ADD COLUMN max_fires integer,
+		ADD COLUMN fire_count integer NOT NULL DEFAULT 0,
+		ADD COLUMN timezone character varying(64)`)
+
+	// a daily schedule which can only fire twice and has already fired once
+	var s1 models.ScheduleID
+	err := db.Get(
+		&s1,
+		`INSERT INTO schedules_schedule(is_active, repeat_period, repeat_hour_of_day, repeat_minute_of_hour, max_fires, fire_count, created_on, modified_on, next_fire, created_by_id, modified_by_id, org_id)
+			VALUES(TRUE, 'D', 12, 0, 2, 1, NOW(), NOW(), NOW()- INTERVAL '1 DAY', 1, 1, $1) RETURNING id`,
+		models.Org1,
+	)
+	assert.NoError(t, err)
+
+	// a cron schedule in its own timezone which ends in a year
+	var s2 models.ScheduleID
+	err = db.Get(
+		&s2,
+		`INSERT INTO schedules_schedule(is_active, repeat_period, repeat_cron, timezone, end_date, fire_count, created_on, modified_on, next_fire, created_by_id, modified_by_id, org_id)
+			VALUES(TRUE, 'C', '0 9 * * MON', 'Africa/Kigali', NOW() + INTERVAL '1 YEAR', 0, NOW(), NOW(), NOW()- INTERVAL '1 DAY', 1, 1, $1) RETURNING id`,
+		models.Org1,
+	)
+	assert.NoError(t, err)
+
+	err = checkSchedules(ctx, db, rp, "lock", "lock")
+	assert.NoError(t, err)
+
+	// our first schedule has reached its max fires and is deactivated
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM schedules_schedule WHERE id = $1 AND next_fire IS NULL AND fire_count = 2 AND is_active = FALSE`, []interface{}{s1}, 1)
+
+	// our second fires next monday at 9am Kigali time
+	testsuite.AssertQueryCount(t, db,
+		`SELECT count(*) FROM schedules_schedule WHERE id = $1 AND fire_count = 1 AND is_active = TRUE AND
+		EXTRACT(DOW FROM next_fire AT TIME ZONE 'Africa/Kigali') = 1 AND EXTRACT(HOUR FROM next_fire AT TIME ZONE 'Africa/Kigali') = 9`,
+		[]interface{}{s2}, 1)
+}
+
+func TestCheckSchedulesAlreadyFired(t *testing.T) {
+	testsuite.Reset()
+	ctx := testsuite.CTX()
+	rp := testsuite.RP()
+	db := testsuite.DB()
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	var s1 models.ScheduleID
+	err := db.Get(
+		&s1,
+		`INSERT INTO schedules_schedule(is_active, repeat_period, created_on, modified_on, next_fire, created_by_id, modified_by_id, org_id)
+			VALUES(TRUE, 'O', NOW(), NOW(), '2020-01-01T10:00:00Z', 1, 1, $1) RETURNING id`,
+		models.Org1,
+	)
+	assert.NoError(t, err)
+	var b1 models.BroadcastID
+	err = db.Get(
+		&b1,
+		`INSERT INTO msgs_broadcast(status, text, base_language, is_active, created_on, modified_on, send_all, created_by_id, modified_by_id, org_id, schedule_id)
+			VALUES('P', hstore(ARRAY['eng','Test message']), 'eng', TRUE, NOW(), NOW(), TRUE, 1, 1, $1, $2) RETURNING id`,
+		models.Org1, s1,
+	)
+	assert.NoError(t, err)
+	db.MustExec(`INSERT INTO msgs_broadcast_contacts(broadcast_id, contact_id) VALUES($1, $2)`, b1, models.CathyID)
+
+	// another process has already claimed this fire
+	dedupKey := fmt.Sprintf("schedule:%d:%d", s1, time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC).Unix())
+	claimed, err := queue.ClaimDedupKey(rc, queue.BatchQueue, dedupKey, time.Hour)
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+
+	err = checkSchedules(ctx, db, rp, "lock", "lock")
+	assert.NoError(t, err)
+
+	// so nothing is inserted or queued and our schedule is left for that process
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM msgs_broadcast WHERE parent_id = $1`, []interface{}{b1}, 0)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM schedules_schedule WHERE id = $1 AND next_fire IS NOT NULL`, []interface{}{s1}, 1)
+
+	task, err := queue.PopNextTask(rc, queue.BatchQueue)
+	assert.NoError(t, err)
+	assert.Nil(t, task)
+
+	// once released, the fire can be handled
+	assert.NoError(t, queue.ReleaseDedupKey(rc, queue.BatchQueue, dedupKey))
+
+	err = checkSchedules(ctx, db, rp, "lock", "lock")
+	assert.NoError(t, err)
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM msgs_broadcast WHERE parent_id = $1`, []interface{}{b1}, 1)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM schedules_schedule WHERE id = $1 AND next_fire IS NULL`, []interface{}{s1}, 1)
+
+	task, err = queue.PopNextTask(rc, queue.BatchQueue)
+	assert.NoError(t, err)
+	assert.Equal(t, queue.SendBroadcast, task.Type)
+}
+
+func TestCheckSchedulesWithWindowAndTemplating(t *testing.T) {
+	testsuite.Reset()
+	ctx := testsuite.CTX()
+	rp := testsuite.RP()
+	db := testsuite.DB()
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	// a scheduled broadcast which should only be delivered during the day and sent with a template
+	var s1 models.ScheduleID
+	err := db.Get(
+		&s1,
+		`INSERT INTO schedules_schedule(is_active, repeat_period, created_on, modified_on, next_fire, created_by_id, modified_by_id, org_id)
+			VALUES(TRUE, 'O', NOW(), NOW(), NOW()- INTERVAL '1 DAY', 1, 1, $1) RETURNING id`,
+		models.Org1,
+	)
+	assert.NoError(t, err)
+	var b1 models.BroadcastID
+	err = db.Get(
+		&b1,
+		`INSERT INTO msgs_broadcast(status, text, base_language, is_active, created_on, modified_on, send_all, created_by_id, modified_by_id, org_id, schedule_id, metadata)
+			VALUES('P', hstore(ARRAY['eng','Test message']), 'eng', TRUE, NOW(), NOW(), TRUE, 1, 1, $1, $2, '{"delivery_window": {"start": "08:00", "end": "20:00", "timezone_field": "tz"}, "templating": {"template": {"uuid": "9c22b594-fcab-4b29-9bcb-ce4404894a80", "name": "revive_issue"}, "variables": []}}') RETURNING id`,
+		models.Org1, s1,
+	)
+	assert.NoError(t, err)
+	db.MustExec(`INSERT INTO msgs_broadcast_contacts(broadcast_id, contact_id) VALUES($1, $2)`, b1, models.CathyID)
+
+	err = checkSchedules(ctx, db, rp, "lock", "lock")
+	assert.NoError(t, err)
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM msgs_broadcast WHERE parent_id = $1`, []interface{}{b1}, 1)
+
+	// the broadcast we queue to send carries the window and templating of its parent
+	task, err := queue.PopNextTask(rc, queue.BatchQueue)
+	assert.NoError(t, err)
+	assert.Equal(t, queue.SendBroadcast, task.Type)
+
+	bcast := &models.Broadcast{}
+	err = json.Unmarshal(task.Task, bcast)
+	assert.NoError(t, err)
+	assert.Equal(t, &models.DeliveryWindow{Start: "08:00", End: "20:00", TimezoneField: "tz"}, bcast.DeliveryWindow())
+	assert.Equal(t, assets.TemplateUUID("9c22b594-fcab-4b29-9bcb-ce4404894a80"), bcast.Templating().Template.UUID)
+}
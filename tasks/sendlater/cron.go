@@ -0,0 +1,128 @@
+package sendlater
+
+import (
+	"context"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/jmoiron/sqlx"
+	"github.com/nyaruka/mailroom"
+	"github.com/nyaruka/mailroom/courier"
+	"github.com/nyaruka/mailroom/cron"
+	"github.com/nyaruka/mailroom/locker"
+	"github.com/nyaruka/mailroom/models"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	sendLaterLock = "send_later_msgs"
+
+	// max number of scheduled messages we send each run
+	sendLaterBatchSize = 1000
+)
+
+func init() {
+	mailroom.AddInitFunction(StartSendLaterCron)
+}
+
+// StartSendLaterCron starts our cron job of sending messages which flows scheduled to be sent later
+func StartSendLaterCron(mr *mailroom.Mailroom) error {
+	cron.StartCron(mr.Quit, mr.RP, sendLaterLock, time.Minute,
+		func(ctx context.Context, lockName string, lockValue string) error {
+			ctx, cancel := context.WithTimeout(ctx, time.Minute*5)
+			defer cancel()
+			return sendScheduledMsgs(ctx, mr.DB, mr.RP, lockName, lockValue)
+		},
+	)
+	return nil
+}
+
+// sendScheduledMsgs looks for scheduled messages which are now due and queues them to courier
+func sendScheduledMsgs(ctx context.Context, db *sqlx.DB, rp *redis.Pool, lockName string, lockValue string) error {
+	log := logrus.WithField("comp", "send_later").WithField("lock", lockValue)
+	start := time.Now()
+
+	msgs, err := models.LoadScheduledMessagesDue(ctx, db, start, sendLaterBatchSize)
+	if err != nil {
+		return err
+	}
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	// group our messages by org
+	byOrg := make(map[models.OrgID][]*models.Msg)
+	for _, msg := range msgs {
+		byOrg[msg.OrgID()] = append(byOrg[msg.OrgID()], msg)
+	}
+
+	sent := 0
+	for orgID, orgMsgs := range byOrg {
+		oa, err := models.GetOrgAssets(ctx, db, orgID)
+		if err != nil {
+			return errors.Wrapf(err, "error loading org assets for org: %d", orgID)
+		}
+
+		// make sure we still hold our lock before sending
+		if err := locker.CheckContext(ctx); err != nil {
+			return errors.Wrapf(err, "error checking lock")
+		}
+
+		count, err := sendOrgMsgs(ctx, db, rc, oa, orgMsgs)
+		if err != nil {
+			return errors.Wrapf(err, "error sending scheduled msgs for org: %d", orgID)
+		}
+		sent += count
+	}
+
+	log.WithField("elapsed", time.Since(start)).WithField("due", len(msgs)).WithField("sent", sent).Info("sent scheduled messages")
+	return nil
+}
+
+// sendOrgMsgs sends the passed in due messages for a single org, returning how many were sent
+func sendOrgMsgs(ctx context.Context, db *sqlx.DB, rc redis.Conn, oa *models.OrgAssets, msgs []*models.Msg) (int, error) {
+	// reattach our channels, cancelling any messages whose channel has since been removed
+	withChannel := make([]*models.Msg, 0, len(msgs))
+	orphaned := make([]*models.Msg, 0)
+	for _, msg := range msgs {
+		channel := oa.ChannelByUUID(msg.ChannelUUID())
+		if channel == nil {
+			orphaned = append(orphaned, msg)
+			continue
+		}
+		msg.SetChannel(channel)
+		withChannel = append(withChannel, msg)
+	}
+
+	if len(orphaned) > 0 {
+		logrus.WithField("org_id", oa.OrgID()).WithField("count", len(orphaned)).Warn("cancelling scheduled msgs whose channel no longer exists")
+		if err := models.FailMessages(ctx, db, orphaned, models.FailedReasonCancelled); err != nil {
+			return 0, err
+		}
+	}
+
+	// mark our messages as queued and send them in the same transaction, so they stay scheduled if sending fails
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, errors.Wrapf(err, "error starting transaction")
+	}
+
+	// only send the messages which haven't been cancelled since we loaded them
+	queued, err := models.MarkPendingMessagesQueued(ctx, tx, withChannel)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	if err := courier.SendMessages(ctx, tx, rc, oa, queued); err != nil {
+		tx.Rollback()
+		return 0, errors.Wrapf(err, "error queuing scheduled msgs")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, errors.Wrapf(err, "error committing scheduled msgs")
+	}
+
+	return len(queued), nil
+}
@@ -0,0 +1,55 @@
+package sendlater
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/goflow/utils/uuids"
+	"github.com/nyaruka/mailroom/models"
+	"github.com/nyaruka/mailroom/testsuite"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendLater(t *testing.T) {
+	testsuite.Reset()
+	ctx := testsuite.CTX()
+	db := testsuite.DB()
+	rp := testsuite.RP()
+	rc := rp.Get()
+	defer rc.Close()
+
+	insertScheduled := func(contactID models.ContactID, urnID models.URNID, sendOn time.Time) models.MsgID {
+		var id models.MsgID
+		err := db.Get(&id,
+			`INSERT INTO msgs_msg(uuid, text, high_priority, created_on, modified_on, direction, status, visibility, msg_type, msg_count, error_count, next_attempt, metadata, channel_id, contact_id, contact_urn_id, org_id)
+			 VALUES($1, 'reminder', FALSE, NOW(), NOW(), 'O', 'P', 'V', 'F', 1, 0, $2, $3, $4, $5, $6, $7) RETURNING id`,
+			uuids.New(), sendOn, fmt.Sprintf(`{"send_on": "%s"}`, sendOn.UTC().Format(time.RFC3339Nano)), models.TwilioChannelID, contactID, urnID, models.Org1)
+		assert.NoError(t, err)
+		return id
+	}
+
+	msg1 := insertScheduled(models.CathyID, models.CathyURNID, time.Now().Add(-time.Minute))
+	msg2 := insertScheduled(models.GeorgeID, models.GeorgeURNID, time.Now().Add(time.Hour))
+
+	err := sendScheduledMsgs(ctx, db, rp, sendLaterLock, "foo")
+	assert.NoError(t, err)
+
+	// only our due message is sent
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM msgs_msg WHERE id = $1 AND status = 'Q'`, []interface{}{msg1}, 1)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM msgs_msg WHERE id = $1 AND status = 'P'`, []interface{}{msg2}, 1)
+
+	count, err := redis.Int(rc.Do("zcard", fmt.Sprintf("msgs:%s|10/0", models.TwilioChannelUUID)))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	// running again doesn't send it twice
+	err = sendScheduledMsgs(ctx, db, rp, sendLaterLock, "foo")
+	assert.NoError(t, err)
+
+	count, err = redis.Int(rc.Do("zcard", fmt.Sprintf("msgs:%s|10/0", models.TwilioChannelUUID)))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
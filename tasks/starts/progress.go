@@ -0,0 +1,171 @@
+package starts
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/goflow/utils/dates"
+	"github.com/nyaruka/mailroom/models"
+	"github.com/nyaruka/mailroom/redisutils"
+	"github.com/pkg/errors"
+)
+
+const (
+	progressPattern    = "start_progress:%d"
+	progressExpiration = time.Hour * 24 * 7
+)
+
+// ProgressStatus is the status of a flow start as recorded in its progress
+type ProgressStatus string
+
+// possible values for progress status
+const (
+	ProgressStatusQueued    = ProgressStatus("queued")
+	ProgressStatusStarting  = ProgressStatus("starting")
+	ProgressStatusCompleted = ProgressStatus("completed")
+)
+
+// Progress is how far a flow start has got in starting its contacts, as recorded in redis
+type Progress struct {
+	StartID            models.StartID `json:"start_id"`
+	OrgID              models.OrgID   `json:"org_id"`
+	Status             ProgressStatus `json:"status"`
+	Contacts           int            `json:"contacts"`
+	ContactsExcluded   int            `json:"contacts_excluded"`
+	ContactsPerMinute  int            `json:"contacts_per_minute"`
+	BatchesTotal       int            `json:"batches_total"`
+	BatchesCompleted   int            `json:"batches_completed"`
+	CallsQueued        int            `json:"calls_queued"`
+	QueuedOn           *time.Time     `json:"queued_on"`
+	ExpectedCompletion *time.Time     `json:"expected_completion"`
+	CompletedOn        *time.Time     `json:"completed_on"`
+}
+
+// writeProgress runs the passed in commands against the progress of the passed in start, refreshing its expiration
+func writeProgress(rc redis.Conn, id models.StartID, commands ...[]interface{}) error {
+	// we can only track starts which have an id
+	if id == models.NilStartID {
+		return nil
+	}
+
+	key := fmt.Sprintf(progressPattern, id)
+
+	rc.Send("multi")
+	for _, command := range commands {
+		rc.Send(command[0].(string), append([]interface{}{key}, command[1:]...)...)
+	}
+	rc.Send("expire", key, int(progressExpiration/time.Second))
+	_, err := rc.Do("exec")
+	return errors.Wrapf(err, "error writing progress of start: %d", id)
+}
+
+// recordBatchesQueued records that all the batches of the passed in start have been queued, how many contacts were
+// excluded from it, and if it is throttled, when we expect the last of them to be released. Starts with no batches, or
+// whose batches have all already been started, are completed.
+func recordBatchesQueued(rc redis.Conn, start *models.FlowStart, contacts int, excluded int, batches int, expectedCompletion time.Time) error {
+	values := []interface{}{"hmset",
+		"org_id", int(start.OrgID()),
+		"contacts", contacts,
+		"contacts_excluded", excluded,
+		"contacts_per_minute", start.ContactsPerMinute(),
+		"batches_total", batches,
+		"queued_on", dates.Now().UnixNano(),
+	}
+	if !expectedCompletion.IsZero() {
+		values = append(values, "expected_completion", expectedCompletion.UnixNano())
+	}
+	if err := writeProgress(rc, start.ID(), values); err != nil {
+		return err
+	}
+	return checkCompleted(rc, start.ID())
+}
+
+// RecordBatchCompleted records that the passed in batch of a flow start has been started
+func RecordBatchCompleted(rc redis.Conn, batch *models.FlowStartBatch) error {
+	return RecordIVRBatchCompleted(rc, batch, 0)
+}
+
+// RecordIVRBatchCompleted records that calls have been requested for the passed in batch of an IVR flow start, along
+// with how many of them were queued because their channel was at its limit of concurrent calls. A start isn't completed
+// until those calls have been made.
+func RecordIVRBatchCompleted(rc redis.Conn, batch *models.FlowStartBatch, callsQueued int) error {
+	err := writeProgress(rc, batch.StartID(),
+		[]interface{}{"hincrby", "batches_completed", 1},
+		[]interface{}{"hincrby", "calls_queued", callsQueued},
+	)
+	if err != nil {
+		return err
+	}
+	return checkCompleted(rc, batch.StartID())
+}
+
+// RecordQueuedCallMade records that a call of the passed in start which was queued because its channel was at its limit
+// of concurrent calls has now been requested, or has been given up on
+func RecordQueuedCallMade(rc redis.Conn, id models.StartID) error {
+	if err := writeProgress(rc, id, []interface{}{"hincrby", "calls_queued", -1}); err != nil {
+		return err
+	}
+	return checkCompleted(rc, id)
+}
+
+// batches can be started in any order and concurrently, so a start is completed once all its batches have been queued
+// and every one of them has been started, and any calls they queued have been made
+var completeProgress = redis.NewScript(1, `
+-- KEYS: [ProgressKey] ARGV: [Now]
+local p = redis.call("hmget", KEYS[1], "queued_on", "completed_on", "batches_total", "batches_completed", "calls_queued")
+if not p[1] or p[2] then
+	return 0
+end
+if tonumber(p[4] or "0") < tonumber(p[3] or "0") or tonumber(p[5] or "0") > 0 then
+	return 0
+end
+redis.call("hset", KEYS[1], "completed_on", ARGV[1])
+return 1
+`)
+
+// checkCompleted marks the passed in start as completed if all its batches and queued calls are done
+func checkCompleted(rc redis.Conn, id models.StartID) error {
+	if id == models.NilStartID {
+		return nil
+	}
+
+	_, err := completeProgress.Do(rc, fmt.Sprintf(progressPattern, id), dates.Now().UnixNano())
+	return errors.Wrapf(err, "error checking whether start is completed: %d", id)
+}
+
+// GetProgress returns the progress of the passed in flow start, or nil if there is none
+func GetProgress(rc redis.Conn, id models.StartID) (*Progress, error) {
+	values, err := redis.StringMap(rc.Do("hgetall", fmt.Sprintf(progressPattern, id)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading progress of start: %d", id)
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	progress := &Progress{
+		StartID:            id,
+		OrgID:              models.OrgID(redisutils.ParseInt(values["org_id"])),
+		Contacts:           redisutils.ParseInt(values["contacts"]),
+		ContactsExcluded:   redisutils.ParseInt(values["contacts_excluded"]),
+		ContactsPerMinute:  redisutils.ParseInt(values["contacts_per_minute"]),
+		BatchesTotal:       redisutils.ParseInt(values["batches_total"]),
+		BatchesCompleted:   redisutils.ParseInt(values["batches_completed"]),
+		CallsQueued:        redisutils.ParseInt(values["calls_queued"]),
+		QueuedOn:           redisutils.ParseNanos(values["queued_on"]),
+		ExpectedCompletion: redisutils.ParseNanos(values["expected_completion"]),
+		CompletedOn:        redisutils.ParseNanos(values["completed_on"]),
+	}
+
+	switch {
+	case progress.CompletedOn != nil:
+		progress.Status = ProgressStatusCompleted
+	case progress.BatchesCompleted > 0:
+		progress.Status = ProgressStatusStarting
+	default:
+		progress.Status = ProgressStatusQueued
+	}
+
+	return progress, nil
+}
@@ -0,0 +1,134 @@
+package starts
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nyaruka/mailroom/models"
+	"github.com/nyaruka/mailroom/testsuite"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProgress(t *testing.T) {
+	testsuite.ResetRP()
+	rc := testsuite.RC()
+	defer rc.Close()
+
+	start := &models.FlowStart{}
+	require.NoError(t, start.UnmarshalJSON([]byte(`{"start_id": 123, "org_id": 1, "flow_id": 1, "contacts_per_minute": 100}`)))
+
+	// no progress yet
+	progress, err := GetProgress(rc, start.ID())
+	assert.NoError(t, err)
+	assert.Nil(t, progress)
+
+	// queue two batches, the second released a minute after the first
+	expected := time.Now().Add(time.Minute)
+	assert.NoError(t, recordBatchesQueued(rc, start, 150, 12, 2, expected))
+
+	progress, err = GetProgress(rc, start.ID())
+	require.NoError(t, err)
+	assert.Equal(t, ProgressStatusQueued, progress.Status)
+	assert.Equal(t, models.Org1, progress.OrgID)
+	assert.Equal(t, 150, progress.Contacts)
+	assert.Equal(t, 12, progress.ContactsExcluded)
+	assert.Equal(t, 100, progress.ContactsPerMinute)
+	assert.Equal(t, 2, progress.BatchesTotal)
+	assert.NotNil(t, progress.QueuedOn)
+	assert.Equal(t, expected.UnixNano(), progress.ExpectedCompletion.UnixNano())
+	assert.Nil(t, progress.CompletedOn)
+
+	// batches can be started in any order, so the last one finishing first doesn't complete the start
+	assert.NoError(t, RecordBatchCompleted(rc, start.CreateBatch(nil, true, 150)))
+
+	progress, _ = GetProgress(rc, start.ID())
+	assert.Equal(t, ProgressStatusStarting, progress.Status)
+	assert.Equal(t, 1, progress.BatchesCompleted)
+	assert.Nil(t, progress.CompletedOn)
+
+	// but the other one finishing does
+	assert.NoError(t, RecordBatchCompleted(rc, start.CreateBatch(nil, false, 150)))
+
+	progress, _ = GetProgress(rc, start.ID())
+	assert.Equal(t, ProgressStatusCompleted, progress.Status)
+	assert.Equal(t, 2, progress.BatchesCompleted)
+	assert.NotNil(t, progress.CompletedOn)
+
+	// batches can also be started before we've finished queuing them all
+	early := &models.FlowStart{}
+	require.NoError(t, early.UnmarshalJSON([]byte(`{"start_id": 125, "org_id": 1, "flow_id": 1}`)))
+	assert.NoError(t, RecordBatchCompleted(rc, early.CreateBatch(nil, false, 10)))
+
+	progress, _ = GetProgress(rc, early.ID())
+	assert.Equal(t, ProgressStatusStarting, progress.Status)
+
+	assert.NoError(t, recordBatchesQueued(rc, early, 10, 0, 1, time.Time{}))
+
+	progress, _ = GetProgress(rc, early.ID())
+	assert.Equal(t, ProgressStatusCompleted, progress.Status)
+
+	// IVR starts aren't completed until the calls which were queued because of channel limits have been made
+	calls := &models.FlowStart{}
+	require.NoError(t, calls.UnmarshalJSON([]byte(`{"start_id": 126, "org_id": 1, "flow_id": 1}`)))
+	assert.NoError(t, recordBatchesQueued(rc, calls, 20, 0, 1, time.Time{}))
+	assert.NoError(t, RecordIVRBatchCompleted(rc, calls.CreateBatch(nil, true, 20), 2))
+
+	progress, _ = GetProgress(rc, calls.ID())
+	assert.Equal(t, ProgressStatusStarting, progress.Status)
+	assert.Equal(t, 2, progress.CallsQueued)
+
+	assert.NoError(t, RecordQueuedCallMade(rc, calls.ID()))
+
+	progress, _ = GetProgress(rc, calls.ID())
+	assert.Equal(t, ProgressStatusStarting, progress.Status)
+	assert.Equal(t, 1, progress.CallsQueued)
+
+	assert.NoError(t, RecordQueuedCallMade(rc, calls.ID()))
+
+	progress, _ = GetProgress(rc, calls.ID())
+	assert.Equal(t, ProgressStatusCompleted, progress.Status)
+	assert.Equal(t, 0, progress.CallsQueued)
+
+	// a start where every contact was excluded has no batches and is completed straight away
+	empty := &models.FlowStart{}
+	require.NoError(t, empty.UnmarshalJSON([]byte(`{"start_id": 124, "org_id": 1, "flow_id": 1}`)))
+	assert.NoError(t, recordBatchesQueued(rc, empty, 0, 5, 0, time.Time{}))
+
+	progress, _ = GetProgress(rc, empty.ID())
+	assert.Equal(t, ProgressStatusCompleted, progress.Status)
+	assert.Equal(t, 5, progress.ContactsExcluded)
+	assert.Nil(t, progress.ExpectedCompletion)
+
+	// starts without ids aren't tracked
+	untracked := models.NewFlowStart(models.Org1, models.StartTypeManual, models.MessagingFlow, models.SingleMessageFlowID, false, false)
+	assert.NoError(t, recordBatchesQueued(rc, untracked, 10, 0, 1, time.Time{}))
+
+	assert.NoError(t, RecordQueuedCallMade(rc, models.NilStartID))
+
+	progress, err = GetProgress(rc, models.NilStartID)
+	assert.NoError(t, err)
+	assert.Nil(t, progress)
+}
+
+func TestThrottleBatches(t *testing.T) {
+	tcs := []struct {
+		ContactsPerMinute int
+		BatchSize         int
+		Interval          time.Duration
+	}{
+		{0, 100, 0},
+		{-5, 100, 0},
+		{2000, 100, time.Second * 3},
+		{100, 100, time.Minute},
+		{150, 100, time.Second * 40},
+		{10, 10, time.Minute},
+	}
+
+	for _, tc := range tcs {
+		batchSize, interval := throttleBatches(tc.ContactsPerMinute)
+		assert.Equal(t, tc.BatchSize, batchSize, "batch size mismatch for rate %d", tc.ContactsPerMinute)
+		assert.Equal(t, tc.Interval, interval, "interval mismatch for rate %d", tc.ContactsPerMinute)
+	}
+}
@@ -26,7 +26,7 @@ const (
 
 func init() {
 	mailroom.AddTaskFunction(queue.StartFlow, handleFlowStart)
-	mailroom.AddTaskFunction(queue.StartFlowBatch, handleFlowStartBatch)
+	mailroom.AddRetryableTaskFunction(queue.StartFlowBatch, handleFlowStartBatch)
 }
 
 // handleFlowStart creates all the batches of contacts to start in a flow
@@ -121,6 +121,12 @@ func CreateFlowBatches(ctx context.Context, db *sqlx.DB, rp *redis.Pool, ec *ela
 		}
 	}
 
+	// remove anybody our start excludes
+	excluded, err := applyExclusions(ctx, db, ec, oa, start, contactIDs)
+	if err != nil {
+		return err
+	}
+
 	rc := rp.Get()
 	defer rc.Close()
 
@@ -136,7 +142,7 @@ func CreateFlowBatches(ctx context.Context, db *sqlx.DB, rp *redis.Pool, ec *ela
 		if err != nil {
 			return errors.Wrapf(err, "error marking start as complete")
 		}
-		return nil
+		return recordBatchesQueued(rc, start, 0, excluded, 0, time.Time{})
 	}
 
 	// by default we start in the batch queue unless we have two or fewer contacts
@@ -151,20 +157,32 @@ func CreateFlowBatches(ctx context.Context, db *sqlx.DB, rp *redis.Pool, ec *ela
 		taskType = queue.StartIVRFlowBatch
 	}
 
+	// if our start is throttled, batches after the first are delayed so they are released at its rate, and as the
+	// delayed tasks live in redis, that rate holds however many mailroom instances are running
+	batchSize, interval := throttleBatches(start.ContactsPerMinute())
+
+	now := time.Now()
+	batches := 0
+
 	contacts := make([]models.ContactID, 0, 100)
 	queueBatch := func(last bool) {
 		batch := start.CreateBatch(contacts, last, len(contactIDs))
-		err = queue.AddTask(rc, q, taskType, int(start.OrgID()), batch, queue.DefaultPriority)
+		if batches == 0 || interval == 0 {
+			err = queue.AddTask(rc, q, taskType, int(start.OrgID()), batch, queue.DefaultPriority)
+		} else {
+			err = queue.AddDelayedTask(rc, q, taskType, int(start.OrgID()), batch, now.Add(interval*time.Duration(batches)))
+		}
 		if err != nil {
 			// TODO: is continuing the right thing here? what do we do if redis is down? (panic!)
 			logrus.WithError(err).WithField("start_id", start.ID()).Error("error while queuing start")
 		}
+		batches++
 		contacts = make([]models.ContactID, 0, 100)
 	}
 
 	// build up batches of contacts to start
 	for c := range contactIDs {
-		if len(contacts) == startBatchSize {
+		if len(contacts) == batchSize {
 			queueBatch(false)
 		}
 		contacts = append(contacts, c)
@@ -175,7 +193,99 @@ func CreateFlowBatches(ctx context.Context, db *sqlx.DB, rp *redis.Pool, ec *ela
 		queueBatch(true)
 	}
 
-	return nil
+	var expectedCompletion time.Time
+	if interval > 0 {
+		expectedCompletion = now.Add(interval * time.Duration(batches-1))
+	}
+
+	return recordBatchesQueued(rc, start, len(contactIDs), excluded, batches, expectedCompletion)
+}
+
+// applyExclusions removes the contacts which the passed in start excludes from the passed in set of contacts, returning
+// how many were removed
+func applyExclusions(ctx context.Context, db *sqlx.DB, ec *elastic.Client, oa *models.OrgAssets, start *models.FlowStart, contactIDs map[models.ContactID]bool) (int, error) {
+	exclusions := start.Exclusions()
+	if exclusions == nil || len(contactIDs) == 0 {
+		return 0, nil
+	}
+
+	before := len(contactIDs)
+	exclude := func(ids []models.ContactID) {
+		for _, id := range ids {
+			delete(contactIDs, id)
+		}
+	}
+	remaining := func() []models.ContactID {
+		ids := make([]models.ContactID, 0, len(contactIDs))
+		for id := range contactIDs {
+			ids = append(ids, id)
+		}
+		return ids
+	}
+
+	if len(exclusions.GroupIDs) > 0 {
+		groupContactIDs, err := models.ContactIDsForGroupIDs(ctx, db, exclusions.GroupIDs)
+		if err != nil {
+			return 0, errors.Wrapf(err, "error getting contact ids for exclusion groups")
+		}
+		exclude(groupContactIDs)
+	}
+
+	if exclusions.Query != "" && len(contactIDs) > 0 {
+		matches, err := models.ContactIDsForQuery(ctx, ec, oa, exclusions.Query)
+		if err != nil {
+			return 0, errors.Wrapf(err, "error performing exclusion search for start: %d", start.ID())
+		}
+		exclude(matches)
+	}
+
+	if exclusions.StartedWithinDays > 0 && len(contactIDs) > 0 {
+		since := time.Now().Add(-time.Hour * 24 * time.Duration(exclusions.StartedWithinDays))
+		started, err := models.FindFlowStartedSinceOverlap(ctx, db, start.FlowID(), remaining(), since)
+		if err != nil {
+			return 0, errors.Wrapf(err, "error finding contacts recently started in flow: %d", start.FlowID())
+		}
+		exclude(started)
+	}
+
+	if exclusions.NotSeenSinceDays > 0 && len(contactIDs) > 0 {
+		since := time.Now().Add(-time.Hour * 24 * time.Duration(exclusions.NotSeenSinceDays))
+		seen, err := models.FindSeenSinceOverlap(ctx, db, remaining(), since)
+		if err != nil {
+			return 0, errors.Wrapf(err, "error finding contacts seen recently")
+		}
+
+		seenIDs := make(map[models.ContactID]bool, len(seen))
+		for _, id := range seen {
+			seenIDs[id] = true
+		}
+		for id := range contactIDs {
+			if !seenIDs[id] {
+				delete(contactIDs, id)
+			}
+		}
+	}
+
+	excluded := before - len(contactIDs)
+	if excluded > 0 {
+		logrus.WithField("start_id", start.ID()).WithField("excluded", excluded).Info("excluded contacts from start")
+	}
+
+	return excluded, nil
+}
+
+// throttleBatches returns the batch size and the interval between releasing batches needed to start contacts at the
+// passed in rate. Slow rates use smaller batches so that contacts aren't started in large bursts.
+func throttleBatches(contactsPerMinute int) (int, time.Duration) {
+	if contactsPerMinute <= 0 {
+		return startBatchSize, 0
+	}
+
+	batchSize := startBatchSize
+	if contactsPerMinute < batchSize {
+		batchSize = contactsPerMinute
+	}
+	return batchSize, time.Duration(batchSize) * time.Minute / time.Duration(contactsPerMinute)
 }
 
 // HandleFlowStartBatch starts a batch of contacts in a flow
@@ -193,11 +303,58 @@ func handleFlowStartBatch(ctx context.Context, mr *mailroom.Mailroom, task *queu
 		return errors.Wrapf(err, "error unmarshalling flow start batch: %s", string(task.Task))
 	}
 
+	// if this is a retry, don't start contacts again who were already started by an earlier attempt
+	if task.ErrorCount > 0 {
+		err = excludeAlreadyStarted(ctx, mr.DB, startBatch)
+		if err != nil {
+			return err
+		}
+	}
+
 	// start these contacts in our flow
 	_, err = runner.StartFlowBatch(ctx, mr.DB, mr.RP, startBatch)
+
+	// if we failed and will be retried, this batch isn't done yet
+	if err != nil && task.ErrorCount < mr.Config.TaskMaxRetries {
+		return errors.Wrapf(err, "error starting flow batch: %s", string(task.Task))
+	}
+
+	rc := mr.RP.Get()
+	defer rc.Close()
+
+	// record this batch as done even if starting failed for good, so that our start can still be completed
+	rerr := RecordBatchCompleted(rc, startBatch)
+
 	if err != nil {
+		if rerr != nil {
+			logrus.WithError(rerr).WithField("start_id", startBatch.StartID()).Error("error recording failed start batch")
+		}
 		return errors.Wrapf(err, "error starting flow batch: %s", string(task.Task))
 	}
+	return rerr
+}
 
-	return err
+// excludeAlreadyStarted removes any contacts from the passed in batch who have already been started by its flow start
+func excludeAlreadyStarted(ctx context.Context, db *sqlx.DB, batch *models.FlowStartBatch) error {
+	started, err := models.FindStartedByStartOverlap(ctx, db, batch.StartID(), batch.ContactIDs())
+	if err != nil {
+		return errors.Wrapf(err, "error finding contacts already started by start: %d", batch.StartID())
+	}
+	if len(started) == 0 {
+		return nil
+	}
+
+	isStarted := make(map[models.ContactID]bool, len(started))
+	for _, id := range started {
+		isStarted[id] = true
+	}
+
+	remaining := make([]models.ContactID, 0, len(batch.ContactIDs())-len(started))
+	for _, id := range batch.ContactIDs() {
+		if !isStarted[id] {
+			remaining = append(remaining, id)
+		}
+	}
+	batch.SetContactIDs(remaining)
+	return nil
 }
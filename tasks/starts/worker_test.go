@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/nyaruka/goflow/utils/uuids"
 	"github.com/nyaruka/mailroom"
@@ -14,6 +15,7 @@ import (
 	"github.com/nyaruka/mailroom/runner"
 	"github.com/nyaruka/mailroom/testsuite"
 
+	"github.com/lib/pq"
 	"github.com/olivere/elastic"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -267,3 +269,128 @@ func TestStarts(t *testing.T) {
 		}
 	}
 }
+
+func TestRetriedStartBatch(t *testing.T) {
+	testsuite.Reset()
+	ctx := testsuite.CTX()
+	rp := testsuite.RP()
+	db := testsuite.DB()
+
+	mr := &mailroom.Mailroom{Config: config.Mailroom, DB: db, RP: rp}
+
+	start := models.NewFlowStart(models.Org1, models.StartTypeManual, models.MessagingFlow, models.SingleMessageFlowID, models.DoRestartParticipants, models.DoIncludeActive).
+		WithContactIDs([]models.ContactID{models.CathyID, models.BobID})
+
+	err := models.InsertFlowStarts(ctx, db, []*models.FlowStart{start})
+	require.NoError(t, err)
+
+	// an earlier attempt at this batch only got as far as starting cathy
+	_, err = runner.StartFlowBatch(ctx, db, rp, start.CreateBatch([]models.ContactID{models.CathyID}, false, 2))
+	require.NoError(t, err)
+
+	batchJSON, err := json.Marshal(start.CreateBatch([]models.ContactID{models.CathyID, models.BobID}, true, 2))
+	require.NoError(t, err)
+
+	err = handleFlowStartBatch(ctx, mr, &queue.Task{Type: queue.StartFlowBatch, Task: batchJSON, ErrorCount: 1})
+	assert.NoError(t, err)
+
+	// retrying the batch only starts bob
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM flows_flowrun WHERE start_id = $1 AND contact_id = $2`, []interface{}{start.ID(), models.CathyID}, 1)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM flows_flowrun WHERE start_id = $1 AND contact_id = $2`, []interface{}{start.ID(), models.BobID}, 1)
+}
+
+func TestThrottledStart(t *testing.T) {
+	testsuite.Reset()
+	ctx := testsuite.CTX()
+	rp := testsuite.RP()
+	db := testsuite.DB()
+	rc := testsuite.RC()
+	defer rc.Close()
+
+	// start our doctors at 50 contacts per minute
+	start := models.NewFlowStart(models.Org1, models.StartTypeManual, models.MessagingFlow, models.SingleMessageFlowID, models.DoRestartParticipants, models.DoIncludeActive).
+		WithGroupIDs([]models.GroupID{models.DoctorsGroupID}).
+		WithContactsPerMinute(50)
+
+	err := models.InsertFlowStarts(ctx, db, []*models.FlowStart{start})
+	require.NoError(t, err)
+
+	err = CreateFlowBatches(ctx, db, rp, nil, start)
+	require.NoError(t, err)
+
+	// our first batch of 50 is queued immediately, the other two are delayed by a minute each
+	size, err := queue.Size(rc, queue.BatchQueue)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, size)
+
+	delayed, err := queue.DelayedSize(rc, queue.BatchQueue)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, delayed)
+
+	progress, err := GetProgress(rc, start.ID())
+	require.NoError(t, err)
+	assert.Equal(t, 121, progress.Contacts)
+	assert.Equal(t, 50, progress.ContactsPerMinute)
+	assert.Equal(t, 3, progress.BatchesTotal)
+	assert.WithinDuration(t, progress.QueuedOn.Add(time.Minute*2), *progress.ExpectedCompletion, time.Second)
+}
+
+func TestStartExclusions(t *testing.T) {
+	testsuite.Reset()
+	ctx := testsuite.CTX()
+	rp := testsuite.RP()
+	db := testsuite.DB()
+	rc := testsuite.RC()
+	defer rc.Close()
+
+	// cathy has been in our flow recently, george a long time ago
+	db.MustExec(`INSERT INTO flows_flowrun(uuid, status, is_active, created_on, modified_on, responded, contact_id, flow_id, org_id)
+	                                VALUES($1, 'C', FALSE, NOW() - INTERVAL '2 days', NOW(), FALSE, $2, $3, 1)`, uuids.New(), models.CathyID, models.SingleMessageFlowID)
+	db.MustExec(`INSERT INTO flows_flowrun(uuid, status, is_active, created_on, modified_on, responded, contact_id, flow_id, org_id)
+	                                VALUES($1, 'C', FALSE, NOW() - INTERVAL '20 days', NOW(), FALSE, $2, $3, 1)`, uuids.New(), models.GeorgeID, models.SingleMessageFlowID)
+
+	// bob and george have messaged us recently
+	db.MustExec(`INSERT INTO msgs_msg(uuid, text, high_priority, created_on, modified_on, direction, status, visibility, msg_type, msg_count, error_count, next_attempt, contact_id, org_id)
+	                          VALUES($1, 'hi', FALSE, NOW(), NOW(), 'I', 'H', 'V', 'I', 1, 0, NOW(), $2, 1)`, uuids.New(), models.BobID)
+	db.MustExec(`INSERT INTO msgs_msg(uuid, text, high_priority, created_on, modified_on, direction, status, visibility, msg_type, msg_count, error_count, next_attempt, contact_id, org_id)
+	                          VALUES($1, 'hi', FALSE, NOW(), NOW(), 'I', 'H', 'V', 'I', 1, 0, NOW(), $2, 1)`, uuids.New(), models.GeorgeID)
+
+	// of our contacts, only cathy is a doctor
+	db.MustExec(`DELETE FROM contacts_contactgroup_contacts WHERE contactgroup_id = $1 AND contact_id = ANY($2)`,
+		models.DoctorsGroupID, pq.Array([]models.ContactID{models.BobID, models.GeorgeID, models.AlexandriaID}))
+
+	allContacts := []models.ContactID{models.CathyID, models.BobID, models.GeorgeID, models.AlexandriaID}
+
+	tcs := []struct {
+		Label      string
+		Exclusions *models.StartExclusions
+		Contacts   int
+		Excluded   int
+	}{
+		{"no exclusions", nil, 4, 0},
+		{"exclusion group", &models.StartExclusions{GroupIDs: []models.GroupID{models.DoctorsGroupID}}, 3, 1},
+		{"started recently", &models.StartExclusions{StartedWithinDays: 7}, 3, 1},
+		{"started within a month", &models.StartExclusions{StartedWithinDays: 30}, 2, 2},
+		{"not seen recently", &models.StartExclusions{NotSeenSinceDays: 7}, 2, 2},
+		{"not seen and started recently", &models.StartExclusions{NotSeenSinceDays: 7, StartedWithinDays: 30}, 1, 3},
+	}
+
+	for _, tc := range tcs {
+		start := models.NewFlowStart(models.Org1, models.StartTypeManual, models.MessagingFlow, models.SingleMessageFlowID, models.DoRestartParticipants, models.DoIncludeActive).
+			WithContactIDs(allContacts).
+			WithExclusions(tc.Exclusions)
+
+		err := models.InsertFlowStarts(ctx, db, []*models.FlowStart{start})
+		require.NoError(t, err)
+
+		err = CreateFlowBatches(ctx, db, rp, nil, start)
+		require.NoError(t, err)
+
+		testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM flows_flowstart where contact_count = $2 AND id = $1`,
+			[]interface{}{start.ID(), tc.Contacts}, 1, "contact count mismatch in '%s'", tc.Label)
+
+		progress, err := GetProgress(rc, start.ID())
+		require.NoError(t, err)
+		assert.Equal(t, tc.Excluded, progress.ContactsExcluded, "excluded count mismatch in '%s'", tc.Label)
+	}
+}
@@ -21,11 +21,16 @@ func init() {
 	mailroom.AddInitFunction(StartStatsCron)
 }
 
-// StartStatsCron starts our cron job of posting stats every minute
+// StartStatsCron starts our cron job of posting stats at the top of every minute
 func StartStatsCron(mr *mailroom.Mailroom) error {
-	cron.StartCron(mr.Quit, mr.RP, expirationLock, time.Second*60,
-		func(lockName string, lockValue string) error {
-			ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
+	schedule, err := cron.ParseExpression("* * * * *")
+	if err != nil {
+		return err
+	}
+
+	cron.StartScheduledCron(mr.Quit, mr.RP, expirationLock, schedule,
+		func(ctx context.Context, lockName string, lockValue string) error {
+			ctx, cancel := context.WithTimeout(ctx, time.Minute*5)
 			defer cancel()
 			return dumpStats(ctx, mr.DB, mr.RP, lockName, lockValue)
 		},
@@ -64,6 +69,16 @@ func dumpStats(ctx context.Context, db *sqlx.DB, rp *redis.Pool, lockName string
 		logrus.WithError(err).Error("error calculating handler queue size")
 	}
 
+	// and the number of dead tasks in each
+	batchDead, err := queue.DeadSize(rc, queue.BatchQueue)
+	if err != nil {
+		logrus.WithError(err).Error("error calculating batch dead size")
+	}
+	handlerDead, err := queue.DeadSize(rc, queue.HandlerQueue)
+	if err != nil {
+		logrus.WithError(err).Error("error calculating handler dead size")
+	}
+
 	logrus.WithFields(logrus.Fields{
 		"db_idle":      stats.Idle,
 		"db_busy":      stats.InUse,
@@ -71,10 +86,14 @@ func dumpStats(ctx context.Context, db *sqlx.DB, rp *redis.Pool, lockName string
 		"db_wait":      stats.WaitDuration - waitDuration,
 		"batch_size":   batchSize,
 		"handler_size": handlerSize,
+		"batch_dead":   batchDead,
+		"handler_dead": handlerDead,
 	}).Info("current stats")
 
 	librato.Gauge("mr.handler_queue", float64(handlerSize))
 	librato.Gauge("mr.batch_queue", float64(batchSize))
+	librato.Gauge("mr.handler_dead", float64(handlerDead))
+	librato.Gauge("mr.batch_dead", float64(batchDead))
 	librato.Gauge("mr.db_busy", float64(stats.InUse))
 	librato.Gauge("mr.db_idle", float64(stats.Idle))
 	librato.Gauge("mr.db_waiting", float64(stats.WaitCount-waitCount))
@@ -9,6 +9,7 @@ import (
 	"github.com/jmoiron/sqlx"
 	"github.com/nyaruka/mailroom"
 	"github.com/nyaruka/mailroom/cron"
+	"github.com/nyaruka/mailroom/locker"
 	"github.com/nyaruka/mailroom/tasks/handler"
 	"github.com/nyaruka/mailroom/marker"
 	"github.com/nyaruka/mailroom/models"
@@ -28,8 +29,8 @@ func init() {
 // StartTimeoutCron starts our cron job of continuing timed out sessions every minute
 func StartTimeoutCron(mr *mailroom.Mailroom) error {
 	cron.StartCron(mr.Quit, mr.RP, timeoutLock, time.Second*60,
-		func(lockName string, lockValue string) error {
-			ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
+		func(ctx context.Context, lockName string, lockValue string) error {
+			ctx, cancel := context.WithTimeout(ctx, time.Minute*5)
 			defer cancel()
 			return timeoutSessions(ctx, mr.DB, mr.RP, lockName, lockValue)
 		},
@@ -74,6 +75,11 @@ func timeoutSessions(ctx context.Context, db *sqlx.DB, rp *redis.Pool, lockName
 			continue
 		}
 
+		// make sure we still hold our lock before queuing
+		if err := locker.CheckContext(ctx); err != nil {
+			return errors.Wrapf(err, "error checking lock")
+		}
+
 		// ok, queue this task
 		task := handler.NewTimeoutTask(timeout.OrgID, timeout.ContactID, timeout.SessionID, timeout.TimeoutOn)
 		err = handler.AddHandleTask(rc, timeout.ContactID, task)
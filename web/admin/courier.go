@@ -0,0 +1,117 @@
+package admin
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/nyaruka/goflow/assets"
+	"github.com/nyaruka/goflow/utils"
+	"github.com/nyaruka/mailroom/courier"
+	"github.com/nyaruka/mailroom/models"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/pkg/errors"
+)
+
+func init() {
+	web.RegisterJSONRoute(http.MethodGet, "/mr/admin/courier/queues", web.RequireAuthToken(handleCourierQueues))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/admin/courier/purge", web.RequireAuthToken(handleCourierPurge))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/admin/courier/prioritize", web.RequireAuthToken(handleCourierPrioritize))
+}
+
+// Response for the state of the courier queues
+//
+//   {
+//     "queues": [
+//       {
+//         "channel_uuid": "74729f45-7f29-4868-9dc4-90e491e3c7d8",
+//         "tps": 10,
+//         "size": 1250,
+//         "high_priority": 3,
+//         "batches": 1240,
+//         "active": true,
+//         "throttled": false,
+//         "oldest_queued_on": "2020-05-22T12:30:00.123456Z"
+//       }
+//     ]
+//   }
+//
+type courierQueuesResponse struct {
+	Queues []*courier.ChannelQueue `json:"queues"`
+}
+
+// handles a request for the state of the courier queues
+func handleCourierQueues(ctx context.Context, s *web.Server, r *http.Request) (interface{}, int, error) {
+	rc := s.RP.Get()
+	defer rc.Close()
+
+	queues, err := courier.GetQueues(rc)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return &courierQueuesResponse{Queues: queues}, http.StatusOK, nil
+}
+
+// Purges all messages in the courier queue for a channel, marking them as failed
+//
+//   {
+//     "channel_uuid": "74729f45-7f29-4868-9dc4-90e491e3c7d8"
+//   }
+//
+type courierPurgeRequest struct {
+	ChannelUUID assets.ChannelUUID `json:"channel_uuid" validate:"required,uuid4"`
+}
+
+// handles a request to purge the courier queue for a channel
+func handleCourierPurge(ctx context.Context, s *web.Server, r *http.Request) (interface{}, int, error) {
+	request := &courierPurgeRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	rc := s.RP.Get()
+	defer rc.Close()
+
+	ids, err := courier.PurgeQueue(rc, request.ChannelUUID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	failed, err := models.FailQueuedMessages(ctx, s.DB, ids, models.FailedReasonPurged)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return map[string]interface{}{"purged": len(ids), "failed": failed}, http.StatusOK, nil
+}
+
+// Moves all messages in the courier queue for a channel to the high or default priority queue
+//
+//   {
+//     "channel_uuid": "74729f45-7f29-4868-9dc4-90e491e3c7d8",
+//     "priority": "high"
+//   }
+//
+type courierPrioritizeRequest struct {
+	ChannelUUID assets.ChannelUUID `json:"channel_uuid" validate:"required,uuid4"`
+	Priority    string             `json:"priority"     validate:"required,oneof=high default"`
+}
+
+// handles a request to re-prioritize the courier queue for a channel
+func handleCourierPrioritize(ctx context.Context, s *web.Server, r *http.Request) (interface{}, int, error) {
+	request := &courierPrioritizeRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	rc := s.RP.Get()
+	defer rc.Close()
+
+	moved, err := courier.PrioritizeQueue(rc, request.ChannelUUID, request.Priority == "high")
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return map[string]interface{}{"moved": moved}, http.StatusOK, nil
+}
@@ -0,0 +1,47 @@
+package admin
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/nyaruka/goflow/utils/uuids"
+	"github.com/nyaruka/mailroom/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCourierQueues(t *testing.T) {
+	testsuite.Reset()
+	db := testsuite.DB()
+	rc := testsuite.RC()
+	defer rc.Close()
+
+	insertMsg := func(channelID models.ChannelID, status models.MsgStatus) models.MsgID {
+		var id models.MsgID
+		err := db.Get(&id,
+			`INSERT INTO msgs_msg(uuid, text, high_priority, created_on, modified_on, direction, status, visibility, msg_type, msg_count, error_count, next_attempt, channel_id, contact_id, contact_urn_id, org_id)
+			 VALUES($1, 'hello', FALSE, NOW(), NOW(), 'O', $2, 'V', 'F', 1, 0, NOW(), $3, $4, $5, $6) RETURNING id`,
+			uuids.New(), status, channelID, models.CathyID, models.CathyURNID, models.Org1)
+		require.NoError(t, err)
+		return id
+	}
+
+	// two messages still waiting to be sent and one which courier has already sent
+	msg1 := insertMsg(models.TwilioChannelID, models.MsgStatusQueued)
+	msg2 := insertMsg(models.TwilioChannelID, models.MsgStatusQueued)
+	msg3 := insertMsg(models.TwilioChannelID, models.MsgStatusWired)
+	msg4 := insertMsg(models.NexmoChannelID, models.MsgStatusQueued)
+
+	_, err := rc.Do("zadd", "msgs:74729f45-7f29-4868-9dc4-90e491e3c7d8|10/0", "1579615200.000000", fmt.Sprintf(`[{"id": %d}, {"id": %d}]`, msg1, msg2))
+	require.NoError(t, err)
+	_, err = rc.Do("zadd", "msgs:74729f45-7f29-4868-9dc4-90e491e3c7d8|10/1", "1579615201.000000", fmt.Sprintf(`[{"id": %d}]`, msg3))
+	require.NoError(t, err)
+	_, err = rc.Do("zincrby", "msgs:active", 0, "msgs:74729f45-7f29-4868-9dc4-90e491e3c7d8|10")
+	require.NoError(t, err)
+	_, err = rc.Do("zadd", "msgs:19012bfd-3ce3-4cae-9bb9-76cf92c73d49|5/0", "1579615202.000000", fmt.Sprintf(`[{"id": %d}]`, msg4))
+	require.NoError(t, err)
+
+	web.RunWebTests(t, "testdata/courier.json")
+}
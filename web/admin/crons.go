@@ -0,0 +1,45 @@
+package admin
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/nyaruka/mailroom/cron"
+	"github.com/nyaruka/mailroom/web"
+)
+
+func init() {
+	web.RegisterJSONRoute(http.MethodGet, "/mr/admin/crons", web.RequireAuthToken(handleCrons))
+}
+
+// Response for the state of our crons
+//
+//   {
+//     "crons": [
+//       {
+//         "name": "retry_errored_messages",
+//         "last_fire": "2020-05-22T12:30:00.123456Z",
+//         "last_host": "mailroom1:1234",
+//         "last_duration_ms": 12,
+//         "last_error": "error loading messages",
+//         "next_fire": "2020-05-22T12:31:01.000000Z"
+//       }
+//     ]
+//   }
+//
+type cronsResponse struct {
+	Crons []*cron.Status `json:"crons"`
+}
+
+// handles a request for the state of our crons
+func handleCrons(ctx context.Context, s *web.Server, r *http.Request) (interface{}, int, error) {
+	rc := s.RP.Get()
+	defer rc.Close()
+
+	statuses, err := cron.GetStatuses(rc)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return &cronsResponse{Crons: statuses}, http.StatusOK, nil
+}
@@ -0,0 +1,35 @@
+package admin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCrons(t *testing.T) {
+	testsuite.ResetRP()
+	rc := testsuite.RC()
+	defer rc.Close()
+
+	// record the fires of our crons directly so that their times are fixed
+	lastFire := time.Date(2020, 5, 22, 12, 30, 0, 123456000, time.UTC)
+
+	_, err := rc.Do("sadd", "cron:jobs", "retry_errored_messages", "stats")
+	require.NoError(t, err)
+	_, err = rc.Do("hmset", "cron:jobs:retry_errored_messages",
+		"last_fire", lastFire.UnixNano(), "last_host", "mailroom1:1234", "next_fire", lastFire.Add(time.Minute).UnixNano(),
+		"last_duration", int64(time.Millisecond*12), "last_error", "error loading messages",
+	)
+	require.NoError(t, err)
+	_, err = rc.Do("hmset", "cron:jobs:stats",
+		"last_fire", lastFire.UnixNano(), "last_host", "mailroom2:5678", "next_fire", lastFire.Add(time.Second*30).UnixNano(),
+		"last_duration", int64(time.Millisecond*250), "last_error", "",
+	)
+	require.NoError(t, err)
+
+	web.RunWebTests(t, "testdata/crons.json")
+}
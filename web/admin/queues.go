@@ -0,0 +1,343 @@
+package admin
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/nyaruka/goflow/utils"
+	"github.com/nyaruka/mailroom/queue"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/pkg/errors"
+)
+
+func init() {
+	web.RegisterJSONRoute(http.MethodGet, "/mr/admin/queues", web.RequireAuthToken(handleQueues))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/admin/queues/peek", web.RequireAuthToken(handlePeek))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/admin/queues/delete", web.RequireAuthToken(handleDelete))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/admin/queues/requeue", web.RequireAuthToken(handleRequeue))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/admin/queues/limits", web.RequireAuthToken(handleLimits))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/admin/queues/dead", web.RequireAuthToken(handleDead))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/admin/queues/dead/replay", web.RequireAuthToken(handleDeadReplay))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/admin/queues/dead/purge", web.RequireAuthToken(handleDeadPurge))
+}
+
+// the queues which can be managed via these endpoints
+var queueNames = []string{queue.BatchQueue, queue.HandlerQueue}
+
+type orgQueue struct {
+	*queue.OrgQueue
+	MaxWorkers int     `json:"max_workers"`
+	Weight     float64 `json:"weight"`
+}
+
+type queueSummary struct {
+	Name    string      `json:"name"`
+	Size    int         `json:"size"`
+	Delayed int         `json:"delayed"`
+	Dead    int         `json:"dead"`
+	Orgs    []*orgQueue `json:"orgs"`
+}
+
+// Response for the state of our queues
+//
+//   {
+//     "queues": [
+//       {
+//         "name": "batch",
+//         "size": 12,
+//         "delayed": 1,
+//         "dead": 0,
+//         "orgs": [
+//           {"org_id": 1, "size": 12, "workers": 2, "oldest_queued_on": "2020-05-22T12:30:00.123456Z", "max_workers": 0, "weight": 1}
+//         ]
+//       }
+//     ]
+//   }
+//
+type queuesResponse struct {
+	Queues []*queueSummary `json:"queues"`
+}
+
+// handles a request for the state of our queues
+func handleQueues(ctx context.Context, s *web.Server, r *http.Request) (interface{}, int, error) {
+	rc := s.RP.Get()
+	defer rc.Close()
+
+	response := &queuesResponse{Queues: make([]*queueSummary, 0, len(queueNames))}
+
+	for _, name := range queueNames {
+		summary := &queueSummary{Name: name}
+		var err error
+
+		if summary.Size, err = queue.Size(rc, name); err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		if summary.Delayed, err = queue.DelayedSize(rc, name); err != nil {
+			return nil, http.StatusInternalServerError, errors.Wrapf(err, "error getting delayed size of: %s", name)
+		}
+		if summary.Dead, err = queue.DeadSize(rc, name); err != nil {
+			return nil, http.StatusInternalServerError, errors.Wrapf(err, "error getting dead size of: %s", name)
+		}
+
+		orgs, err := queue.GetOrgQueues(rc, name)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+
+		summary.Orgs = make([]*orgQueue, len(orgs))
+		for i, org := range orgs {
+			limits, err := queue.GetOrgLimits(rc, name, org.OrgID)
+			if err != nil {
+				return nil, http.StatusInternalServerError, err
+			}
+			summary.Orgs[i] = &orgQueue{OrgQueue: org, MaxWorkers: limits.MaxWorkers, Weight: limits.Weight}
+		}
+
+		response.Queues = append(response.Queues, summary)
+	}
+
+	return response, http.StatusOK, nil
+}
+
+// Peeks at the next tasks in the queue for an org
+//
+//   {
+//     "queue": "batch",
+//     "org_id": 1,
+//     "count": 10
+//   }
+//
+type peekRequest struct {
+	Queue string `json:"queue"  validate:"required,oneof=batch handler"`
+	OrgID int    `json:"org_id" validate:"required"`
+	Count int    `json:"count"  validate:"min=1,max=1000"`
+}
+
+// handles a request to peek at the next tasks for an org
+func handlePeek(ctx context.Context, s *web.Server, r *http.Request) (interface{}, int, error) {
+	request := &peekRequest{Count: 10}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	rc := s.RP.Get()
+	defer rc.Close()
+
+	tasks, err := queue.PeekOrgTasks(rc, request.Queue, request.OrgID, request.Count)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return map[string]interface{}{"tasks": tasks}, http.StatusOK, nil
+}
+
+// Deletes or requeues specific tasks in the queue for an org, task ids are those returned by peeking
+//
+//   {
+//     "queue": "batch",
+//     "org_id": 1,
+//     "task_ids": ["1b3a0f27a1cc7bd93d6a44e30bf1a7f0f3b6bc56"],
+//     "priority": "high"
+//   }
+//
+type tasksRequest struct {
+	Queue    string   `json:"queue"    validate:"required,oneof=batch handler"`
+	OrgID    int      `json:"org_id"   validate:"required"`
+	TaskIDs  []string `json:"task_ids" validate:"required"`
+	Priority string   `json:"priority" validate:"omitempty,oneof=high default low"`
+}
+
+// handles a request to delete tasks from the queue for an org
+func handleDelete(ctx context.Context, s *web.Server, r *http.Request) (interface{}, int, error) {
+	request := &tasksRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	rc := s.RP.Get()
+	defer rc.Close()
+
+	removed, err := queue.RemoveOrgTasks(rc, request.Queue, request.OrgID, request.TaskIDs)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return map[string]interface{}{"deleted": len(removed)}, http.StatusOK, nil
+}
+
+var priorities = map[string]queue.Priority{
+	"high":    queue.HighPriority,
+	"default": queue.DefaultPriority,
+	"low":     queue.LowPriority,
+}
+
+// handles a request to requeue tasks in the queue for an org with a new priority
+func handleRequeue(ctx context.Context, s *web.Server, r *http.Request) (interface{}, int, error) {
+	request := &tasksRequest{Priority: "default"}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	rc := s.RP.Get()
+	defer rc.Close()
+
+	requeued, err := queue.RequeueOrgTasks(rc, request.Queue, request.OrgID, request.TaskIDs, priorities[request.Priority])
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return map[string]interface{}{"requeued": requeued}, http.StatusOK, nil
+}
+
+// Sets the maximum workers and weight for an org in a queue, zero values restore the defaults
+//
+//   {
+//     "queue": "batch",
+//     "org_id": 1,
+//     "max_workers": 2,
+//     "weight": 1.5
+//   }
+//
+type limitsRequest struct {
+	Queue      string  `json:"queue"       validate:"required,oneof=batch handler"`
+	OrgID      int     `json:"org_id"      validate:"required"`
+	MaxWorkers int     `json:"max_workers" validate:"min=0"`
+	Weight     float64 `json:"weight"      validate:"min=0"`
+}
+
+// handles a request to set the limits for an org
+func handleLimits(ctx context.Context, s *web.Server, r *http.Request) (interface{}, int, error) {
+	request := &limitsRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	rc := s.RP.Get()
+	defer rc.Close()
+
+	if err := queue.SetOrgMaxWorkers(rc, request.Queue, request.OrgID, request.MaxWorkers); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if err := queue.SetOrgWeight(rc, request.Queue, request.OrgID, request.Weight); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	limits, err := queue.GetOrgLimits(rc, request.Queue, request.OrgID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return limits, http.StatusOK, nil
+}
+
+// Lists the dead tasks in a queue, oldest first
+//
+//   {
+//     "queue": "batch",
+//     "offset": 0,
+//     "count": 50
+//   }
+//
+type deadRequest struct {
+	Queue  string `json:"queue"  validate:"required,oneof=batch handler"`
+	Offset int    `json:"offset" validate:"min=0"`
+	Count  int    `json:"count"  validate:"min=1,max=1000"`
+}
+
+// handles a request to list dead tasks
+func handleDead(ctx context.Context, s *web.Server, r *http.Request) (interface{}, int, error) {
+	request := &deadRequest{Count: 50}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	rc := s.RP.Get()
+	defer rc.Close()
+
+	total, err := queue.DeadSize(rc, request.Queue)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "error getting dead size of: %s", request.Queue)
+	}
+
+	tasks, err := queue.GetDeadTasks(rc, request.Queue, request.Offset, request.Count)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return map[string]interface{}{"total": total, "tasks": tasks}, http.StatusOK, nil
+}
+
+// Replays or purges dead tasks in a queue, if no ids are provided then all dead tasks are replayed or purged
+//
+//   {
+//     "queue": "batch",
+//     "ids": [12, 13]
+//   }
+//
+type deadTasksRequest struct {
+	Queue string  `json:"queue" validate:"required,oneof=batch handler"`
+	IDs   []int64 `json:"ids"`
+}
+
+// handles a request to replay dead tasks
+func handleDeadReplay(ctx context.Context, s *web.Server, r *http.Request) (interface{}, int, error) {
+	request := &deadTasksRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	rc := s.RP.Get()
+	defer rc.Close()
+
+	replayed := 0
+	if len(request.IDs) == 0 {
+		var err error
+		if replayed, err = queue.ReplayDeadTasks(rc, request.Queue); err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+	}
+
+	for _, id := range request.IDs {
+		found, err := queue.ReplayDeadTask(rc, request.Queue, id)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		if found {
+			replayed++
+		}
+	}
+
+	return map[string]interface{}{"replayed": replayed}, http.StatusOK, nil
+}
+
+// handles a request to purge dead tasks
+func handleDeadPurge(ctx context.Context, s *web.Server, r *http.Request) (interface{}, int, error) {
+	request := &deadTasksRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	rc := s.RP.Get()
+	defer rc.Close()
+
+	purged := 0
+	if len(request.IDs) == 0 {
+		var err error
+		if purged, err = queue.PurgeDeadTasks(rc, request.Queue); err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+	}
+
+	for _, id := range request.IDs {
+		found, err := queue.PurgeDeadTask(rc, request.Queue, id)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		if found {
+			purged++
+		}
+	}
+
+	return map[string]interface{}{"purged": purged}, http.StatusOK, nil
+}
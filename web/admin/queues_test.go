@@ -0,0 +1,50 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/mailroom/queue"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/require"
+)
+
+// queueTestTask adds a task queued at a fixed time so that the id derived from its payload is always the same
+func queueTestTask(t *testing.T, rc redis.Conn, q string, orgID int, body string, queuedOn time.Time) {
+	payload, err := json.Marshal(&queue.Task{Type: queue.StartFlow, OrgID: orgID, Task: json.RawMessage(body), QueuedOn: queuedOn})
+	require.NoError(t, err)
+
+	_, err = rc.Do("zadd", fmt.Sprintf("%s:%d", q, orgID), queuedOn.Unix(), payload)
+	require.NoError(t, err)
+	_, err = rc.Do("zadd", fmt.Sprintf("%s:active", q), 0, orgID)
+	require.NoError(t, err)
+}
+
+func TestQueues(t *testing.T) {
+	testsuite.ResetRP()
+	rc := testsuite.RC()
+	defer rc.Close()
+
+	queuedOn := time.Date(2020, 5, 22, 12, 30, 0, 0, time.UTC)
+	queueTestTask(t, rc, queue.BatchQueue, 1, `"task1"`, queuedOn)
+	queueTestTask(t, rc, queue.BatchQueue, 1, `"task2"`, queuedOn.Add(time.Second))
+	queueTestTask(t, rc, queue.BatchQueue, 2, `"task3"`, queuedOn.Add(time.Second*2))
+
+	// add a dead task directly so that when it died is also fixed
+	dead, err := json.Marshal(&queue.DeadTask{
+		Task:   &queue.Task{Type: queue.HandleContactEvent, OrgID: 1, Task: json.RawMessage(`{}`), QueuedOn: queuedOn},
+		Error:  "boom",
+		DeadOn: queuedOn.Add(time.Minute),
+	})
+	require.NoError(t, err)
+	rc.Do("hset", "handler:dead:tasks", 1, dead)
+	rc.Do("zadd", "handler:dead", queuedOn.Add(time.Minute).Unix(), 1)
+	rc.Do("set", "handler:dead:seq", 1)
+
+	web.RunWebTests(t, "testdata/queues.json")
+}
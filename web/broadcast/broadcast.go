@@ -0,0 +1,205 @@
+package broadcast
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/goflow/envs"
+	"github.com/nyaruka/goflow/utils"
+	"github.com/nyaruka/mailroom/models"
+	"github.com/nyaruka/mailroom/tasks/broadcasts"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/pkg/errors"
+)
+
+func init() {
+	web.RegisterJSONRoute(http.MethodPost, "/mr/broadcast/preview", web.RequireAuthToken(handlePreview))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/broadcast/status", web.RequireAuthToken(handleStatus))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/broadcast/cancel", web.RequireAuthToken(handleCancel))
+}
+
+// Previews the messages a broadcast would send, without sending anything
+//
+//   {
+//     "org_id": 1,
+//     "translations": {"eng": {"text": "Hi @contact.name"}, "fra": {"text": "Bonjour @contact.name"}},
+//     "base_language": "eng",
+//     "template_state": "unevaluated",
+//     "templating": {
+//       "template": {"uuid": "9c22b594-fcab-4b29-9bcb-ce4404894a80", "name": "revive_issue"},
+//       "variables": ["@contact.name"]
+//     },
+//     "contact_ids": [12, 13],
+//     "group_ids": [4],
+//     "urns": ["tel:+250788123123"],
+//     "sample_size": 5
+//   }
+//
+type previewRequest struct {
+	OrgID         models.OrgID                                   `json:"org_id"         validate:"required"`
+	Translations  map[envs.Language]*models.BroadcastTranslation `json:"translations"   validate:"required"`
+	BaseLanguage  envs.Language                                  `json:"base_language"  validate:"required"`
+	TemplateState models.TemplateState                           `json:"template_state" validate:"omitempty,oneof=evaluated legacy unevaluated"`
+	Templating    *models.BroadcastTemplating                    `json:"templating"`
+	ContactIDs    []models.ContactID                             `json:"contact_ids"`
+	GroupIDs      []models.GroupID                               `json:"group_ids"`
+	URNs          []urns.URN                                     `json:"urns"`
+	SampleSize    int                                            `json:"sample_size"    validate:"min=0,max=100"`
+}
+
+// Response for a broadcast preview
+//
+//   {
+//     "contacts": 3,
+//     "new_urns": 0,
+//     "messages": 2,
+//     "segments": 2,
+//     "channels": [
+//       {"uuid": "74729f45-7f29-4868-9dc4-90e491e3c7d8", "name": "Twilio", "messages": 2, "segments": 2}
+//     ],
+//     "languages": {
+//       "eng": {"messages": 1, "segments": 1},
+//       "fra": {"messages": 1, "segments": 1}
+//     },
+//     "no_template": {"contacts": 1, "contact_ids": [13]},
+//     "samples": [
+//       {
+//         "contact_id": 12,
+//         "urn": "tel:+250788123124",
+//         "channel_uuid": "74729f45-7f29-4868-9dc4-90e491e3c7d8",
+//         "language": "eng",
+//         "text": "Hi Bob",
+//         "segments": 1
+//       },
+//       {
+//         "contact_id": 14,
+//         "urn": "tel:+250788123125",
+//         "channel_uuid": "74729f45-7f29-4868-9dc4-90e491e3c7d8",
+//         "language": "fra",
+//         "text": "Bonjour Ève ☺",
+//         "segments": 1,
+//         "ucs2_chars": ["È", "☺"]
+//       }
+//     ]
+//   }
+//
+type previewResponse struct {
+	*broadcasts.Preview
+}
+
+// handles a request to preview a broadcast
+func handlePreview(ctx context.Context, s *web.Server, r *http.Request) (interface{}, int, error) {
+	request := &previewRequest{TemplateState: models.TemplateStateUnevaluated, SampleSize: 5}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	oa, err := models.GetOrgAssets(ctx, s.DB, request.OrgID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load org assets")
+	}
+
+	bcast := models.NewBroadcast(oa.OrgID(), models.NilBroadcastID, request.Translations, request.TemplateState, request.BaseLanguage, request.URNs, request.ContactIDs, request.GroupIDs)
+	bcast.SetTemplating(request.Templating)
+
+	preview, err := broadcasts.PreviewBroadcast(ctx, s.DB, oa, bcast, request.SampleSize)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return &previewResponse{Preview: preview}, http.StatusOK, nil
+}
+
+// Requests the progress of a broadcast which has been queued for sending, or cancellation of it
+//
+//   {
+//     "org_id": 1,
+//     "broadcast_id": 1234
+//   }
+//
+type progressRequest struct {
+	OrgID       models.OrgID       `json:"org_id"       validate:"required"`
+	BroadcastID models.BroadcastID `json:"broadcast_id" validate:"required"`
+}
+
+// Response for a broadcast status or cancellation
+//
+//   {
+//     "broadcast_id": 1234,
+//     "org_id": 1,
+//     "status": "sending",
+//     "contacts": 250,
+//     "batches_total": 3,
+//     "batches_completed": 1,
+//     "batches_skipped": 0,
+//     "msgs_created": 100,
+//     "no_template": 0,
+//     "queued_on": "2020-01-21T14:03:15.123456Z",
+//     "completed_on": null,
+//     "cancelled_on": null
+//   }
+//
+type progressResponse struct {
+	*broadcasts.Progress
+}
+
+// handles a request for the progress of a broadcast
+func handleStatus(ctx context.Context, s *web.Server, r *http.Request) (interface{}, int, error) {
+	request := &progressRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	rc := s.RP.Get()
+	defer rc.Close()
+
+	progress, err := broadcasts.GetProgress(rc, request.BroadcastID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if progress == nil || progress.OrgID != request.OrgID {
+		return errors.Errorf("no progress found for broadcast: %d", request.BroadcastID), http.StatusNotFound, nil
+	}
+
+	return &progressResponse{Progress: progress}, http.StatusOK, nil
+}
+
+// handles a request to cancel a broadcast, batches which haven't yet been sent will be skipped. Broadcasts which have
+// already completed can't be cancelled.
+func handleCancel(ctx context.Context, s *web.Server, r *http.Request) (interface{}, int, error) {
+	request := &progressRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	exists, err := models.BroadcastExists(ctx, s.DB, request.OrgID, request.BroadcastID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if !exists {
+		return errors.Errorf("no such broadcast: %d", request.BroadcastID), http.StatusNotFound, nil
+	}
+
+	rc := s.RP.Get()
+	defer rc.Close()
+
+	result, err := broadcasts.CancelBroadcast(rc, request.OrgID, request.BroadcastID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	switch result {
+	case broadcasts.CancelResultNotFound:
+		return errors.Errorf("no such broadcast: %d", request.BroadcastID), http.StatusNotFound, nil
+	case broadcasts.CancelResultCompleted:
+		return errors.Errorf("broadcast has already completed: %d", request.BroadcastID), http.StatusConflict, nil
+	}
+
+	progress, err := broadcasts.GetProgress(rc, request.BroadcastID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return &progressResponse{Progress: progress}, http.StatusOK, nil
+}
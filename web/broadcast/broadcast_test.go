@@ -0,0 +1,33 @@
+package broadcast
+
+import (
+	"testing"
+
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/web"
+)
+
+func TestPreview(t *testing.T) {
+	testsuite.Reset()
+
+	web.RunWebTests(t, "testdata/preview.json")
+}
+
+func TestStatusAndCancel(t *testing.T) {
+	testsuite.Reset()
+
+	testsuite.DB().MustExec(
+		`INSERT INTO msgs_broadcast(id, status, text, base_language, is_active, created_on, modified_on, send_all, created_by_id, modified_by_id, org_id)
+							VALUES(1234, 'Q', '"eng"=>"hello"'::hstore, 'eng', TRUE, NOW(), NOW(), FALSE, 1, 1, 1)`)
+
+	// and one which has already been sent
+	testsuite.DB().MustExec(
+		`INSERT INTO msgs_broadcast(id, status, text, base_language, is_active, created_on, modified_on, send_all, created_by_id, modified_by_id, org_id)
+							VALUES(1235, 'S', '"eng"=>"hello"'::hstore, 'eng', TRUE, NOW(), NOW(), FALSE, 1, 1, 1)`)
+
+	rc := testsuite.RC()
+	defer rc.Close()
+	rc.Do("hmset", "broadcast_progress:1235", "org_id", 1, "batches_total", 1, "batches_completed", 1, "queued_on", 1530880200000000000, "completed_on", 1530880260000000000)
+
+	web.RunWebTests(t, "testdata/status.json")
+}
@@ -11,6 +11,7 @@ import (
 	"github.com/nyaruka/goflow/utils/uuids"
 	"github.com/nyaruka/mailroom/goflow"
 	"github.com/nyaruka/mailroom/models"
+	"github.com/nyaruka/mailroom/tasks/starts"
 	"github.com/nyaruka/mailroom/web"
 
 	"github.com/Masterminds/semver"
@@ -22,6 +23,7 @@ func init() {
 	web.RegisterJSONRoute(http.MethodPost, "/mr/flow/inspect", web.RequireAuthToken(handleInspect))
 	web.RegisterJSONRoute(http.MethodPost, "/mr/flow/clone", web.RequireAuthToken(handleClone))
 	web.RegisterJSONRoute(http.MethodPost, "/mr/flow/change_language", web.RequireAuthToken(handleChangeLanguage))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/flow/start_status", web.RequireAuthToken(handleStartStatus))
 }
 
 // Migrates a flow to the latest flow specification
@@ -161,3 +163,57 @@ func handleChangeLanguage(ctx context.Context, s *web.Server, r *http.Request) (
 
 	return copy, http.StatusOK, nil
 }
+
+// Gets the progress of a flow start, including how many contacts it excluded and when a throttled start is expected
+// to have started all its contacts
+//
+//   {
+//     "org_id": 1,
+//     "start_id": 1234
+//   }
+//
+type startStatusRequest struct {
+	OrgID   models.OrgID   `json:"org_id"   validate:"required"`
+	StartID models.StartID `json:"start_id" validate:"required"`
+}
+
+// Response for a flow start status
+//
+//   {
+//     "start_id": 1234,
+//     "org_id": 1,
+//     "status": "starting",
+//     "contacts": 500000,
+//     "contacts_excluded": 1250,
+//     "contacts_per_minute": 2000,
+//     "batches_total": 5000,
+//     "batches_completed": 120,
+//     "calls_queued": 0,
+//     "queued_on": "2020-01-21T14:03:15.123456Z",
+//     "expected_completion": "2020-01-21T18:13:12.123456Z",
+//     "completed_on": null
+//   }
+//
+type startStatusResponse struct {
+	*starts.Progress
+}
+
+func handleStartStatus(ctx context.Context, s *web.Server, r *http.Request) (interface{}, int, error) {
+	request := &startStatusRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	rc := s.RP.Get()
+	defer rc.Close()
+
+	progress, err := starts.GetProgress(rc, request.StartID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if progress == nil || progress.OrgID != request.OrgID {
+		return errors.Errorf("no progress found for start: %d", request.StartID), http.StatusNotFound, nil
+	}
+
+	return &startStatusResponse{Progress: progress}, http.StatusOK, nil
+}
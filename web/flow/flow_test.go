@@ -11,4 +11,5 @@ func TestServer(t *testing.T) {
 	web.RunWebTests(t, "testdata/clone.json")
 	web.RunWebTests(t, "testdata/inspect.json")
 	web.RunWebTests(t, "testdata/migrate.json")
+	web.RunWebTests(t, "testdata/start_status.json")
 }
@@ -89,7 +89,7 @@ func TestTwilioIVR(t *testing.T) {
 	assert.NoError(t, err)
 
 	// request our call to start
-	err = ivr_tasks.HandleFlowStartBatch(ctx, config.Mailroom, db, rp, batch)
+	_, err = ivr_tasks.HandleFlowStartBatch(ctx, config.Mailroom, db, rp, batch)
 	assert.NoError(t, err)
 
 	testsuite.AssertQueryCount(t, db,
@@ -391,7 +391,7 @@ func TestNexmoIVR(t *testing.T) {
 	assert.NoError(t, err)
 
 	// request our call to start
-	err = ivr_tasks.HandleFlowStartBatch(ctx, config.Mailroom, db, rp, batch)
+	_, err = ivr_tasks.HandleFlowStartBatch(ctx, config.Mailroom, db, rp, batch)
 	assert.NoError(t, err)
 
 	testsuite.AssertQueryCount(t, db,
@@ -0,0 +1,97 @@
+package schedule
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/nyaruka/goflow/utils"
+	"github.com/nyaruka/mailroom/models"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/pkg/errors"
+)
+
+func init() {
+	web.RegisterJSONRoute(http.MethodPost, "/mr/schedule/preview", web.RequireAuthToken(handlePreview))
+}
+
+// Previews the next fires of a schedule, calculated in the same way as when the schedule is fired. If the schedule
+// doesn't have its own timezone, the org's timezone is used.
+//
+//   {
+//     "org_id": 1,
+//     "schedule": {
+//       "repeat_period": "M",
+//       "repeat_hour_of_day": 2,
+//       "repeat_minute_of_hour": 30,
+//       "repeat_day_of_month": 31,
+//       "timezone": "America/Los_Angeles"
+//     },
+//     "after": "2019-01-15T10:00:00Z",
+//     "count": 3
+//   }
+//
+type previewRequest struct {
+	OrgID    models.OrgID     `json:"org_id"   validate:"required"`
+	Schedule *models.Schedule `json:"schedule" validate:"required"`
+	After    *time.Time       `json:"after"`
+	Count    int              `json:"count"    validate:"min=0,max=100"`
+}
+
+// Response for a schedule preview, fires are flagged as clamped if they are on the last day of a month which doesn't
+// have the schedule's day of month, and as dst_skipped if the schedule's time of day doesn't exist on that day
+//
+//   {
+//     "timezone": "America/Los_Angeles",
+//     "fires": [
+//       {"time": "2019-01-31T02:30:00-08:00"},
+//       {"time": "2019-02-28T02:30:00-08:00", "clamped": true},
+//       {"time": "2019-03-31T02:30:00-07:00"}
+//     ]
+//   }
+//
+type previewResponse struct {
+	Timezone string                 `json:"timezone"`
+	Fires    []*models.ScheduleFire `json:"fires"`
+}
+
+// the number of fires we preview if not specified
+const defaultPreviewCount = 10
+
+func handlePreview(ctx context.Context, s *web.Server, r *http.Request) (interface{}, int, error) {
+	request := &previewRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	oa, err := models.GetOrgAssets(ctx, s.DB, request.OrgID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load org assets")
+	}
+
+	tz := oa.Env().Timezone()
+	if request.Schedule.HasTimezone() {
+		tz, err = request.Schedule.Timezone()
+		if err != nil {
+			return errors.Wrapf(err, "invalid schedule timezone"), http.StatusBadRequest, nil
+		}
+	}
+
+	after := time.Now()
+	if request.After != nil {
+		after = *request.After
+	}
+
+	count := request.Count
+	if count == 0 {
+		count = defaultPreviewCount
+	}
+
+	fires, err := request.Schedule.Preview(tz, after, count)
+	if err != nil {
+		return errors.Wrapf(err, "invalid schedule"), http.StatusUnprocessableEntity, nil
+	}
+
+	return &previewResponse{Timezone: tz.String(), Fires: fires}, http.StatusOK, nil
+}
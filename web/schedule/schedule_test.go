@@ -0,0 +1,11 @@
+package schedule_test
+
+import (
+	"testing"
+
+	"github.com/nyaruka/mailroom/web"
+)
+
+func TestServer(t *testing.T) {
+	web.RunWebTests(t, "testdata/preview.json")
+}
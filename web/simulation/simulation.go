@@ -220,7 +220,13 @@ func handleResume(ctx context.Context, s *web.Server, r *http.Request) (interfac
 	// if this is a msg resume we want to check whether it might be caught by a trigger
 	if resume.Type() == resumes.TypeMsg {
 		msgResume := resume.(*resumes.MsgResume)
-		trigger := models.FindMatchingMsgTrigger(oa, msgResume.Contact(), msgResume.Msg().Text())
+
+		var channel *models.Channel
+		if msgResume.Msg().Channel() != nil {
+			channel = oa.ChannelByUUID(msgResume.Msg().Channel().UUID)
+		}
+
+		trigger := models.FindMatchingMsgTrigger(oa, channel, msgResume.Contact(), msgResume.Msg().Text())
 		if trigger != nil {
 			var flow *models.Flow
 			for _, r := range session.Runs() {
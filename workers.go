@@ -2,69 +2,145 @@ package mailroom
 
 import (
 	"context"
+	"fmt"
+	"os"
 	"runtime/debug"
+	"sync"
 	"time"
 
+	"github.com/nyaruka/goflow/utils/uuids"
 	"github.com/nyaruka/mailroom/queue"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
+// taskLease is how long a worker's claim on a task lasts before it must be renewed
+const taskLease = time.Minute
+
 // Foreman takes care of managing our set of workers and assigns msgs for each to send
 type Foreman struct {
 	mr               *Mailroom
 	queue            string
+	owner            string
+	minWorkers       int
+	maxWorkers       int
+	nextWorkerID     int
 	workers          []*Worker
 	availableWorkers chan *Worker
+	workerWait       sync.WaitGroup
+	lastDBWait       time.Duration
 	quit             chan bool
 }
 
-// NewForeman creates a new Foreman for the passed in server with the number of max workers
-func NewForeman(mr *Mailroom, queue string, maxWorkers int) *Foreman {
+// NewForeman creates a new Foreman for the passed in server which starts with the minimum number of workers and
+// scales up to the maximum number of workers when busy. If max is less than min, the number of workers is fixed.
+func NewForeman(mr *Mailroom, queue string, minWorkers int, maxWorkers int) *Foreman {
+	// our claims must never be mistaken for those of a previous process, which in a restarted container can have the
+	// same host and pid, so we identify ourselves with a random UUID, ignoring any seeded generator used in testing
+	host, _ := os.Hostname()
+	owner := fmt.Sprintf("%s:%s", host, uuids.DefaultGenerator.Next())
+
+	if maxWorkers < minWorkers {
+		maxWorkers = minWorkers
+	}
+
 	foreman := &Foreman{
 		mr:               mr,
 		queue:            queue,
-		workers:          make([]*Worker, maxWorkers),
+		owner:            owner,
+		minWorkers:       minWorkers,
+		maxWorkers:       maxWorkers,
+		workers:          make([]*Worker, 0, maxWorkers),
 		availableWorkers: make(chan *Worker, maxWorkers),
 		quit:             make(chan bool),
 	}
 
-	for i := 0; i < maxWorkers; i++ {
-		foreman.workers[i] = NewWorker(foreman, i)
+	for i := 0; i < minWorkers; i++ {
+		foreman.addWorker()
 	}
 
 	return foreman
 }
 
+// addWorker adds a new worker to our pool, it is up to the caller to start it
+func (f *Foreman) addWorker() *Worker {
+	worker := NewWorker(f, f.nextWorkerID)
+	f.nextWorkerID++
+	f.workers = append(f.workers, worker)
+	return worker
+}
+
 // Start starts the foreman and all its workers, assigning jobs while there are some
 func (f *Foreman) Start() {
 	for _, worker := range f.workers {
 		worker.Start()
 	}
+	if f.mr.DB != nil {
+		f.lastDBWait = f.mr.DB.Stats().WaitDuration
+	}
+	f.mr.WaitGroup.Add(2)
 	go f.Assign()
+	go f.Promote()
 }
 
-// Stop stops the foreman and all its workers, the wait group of the worker can be used to track progress
+// Stop stops the foreman from assigning new tasks, workers will exit once they finish their current task
+// and Drain can be used to wait for them
 func (f *Foreman) Stop() {
-	for _, worker := range f.workers {
-		worker.Stop()
-	}
 	close(f.quit)
 	logrus.WithField("comp", "foreman").WithField("state", "stopping").Info("foreman stopping")
 }
 
+// Drain waits for all our workers to finish their in-flight tasks, giving up at the passed in deadline. It
+// returns whether all workers finished. Tasks which are still in-flight when we give up keep their claims,
+// so if this process exits they will be requeued once their leases expire.
+func (f *Foreman) Drain(deadline time.Time) bool {
+	done := make(chan bool)
+	go func() {
+		f.workerWait.Wait()
+		close(done)
+	}()
+
+	log := logrus.WithField("comp", "foreman").WithField("queue", f.queue)
+
+	select {
+	case <-done:
+		log.WithField("state", "drained").Info("all workers finished")
+		return true
+	case <-time.After(time.Until(deadline)):
+		log.WithField("state", "drain_timeout").Warn("timed out waiting for workers to finish in-flight tasks")
+		return false
+	}
+}
+
 // Assign is our main loop for the Foreman, it takes care of popping the next outgoing task from our
 // backend and assigning them to workers
 func (f *Foreman) Assign() {
-	f.mr.WaitGroup.Add(1)
 	defer f.mr.WaitGroup.Done()
 	log := logrus.WithField("comp", "foreman")
 
+	// we are the only sender to our workers so once we exit, stop them all
+	defer func() {
+		for _, worker := range f.workers {
+			worker.Stop()
+		}
+	}()
+
 	log.WithFields(logrus.Fields{
-		"state":   "started",
-		"workers": len(f.workers),
-		"queue":   f.queue,
+		"state":       "started",
+		"workers":     len(f.workers),
+		"max_workers": f.maxWorkers,
+		"queue":       f.queue,
 	}).Info("workers started and waiting")
 
+	// if we can scale our pool, check whether we should every so often
+	var scaleTicks <-chan time.Time
+	scaleWait := time.Second * time.Duration(f.mr.Config.WorkerScaleWait)
+	if f.maxWorkers > f.minWorkers && scaleWait > 0 {
+		ticker := time.NewTicker(scaleWait)
+		defer ticker.Stop()
+		scaleTicks = ticker.C
+	}
+
 	lastSleep := false
 
 	for true {
@@ -74,12 +150,14 @@ func (f *Foreman) Assign() {
 			log.WithField("state", "stopped").Info("foreman stopped")
 			return
 
+		// time to check whether our pool is the right size
+		case <-scaleTicks:
+			f.scale(scaleWait)
+
 		// otherwise, grab the next task and assign it to a worker
 		case worker := <-f.availableWorkers:
 			// see if we have a task to work on
-			rc := f.mr.RP.Get()
-			task, err := queue.PopNextTask(rc, f.queue)
-			rc.Close()
+			task, err := f.mr.Queue.PopNextTask(f.queue, worker.owner, taskLease)
 
 			if err == nil && task != nil {
 				// if so, assign it to our worker
@@ -103,9 +181,133 @@ func (f *Foreman) Assign() {
 	}
 }
 
+// scale grows or shrinks our pool of workers based on the size of our queue, how many of our workers are idle and
+// how long queries have been waiting for DB connections over the passed in period. It must only be called from
+// our Assign loop as that owns our pool of workers.
+func (f *Foreman) scale(period time.Duration) {
+	log := logrus.WithField("comp", "foreman").WithField("queue", f.queue)
+
+	queued, err := f.mr.Queue.Size(f.queue)
+	if err != nil {
+		log.WithError(err).Error("error getting queue size to scale workers")
+		return
+	}
+
+	// if queries are waiting on the DB pool, more workers will only make things worse
+	dbSaturated := false
+	if f.mr.DB != nil {
+		dbWait := f.mr.DB.Stats().WaitDuration
+		maxDBWait := time.Duration(f.mr.Config.WorkerMaxDBWait) * time.Millisecond * time.Duration(period/time.Second)
+		dbSaturated = dbWait-f.lastDBWait > maxDBWait
+		f.lastDBWait = dbWait
+	}
+
+	current := len(f.workers)
+	desired := scaleWorkers(current, f.minWorkers, f.maxWorkers, queued, len(f.availableWorkers), dbSaturated)
+
+	for len(f.workers) < desired {
+		f.addWorker().Start()
+	}
+
+	// we can only remove workers which are idle
+	for len(f.workers) > desired && f.removeIdleWorker() {
+	}
+
+	if len(f.workers) != current {
+		log.WithFields(logrus.Fields{
+			"workers":      len(f.workers),
+			"queued":       queued,
+			"db_saturated": dbSaturated,
+		}).Info("scaled workers")
+	}
+}
+
+// removeIdleWorker stops and removes one of our idle workers, returning false if none are idle
+func (f *Foreman) removeIdleWorker() bool {
+	select {
+	case worker := <-f.availableWorkers:
+		for i, w := range f.workers {
+			if w == worker {
+				f.workers = append(f.workers[:i], f.workers[i+1:]...)
+				break
+			}
+		}
+		worker.Stop()
+		return true
+	default:
+		return false
+	}
+}
+
+// scaleWorkers calculates how many workers we should have, growing by up to a quarter of our current size when all
+// our workers are busy and there are tasks waiting, and shrinking by the same when workers are idle or the DB is
+// saturated
+func scaleWorkers(current int, min int, max int, queued int, idle int, dbSaturated bool) int {
+	step := current / 4
+	if step < 1 {
+		step = 1
+	}
+
+	desired := current
+	if dbSaturated {
+		desired = current - step
+	} else if queued > 0 && idle == 0 {
+		if queued < step {
+			step = queued
+		}
+		desired = current + step
+	} else if queued == 0 && idle > 0 {
+		if idle < step {
+			step = idle
+		}
+		desired = current - step
+	}
+
+	if desired < min {
+		desired = min
+	}
+	if desired > max {
+		desired = max
+	}
+	return desired
+}
+
+// Promote is our loop for moving delayed tasks, including those being retried, into our queue once they are
+// due, and for requeuing tasks whose claims expired because the worker handling them died
+func (f *Foreman) Promote() {
+	defer f.mr.WaitGroup.Done()
+	log := logrus.WithField("comp", "foreman").WithField("queue", f.queue)
+
+	for true {
+		select {
+		// return if we have been told to stop
+		case <-f.quit:
+			return
+
+		case <-time.After(time.Second):
+			count, err := f.mr.Queue.PromoteDelayedTasks(f.queue)
+
+			if err != nil {
+				log.WithError(err).Error("error promoting delayed tasks")
+			} else if count > 0 {
+				log.WithField("count", count).Info("promoted delayed tasks")
+			}
+
+			count, err = f.mr.Queue.ReapExpiredClaims(f.queue)
+
+			if err != nil {
+				log.WithError(err).Error("error reaping expired claims")
+			} else if count > 0 {
+				log.WithField("count", count).Warn("requeued tasks with expired claims")
+			}
+		}
+	}
+}
+
 // Worker is our type for a single goroutine that is handling queued events
 type Worker struct {
 	id      int
+	owner   string
 	foreman *Foreman
 	job     chan *queue.Task
 	log     *logrus.Entry
@@ -115,6 +317,7 @@ type Worker struct {
 func NewWorker(foreman *Foreman, id int) *Worker {
 	worker := &Worker{
 		id:      id,
+		owner:   fmt.Sprintf("%s:%d", foreman.owner, id),
 		foreman: foreman,
 		job:     make(chan *queue.Task, 1),
 	}
@@ -123,9 +326,10 @@ func NewWorker(foreman *Foreman, id int) *Worker {
 
 // Start starts our Worker's goroutine and has it start waiting for tasks from the foreman
 func (w *Worker) Start() {
+	w.foreman.workerWait.Add(1)
+
 	go func() {
-		w.foreman.mr.WaitGroup.Add(1)
-		defer w.foreman.mr.WaitGroup.Done()
+		defer w.foreman.workerWait.Done()
 
 		log := logrus.WithField("queue", w.foreman.queue).WithField("worker_id", w.id)
 		log.Debug("started")
@@ -156,35 +360,96 @@ func (w *Worker) Stop() {
 func (w *Worker) handleTask(task *queue.Task) {
 	log := logrus.WithField("queue", w.foreman.queue).WithField("worker_id", w.id).WithField("task_type", task.Type).WithField("org_id", task.OrgID)
 
+	var taskErr error
+	retryable := retryableTasks[task.Type]
+
 	defer func() {
 		// catch any panics and recover
 		panicLog := recover()
 		if panicLog != nil {
 			debug.PrintStack()
 			log.WithField("task", string(task.Task)).WithField("task_type", task.Type).WithField("org_id", task.OrgID).Errorf("panic handling task: %s", panicLog)
+			taskErr = errors.Errorf("panic handling task: %s", panicLog)
 		}
 
-		// mark our task as complete
-		rc := w.foreman.mr.RP.Get()
-		err := queue.MarkTaskComplete(rc, w.foreman.queue, task.OrgID)
+		// if our task failed, either retry it or move it to our dead letters
+		if taskErr != nil {
+			w.failTask(task, taskErr, retryable)
+		}
+
+		// mark our task as complete, releasing our claim on it
+		err := w.foreman.mr.Queue.MarkTaskComplete(w.foreman.queue, w.owner, task.OrgID)
 		if err != nil {
-			log.WithError(err)
+			log.WithError(err).Error("error marking task complete")
 		}
-		rc.Close()
 	}()
 
+	// keep renewing our claim on this task for as long as we are handling it
+	done := make(chan bool)
+	defer close(done)
+	go w.renewClaim(done)
+
 	log.Info("starting handling of task")
 	start := time.Now()
 
 	taskFunc, found := taskFunctions[task.Type]
 	if found {
-		err := taskFunc(context.Background(), w.foreman.mr, task)
-		if err != nil {
-			log.WithError(err).WithField("task", string(task.Task)).WithField("task_type", task.Type).WithField("org_id", task.OrgID).Error("error running task")
+		taskErr = taskFunc(context.Background(), w.foreman.mr, task)
+		if taskErr != nil {
+			log.WithError(taskErr).WithField("task", string(task.Task)).WithField("task_type", task.Type).WithField("org_id", task.OrgID).WithField("error_count", task.ErrorCount).Error("error running task")
 		}
 	} else {
 		log.Error("unable to find function for task type")
+		taskErr = errors.Errorf("unable to find function for task type: %s", task.Type)
 	}
 
 	log.WithField("elapsed", time.Since(start)).Info("task complete")
 }
+
+// failTask schedules a retry of the passed in failed task with exponential backoff, or moves it to the
+// dead letter set for our queue if it isn't retryable or has used up all its retries
+func (w *Worker) failTask(task *queue.Task, taskErr error, retryable bool) {
+	config := w.foreman.mr.Config
+	log := logrus.WithField("queue", w.foreman.queue).WithField("task_type", task.Type).WithField("org_id", task.OrgID).WithField("error_count", task.ErrorCount)
+
+	if retryable && task.ErrorCount < config.TaskMaxRetries {
+		backoff := time.Duration(config.TaskInitialBackoff) * time.Millisecond * time.Duration(1<<uint(task.ErrorCount))
+
+		err := w.foreman.mr.Queue.RetryTask(w.foreman.queue, task, backoff)
+		if err != nil {
+			log.WithError(err).Error("error scheduling retry of failed task")
+		} else {
+			log.WithField("backoff", backoff).Info("scheduled retry of failed task")
+		}
+		return
+	}
+
+	id, err := w.foreman.mr.Queue.DeadLetterTask(w.foreman.queue, task, taskErr.Error())
+	if err != nil {
+		log.WithError(err).WithField("task", string(task.Task)).Error("error dead lettering failed task")
+	} else {
+		log.WithField("dead_id", id).Error("failed task moved to dead letters")
+	}
+}
+
+// renewClaim renews our claim on our current task until the passed in channel is closed
+func (w *Worker) renewClaim(done chan bool) {
+	log := logrus.WithField("queue", w.foreman.queue).WithField("worker_id", w.id)
+
+	for {
+		select {
+		case <-done:
+			return
+
+		case <-time.After(taskLease / 4):
+			renewed, err := w.foreman.mr.Queue.RenewClaim(w.foreman.queue, w.owner, taskLease)
+
+			if err != nil {
+				log.WithError(err).Error("error renewing claim on task")
+			} else if !renewed {
+				log.Warn("claim on task expired and task was requeued")
+				return
+			}
+		}
+	}
+}
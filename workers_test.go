@@ -0,0 +1,100 @@
+package mailroom
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/mailroom/config"
+	"github.com/nyaruka/mailroom/queue"
+	"github.com/nyaruka/mailroom/testsuite"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScaleWorkers(t *testing.T) {
+	tcs := []struct {
+		current     int
+		min         int
+		max         int
+		queued      int
+		idle        int
+		dbSaturated bool
+		desired     int
+	}{
+		{4, 4, 4, 100, 0, false, 4},    // can't scale if min == max
+		{4, 4, 16, 100, 0, false, 5},   // all busy with lots queued, grow by a quarter
+		{12, 4, 16, 100, 0, false, 15}, // ...
+		{15, 4, 16, 100, 0, false, 16}, // ... but not above max
+		{12, 4, 16, 1, 0, false, 13},   // only grow as much as we have tasks
+		{12, 4, 16, 100, 2, false, 12}, // some workers idle, stay put
+		{12, 4, 16, 0, 0, false, 12},   // all busy but nothing queued, stay put
+		{12, 4, 16, 0, 8, false, 9},    // nothing queued and idle workers, shrink by a quarter
+		{12, 4, 16, 0, 1, false, 11},   // ... but only by as many as are idle
+		{5, 4, 16, 0, 5, false, 4},     // ... and not below min
+		{12, 4, 16, 100, 0, true, 9},   // DB saturated, shrink even though busy
+	}
+
+	for _, tc := range tcs {
+		desired := scaleWorkers(tc.current, tc.min, tc.max, tc.queued, tc.idle, tc.dbSaturated)
+		assert.Equal(t, tc.desired, desired, "desired workers mismatch for %+v", tc)
+	}
+}
+
+func TestFailedTasks(t *testing.T) {
+	testsuite.ResetRP()
+	rc := testsuite.RC()
+	defer rc.Close()
+
+	failing := func(ctx context.Context, mr *Mailroom, task *queue.Task) error {
+		return errors.New("boom")
+	}
+	AddTaskFunction("test_unsafe", failing)
+	AddRetryableTaskFunction("test_safe", failing)
+
+	mr := &Mailroom{Config: config.NewMailroomConfig(), Queue: queue.NewRedisBackend(testsuite.RP())}
+	worker := NewWorker(NewForeman(mr, queue.BatchQueue, 0, 0), 0)
+
+	handle := func(taskType string, errorCount int) {
+		queue.AddTask(rc, queue.BatchQueue, taskType, 1, "{}", queue.DefaultPriority)
+		task, err := mr.Queue.PopNextTask(queue.BatchQueue, worker.owner, time.Minute)
+		assert.NoError(t, err)
+		task.ErrorCount = errorCount
+		worker.handleTask(task)
+	}
+
+	// tasks which haven't opted in to retries are dead lettered straight away
+	handle("test_unsafe", 0)
+
+	delayed, _ := queue.DelayedSize(rc, queue.BatchQueue)
+	dead, _ := queue.DeadSize(rc, queue.BatchQueue)
+	assert.Equal(t, 0, delayed)
+	assert.Equal(t, 1, dead)
+
+	// those which have are retried
+	handle("test_safe", 0)
+
+	delayed, _ = queue.DelayedSize(rc, queue.BatchQueue)
+	dead, _ = queue.DeadSize(rc, queue.BatchQueue)
+	assert.Equal(t, 1, delayed)
+	assert.Equal(t, 1, dead)
+
+	// until they run out of retries
+	handle("test_safe", mr.Config.TaskMaxRetries)
+
+	delayed, _ = queue.DelayedSize(rc, queue.BatchQueue)
+	dead, _ = queue.DeadSize(rc, queue.BatchQueue)
+	assert.Equal(t, 1, delayed)
+	assert.Equal(t, 2, dead)
+}
+
+func TestForemanOwner(t *testing.T) {
+	mr := &Mailroom{Config: config.NewMailroomConfig()}
+
+	// each foreman gets its own owner so that its claims can't be confused with those of a previous process
+	foreman1 := NewForeman(mr, queue.BatchQueue, 1, 1)
+	foreman2 := NewForeman(mr, queue.BatchQueue, 1, 1)
+	assert.NotEqual(t, foreman1.owner, foreman2.owner)
+	assert.NotEqual(t, foreman1.workers[0].owner, foreman2.workers[0].owner)
+}